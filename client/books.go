@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	routes "bookManagement/routes"
+)
+
+// BooksService calls the /api/v1/books and /api/v1/filter endpoints
+type BooksService struct {
+	client *Client
+}
+
+// ListOptions are the options of listings that can include the trash
+type ListOptions struct {
+	IncludeDeleted bool
+}
+
+func (opts *ListOptions) query() url.Values {
+	query := url.Values{}
+	if opts != nil && opts.IncludeDeleted {
+		query.Set("include_deleted", "true")
+	}
+	return query
+}
+
+// FilterOptions narrow down Filter, every field left empty matches all books. The dates take
+// the YYYY, YYYY-MM and YYYY-MM-DD forms the API parses.
+type FilterOptions struct {
+	Title          string
+	Author         string
+	Genre          string
+	FromDate       string
+	ToDate         string
+	IncludeDeleted bool
+}
+
+// BookUpdate is a change to a book, fields left nil are kept as they are
+type BookUpdate struct {
+	Title         *string `json:"title,omitempty"`
+	Author        *string `json:"author,omitempty"`
+	PublishedDate *string `json:"published_date,omitempty"`
+	Edition       *string `json:"edition,omitempty"`
+	Description   *string `json:"description,omitempty"`
+	Genre         *string `json:"genre,omitempty"`
+}
+
+// String returns a pointer to s, for the fields of BookUpdate
+func String(s string) *string {
+	return &s
+}
+
+// Add creates a book, the response has its BookID
+func (s *BooksService) Add(ctx context.Context, book routes.Book) (routes.Response, error) {
+	request := routes.BookRequest{
+		Title:         book.Title,
+		Author:        book.Author,
+		PublishedDate: book.PublishedDate,
+		Edition:       book.Edition,
+		Description:   book.Description,
+		Genre:         book.Genre,
+	}
+	var response routes.Response
+	err := s.client.Do(ctx, http.MethodPost, "/api/v1/books", request, &response)
+	return response, err
+}
+
+// List returns every book with its availability
+func (s *BooksService) List(ctx context.Context, opts *ListOptions) ([]routes.Book, error) {
+	var books []routes.Book
+	err := s.client.Do(ctx, http.MethodGet, withQuery("/api/v1/books", opts.query()), nil, &books)
+	return books, err
+}
+
+func (s *BooksService) Get(ctx context.Context, bookID string) (routes.Book, error) {
+	var book routes.Book
+	err := s.client.Do(ctx, http.MethodGet, bookPath(bookID), nil, &book)
+	return book, err
+}
+
+// Update edits a book, the response has the revision it's now at
+func (s *BooksService) Update(ctx context.Context, bookID string, update BookUpdate) (routes.Response, error) {
+	var response routes.Response
+	err := s.client.Do(ctx, http.MethodPatch, bookPath(bookID), update, &response)
+	return response, err
+}
+
+// Delete moves a book to the trash
+func (s *BooksService) Delete(ctx context.Context, bookID string) (routes.Response, error) {
+	var response routes.Response
+	err := s.client.Do(ctx, http.MethodDelete, bookPath(bookID), nil, &response)
+	return response, err
+}
+
+// Filter returns the books matching opts
+func (s *BooksService) Filter(ctx context.Context, opts FilterOptions) ([]routes.Book, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"title":     opts.Title,
+		"author":    opts.Author,
+		"genre":     opts.Genre,
+		"from_date": opts.FromDate,
+		"to_date":   opts.ToDate,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if opts.IncludeDeleted {
+		query.Set("include_deleted", "true")
+	}
+
+	var books []routes.Book
+	err := s.client.Do(ctx, http.MethodGet, withQuery("/api/v1/filter", query), nil, &books)
+	return books, err
+}
+
+func bookPath(bookID string) string {
+	return strings.Replace(routes.BookPath, "{id}", url.PathEscape(bookID), 1)
+}
+
+func withQuery(path string, query url.Values) string {
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	routes "bookManagement/routes"
+)
+
+func TestBooks(t *testing.T) {
+	c := newTestClient(t, nil)
+	c.Actor = "librarian@example.com"
+	ctx := context.Background()
+
+	dune, err := c.Books.Add(ctx, routes.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Genre: "Science Fiction"})
+	if err != nil || dune.BookID == "" {
+		t.Fatalf("Expected the book to be added, got %+v, %v", dune, err)
+	}
+	_, err = c.Books.Add(ctx, routes.Book{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815", Genre: "Romance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := c.Books.Update(ctx, dune.BookID, BookUpdate{Edition: String("2nd")})
+	if err != nil || updated.Revision != 2 {
+		t.Fatalf("Expected revision 2, got %+v, %v", updated, err)
+	}
+	book, err := c.Books.Get(ctx, dune.BookID)
+	if err != nil || book.Edition != "2nd" || book.Title != "Dune" || book.Availability == nil {
+		t.Fatalf("Expected the updated book with its availability, got %+v, %v", book, err)
+	}
+
+	books, err := c.Books.Filter(ctx, FilterOptions{FromDate: "1900", ToDate: "1999-12-31"})
+	if err != nil || len(books) != 1 || books[0].BookID != dune.BookID {
+		t.Errorf("Expected the date range to find only Dune, got %+v, %v", books, err)
+	}
+	books, err = c.Books.Filter(ctx, FilterOptions{Genre: "Romance"})
+	if err != nil || len(books) != 1 || books[0].Title != "Emma" {
+		t.Errorf("Expected the genre to find only Emma, got %+v, %v", books, err)
+	}
+
+	_, err = c.Books.Delete(ctx, dune.BookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err = c.Books.List(ctx, nil)
+	if err != nil || len(books) != 1 {
+		t.Errorf("Expected the deleted book to be left out, got %+v, %v", books, err)
+	}
+	books, err = c.Books.List(ctx, &ListOptions{IncludeDeleted: true})
+	if err != nil || len(books) != 2 {
+		t.Errorf("Expected the deleted book to be included, got %+v, %v", books, err)
+	}
+
+	// Without a token the changes are made from the client's address, claiming to be the actor
+	var entries []routes.AuditEntry
+	err = c.Do(ctx, http.MethodGet, "/api/v1/audit?entity=book&entity_id="+dune.BookID, nil, &entries)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %+v, %v", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.Actor != "127.0.0.1" || entry.ClaimedActor != c.Actor {
+			t.Errorf("Expected the change to be made from 127.0.0.1 claiming to be %s, got %s claiming %s", c.Actor, entry.Actor, entry.ClaimedActor)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package client calls the bookManagement API from Go, with the request and response types of
+// the routes package. It follows routes/openapi.json, which describes every endpoint; the ones
+// without a typed method here can be called with Client.Do.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	routes "bookManagement/routes"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Errors that an *Error matches with errors.Is, by the status the API answered with
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+)
+
+// Error is an answer from the API other than a success, and the problem it described. Code is
+// the reason to check, Errors the fields that failed validation, and Extensions hold the IDs of
+// the records involved, like the book_id of a book that can't be deleted.
+type Error struct {
+	StatusCode int
+	// Problem is the problem detail the API answered with, empty if the body wasn't one
+	routes.Problem
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("bookManagement: %d %s", e.StatusCode, e.Detail)
+	}
+	return fmt.Sprintf("bookManagement: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	}
+	return false
+}
+
+// Client calls the API at BaseURL. Its fields can be changed after New, before it's used.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Actor is sent in the X-Actor header, the audit log keeps it as who claimed to make the
+	// changes. The actor it names is the token's, or the client's address without one.
+	Actor string
+	// Token is sent as a bearer token, for a server started with API_TOKENS. The server then
+	// names the token's actor in the audit log.
+	Token string
+	// MaxRetries is how many times a request is tried again after an answer that says to,
+	// see retryable
+	MaxRetries int
+	// RetryWait is how long to wait before the first retry, doubling before each one after
+	RetryWait time.Duration
+
+	Books       *BooksService
+	Collections *CollectionsService
+}
+
+// New returns a Client for the API at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string) *Client {
+	c := &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		RetryWait:  500 * time.Millisecond,
+	}
+	c.Books = &BooksService{client: c}
+	c.Collections = &CollectionsService{client: c}
+	return c
+}
+
+// Do sends body as JSON to path, which can include a query string, and decodes the answer into
+// out unless it's nil. Answers other than a 2xx are returned as an *Error.
+func (c *Client) Do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, payload)
+		if attempt < c.MaxRetries && retryable(method, resp, err) && ctx.Err() == nil {
+			if resp != nil {
+				wait = retryAfter(resp, wait)
+				resp.Body.Close()
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+			wait *= 2
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return decodeResponse(resp, out)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Actor != "" {
+		req.Header.Set(routes.ActorHeader, c.Actor)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	// The server continues the trace in ctx, if there is one and tracing is set up
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return c.HTTPClient.Do(req)
+}
+
+// retryable reports whether a request should be tried again. A 429 means the API didn't act on
+// the request, so any method can be retried. Failures that leave it unknown whether the API
+// did, like a dropped connection or a 503 from a proxy, are only retried for methods that are
+// safe to send twice.
+func retryable(method string, resp *http.Response, err error) bool {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+	default:
+		return false
+	}
+	if err != nil {
+		// Giving up on the request, through its context, isn't a failure to retry
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter is how long the Retry-After header of resp says to wait, or wait without one
+func retryAfter(resp *http.Response, wait time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return wait
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		// A proxy in the way may answer without a problem
+		json.Unmarshal(body, &apiErr.Problem)
+		return apiErr
+	}
+
+	if out == nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
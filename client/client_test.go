@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	routes "bookManagement/routes"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTestClient runs the API on a database of its own, wrapped by wrap if it's given, and
+// returns a client for it
+func newTestClient(t *testing.T, wrap func(http.Handler) http.Handler) *Client {
+	injectedDB := filepath.Join(t.TempDir(), "library.db")
+	err := routes.MigrateDatabase(injectedDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handler http.Handler = routes.NewServeMux(injectedDB)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c := New(server.URL)
+	c.RetryWait = time.Millisecond
+	return c
+}
+
+// failFirst answers the first n requests with status, before letting them through
+func failFirst(n int32, status int, seen *int32) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(seen, 1) <= n {
+				w.WriteHeader(status)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestErrorsFromResponses(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	_, err := c.Books.Get(ctx, "999")
+	var apiErr *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Detail != "Book not found" || apiErr.Code != routes.CodeBookNotFound {
+		t.Fatalf("Expected a not found error with the API's problem, got %v", err)
+	}
+
+	_, err = c.Books.Add(ctx, routes.Book{Title: "Dune"})
+	if !errors.Is(err, ErrBadRequest) || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a bad request error, got %v", err)
+	}
+	if !errors.As(err, &apiErr) || len(apiErr.Errors) == 0 || apiErr.Errors[0].Field != "author" {
+		t.Errorf("Expected the missing author to be named, got %+v", apiErr)
+	}
+
+	book, err := c.Books.Add(ctx, routes.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Do(ctx, http.MethodPost, "/api/v1/copies", routes.Copy{BookID: book.BookID, Barcode: "C-1", Branch: "Main"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Books.Delete(ctx, book.BookID)
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &apiErr) || apiErr.Extensions["book_id"] != book.BookID {
+		t.Errorf("Expected a conflict naming the book, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	// Reads are retried through a proxy's 503s
+	var seen int32
+	c := newTestClient(t, failFirst(2, http.StatusServiceUnavailable, &seen))
+	_, err := c.Books.List(ctx, nil)
+	if err != nil || seen != 3 {
+		t.Errorf("Expected the list to succeed on the third try, got %v after %d", err, seen)
+	}
+
+	// Writes aren't, the first try might have gone through
+	seen = 0
+	_, err = c.Books.Add(ctx, routes.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || seen != 1 {
+		t.Errorf("Expected the 503 after a single try, got %v after %d", err, seen)
+	}
+
+	// Unless they were turned away before they were acted on
+	seen = 0
+	c = newTestClient(t, failFirst(1, http.StatusTooManyRequests, &seen))
+	_, err = c.Books.Add(ctx, routes.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	if err != nil || seen != 2 {
+		t.Errorf("Expected the add to succeed on the second try, got %v after %d", err, seen)
+	}
+
+	// Retries give up after MaxRetries
+	seen = 0
+	c = newTestClient(t, failFirst(100, http.StatusBadGateway, &seen))
+	c.MaxRetries = 2
+	_, err = c.Books.List(ctx, nil)
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || seen != 3 {
+		t.Errorf("Expected the 502 after 3 tries, got %v after %d", err, seen)
+	}
+}
+
+func TestRetriesStopWithTheContext(t *testing.T) {
+	var seen int32
+	c := newTestClient(t, failFirst(100, http.StatusServiceUnavailable, &seen))
+	c.RetryWait = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := c.Books.List(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || seen != 1 {
+		t.Errorf("Expected the wait for a retry to end with the context, got %v after %d", err, seen)
+	}
+}
+
+func TestToken(t *testing.T) {
+	c := newTestClient(t, routes.RequireToken(map[string]string{"s3cret": "ada"}))
+	ctx := context.Background()
+
+	_, err := c.Books.List(ctx, nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != routes.CodeUnauthorized {
+		t.Fatalf("Expected a 401 without the token, got %v", err)
+	}
+
+	c.Token = "s3cret"
+	_, err = c.Books.List(ctx, nil)
+	if err != nil {
+		t.Errorf("Expected the token to be accepted, got %v", err)
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	c := newTestClient(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparent = r.Header.Get("Traceparent")
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled}))
+	_, err := c.Books.List(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceparent != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the trace in the context to be sent, got %q", traceparent)
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	routes "bookManagement/routes"
+)
+
+// CollectionsService calls the /api/v1/collections and /api/v1/booksToCollection endpoints
+type CollectionsService struct {
+	client *Client
+}
+
+// Add creates a collection, the response has its CollectionID. The collection's Books are
+// ignored, they're added with AddBooks.
+func (s *CollectionsService) Add(ctx context.Context, collection routes.Collection) (routes.CollectionResponse, error) {
+	request := routes.CollectionRequest{Name: collection.Name, Description: collection.Description}
+	var response routes.CollectionResponse
+	err := s.client.Do(ctx, http.MethodPost, "/api/v1/collections", request, &response)
+	return response, err
+}
+
+// List returns every collection with its books
+func (s *CollectionsService) List(ctx context.Context, opts *ListOptions) ([]routes.Collection, error) {
+	var collections []routes.Collection
+	err := s.client.Do(ctx, http.MethodGet, withQuery("/api/v1/collections", opts.query()), nil, &collections)
+	return collections, err
+}
+
+// AddBooks puts books in a collection
+func (s *CollectionsService) AddBooks(ctx context.Context, collectionID string, bookIDs ...string) (routes.Response, error) {
+	request := struct {
+		CollectionID string   `json:"collection_id"`
+		BookIDs      []string `json:"book_ids"`
+	}{collectionID, bookIDs}
+
+	var response routes.Response
+	err := s.client.Do(ctx, http.MethodPost, "/api/v1/booksToCollection", request, &response)
+	return response, err
+}
+
+// Delete moves a collection to the trash
+func (s *CollectionsService) Delete(ctx context.Context, collectionID string) (routes.CollectionResponse, error) {
+	var response routes.CollectionResponse
+	path := strings.Replace(routes.CollectionPath, "{id}", url.PathEscape(collectionID), 1)
+	err := s.client.Do(ctx, http.MethodDelete, path, nil, &response)
+	return response, err
+}
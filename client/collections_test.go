@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	routes "bookManagement/routes"
+)
+
+func TestCollections(t *testing.T) {
+	c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	dune, err := c.Books.Add(ctx, routes.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection, err := c.Collections.Add(ctx, routes.Collection{Name: "Deserts", Description: "Sand"})
+	if err != nil || collection.CollectionID == "" {
+		t.Fatalf("Expected the collection to be added, got %+v, %v", collection, err)
+	}
+
+	_, err = c.Collections.AddBooks(ctx, collection.CollectionID, dune.BookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Collections.AddBooks(ctx, "999", dune.BookID)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a not found error for a missing collection, got %v", err)
+	}
+
+	collections, err := c.Collections.List(ctx, nil)
+	if err != nil || len(collections) != 1 || len(collections[0].Books) != 1 || collections[0].Books[0].Title != "Dune" {
+		t.Fatalf("Expected the collection with Dune in it, got %+v, %v", collections, err)
+	}
+
+	_, err = c.Collections.Delete(ctx, collection.CollectionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collections, err = c.Collections.List(ctx, nil)
+	if err != nil || len(collections) != 0 {
+		t.Errorf("Expected the deleted collection to be left out, got %+v, %v", collections, err)
+	}
+	collections, err = c.Collections.List(ctx, &ListOptions{IncludeDeleted: true})
+	if err != nil || len(collections) != 1 {
+		t.Errorf("Expected the deleted collection to be included, got %+v, %v", collections, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bookManagement/config"
+	routes "bookManagement/routes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runCommand runs one of the admin subcommands instead of starting the server:
+//
+//	bookManagement backup [-dir dir] [-keep n]
+//	bookManagement restore [-dir dir] [-keep n] backup-file
+//
+// config print is handled by runConfigCommand, before the database is opened.
+func runCommand(args []string, injectedDB string) error {
+	switch args[0] {
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ExitOnError)
+		dir := flags.String("dir", routes.BackupDir(injectedDB), "directory to write the backup to")
+		keep := flags.Int("keep", routes.BackupKeep, "how many backups to keep in dir, older ones are removed")
+		flags.Parse(args[1:])
+
+		path, err := routes.BackupDatabase(injectedDB, *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+		return routes.RotateBackups(*dir, *keep)
+
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ExitOnError)
+		dir := flags.String("dir", routes.BackupDir(injectedDB), "directory to back the current database up to before restoring")
+		keep := flags.Int("keep", routes.BackupKeep, "how many backups to keep in dir, older ones are removed")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			return errors.New("usage: restore [-dir dir] [-keep n] backup-file")
+		}
+
+		return routes.RestoreDatabase(injectedDB, flags.Arg(0), *dir, *keep)
+
+	default:
+		return fmt.Errorf("unknown command %q, expected backup, restore or config", args[0])
+	}
+}
+
+// runConfigCommand runs the config subcommand:
+//
+//	bookManagement [flags] config print
+//
+// print writes the settings the server would start with as a config file, with where each
+// came from already applied and the API and admin tokens left out.
+func runConfigCommand(args []string, cfg config.Config) error {
+	if len(args) != 1 || args[0] != "print" {
+		return errors.New("usage: config print")
+	}
+	return cfg.Print(os.Stdout)
+}
@@ -0,0 +1,554 @@
+// Package config loads the server's settings. Each comes from, in order of precedence, a
+// command-line flag, a BOOKS_ environment variable, the YAML config file, or its default.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the server's settings, the yaml tags are the keys of the config file
+type Config struct {
+	// Listen is the address the HTTP API is served on, and GRPCListen the gRPC API's
+	Listen     string `yaml:"listen"`
+	GRPCListen string `yaml:"grpc_listen"`
+
+	Server   Server   `yaml:"server"`
+	Database Database `yaml:"database"`
+	TLS      TLS      `yaml:"tls"`
+
+	// LogLevel is "debug", "info", "warn" or "error"
+	LogLevel string `yaml:"log_level"`
+	// CORSOrigins are the origins whose pages may call the API, "*" for any
+	CORSOrigins []string `yaml:"cors_origins"`
+	// APITokens are the bearer tokens the API takes, none leaving it open
+	APITokens []Token `yaml:"api_tokens"`
+	// AdminTokens are the bearer tokens the admin endpoints, like restoring a backup, take.
+	// They can't be API tokens, and without any there are no admin endpoints.
+	AdminTokens []Token `yaml:"admin_tokens"`
+
+	Pagination Pagination `yaml:"pagination"`
+	Tracing    Tracing    `yaml:"tracing"`
+	RateLimit  RateLimit  `yaml:"rate_limit"`
+}
+
+// Server is how long the HTTP server waits on clients and how much it reads from them
+type Server struct {
+	// ReadHeaderTimeout is how long a client has to send a request's headers, and ReadTimeout
+	// the whole request. A client trickling a request in can't hold a connection past them.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	// WriteTimeout is how long a request has to be answered, except for event streams
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	// IdleTimeout is how long a kept-alive connection waits for its next request
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long a server that's been told to stop waits for the requests
+	// it's serving before it closes their connections
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`
+}
+
+// Database is where the records are kept. sqlite3 is the only driver, the DSN is a file path.
+type Database struct {
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+// TLS is the certificate and key the HTTP API is served with, neither serving plain HTTP.
+// MinVersion is "1.2" or "1.3", and HTTP2 is offered to clients unless it's turned off.
+type TLS struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	MinVersion string `yaml:"min_version"`
+	HTTP2      bool   `yaml:"http2"`
+}
+
+// Token is a bearer token and the actor the audit log names for requests made with it. Quota
+// is the requests a client with it can make in rate_limit.quota's period, 0 for that quota's.
+type Token struct {
+	Token string `yaml:"token"`
+	Actor string `yaml:"actor"`
+	Quota int    `yaml:"quota,omitempty"`
+}
+
+// Pagination is how many entries a listing returns when the request doesn't say, and the
+// most a request can ask for
+type Pagination struct {
+	DefaultLimit int `yaml:"default_limit"`
+	MaxLimit     int `yaml:"max_limit"`
+}
+
+// Tracing is where the spans of requests and SQL statements are sent. Exporter is "none",
+// "stdout", which writes them to standard output as JSON, or "otlp", which sends them to the
+// OpenTelemetry collector at OTLPEndpoint over HTTP. SampleRatio is the share of new traces
+// kept, a request continuing a trace follows the caller's choice.
+type Tracing struct {
+	Exporter     string  `yaml:"exporter"`
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+// RateLimit is how many requests a client can make to the HTTP and gRPC APIs, told apart by
+// its API token, or by its IP address without a valid one. Reads are GET requests and writes
+// the rest, and Routes have limits of their own in place of those. Every request counts
+// towards the client's Quota.
+type RateLimit struct {
+	Read   Limit        `yaml:"read"`
+	Write  Limit        `yaml:"write"`
+	Routes []RouteLimit `yaml:"routes"`
+	Quota  Quota        `yaml:"quota"`
+}
+
+// Quota is how many requests a client can make in a Period, counted from its first. A Requests
+// of 0 doesn't limit.
+type Quota struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+}
+
+// Limit is a token bucket, Rate requests a second on average in bursts of up to Burst. A Rate
+// of 0 doesn't limit.
+type Limit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// RouteLimit is the limit of a route, named by its method and pattern, like
+// "GET /api/v1/books/{id}"
+type RouteLimit struct {
+	Route string `yaml:"route"`
+	Limit `yaml:",inline"`
+}
+
+// FileEnv names the environment variable with the path of the config file, which the -config
+// flag overrides
+const FileEnv = "BOOKS_CONFIG"
+
+// Default returns the settings used for anything that isn't configured
+func Default() Config {
+	return Config{
+		Listen:     ":8080",
+		GRPCListen: ":9090",
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+		},
+		Database:   Database{Driver: "sqlite3", DSN: "routes/database.db"},
+		TLS:        TLS{MinVersion: "1.2", HTTP2: true},
+		LogLevel:   "info",
+		Pagination: Pagination{DefaultLimit: 100, MaxLimit: 1000},
+		Tracing:    Tracing{Exporter: "none", OTLPEndpoint: "http://localhost:4318", SampleRatio: 1},
+		RateLimit: RateLimit{
+			Read:  Limit{Rate: 20, Burst: 40},
+			Write: Limit{Rate: 5, Burst: 20},
+			// Listing the books reads the whole table
+			Routes: []RouteLimit{{Route: "GET /api/v1/books", Limit: Limit{Rate: 1, Burst: 5}}},
+			Quota:  Quota{Period: 24 * time.Hour},
+		},
+	}
+}
+
+// setting is a value that can be set by a flag and an environment variable as well as in the
+// config file
+type setting struct {
+	flag, env, usage string
+	set              func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "BOOKS_LISTEN", "address to serve the HTTP API on", func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"grpc-listen", "BOOKS_GRPC_LISTEN", "address to serve the gRPC API on", func(c *Config, v string) error { c.GRPCListen = v; return nil }},
+	{"read-header-timeout", "BOOKS_READ_HEADER_TIMEOUT", "how long a client has to send a request's headers", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.ReadHeaderTimeout)
+	}},
+	{"read-timeout", "BOOKS_READ_TIMEOUT", "how long a client has to send a whole request", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.ReadTimeout)
+	}},
+	{"write-timeout", "BOOKS_WRITE_TIMEOUT", "how long a request has to be answered", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.WriteTimeout)
+	}},
+	{"idle-timeout", "BOOKS_IDLE_TIMEOUT", "how long a kept-alive connection waits for its next request", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.IdleTimeout)
+	}},
+	{"shutdown-timeout", "BOOKS_SHUTDOWN_TIMEOUT", "how long to wait for requests being served when stopping", func(c *Config, v string) error {
+		return parseDuration(v, &c.Server.ShutdownTimeout)
+	}},
+	{"max-header-bytes", "BOOKS_MAX_HEADER_BYTES", "largest request headers read", func(c *Config, v string) error {
+		return parseInt(v, &c.Server.MaxHeaderBytes)
+	}},
+	{"max-body-bytes", "BOOKS_MAX_BODY_BYTES", "largest request body read", func(c *Config, v string) error {
+		var n int
+		err := parseInt(v, &n)
+		c.Server.MaxBodyBytes = int64(n)
+		return err
+	}},
+	{"db-driver", "BOOKS_DB_DRIVER", "database driver, sqlite3", func(c *Config, v string) error { c.Database.Driver = v; return nil }},
+	{"db-dsn", "BOOKS_DB_DSN", "database to open, for sqlite3 a file path", func(c *Config, v string) error { c.Database.DSN = v; return nil }},
+	{"tls-cert", "BOOKS_TLS_CERT", "certificate file to serve the HTTP API over TLS with", func(c *Config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"tls-key", "BOOKS_TLS_KEY", "key file for -tls-cert", func(c *Config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"tls-min-version", "BOOKS_TLS_MIN_VERSION", "oldest TLS version accepted, 1.2 or 1.3", func(c *Config, v string) error { c.TLS.MinVersion = v; return nil }},
+	{"http2", "BOOKS_HTTP2", "offer HTTP/2 over TLS, true or false", func(c *Config, v string) error {
+		http2, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", v)
+		}
+		c.TLS.HTTP2 = http2
+		return nil
+	}},
+	{"log-level", "BOOKS_LOG_LEVEL", "least severe messages to log: debug, info, warn or error", func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"cors-origins", "BOOKS_CORS_ORIGINS", "comma separated origins whose pages may call the API, * for any", func(c *Config, v string) error {
+		c.CORSOrigins = splitList(v)
+		return nil
+	}},
+	{"page-limit", "BOOKS_PAGE_LIMIT", "entries a listing returns when the request doesn't say", func(c *Config, v string) error {
+		return parseInt(v, &c.Pagination.DefaultLimit)
+	}},
+	{"max-page-limit", "BOOKS_MAX_PAGE_LIMIT", "most entries a request can ask a listing for", func(c *Config, v string) error {
+		return parseInt(v, &c.Pagination.MaxLimit)
+	}},
+	{"trace-exporter", "BOOKS_TRACE_EXPORTER", "where to send traces: none, stdout or otlp", func(c *Config, v string) error { c.Tracing.Exporter = v; return nil }},
+	{"otlp-endpoint", "BOOKS_OTLP_ENDPOINT", "URL of the OpenTelemetry collector for -trace-exporter otlp", func(c *Config, v string) error { c.Tracing.OTLPEndpoint = v; return nil }},
+	{"trace-sample-ratio", "BOOKS_TRACE_SAMPLE_RATIO", "share of new traces kept, from 0 to 1", func(c *Config, v string) error {
+		return parseFloat(v, &c.Tracing.SampleRatio)
+	}},
+	{"rate-limit-read", "BOOKS_RATE_LIMIT_READ", "GET requests a client can make a second, 0 for no limit", func(c *Config, v string) error {
+		return parseFloat(v, &c.RateLimit.Read.Rate)
+	}},
+	{"rate-limit-read-burst", "BOOKS_RATE_LIMIT_READ_BURST", "most GET requests a client can make at once", func(c *Config, v string) error {
+		return parseInt(v, &c.RateLimit.Read.Burst)
+	}},
+	{"rate-limit-write", "BOOKS_RATE_LIMIT_WRITE", "other requests a client can make a second, 0 for no limit", func(c *Config, v string) error {
+		return parseFloat(v, &c.RateLimit.Write.Rate)
+	}},
+	{"rate-limit-write-burst", "BOOKS_RATE_LIMIT_WRITE_BURST", "most other requests a client can make at once", func(c *Config, v string) error {
+		return parseInt(v, &c.RateLimit.Write.Burst)
+	}},
+	{"rate-limit-quota", "BOOKS_RATE_LIMIT_QUOTA", "requests a client can make in the quota period, 0 for no quota", func(c *Config, v string) error {
+		return parseInt(v, &c.RateLimit.Quota.Requests)
+	}},
+	{"rate-limit-quota-period", "BOOKS_RATE_LIMIT_QUOTA_PERIOD", "how long a quota lasts, like 24h", func(c *Config, v string) error {
+		return parseDuration(v, &c.RateLimit.Quota.Period)
+	}},
+	// Tokens aren't taken as a flag, where other users of the machine could see them
+	{"", "BOOKS_API_TOKENS", "", func(c *Config, v string) error { c.APITokens = parseTokens(v, "api"); return nil }},
+	{"", "BOOKS_ADMIN_TOKENS", "", func(c *Config, v string) error { c.AdminTokens = parseTokens(v, "admin"); return nil }},
+}
+
+// Load returns the settings for a server started with args, the command line less the program
+// name, looking environment variables up with getenv. It also returns the arguments after the
+// flags, the subcommand if there is one. The settings are validated.
+func Load(args []string, getenv func(string) string) (Config, []string, error) {
+	flags := flag.NewFlagSet("bookManagement", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	file := flags.String("config", getenv(FileEnv), "YAML config file, also read from $"+FileEnv)
+	for _, s := range settings {
+		if s.flag != "" {
+			flags.String(s.flag, "", s.usage+", also read from $"+s.env)
+		}
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	config := Default()
+	if *file != "" {
+		err = config.readFile(*file)
+		if err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			err = s.set(&config, value)
+			if err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(&config, f.Value.String())
+				if err != nil {
+					err = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	return config, flags.Args(), config.Validate()
+}
+
+// Usage writes the flags Load takes to w
+func Usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: bookManagement [flags] [backup|restore|config print]")
+	fmt.Fprintf(w, "  -config file\n\tYAML config file, also read from $%s\n", FileEnv)
+	for _, s := range settings {
+		if s.flag != "" {
+			fmt.Fprintf(w, "  -%s value\n\t%s, also read from $%s\n", s.flag, s.usage, s.env)
+		}
+	}
+}
+
+// readFile reads the YAML file at path over c. Keys the file doesn't have keep their values,
+// and keys Config doesn't have are an error, so a misspelt one isn't silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns every setting that's wrong, or nil if they're all usable
+func (c Config) Validate() error {
+	var errs []error
+	for _, address := range []struct{ name, value string }{{"listen", c.Listen}, {"grpc_listen", c.GRPCListen}} {
+		if _, _, err := net.SplitHostPort(address.value); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q isn't a host:port address", address.name, address.value))
+		}
+	}
+	if c.Listen == c.GRPCListen {
+		errs = append(errs, fmt.Errorf("listen and grpc_listen are both %q", c.Listen))
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read_header_timeout", c.Server.ReadHeaderTimeout}, {"read_timeout", c.Server.ReadTimeout}, {"write_timeout", c.Server.WriteTimeout},
+		{"idle_timeout", c.Server.IdleTimeout}, {"shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("server.%s must be more than 0, like 30s", timeout.name))
+		}
+	}
+	if c.Server.MaxHeaderBytes < 1<<10 {
+		errs = append(errs, fmt.Errorf("server.max_header_bytes %d must be at least 1024", c.Server.MaxHeaderBytes))
+	}
+	if c.Server.MaxBodyBytes < 1<<10 {
+		errs = append(errs, fmt.Errorf("server.max_body_bytes %d must be at least 1024", c.Server.MaxBodyBytes))
+	}
+	if c.Database.Driver != "sqlite3" {
+		errs = append(errs, fmt.Errorf("database.driver %q isn't supported, it must be sqlite3", c.Database.Driver))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, errors.New("database.dsn is required"))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.cert_file and tls.key_file must be set together"))
+	}
+	if _, ok := TLSVersions[c.TLS.MinVersion]; !ok {
+		errs = append(errs, fmt.Errorf("tls.min_version %q must be 1.2 or 1.3", c.TLS.MinVersion))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log_level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	for _, origin := range c.CORSOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			errs = append(errs, fmt.Errorf("cors_origins %q must be * or a scheme and host, like https://example.org", origin))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, token := range c.APITokens {
+		if token.Token == "" || token.Actor == "" {
+			errs = append(errs, fmt.Errorf("api_tokens[%d] needs a token and an actor", i))
+		} else if seen[token.Token] {
+			errs = append(errs, fmt.Errorf("api_tokens[%d] repeats the token of another", i))
+		}
+		if token.Quota < 0 {
+			errs = append(errs, fmt.Errorf("api_tokens[%d].quota %d can't be below 0", i, token.Quota))
+		}
+		seen[token.Token] = true
+	}
+	admins := make(map[string]bool)
+	for i, token := range c.AdminTokens {
+		if token.Token == "" || token.Actor == "" {
+			errs = append(errs, fmt.Errorf("admin_tokens[%d] needs a token and an actor", i))
+		} else if seen[token.Token] {
+			errs = append(errs, fmt.Errorf("admin_tokens[%d] is also an API token, admin tokens must be separate", i))
+		} else if admins[token.Token] {
+			errs = append(errs, fmt.Errorf("admin_tokens[%d] repeats the token of another", i))
+		}
+		admins[token.Token] = true
+	}
+	if c.Pagination.DefaultLimit < 1 || c.Pagination.DefaultLimit > c.Pagination.MaxLimit {
+		errs = append(errs, fmt.Errorf("pagination.default_limit %d must be between 1 and max_limit %d", c.Pagination.DefaultLimit, c.Pagination.MaxLimit))
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.otlp_endpoint %q must be an http or https URL, like http://localhost:4318", c.Tracing.OTLPEndpoint))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter %q must be none, stdout or otlp", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio %v must be between 0 and 1", c.Tracing.SampleRatio))
+	}
+	checkLimit := func(name string, limit Limit) {
+		if limit.Rate < 0 {
+			errs = append(errs, fmt.Errorf("%s.rate %v can't be below 0", name, limit.Rate))
+		} else if limit.Rate > 0 && limit.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s.burst %d must be at least 1", name, limit.Burst))
+		}
+	}
+	checkLimit("rate_limit.read", c.RateLimit.Read)
+	checkLimit("rate_limit.write", c.RateLimit.Write)
+	routes := make(map[string]bool)
+	for i, route := range c.RateLimit.Routes {
+		name := fmt.Sprintf("rate_limit.routes[%d]", i)
+		method, path, _ := strings.Cut(route.Route, " ")
+		switch {
+		case !httpMethods[method] || !strings.HasPrefix(path, "/"):
+			errs = append(errs, fmt.Errorf("%s route %q must be a method and a path, like \"GET /api/v1/books\"", name, route.Route))
+		case routes[route.Route]:
+			errs = append(errs, fmt.Errorf("%s repeats the route %q", name, route.Route))
+		}
+		routes[route.Route] = true
+		checkLimit(name, route.Limit)
+	}
+	if c.RateLimit.Quota.Requests < 0 {
+		errs = append(errs, fmt.Errorf("rate_limit.quota.requests %d can't be below 0", c.RateLimit.Quota.Requests))
+	}
+	if c.RateLimit.Quota.Period <= 0 {
+		errs = append(errs, errors.New("rate_limit.quota.period must be more than 0, like 24h"))
+	}
+	return errors.Join(errs...)
+}
+
+// Tokens maps each API token to its actor, for routes.RequireToken
+func (c Config) Tokens() map[string]string {
+	tokens := make(map[string]string, len(c.APITokens))
+	for _, token := range c.APITokens {
+		tokens[token.Token] = token.Actor
+	}
+	return tokens
+}
+
+// AdminActors maps each admin token to its actor, for routes.RequireToken on the admin
+// endpoints
+func (c Config) AdminActors() map[string]string {
+	tokens := make(map[string]string, len(c.AdminTokens))
+	for _, token := range c.AdminTokens {
+		tokens[token.Token] = token.Actor
+	}
+	return tokens
+}
+
+// TokenQuotas maps each API token with a quota of its own to it, for routes.RateLimits
+func (c Config) TokenQuotas() map[string]int {
+	quotas := make(map[string]int)
+	for _, token := range c.APITokens {
+		if token.Quota > 0 {
+			quotas[token.Token] = token.Quota
+		}
+	}
+	return quotas
+}
+
+// Print writes the settings to w as a config file, with the tokens left out
+func (c Config) Print(w io.Writer) error {
+	// Placeholders for the tokens would read back as real ones, all the same and so invalid,
+	// they're left out altogether
+	redacted := c
+	redacted.APITokens = nil
+	redacted.AdminTokens = nil
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(redacted)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// parseTokens reads a comma separated list of token:actor pairs. A token without an actor
+// stands for defaultActor.
+func parseTokens(list, defaultActor string) []Token {
+	var tokens []Token
+	for _, pair := range splitList(list) {
+		token, actor, ok := strings.Cut(pair, ":")
+		if !ok {
+			actor = defaultActor
+		}
+		tokens = append(tokens, Token{Token: token, Actor: actor})
+	}
+	return tokens
+}
+
+// splitList splits a comma separated list, leaving out empty entries
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// httpMethods are the methods the API's routes take
+var httpMethods = map[string]bool{"GET": true, "POST": true, "PATCH": true, "DELETE": true}
+
+// TLSVersions are the tls.min_version settings and the crypto/tls versions they stand for
+var TLSVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+func parseDuration(value string, into *time.Duration) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q isn't a duration, like 30s", value)
+	}
+	*into = d
+	return nil
+}
+
+func parseFloat(value string, into *float64) error {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("%q isn't a number", value)
+	}
+	*into = f
+	return nil
+}
+
+func parseInt(value string, into *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q isn't a whole number", value)
+	}
+	*into = n
+	return nil
+}
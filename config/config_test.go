@@ -0,0 +1,201 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env is a getenv over a map
+func env(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+// writeFile writes a config file into a temporary directory and returns its path
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	config, args, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":8080" || config.GRPCListen != ":9090" || config.Database.DSN != "routes/database.db" || config.Pagination.MaxLimit != 1000 || len(args) != 0 {
+		t.Errorf("Expected the defaults, got %+v %v", config, args)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `
+listen: ":7000"
+grpc_listen: ":7001"
+database:
+  dsn: /var/lib/books/library.db
+log_level: debug
+cors_origins: [https://catalog.example.org]
+api_tokens:
+  - token: s3cret
+    actor: ada
+    quota: 5000
+pagination:
+  default_limit: 20
+server:
+  write_timeout: 2m
+  shutdown_timeout: 10s
+tls:
+  http2: false
+tracing:
+  exporter: otlp
+  otlp_endpoint: http://collector:4318
+rate_limit:
+  read:
+    rate: 50
+    burst: 100
+  routes:
+    - route: POST /api/v1/booksToCollection
+      rate: 0.5
+      burst: 2
+  quota:
+    requests: 1000
+`)
+
+	// The file sets what the defaults don't, the environment overrides the file, and flags
+	// override both
+	config, args, err := Load([]string{"-config", path, "-listen", ":6000", "backup", "-keep", "3"}, env(map[string]string{
+		"BOOKS_LISTEN":                  ":5000",
+		"BOOKS_LOG_LEVEL":               "warn",
+		"BOOKS_PAGE_LIMIT":              "50",
+		"BOOKS_SHUTDOWN_TIMEOUT":        "45s",
+		"BOOKS_TRACE_SAMPLE_RATIO":      "0.25",
+		"BOOKS_RATE_LIMIT_WRITE":        "2",
+		"BOOKS_RATE_LIMIT_QUOTA_PERIOD": "1h",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":6000" || config.GRPCListen != ":7001" || config.LogLevel != "warn" || config.Pagination.DefaultLimit != 50 {
+		t.Errorf("Expected the flag, file and environment to be applied in order, got %+v", config)
+	}
+	if config.Server.WriteTimeout != 2*time.Minute || config.Server.ShutdownTimeout != 45*time.Second || config.Server.ReadHeaderTimeout != 5*time.Second || config.TLS.HTTP2 || config.TLS.MinVersion != "1.2" {
+		t.Errorf("Expected durations from the file and environment over the defaults, got %+v %+v", config.Server, config.TLS)
+	}
+	if config.Database.Driver != "sqlite3" || config.Database.DSN != "/var/lib/books/library.db" || config.Tokens()["s3cret"] != "ada" {
+		t.Errorf("Expected the file to keep the default driver and set the rest, got %+v", config)
+	}
+	if config.Tracing.Exporter != "otlp" || config.Tracing.OTLPEndpoint != "http://collector:4318" || config.Tracing.SampleRatio != 0.25 {
+		t.Errorf("Expected tracing from the file and environment, got %+v", config.Tracing)
+	}
+	// Routes in the file replace the default ones
+	limits := config.RateLimit
+	if limits.Read != (Limit{Rate: 50, Burst: 100}) || limits.Write != (Limit{Rate: 2, Burst: 20}) || len(limits.Routes) != 1 || limits.Routes[0] != (RouteLimit{Route: "POST /api/v1/booksToCollection", Limit: Limit{Rate: 0.5, Burst: 2}}) {
+		t.Errorf("Expected rate limits from the file and environment, got %+v", limits)
+	}
+	if limits.Quota != (Quota{Requests: 1000, Period: time.Hour}) || config.TokenQuotas()["s3cret"] != 5000 {
+		t.Errorf("Expected quotas from the file and environment, got %+v %v", limits.Quota, config.TokenQuotas())
+	}
+	if strings.Join(args, " ") != "backup -keep 3" {
+		t.Errorf("Expected the subcommand to be left, got %v", args)
+	}
+
+	// The file can be named in the environment too
+	config, _, err = Load(nil, env(map[string]string{FileEnv: path, "BOOKS_API_TOKENS": "t1:sync,t2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":7000" || len(config.APITokens) != 2 || config.Tokens()["t2"] != "api" {
+		t.Errorf("Expected the file from %s and the tokens from the environment, got %+v", FileEnv, config)
+	}
+}
+
+func TestLoadRejectsBadSettings(t *testing.T) {
+	_, _, err := Load(nil, env(map[string]string{FileEnv: writeFile(t, "listen: :7000\nport: 7000\n")}))
+	if err == nil || !strings.Contains(err.Error(), "port") {
+		t.Errorf("Expected the unknown key to be an error, got %v", err)
+	}
+
+	_, _, err = Load([]string{"-page-limit", "many"}, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "-page-limit") {
+		t.Errorf("Expected the limit to need a number, got %v", err)
+	}
+	_, _, err = Load(nil, env(map[string]string{"BOOKS_READ_TIMEOUT": "30"}))
+	if err == nil || !strings.Contains(err.Error(), "BOOKS_READ_TIMEOUT") {
+		t.Errorf("Expected the timeout to need a unit, got %v", err)
+	}
+
+	// Every problem is reported at once
+	_, _, err = Load([]string{"-listen", "8080", "-db-driver", "postgres", "-tls-cert", "cert.pem", "-log-level", "verbose", "-cors-origins", "catalog.example.org", "-page-limit", "5000", "-idle-timeout", "0s", "-max-body-bytes", "10", "-tls-min-version", "1.1", "-trace-exporter", "jaeger", "-trace-sample-ratio", "2", "-rate-limit-read", "-1", "-rate-limit-write-burst", "0", "-rate-limit-quota", "-5", "-rate-limit-quota-period", "0s"}, env(nil))
+	for _, want := range []string{"rate_limit.quota.requests", "rate_limit.quota.period", "rate_limit.read.rate", "rate_limit.write.burst", "tracing.exporter", "tracing.sample_ratio", "server.idle_timeout", "server.max_body_bytes", "tls.min_version", "listen", "database.driver", "tls.key_file", "log_level", "cors_origins", "pagination.default_limit"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s to be reported, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadRejectsBadRouteLimits(t *testing.T) {
+	_, _, err := Load(nil, env(map[string]string{FileEnv: writeFile(t, `
+rate_limit:
+  routes:
+    - route: /api/v1/books
+      rate: 1
+      burst: 1
+    - route: GET /api/v1/filter
+      rate: 1
+    - route: GET /api/v1/filter
+      rate: 2
+      burst: 2
+`)}))
+	for _, want := range []string{"rate_limit.routes[0] route", "rate_limit.routes[1].burst", "rate_limit.routes[2] repeats"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s to be reported, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadAdminTokens(t *testing.T) {
+	config, _, err := Load(nil, env(map[string]string{"BOOKS_API_TOKENS": "s3cret:ada", "BOOKS_ADMIN_TOKENS": "r00t,0ps:grace"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admins := config.AdminActors(); len(admins) != 2 || admins["r00t"] != "admin" || admins["0ps"] != "grace" || config.Tokens()["r00t"] != "" {
+		t.Errorf("Expected admin tokens of their own, got %v", admins)
+	}
+
+	// An API token can't double as an admin token
+	_, _, err = Load(nil, env(map[string]string{"BOOKS_API_TOKENS": "s3cret:ada", "BOOKS_ADMIN_TOKENS": "s3cret"}))
+	if err == nil || !strings.Contains(err.Error(), "admin_tokens[0] is also an API token") {
+		t.Errorf("Expected the shared token to be reported, got %v", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	config, _, err := Load(nil, env(map[string]string{"BOOKS_API_TOKENS": "s3cret:ada,t0ps3cret:grace", "BOOKS_ADMIN_TOKENS": "r00t", "BOOKS_CORS_ORIGINS": "*"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var printed bytes.Buffer
+	err = config.Print(&printed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(printed.String(), "s3cret") || strings.Contains(printed.String(), "r00t") || strings.Contains(printed.String(), "actor:") {
+		t.Errorf("Expected the tokens left out, got\n%s", printed.String())
+	}
+
+	// What's printed reads back as the same settings, less the tokens
+	reread, _, err := Load([]string{"-config", writeFile(t, printed.String())}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread.Listen != config.Listen || reread.Server != config.Server || len(reread.CORSOrigins) != 1 || reread.CORSOrigins[0] != "*" || len(reread.APITokens) != 0 || len(reread.RateLimit.Routes) != 1 || reread.RateLimit.Routes[0] != config.RateLimit.Routes[0] {
+		t.Errorf("Expected the printed settings to load, got %+v", reread)
+	}
+}
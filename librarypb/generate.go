@@ -0,0 +1,5 @@
+// Package librarypb is the protobuf and gRPC code generated from library.proto. The services
+// are implemented by routes.NewGRPCServer.
+package librarypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative library.proto
@@ -1,47 +1,258 @@
 package main
 
 import (
+	"bookManagement/config"
 	routes "bookManagement/routes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
 )
 
 func main() {
-	// api/v1/books endpoint (this will handle both the get and the post methods)
-	injectedDB := "routes/database.db"
-	http.HandleFunc("/api/v1/books", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			routes.AddBookHandler(w, r, injectedDB)
-		} else if r.Method == "GET" {
-			routes.GetBooksHandler(w, r, injectedDB)
-		} else {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	cfg, args, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		config.Usage(os.Stderr)
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevels[cfg.LogLevel]})))
+	routes.DefaultPageLimit = cfg.Pagination.DefaultLimit
+	routes.MaxPageLimit = cfg.Pagination.MaxLimit
+
+	// config print doesn't touch the database
+	if len(args) > 0 && args[0] == "config" {
+		err := runConfigCommand(args[1:], cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	injectedDB := cfg.Database.DSN
+	err = routes.MigrateDatabase(injectedDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Admin subcommands like backup and restore run instead of the server
+	if len(args) > 0 {
+		err := runCommand(args, injectedDB)
+		if err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+
+	// SIGTERM, as sent on a deploy, or Ctrl-C stops the server gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err = serve(ctx, cfg, injectedDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("server stopped")
+}
+
+// logLevels maps the log_level setting to slog's levels. Requests are logged at info, so
+// "warn" and "error" leave them out and only failures are logged.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// serve runs the APIs and the background jobs until ctx is done. Then it stops taking
+// requests, waits up to the shutdown timeout for the ones being served and for any job that's
+// running, and returns once nothing has the database open.
+func serve(ctx context.Context, cfg config.Config, injectedDB string) error {
+	limiter := newRateLimiter(cfg)
+	server, err := newHTTPServer(cfg, injectedDB, limiter)
+	if err != nil {
+		return err
+	}
+	flushSpans, err := setupTracing(ctx, cfg.Tracing)
+	if err != nil {
+		return err
+	}
+
+	// Background jobs, stopped with stopJobs on the way out however that's reached
+	ctx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+	var jobs sync.WaitGroup
+	runJob := func(interval time.Duration, name string, job func() error) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			runEvery(ctx, interval, name, job)
+		}()
+	}
+	runJob(time.Hour, "expire holds", func() error { return routes.ExpireHolds(injectedDB) })
+	runJob(time.Hour, "assess fines", func() error { return routes.AssessFines(injectedDB) })
+	runJob(24*time.Hour, "purge trash", func() error { return routes.PurgeTrash(injectedDB) })
+	runJob(5*time.Second, "deliver webhooks", func() error { return routes.DeliverWebhooks(injectedDB) })
 
-	})
+	// The gRPC API is served on a port of its own
+	grpcListener, err := net.Listen("tcp", cfg.GRPCListen)
+	if err != nil {
+		return err
+	}
+	grpcServer := routes.NewGRPCServer(injectedDB, grpcOptions(cfg, limiter)...)
+	failed := make(chan error, 2)
+	go func() {
+		failed <- grpcServer.Serve(grpcListener)
+	}()
+	slog.Info("gRPC server listening", "address", cfg.GRPCListen)
 
-	// api/v1/collection endpoints
-	http.HandleFunc("/api/v1/collections", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			routes.AddCollectionHandler(w, r, injectedDB)
-		} else if r.Method == "GET" {
-			routes.GetCollectionsHandler(w, r, injectedDB)
+	go func() {
+		var err error
+		if cfg.TLS.CertFile != "" {
+			slog.Info("server listening", "address", "https://"+cfg.Listen)
+			err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		} else {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			slog.Info("server listening", "address", "http://"+cfg.Listen)
+			err = server.ListenAndServe()
 		}
+		if err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	select {
+	case err = <-failed:
+		// One server failing takes the other down with it
+	case <-ctx.Done():
+		slog.Info("shutting down, waiting for requests being served", "timeout", cfg.Server.ShutdownTimeout.String())
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	go func() {
+		// GracefulStop waits for every RPC, stop them at the deadline like the HTTP requests
+		<-shutdownCtx.Done()
+		grpcServer.Stop()
+	}()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		slog.Warn("requests still being served were cut off", "error", shutdownErr)
+	}
+	grpcServer.GracefulStop()
+	stopJobs()
+	jobs.Wait()
+	if flushErr := flushSpans(shutdownCtx); flushErr != nil {
+		slog.Warn("spans still being exported were lost", "error", flushErr)
+	}
+	return err
+}
+
+// newHTTPServer is the HTTP API with the timeouts and limits cfg sets. Clients trickling a
+// request in, or never reading the answer, can't keep a connection open past them, and a
+// client making requests faster than limiter allows is turned away.
+func newHTTPServer(cfg config.Config, injectedDB string, limiter *routes.RateLimiter) (*http.Server, error) {
+	// Clients are rate limited before their token is checked, so guessing tokens is too. With
+	// API tokens configured the API needs one, and with CORS origins pages from those origins
+	// can call it.
+	apiMiddleware := []routes.Middleware{limiter.Limit}
+	if len(cfg.APITokens) > 0 {
+		apiMiddleware = append(apiMiddleware, routes.RequireToken(cfg.Tokens()))
+	}
+	router := routes.NewServeMux(injectedDB, apiMiddleware...)
+
+	// The admin endpoints can restore a backup over the whole catalog, so they need a token of
+	// their own, and aren't served at all without one
+	if len(cfg.AdminTokens) > 0 {
+		routes.MountAdmin(router, injectedDB, limiter.Limit, routes.RequireToken(cfg.AdminActors()))
+	}
 
-	})
+	// A limit for a route there isn't would quietly limit nothing
+	known := make(map[string]bool)
+	for _, route := range router.Routes() {
+		known[route] = true
+	}
+	for _, route := range cfg.RateLimit.Routes {
+		if !known[route.Route] {
+			return nil, fmt.Errorf("rate_limit.routes: %q isn't a route", route.Route)
+		}
+	}
+	if len(cfg.CORSOrigins) > 0 {
+		router.Use(routes.CORS(cfg.CORSOrigins...))
+	}
+	router.Use(routes.LimitBody(cfg.Server.MaxBodyBytes))
+
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		TLSConfig:         &tls.Config{MinVersion: config.TLSVersions[cfg.TLS.MinVersion]},
+	}
+	if !cfg.TLS.HTTP2 {
+		// A non-nil, empty map turns off the HTTP/2 net/http would otherwise offer over TLS
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	// Event streams don't end on their own, Shutdown would wait for them until the timeout
+	server.RegisterOnShutdown(routes.CloseEventStreams)
+	return server, nil
+}
 
-	//filter endpoint
-	http.HandleFunc("/api/v1/filter", func(w http.ResponseWriter, r *http.Request) {
-		routes.FilterBooksHandler(w, r, injectedDB)
-	})
+// grpcOptions holds the gRPC API to the limits of the HTTP API. It reads no message longer
+// than a request body, limiter holds calls to the rate limits of the routes they stand for,
+// and with API tokens configured calls need one too.
+func grpcOptions(cfg config.Config, limiter *routes.RateLimiter) []grpc.ServerOption {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(int(cfg.Server.MaxBodyBytes))}
+	opts = append(opts, limiter.GRPCOptions()...)
+	if len(cfg.APITokens) > 0 {
+		opts = append(opts, routes.RequireGRPCToken(cfg.Tokens())...)
+	}
+	return opts
+}
 
-	//booksToCollection endpoint
-	http.HandleFunc("/api/v1/booksToCollection", func(w http.ResponseWriter, r *http.Request) {
-		routes.AddBookToCollectionHandler(w, r, injectedDB)
-	})
+// newRateLimiter holds clients to the rate limits and quotas of cfg, over HTTP and gRPC
+func newRateLimiter(cfg config.Config) *routes.RateLimiter {
+	limits := routes.RateLimits{
+		Read:        routes.RateLimit(cfg.RateLimit.Read),
+		Write:       routes.RateLimit(cfg.RateLimit.Write),
+		Routes:      make(map[string]routes.RateLimit),
+		Quota:       routes.Quota(cfg.RateLimit.Quota),
+		Tokens:      cfg.Tokens(),
+		TokenQuotas: cfg.TokenQuotas(),
+	}
+	for _, route := range cfg.RateLimit.Routes {
+		limits.Routes[route.Route] = routes.RateLimit(route.Limit)
+	}
+	return routes.NewRateLimiter(limits)
+}
 
-	log.Println("Server listening on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// runEvery calls job every interval until ctx is done, logging any failures. A job that's
+// running when ctx is done is finished first.
+func runEvery(ctx context.Context, interval time.Duration, name string, job func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := job()
+			if err != nil {
+				slog.Error("job failed", "job", name, "error", err)
+			}
+		}
+	}
 }
@@ -0,0 +1,278 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Audited actions
+const (
+	AuditCreate   = "create"
+	AuditUpdate   = "update"
+	AuditDelete   = "delete"
+	AuditAddBooks = "add_books"
+	// AuditPurge is a record leaving the trash for good, see PurgeTrash
+	AuditPurge = "purge"
+)
+
+// Audited entities
+const (
+	AuditBook       = "book"
+	AuditCollection = "collection"
+	AuditCopy       = "copy"
+)
+
+// Limits on how many entries GetAuditLogHandler returns at once, when the request doesn't say
+// and the most it can ask for. main sets them from the configuration.
+var (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+// ActorHeader is who a client says is making a change. Nothing checks it, so the audit log
+// keeps it apart from the actor, as the claimed_actor.
+const ActorHeader = "X-Actor"
+
+// SystemActor is the actor of changes made by background jobs
+const SystemActor = "system"
+
+// principalKey is the context key of the actor a request was authenticated as, see RequireToken
+type principalKey struct{}
+
+// withPrincipal returns ctx for a request authenticated as actor
+func withPrincipal(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, principalKey{}, actor)
+}
+
+// auditActor is who made a change. name is who the request was authenticated as, or the
+// address it came from when the API takes no token, claimed is the X-Actor it was sent with.
+type auditActor struct {
+	name, claimed string
+}
+
+// systemActor makes the changes of background jobs
+var systemActor = auditActor{name: SystemActor}
+
+// FieldChange is the before and after value of one field that a change touched
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry is one change in the audit log. Actor is who made it, see actorFrom, and
+// ClaimedActor the X-Actor it was requested with, which isn't verified.
+type AuditEntry struct {
+	AuditID      string                 `json:"audit_id"`
+	Actor        string                 `json:"actor"`
+	ClaimedActor string                 `json:"claimed_actor,omitempty"`
+	Action       string                 `json:"action"`
+	Entity       string                 `json:"entity"`
+	EntityID     string                 `json:"entity_id"`
+	Before       json.RawMessage        `json:"before,omitempty"`
+	After        json.RawMessage        `json:"after,omitempty"`
+	Diff         map[string]FieldChange `json:"diff"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// execer is the part of *sql.DB and *sql.Tx that writes
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit appends an entry for a change to the audit log. before is nil for creates and
+// after is nil for deletes. Pass the transaction that made the change so the entry is only
+// kept if the change is.
+func recordAudit(db execer, actor auditActor, action, entity, entityID string, before, after interface{}) error {
+	beforeJSON, beforeFields, err := auditSnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, afterFields, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+
+	diff, err := json.Marshal(diffFields(beforeFields, afterFields))
+	if err != nil {
+		return err
+	}
+
+	insertAuditQuery := `INSERT INTO AuditLog (actor, claimed_actor, action, entity, entity_id, before_json, after_json, diff_json, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err = db.Exec(insertAuditQuery, actor.name, actor.claimed, action, entity, entityID, beforeJSON, afterJSON, string(diff), now().UTC())
+	return err
+}
+
+// actorFrom returns who is making a request: the actor of its token, or without one the IP
+// address it connected from, along with the X-Actor it claims to be
+func actorFrom(r *http.Request) auditActor {
+	actor := auditActor{claimed: r.Header.Get(ActorHeader)}
+	if principal, ok := r.Context().Value(principalKey{}).(string); ok {
+		actor.name = principal
+		return actor
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	actor.name = host
+	if actor.name == "" {
+		actor.name = "anonymous"
+	}
+	return actor
+}
+
+// auditSnapshot returns the JSON of a record for the audit log, or nil for no record, along
+// with its fields so it can be diffed
+func auditSnapshot(record interface{}) (interface{}, map[string]interface{}, error) {
+	if record == nil || reflect.ValueOf(record).IsZero() {
+		return nil, nil, nil
+	}
+
+	snapshot, err := json.Marshal(record)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(snapshot, &fields)
+	return string(snapshot), fields, err
+}
+
+// diffFields returns every field whose value differs between before and after
+func diffFields(before, after map[string]interface{}) map[string]FieldChange {
+	diff := make(map[string]FieldChange)
+	for field, value := range before {
+		if !reflect.DeepEqual(value, after[field]) {
+			diff[field] = FieldChange{Before: value, After: after[field]}
+		}
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok {
+			diff[field] = FieldChange{After: value}
+		}
+	}
+	return diff
+}
+
+// GetAuditLogHandler lists audit entries, newest first. Filter with actor, claimed_actor, action,
+// entity, entity_id, and from and to which take dates or RFC 3339 timestamps. limit defaults to 100.
+func GetAuditLogHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	queryParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Incorrectly formatted audit parameters")
+		return
+	}
+
+	query := "SELECT audit_id, actor, claimed_actor, action, entity, entity_id, before_json, after_json, diff_json, created_at FROM AuditLog WHERE 1=1"
+	args := make([]interface{}, 0)
+
+	// The column names come from this fixed list, never from the request
+	for _, column := range []string{"actor", "claimed_actor", "action", "entity", "entity_id"} {
+		if value := queryParams.Get(column); value != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+
+	for _, bound := range []struct {
+		param, operator string
+	}{{"from", ">="}, {"to", "<="}} {
+		value := queryParams.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := parseAuditTime(value, bound.param == "to")
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Audit "+bound.param+" must be a date or an RFC 3339 timestamp")
+			return
+		}
+		query += " AND created_at " + bound.operator + " ?"
+		args = append(args, t)
+	}
+
+	limit := DefaultPageLimit
+	if value := queryParams.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Audit limit must be between 1 and "+strconv.Itoa(MaxPageLimit))
+			return
+		}
+	}
+	query += " ORDER BY created_at DESC, audit_id DESC LIMIT ?"
+	args = append(args, limit)
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after sql.NullString
+		var diff string
+		err := rows.Scan(&entry.AuditID, &entry.Actor, &entry.ClaimedActor, &entry.Action, &entry.Entity, &entry.EntityID, &before, &after, &diff, &entry.CreatedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		err = json.Unmarshal([]byte(diff), &entry.Diff)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// parseAuditTime accepts a full timestamp or a date. A date used as an upper bound covers
+// the whole day.
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// callHandlerAs calls a handler on behalf of actor, with a token RequireToken lets in as them
+func callHandlerAs(t *testing.T, actor string, handler func(http.ResponseWriter, *http.Request, string), method, target string, payload interface{}) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+
+	req, err := http.NewRequest(method, target, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+actor+"-token")
+
+	r := httptest.NewRecorder()
+	RequireToken(map[string]string{actor + "-token": actor})(handleWith(testDB)(handler)).ServeHTTP(r, req)
+	return r
+}
+
+// auditLog returns the audit entries matching query, newest first
+func auditLog(t *testing.T, query string) []AuditEntry {
+	r := callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?"+query, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	var entries []AuditEntry
+	err := json.Unmarshal(r.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditLogRecordsCatalogWrites(t *testing.T) {
+	// The audit log is append-only, so each test only looks at its own actor's entries
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+
+	r := callHandlerAs(t, "catalog-audit", AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	var book Response
+	json.Unmarshal(r.Body.Bytes(), &book)
+
+	r = callHandlerAs(t, "catalog-audit", AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Desert Planets", Description: "Sand"})
+	var collection CollectionResponse
+	json.Unmarshal(r.Body.Bytes(), &collection)
+
+	callHandlerAs(t, "catalog-audit", AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{
+		"collection_id": collection.CollectionID,
+		"book_ids":      []string{book.BookID},
+	})
+
+	entries := auditLog(t, "actor=catalog-audit")
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(entries))
+	}
+
+	expected := []struct{ action, entity, entityID string }{
+		{AuditAddBooks, AuditCollection, collection.CollectionID},
+		{AuditCreate, AuditCollection, collection.CollectionID},
+		{AuditCreate, AuditBook, book.BookID},
+	}
+	for i, e := range expected {
+		if entries[i].Action != e.action || entries[i].Entity != e.entity || entries[i].EntityID != e.entityID {
+			t.Errorf("Expected entry %d to be %s %s %s, got %s %s %s", i, e.action, e.entity, e.entityID, entries[i].Action, entries[i].Entity, entries[i].EntityID)
+		}
+	}
+
+	created := entries[2]
+	if created.Before != nil || created.After == nil {
+		t.Errorf("Expected a create to have only an after snapshot, got before %s and after %s", created.Before, created.After)
+	}
+	if created.Diff["title"].After != "Dune" {
+		t.Errorf("Expected the diff to set the title to Dune, got %v", created.Diff["title"])
+	}
+
+	added := entries[0].Diff["book_ids"]
+	if before, _ := added.Before.([]interface{}); len(before) != 0 {
+		t.Errorf("Expected the collection to start empty, got %v", added.Before)
+	}
+	if after, _ := added.After.([]interface{}); len(after) != 1 || after[0] != book.BookID {
+		t.Errorf("Expected the collection to end with book %s, got %v", book.BookID, added.After)
+	}
+
+	// Filters combine
+	entries = auditLog(t, "actor=catalog-audit&entity=book&entity_id="+book.BookID)
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 audit entry for the book, got %d", len(entries))
+	}
+}
+
+func TestAuditLogDiffsOnlyChangedFields(t *testing.T) {
+	cleanBooksTable()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	copyID, _ := insertBarcodedCopy(Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "AUDIT-1", Branch: "Main", ShelfLocation: "SF1"})
+
+	r := callHandlerAs(t, "copy-audit", UpdateCopyHandler, "PATCH", "/api/v1/copies/AUDIT-1", map[string]string{"condition": "fair"})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	entries := auditLog(t, "actor=copy-audit&entity=copy&entity_id="+strconv.FormatInt(copyID, 10))
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(entries))
+	}
+
+	diff := entries[0].Diff
+	if len(diff) != 1 || diff["condition"].Before != "good" || diff["condition"].After != "fair" {
+		t.Errorf("Expected only the condition to change from good to fair, got %v", diff)
+	}
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	callHandlerAs(t, "append-only", AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Append Only", Description: "Can't touch this"})
+
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE AuditLog SET actor = 'someone-else' WHERE actor = 'append-only';")
+	if err == nil {
+		t.Error("Expected updating the audit log to fail")
+	}
+	_, err = db.Exec("DELETE FROM AuditLog WHERE actor = 'append-only';")
+	if err == nil {
+		t.Error("Expected deleting from the audit log to fail")
+	}
+
+	if entries := auditLog(t, "actor=append-only"); len(entries) != 1 {
+		t.Errorf("Expected the audit entry to survive, got %d entries", len(entries))
+	}
+}
+
+func TestAuditLogActorIsVerified(t *testing.T) {
+	// Without a token the actor is the address the request came from, and the X-Actor it was
+	// sent with is only what it claims
+	req := httptest.NewRequest("POST", "/api/v1/collections", strings.NewReader(`{"name": "Claimed", "description": "Says who"}`))
+	req.RemoteAddr = "203.0.113.9:41234"
+	req.Header.Set(ActorHeader, "head-librarian")
+	r := httptest.NewRecorder()
+	AddCollectionHandler(r, req, testDB)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	entries := auditLog(t, "claimed_actor=head-librarian")
+	if len(entries) != 1 || entries[0].Actor != "203.0.113.9" || entries[0].ClaimedActor != "head-librarian" {
+		t.Errorf("Expected the address as the actor and head-librarian as claimed, got %+v", entries)
+	}
+	if entries := auditLog(t, "actor=head-librarian"); len(entries) != 0 {
+		t.Errorf("Expected nothing to be made by head-librarian, got %+v", entries)
+	}
+}
+
+func TestGetAuditLogHandlerBadFilters(t *testing.T) {
+	for _, query := range []string{"from=yesterday", "to=2023-13-01", "limit=0", "limit=lots"} {
+		r := callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?"+query, nil)
+		if r.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %s, got %d", http.StatusBadRequest, query, r.Code)
+		}
+	}
+
+	// A date range that ends before anything was written is simply empty
+	if entries := auditLog(t, "to=2000-01-01"); len(entries) != 0 {
+		t.Errorf("Expected no audit entries before 2000, got %d", len(entries))
+	}
+}
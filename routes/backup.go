@@ -0,0 +1,397 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// BackupKeep is how many backups RotateBackups leaves in place, the rest are removed oldest first
+const BackupKeep = 7
+
+// BackupRestorePath restores the backup with the given name from the backup directory
+const BackupRestorePath = "/api/v1/admin/backups/{name}:restore"
+
+// Backups are named after the time they were taken. A backup taken in the same millisecond as
+// another gets a sequence number after the time, like backup-20230601T080000.000Z-1.db.
+const (
+	backupPrefix     = "backup-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+// ErrBackupTooNew is returned when restoring a backup made by a newer version of the server,
+// whose schema this version doesn't know how to use
+var ErrBackupTooNew = errors.New("backup has a newer schema version than this server supports")
+
+type Backup struct {
+	Name          string    `json:"name"`
+	SizeBytes     int64     `json:"size_bytes"`
+	SchemaVersion int       `json:"schema_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	// seq orders the backups taken in the same millisecond, see createBackupFile
+	seq int
+}
+
+// BackupDir is where backups of the database at injectedDB are kept, next to the database itself
+func BackupDir(injectedDB string) string {
+	return filepath.Join(filepath.Dir(injectedDB), "backups")
+}
+
+// BackupDatabase takes a consistent copy of the database at injectedDB into a new file in dir
+// and returns its path. It uses SQLite's online backup API, so the server can keep serving
+// requests while it runs.
+func BackupDatabase(injectedDB, dir string) (string, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := createBackupFile(dir, now().UTC())
+	if err != nil {
+		return "", err
+	}
+
+	err = copyDatabase(path, injectedDB)
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// createBackupFile creates the empty file a backup taken at taken is written to. The file is
+// created exclusively, so two backups taken at once, say by the admin endpoint and the backup
+// command, never write to the same one, the later getting the next sequence number.
+func createBackupFile(dir string, taken time.Time) (string, error) {
+	stamp := taken.Format(backupTimeFormat)
+	for seq := 0; ; seq++ {
+		name := backupPrefix + stamp + backupSuffix
+		if seq > 0 {
+			name = backupPrefix + stamp + "-" + strconv.Itoa(seq) + backupSuffix
+		}
+		path := filepath.Join(dir, name)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return path, file.Close()
+	}
+}
+
+// parseBackupName returns when the backup with name was taken and its sequence number among
+// the backups taken in the same millisecond, ok is false for a file that isn't a backup
+func parseBackupName(name string) (taken time.Time, seq int, ok bool) {
+	stamp, found := strings.CutPrefix(name, backupPrefix)
+	if !found {
+		return time.Time{}, 0, false
+	}
+	stamp, found = strings.CutSuffix(stamp, backupSuffix)
+	if !found {
+		return time.Time{}, 0, false
+	}
+	if before, after, found := strings.Cut(stamp, "Z-"); found {
+		n, err := strconv.Atoi(after)
+		if err != nil || n < 1 {
+			return time.Time{}, 0, false
+		}
+		stamp, seq = before+"Z", n
+	}
+	taken, err := time.Parse(backupTimeFormat, stamp)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return taken, seq, true
+}
+
+// RestoreDatabase replaces the contents of the database at injectedDB with the backup at
+// backupFile. The backup is checked first, and the current database is backed up into dir so
+// the restore can itself be undone, leaving the newest keep backups there. Backups from older schema versions are migrated after
+// they're restored. Webhook deliveries still pending in the backup are dead-lettered, they
+// may have been sent since it was taken, and can be redelivered if they weren't.
+func RestoreDatabase(injectedDB, backupFile, dir string, keep int) error {
+	if _, err := os.Stat(backupFile); err != nil {
+		return err
+	}
+
+	backup, err := sql.Open("sqlite3", backupFile)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var integrity string
+	err = backup.QueryRow("PRAGMA integrity_check;").Scan(&integrity)
+	if err != nil {
+		return fmt.Errorf("%s is not a usable database: %w", backupFile, err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("%s failed its integrity check: %s", backupFile, integrity)
+	}
+
+	version, err := schemaVersion(backup)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: %s is at version %d, this server knows %d", ErrBackupTooNew, backupFile, version, len(migrations))
+	}
+
+	_, err = BackupDatabase(injectedDB, dir)
+	if err != nil {
+		return fmt.Errorf("backing up the current database before restoring: %w", err)
+	}
+
+	err = copyDatabase(injectedDB, backupFile)
+	if err != nil {
+		return err
+	}
+
+	err = MigrateDatabase(injectedDB)
+	if err != nil {
+		return err
+	}
+	err = deadLetterRestoredDeliveries(injectedDB)
+	if err != nil {
+		return err
+	}
+
+	// Only now the backup has been restored from can it be rotated out
+	return RotateBackups(dir, keep)
+}
+
+// deadLetterRestoredDeliveries moves the pending webhook deliveries of a database just restored
+// from a backup to the dead letters, with an attempt saying why
+func deadLetterRestoredDeliveries(injectedDB string) error {
+	db, err := sql.Open("sqlite3", injectedDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO WebhookAttempts (delivery_id, error, duration_ms, attempted_at)
+		SELECT delivery_id, ?, 0, ? FROM WebhookDeliveries WHERE status = ?;
+		UPDATE WebhookDeliveries SET status = ? WHERE status = ?;`,
+		"The database was restored from a backup taken before this delivery was sent, redeliver it if it's still wanted", now().UTC(), WebhookPending,
+		WebhookDead, WebhookPending)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateBackups removes all but the newest keep backups in dir
+func RotateBackups(dir string, keep int) error {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := keep; i < len(backups); i++ {
+		err := os.Remove(filepath.Join(dir, backups[i].Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the backups in dir, newest first. A directory that doesn't exist yet
+// has no backups.
+func ListBackups(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		createdAt, seq, ok := parseBackupName(name)
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		db, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		version, err := schemaVersion(db)
+		db.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		backups = append(backups, Backup{Name: name, SizeBytes: info.Size(), SchemaVersion: version, CreatedAt: createdAt, seq: seq})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.After(backups[j].CreatedAt)
+		}
+		return backups[i].seq > backups[j].seq
+	})
+	return backups, nil
+}
+
+// copyDatabase copies every page of the database at src over the database at dst with the
+// online backup API. The copy is taken in a single step, so it's a consistent snapshot of src
+// even while other connections are writing to it.
+func copyDatabase(dst, src string) error {
+	srcDB, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	dstDB, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		return err
+	}
+	defer dstDB.Close()
+
+	ctx := context.Background()
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	dstConn, err := dstDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+
+			done, err := backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+			if !done {
+				backup.Finish()
+				return errors.New("backup did not complete")
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// CreateBackupHandler backs up the database and rotates old backups out
+func CreateBackupHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	dir := BackupDir(injectedDB)
+	path, err := BackupDatabase(injectedDB, dir)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = RotateBackups(dir, BackupKeep)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	backups, err := ListBackups(dir)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	for _, backup := range backups {
+		if backup.Name == filepath.Base(path) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(backup)
+			return
+		}
+	}
+	writeServerError(w, r, fmt.Errorf("backup %s isn't in %s", filepath.Base(path), dir))
+}
+
+// GetBackupsHandler lists the backups that can be restored, newest first
+func GetBackupsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	backups, err := ListBackups(BackupDir(injectedDB))
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(backups)
+}
+
+// RestoreBackupHandler restores one of the backups listed by GetBackupsHandler
+func RestoreBackupHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	dir := BackupDir(injectedDB)
+	name := pathParam(r.URL.Path, BackupRestorePath, "name")
+
+	// Only names from the listing are accepted, never a path to somewhere else on disk
+	backups, err := ListBackups(dir)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	found := false
+	for _, backup := range backups {
+		if backup.Name == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeProblem(w, r, http.StatusNotFound, CodeBackupNotFound, "Backup not found")
+		return
+	}
+
+	err = RestoreDatabase(injectedDB, filepath.Join(dir, name), dir, BackupKeep)
+	if errors.Is(err, ErrBackupTooNew) {
+		writeProblem(w, r, http.StatusConflict, CodeBackupTooNew, err.Error())
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	restartEventStreams()
+
+	response := Response{
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
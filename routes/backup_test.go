@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// backupFixture returns a fresh database in a temporary directory with a single book
+func backupFixture(t *testing.T) string {
+	injectedDB := filepath.Join(t.TempDir(), "library.db")
+	err := MigrateDatabase(injectedDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countBooksIn(t, injectedDB, "INSERT INTO Books (title, author) VALUES ('Dune', 'Frank Herbert');")
+	return injectedDB
+}
+
+// countBooksIn runs any statements given, then counts the books in the database
+func countBooksIn(t *testing.T, injectedDB string, statements ...string) int {
+	db, err := sql.Open("sqlite3", injectedDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM Books;").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBackupAndRestoreDatabase(t *testing.T) {
+	defer func() { now = time.Now }()
+	taken := time.Date(2023, 6, 1, 8, 0, 0, 0, time.UTC)
+	now = func() time.Time { return taken }
+
+	injectedDB := backupFixture(t)
+	dir := BackupDir(injectedDB)
+
+	path, err := BackupDatabase(injectedDB, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countBooksIn(t, path) != 1 {
+		t.Errorf("Expected the backup to have the book")
+	}
+
+	countBooksIn(t, injectedDB, "INSERT INTO Books (title, author) VALUES ('Emma', 'Jane Austen');")
+
+	now = func() time.Time { return taken.Add(time.Hour) }
+	err = RestoreDatabase(injectedDB, path, dir, BackupKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countBooksIn(t, injectedDB); count != 1 {
+		t.Errorf("Expected 1 book after restoring, got %d", count)
+	}
+
+	// The database was backed up before it was overwritten
+	backups, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || !backups[0].CreatedAt.Equal(taken.Add(time.Hour)) {
+		t.Fatalf("Expected the restore to add a backup from %s, got %v", taken.Add(time.Hour), backups)
+	}
+	if count := countBooksIn(t, filepath.Join(dir, backups[0].Name)); count != 2 {
+		t.Errorf("Expected the safety backup to have 2 books, got %d", count)
+	}
+	if backups[0].SchemaVersion != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), backups[0].SchemaVersion)
+	}
+}
+
+func TestRestoreDatabaseDeadLettersDeliveries(t *testing.T) {
+	injectedDB := backupFixture(t)
+	countBooksIn(t, injectedDB,
+		"INSERT INTO WebhookSubscriptions (subscription_id, url, secret, created_at) VALUES (1, 'https://example.com/hook', 's3cret', '2023-06-01 08:00:00');",
+		"INSERT INTO Events (event_id, type, entity_id, payload, created_at) VALUES (1, 'book.created', '1', '{}', '2023-06-01 08:00:00');",
+		"INSERT INTO WebhookDeliveries (delivery_id, subscription_id, event_id, status, next_attempt_at, created_at) VALUES (1, 1, 1, 'pending', '2023-06-01 08:00:00', '2023-06-01 08:00:00');")
+	path, err := BackupDatabase(injectedDB, BackupDir(injectedDB))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The delivery may have gone out since the backup was taken, it isn't sent again
+	time.Sleep(2 * time.Millisecond)
+	err = RestoreDatabase(injectedDB, path, BackupDir(injectedDB), BackupKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := sql.Open("sqlite3", injectedDB)
+	defer db.Close()
+	var status string
+	var attempts int
+	db.QueryRow("SELECT status, (SELECT COUNT(*) FROM WebhookAttempts WHERE delivery_id = 1) FROM WebhookDeliveries WHERE delivery_id = 1;").Scan(&status, &attempts)
+	if status != WebhookDead || attempts != 1 {
+		t.Errorf("Expected the pending delivery to be dead-lettered with an attempt, got %s with %d", status, attempts)
+	}
+}
+
+func TestRestoreDatabaseChecksSchemaVersion(t *testing.T) {
+	injectedDB := backupFixture(t)
+	newer := filepath.Join(t.TempDir(), "newer.db")
+	countBooksIn(t, newer, "CREATE TABLE Books (title TEXT);", "PRAGMA user_version = 1000;")
+
+	err := RestoreDatabase(injectedDB, newer, BackupDir(injectedDB), BackupKeep)
+	if !errors.Is(err, ErrBackupTooNew) {
+		t.Errorf("Expected ErrBackupTooNew, got %v", err)
+	}
+	if count := countBooksIn(t, injectedDB); count != 1 {
+		t.Errorf("Expected the database to be left alone, got %d books", count)
+	}
+
+	// Older backups are brought up to date
+	older := filepath.Join(t.TempDir(), "older.db")
+	countBooksIn(t, older, migrations[0])
+	err = RestoreDatabase(injectedDB, older, BackupDir(injectedDB), BackupKeep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := sql.Open("sqlite3", injectedDB)
+	defer db.Close()
+	version, _ := schemaVersion(db)
+	if version != len(migrations) {
+		t.Errorf("Expected the restored database to be migrated to version %d, got %d", len(migrations), version)
+	}
+
+	err = RestoreDatabase(injectedDB, filepath.Join(t.TempDir(), "missing.db"), BackupDir(injectedDB), BackupKeep)
+	if err == nil {
+		t.Error("Expected restoring a missing file to fail")
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	defer func() { now = time.Now }()
+	injectedDB := backupFixture(t)
+	dir := BackupDir(injectedDB)
+
+	taken := time.Date(2023, 6, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		now = func() time.Time { return taken.Add(time.Duration(i) * time.Hour) }
+		_, err := BackupDatabase(injectedDB, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := RotateBackups(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, _ := ListBackups(dir)
+	if len(backups) != 2 || !backups[1].CreatedAt.Equal(taken.Add(2*time.Hour)) {
+		t.Errorf("Expected the 2 newest backups to be kept, got %v", backups)
+	}
+
+	// A restore rotates too, once the backup it restores from is no longer needed
+	now = func() time.Time { return taken.Add(5 * time.Hour) }
+	err = RestoreDatabase(injectedDB, filepath.Join(dir, backups[1].Name), dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, _ = ListBackups(dir)
+	if len(backups) != 2 || !backups[0].CreatedAt.Equal(taken.Add(5*time.Hour)) || !backups[1].CreatedAt.Equal(taken.Add(3*time.Hour)) {
+		t.Errorf("Expected the safety backup and the newest before it to be kept, got %v", backups)
+	}
+}
+
+func TestBackupDatabaseSameMillisecond(t *testing.T) {
+	defer func() { now = time.Now }()
+	injectedDB := backupFixture(t)
+	dir := BackupDir(injectedDB)
+
+	taken := time.Date(2023, 6, 1, 8, 0, 0, 0, time.UTC)
+	now = func() time.Time { return taken }
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, err := BackupDatabase(injectedDB, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.Base(path))
+	}
+
+	// Each gets a name of its own, and the later ones list as newer
+	backups, _ := ListBackups(dir)
+	if len(backups) != 3 || backups[0].Name != paths[2] || backups[1].Name != paths[1] || backups[2].Name != paths[0] {
+		t.Fatalf("Expected %v newest first, got %v", paths, backups)
+	}
+	if paths[1] != "backup-20230601T080000.000Z-1.db" || !backups[0].CreatedAt.Equal(taken) {
+		t.Errorf("Expected a sequence number after the time, got %v", backups)
+	}
+}
+
+func TestBackupHandlers(t *testing.T) {
+	injectedDB := backupFixture(t)
+
+	r := httptest.NewRecorder()
+	CreateBackupHandler(r, httptest.NewRequest("POST", "/api/v1/admin/backups", nil), injectedDB)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var backup Backup
+	json.Unmarshal(r.Body.Bytes(), &backup)
+	if backup.Name == "" || backup.SizeBytes == 0 {
+		t.Errorf("Expected the new backup to be described, got %+v", backup)
+	}
+
+	r = httptest.NewRecorder()
+	RestoreBackupHandler(r, httptest.NewRequest("POST", "/api/v1/admin/backups/..%2Flibrary.db:restore", nil), injectedDB)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a name that isn't a backup, got %d", http.StatusNotFound, r.Code)
+	}
+
+	r = httptest.NewRecorder()
+	RestoreBackupHandler(r, httptest.NewRequest("POST", "/api/v1/admin/backups/"+backup.Name+":restore", nil), injectedDB)
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+}
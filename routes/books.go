@@ -3,7 +3,7 @@ package routes
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -20,65 +20,66 @@ type Book struct {
 	Edition       string `json:"edition"`
 	Description   string `json:"description"`
 	Genre         string `json:"genre"`
+	// DeletedAt is set while the book is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Availability is only filled in when listing books, it isn't part of the record itself
+	Availability *Availability `json:"availability,omitempty"`
+}
+
+// BookRequest is the body of a request adding a book. It has only the fields a client sets,
+// so one sending book_id, deleted_at or availability back is told they aren't known.
+type BookRequest struct {
+	Title         string `json:"title" validate:"required,max=300,line"`
+	Author        string `json:"author" validate:"required,max=200,line"`
+	PublishedDate string `json:"published_date" validate:"required,date"`
+	Edition       string `json:"edition" validate:"max=100,line"`
+	Description   string `json:"description" validate:"max=5000,text"`
+	Genre         string `json:"genre" validate:"max=100,line"`
+}
+
+type Availability struct {
+	TotalCopies     int `json:"total_copies"`
+	AvailableCopies int `json:"available_copies"`
+	// CopiesByStatus counts every copy of the book by its status, e.g. how many are lost
+	CopiesByStatus map[string]int `json:"copies_by_status"`
 }
 
 type Response struct {
-	Status  string `json:"status"`
-	Code    int    `json:"code"`
-	Message string `json:"message,omitempty"`
-	BookID  string `json:"book_id,omitempty"`
+	Status string `json:"status"`
+	Code   int    `json:"code"`
+	BookID string `json:"book_id,omitempty"`
+	// Revision is the book's revision after a write, see BookRevision
+	Revision int `json:"revision,omitempty"`
 }
 
+// BookPath is the path of a single book
+const BookPath = "/api/v1/books/{id}"
+
 func AddBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
-	db, err := sql.Open("sqlite3", injectedDB)
+	db, err := openDB(r.Context(), injectedDB)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
-	// Parse request body
-	var book Book
-	err = json.NewDecoder(r.Body).Decode(&book)
-	if err != nil {
-		// Return error response
-		response := Response{
-			Status: "error",
-			Code:   http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	// Parse and validate the request body, see the rules on BookRequest
+	var request BookRequest
+	if !decodeRequest(w, r, &request) {
 		return
 	}
-
-	// Sanity checks, making sure we have at least a title and author
-	if book.Author == "" || book.Title == "" {
-		// Return error response
-		response := Response{
-			Status:  "error",
-			Message: "Request to add book must include Author and Title at a minimum.",
-			Code:    http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
+	book := Book{
+		Title:         request.Title,
+		Author:        request.Author,
+		PublishedDate: request.PublishedDate,
+		Edition:       request.Edition,
+		Description:   request.Description,
+		Genre:         request.Genre,
 	}
+	publishedDate, _ := parseDate(book.PublishedDate)
 
-	// Parse the published date string
-	publishedDate, err := parseDate(book.PublishedDate)
-	if err != nil {
-		// Return error response if the date parsing fails
-		response := Response{
-			Status:  "error",
-			Message: "Failed to parse the published date. Valid formats for the date include YYYY, YYYY-MM, and YYYY-MM-DD",
-			Code:    http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 	// Check if the book already exists
-	checkBookQuery := "SELECT book_id FROM Books WHERE title = ? AND author = ?;"
+	checkBookQuery := "SELECT book_id FROM Books WHERE title = ? AND author = ? AND deleted_at IS NULL;"
 	var existingBookID int64
 	err = db.QueryRow(checkBookQuery, book.Title, book.Author).Scan(&existingBookID)
 	if err == nil {
@@ -93,39 +94,56 @@ func AddBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
 		return
 	} else if err != sql.ErrNoRows {
 		// Error occurred during the database query
-		response := Response{
-			Status:  "error",
-			Message: "Something went wrong with the database Query",
-			Code:    http.StatusInternalServerError,
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err)
 		return
 	}
-	// Save the book to the database
+	// Save the book to the database, together with its audit entry
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
 	insertBookQuery := "INSERT INTO Books (title, author, published_date, edition, description, genre)VALUES (?, ?, ?, ?, ?, ?);"
-	result, err := db.Exec(insertBookQuery, book.Title, book.Author, publishedDate, book.Edition, book.Description, book.Genre)
+	result, err := tx.Exec(insertBookQuery, book.Title, book.Author, publishedDate, book.Edition, book.Description, book.Genre)
 	if err != nil {
-		// Return error response
-		response := Response{
-			Status:  "error",
-			Message: fmt.Sprintf("Failed to save book to the database with error: %s", err),
-			Code:    http.StatusInternalServerError,
-		}
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err)
 		return
 	}
 
 	// retrieve the unique book ID
 	bookID, _ := result.LastInsertId()
+	book.BookID = strconv.FormatInt(bookID, 10)
+
+	revision, err := recordBookRevision(tx, r, book.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordAudit(tx, actorFrom(r), AuditCreate, AuditBook, book.BookID, nil, book)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordEvent(tx, EventBookCreated, book.BookID, book)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	notifyEvents()
 
 	// Return success response
 	response := Response{
-		Status: "success",
-		Code:   http.StatusOK,
-		BookID: strconv.FormatInt(bookID, 10),
+		Status:   "success",
+		Code:     http.StatusOK,
+		BookID:   book.BookID,
+		Revision: revision,
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -133,18 +151,21 @@ func AddBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
 }
 
 func GetBooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
-	db, err := sql.Open("sqlite3", injectedDB)
+	db, err := openDB(r.Context(), injectedDB)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
 	// Query the database to get all books. Even tho we could use Select * notation here, we use the col names for clarity and readability
-	query := "SELECT book_id, title, author, published_date, edition, description, genre FROM Books"
+	query := bookSelectQuery
+	if !includeDeleted(r) {
+		query += " WHERE deleted_at IS NULL"
+	}
 	rows, err := db.Query(query)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer rows.Close()
@@ -152,10 +173,9 @@ func GetBooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string)
 	// Iterate over the rows and create a list of books
 	var books []Book
 	for rows.Next() {
-		var book Book
-		err := rows.Scan(&book.BookID, &book.Title, &book.Author, &book.PublishedDate, &book.Edition, &book.Description, &book.Genre)
+		book, err := scanBook(rows)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, r, err)
 			return
 		}
 		books = append(books, book)
@@ -164,7 +184,14 @@ func GetBooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string)
 	// Check for any errors during row iteration
 	err = rows.Err()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
+		return
+	}
+
+	// The copy counts let patrons see whether a book can be checked out right now
+	err = loadAvailability(db, books)
+	if err != nil {
+		writeServerError(w, r, err)
 		return
 	}
 
@@ -174,102 +201,404 @@ func GetBooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string)
 	json.NewEncoder(w).Encode(books)
 }
 
+// GetBookHandler returns the book with the ID in the path
+func GetBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	book, ok := findBook(w, r, tx, pathParam(r.URL.Path, BookPath, "id"))
+	if !ok {
+		return
+	}
+
+	books := []Book{book}
+	err = loadAvailability(db, books)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(books[0])
+}
+
+// UpdateBookHandler edits the book with the ID in the path. Fields left out of the request are
+// kept. Every edit is stored as a new revision of the book.
+func UpdateBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	// The rules are BookRequest's, a field that's left out keeps its stored value
+	var update struct {
+		Title         *string `json:"title" validate:"required,max=300,line"`
+		Author        *string `json:"author" validate:"required,max=200,line"`
+		PublishedDate *string `json:"published_date" validate:"required,date"`
+		Edition       *string `json:"edition" validate:"max=100,line"`
+		Description   *string `json:"description" validate:"max=5000,text"`
+		Genre         *string `json:"genre" validate:"max=100,line"`
+	}
+	if !decodeRequest(w, r, &update) {
+		return
+	}
+
+	// The published date is only replaced when it's in the request, nil keeps the stored one
+	var publishedDate interface{}
+	if update.PublishedDate != nil {
+		publishedDate, _ = parseDate(*update.PublishedDate)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, ok := findBook(w, r, tx, pathParam(r.URL.Path, BookPath, "id"))
+	if !ok {
+		return
+	}
+
+	book := before
+	if update.Title != nil {
+		book.Title = *update.Title
+	}
+	if update.Author != nil {
+		book.Author = *update.Author
+	}
+	if update.Edition != nil {
+		book.Edition = *update.Edition
+	}
+	if update.Description != nil {
+		book.Description = *update.Description
+	}
+	if update.Genre != nil {
+		book.Genre = *update.Genre
+	}
+
+	updateBookQuery := `UPDATE Books SET title = ?, author = ?, published_date = COALESCE(?, published_date), edition = ?, description = ?, genre = ? WHERE book_id = ?;`
+	_, err = tx.Exec(updateBookQuery, book.Title, book.Author, publishedDate, book.Edition, book.Description, book.Genre, book.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	revision, ok := recordBookChange(w, tx, r, AuditUpdate, before)
+	if !ok {
+		return
+	}
+
+	response := Response{
+		Status:   "success",
+		Code:     http.StatusOK,
+		BookID:   book.BookID,
+		Revision: revision,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteBookHandler moves the book with the ID in the path to the trash, where it can be
+// restored until it's purged. Books with copies in circulation or patrons waiting for them
+// can't be deleted.
+func DeleteBookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	book, ok := findBook(w, r, tx, pathParam(r.URL.Path, BookPath, "id"))
+	if !ok {
+		return
+	}
+
+	// Lost copies don't count, there's nothing left on the shelves to account for
+	var copies, holds int
+	err = tx.QueryRow("SELECT (SELECT COUNT(*) FROM Copies WHERE book_id = ? AND status != ?), (SELECT COUNT(*) FROM Holds WHERE book_id = ? AND status IN (?, ?));",
+		book.BookID, CopyLost, book.BookID, HoldWaiting, HoldReady).Scan(&copies, &holds)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if copies > 0 || holds > 0 {
+		problem := newProblem(r, http.StatusConflict, CodeBookInUse, "Book still has copies or holds, mark its copies lost and cancel its holds first")
+		problem.Extensions = map[string]interface{}{"book_id": book.BookID}
+		problem.write(w)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Books SET deleted_at = ? WHERE book_id = ?;", now().UTC(), book.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = recordAudit(tx, actorFrom(r), AuditDelete, AuditBook, book.BookID, book, nil)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordEvent(tx, EventBookDeleted, book.BookID, map[string]string{"book_id": book.BookID})
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	notifyEvents()
+
+	response := Response{
+		Status: "success",
+		Code:   http.StatusOK,
+		BookID: book.BookID,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
 func FilterBooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
 	queryParams, err := url.ParseQuery(r.URL.RawQuery)
 
 	if err != nil {
-		response := Response{
-			Status:  "error",
-			Message: "Incorrectly formatted filter parameters",
-			Code:    http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Incorrectly formatted filter parameters")
 		return
 	}
 
 	//extract values from queryParams
-	title := queryParams.Get("title")
-	author := queryParams.Get("author")
-	genre := queryParams.Get("genre")
-	fromDate := queryParams.Get("fromData")
-	toDate := queryParams.Get("toData")
+	filter := bookFilter{
+		Title:          queryParams.Get("title"),
+		Author:         queryParams.Get("author"),
+		Genre:          queryParams.Get("genre"),
+		FromDate:       queryParams.Get("from_date"),
+		ToDate:         queryParams.Get("to_date"),
+		IncludeDeleted: includeDeleted(r),
+	}
+	// fromData and toData are the names the range went by before, kept for older clients
+	if filter.FromDate == "" {
+		filter.FromDate = queryParams.Get("fromData")
+	}
+	if filter.ToDate == "" {
+		filter.ToDate = queryParams.Get("toData")
+	}
 
-	db, err := sql.Open("sqlite3", injectedDB)
+	query, args, err := filter.query()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
-	query := "SELECT book_id, title, author, published_date, edition, description, genre FROM books WHERE 1=1"
+	books, err := selectBooks(db, query, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = loadAvailability(db, books)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	respJSON, err := json.Marshal(books)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJSON)
+}
+
+// bookFilter narrows down the books FilterBooksHandler and the GraphQL books query return,
+// fields left empty match every book
+type bookFilter struct {
+	Title          string
+	Author         string
+	Genre          string
+	FromDate       string
+	ToDate         string
+	IncludeDeleted bool
+}
+
+var errBadDateRange = errors.New("Failed to parse the date range. Valid formats for the date include YYYY, YYYY-MM, and YYYY-MM-DD")
+
+// query returns the query selecting the books that match the filter and its arguments
+func (filter bookFilter) query() (string, []interface{}, error) {
+	query := bookSelectQuery + " WHERE 1=1"
 	args := make([]interface{}, 0)
 
-	if title != "" {
+	if !filter.IncludeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	if filter.Title != "" {
 		query += " AND title = ?"
-		args = append(args, title)
+		args = append(args, filter.Title)
 	}
-	if author != "" {
+	if filter.Author != "" {
 		query += " AND author = ?"
-		args = append(args, author)
+		args = append(args, filter.Author)
 	}
-	if genre != "" {
+	if filter.Genre != "" {
 		query += " AND genre = ?"
-		args = append(args, genre)
+		args = append(args, filter.Genre)
 	}
-	if fromDate != "" {
+	// The dates are compared as the times they're stored as, a bare "1900" would otherwise be
+	// compared as a number, which sorts before every stored date. A to_date covers the whole
+	// year, month or day it names.
+	if filter.FromDate != "" {
+		from, err := parseDate(filter.FromDate)
+		if err != nil {
+			return "", nil, errBadDateRange
+		}
 		query += " AND published_date >= ?"
-		args = append(args, fromDate)
+		args = append(args, from)
 	}
-	if toDate != "" {
-		query += " AND published_date <= ?"
-		args = append(args, toDate)
+	if filter.ToDate != "" {
+		to, err := parseDate(filter.ToDate)
+		if err != nil {
+			return "", nil, errBadDateRange
+		}
+		switch len(filter.ToDate) {
+		case 4:
+			to = to.AddDate(1, 0, 0)
+		case 7:
+			to = to.AddDate(0, 1, 0)
+		default:
+			to = to.AddDate(0, 0, 1)
+		}
+		query += " AND published_date < ?"
+		args = append(args, to)
 	}
 
+	return query, args, nil
+}
+
+// selectBooks runs a query selecting the columns scanBook expects
+func selectBooks(db *sql.DB, query string, args ...interface{}) ([]Book, error) {
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
 	defer rows.Close()
 
 	books := make([]Book, 0)
-
 	for rows.Next() {
-		var book Book
-		err = rows.Scan(
-			&book.BookID,
-			&book.Title,
-			&book.Author,
-			&book.PublishedDate,
-			&book.Edition,
-			&book.Description,
-			&book.Genre,
-		)
-
+		book, err := scanBook(rows)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 		books = append(books, book)
 	}
+	return books, rows.Err()
+}
 
-	err = rows.Err()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// loadAvailability fills in the copy counts of every book in books
+func loadAvailability(db *sql.DB, books []Book) error {
+	byID := make(map[string]*Availability, len(books))
+	bookIDs := make([]string, len(books))
+	for i := range books {
+		books[i].Availability = &Availability{CopiesByStatus: make(map[string]int)}
+		byID[books[i].BookID] = books[i].Availability
+		bookIDs[i] = books[i].BookID
+	}
+	if len(books) == 0 {
+		return nil
 	}
 
-	respJSON, err := json.Marshal(books)
+	// Only the copies of these books are counted, not the whole table
+	rows, err := db.Query("SELECT book_id, status, COUNT(*) FROM Copies WHERE book_id IN ("+placeholders(len(bookIDs))+") GROUP BY book_id, status;", stringArgs(bookIDs)...)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
+	defer rows.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(respJSON)
+	for rows.Next() {
+		var bookID, status string
+		var count int
+		err := rows.Scan(&bookID, &status, &count)
+		if err != nil {
+			return err
+		}
+
+		availability, ok := byID[bookID]
+		if !ok {
+			continue
+		}
+		availability.TotalCopies += count
+		availability.CopiesByStatus[status] = count
+		if status == CopyAvailable {
+			availability.AvailableCopies = count
+		}
+	}
+
+	return rows.Err()
+}
+
+// bookSelectQuery selects the columns scanBook expects
+const bookSelectQuery = "SELECT book_id, title, author, published_date, edition, description, genre, deleted_at FROM Books"
+
+func scanBook(row rowScanner) (Book, error) {
+	var book Book
+	var deletedAt sql.NullTime
+	err := row.Scan(&book.BookID, &book.Title, &book.Author, &book.PublishedDate, &book.Edition, &book.Description, &book.Genre, &deletedAt)
+	if deletedAt.Valid {
+		book.DeletedAt = &deletedAt.Time
+	}
+	return book, err
+}
+
+// findBook looks up a book that isn't in the trash. If there isn't one it writes the error
+// response itself and returns false, so the caller should just return.
+func findBook(w http.ResponseWriter, r *http.Request, tx *sql.Tx, bookID string) (Book, bool) {
+	book, err := scanBook(tx.QueryRow(bookSelectQuery+" WHERE book_id = ? AND deleted_at IS NULL;", bookID))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeBookNotFound, "Book not found")
+		return book, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return book, false
+	}
+
+	return book, true
 }
 
 // This is a helper function to parse the dates because in testing the date wasnt being saved correctly in my DB
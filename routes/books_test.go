@@ -15,6 +15,17 @@ import (
 
 var testDB string = "testDB.db"
 
+func TestMain(m *testing.M) {
+	// Start every run from an empty database with the latest schema
+	os.Remove(testDB)
+	err := MigrateDatabase(testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestAddBookHandlerSuccess(t *testing.T) {
 	// Create a sample book payload
 	book := Book{
@@ -86,24 +97,42 @@ func TestAddBookHandlerFail(t *testing.T) {
 	}
 
 	// Check the response body
-	var response Response
+	var response Problem
 	err = json.Unmarshal(r.Body.Bytes(), &response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedResponse := Response{
-		Status:  "error",
-		Message: "Request to add book must include Author and Title at a minimum.",
-		Code:    http.StatusBadRequest,
+	expectedResponse := Problem{
+		Status: http.StatusBadRequest,
+		Code:   CodeValidationFailed,
+		Detail: "title is required; author is required; published_date is required",
+		Errors: []FieldError{
+			{Field: "title", Message: "is required"},
+			{Field: "author", Message: "is required"},
+			{Field: "published_date", Message: "is required"},
+		},
 	}
 
 	if response.Status != expectedResponse.Status {
-		t.Errorf("Expected status %s, got %s", expectedResponse.Status, response.Status)
+		t.Errorf("Expected status %d, got %d", expectedResponse.Status, response.Status)
 	}
 
 	if response.Code != expectedResponse.Code {
-		t.Errorf("Expected code %d, got %d", expectedResponse.Code, response.Code)
+		t.Errorf("Expected code %s, got %s", expectedResponse.Code, response.Code)
+	}
+
+	if response.Detail != expectedResponse.Detail {
+		t.Errorf("Expected detail %q, got %q", expectedResponse.Detail, response.Detail)
+	}
+
+	if len(response.Errors) != len(expectedResponse.Errors) {
+		t.Fatalf("Expected errors %+v, got %+v", expectedResponse.Errors, response.Errors)
+	}
+	for i := range expectedResponse.Errors {
+		if response.Errors[i] != expectedResponse.Errors[i] {
+			t.Errorf("Expected error %+v, got %+v", expectedResponse.Errors[i], response.Errors[i])
+		}
 	}
 }
 
@@ -231,6 +260,40 @@ func TestBookFilterHandlerLongFilterURL(t *testing.T) {
 	}
 }
 
+func TestBookFilterHandlerDateRange(t *testing.T) {
+	cleanBooksTable()
+	defer cleanBooksTable()
+	for _, book := range []Book{
+		{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815"},
+		{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01"},
+		{Title: "Neuromancer", Author: "William Gibson", PublishedDate: "1984-07"},
+	} {
+		callHandler(t, AddBookHandler, "POST", "/api/v1/books", book)
+	}
+
+	// A to_date takes in the whole year, month or day it names
+	for query, expected := range map[string]int{
+		"from_date=1900":                          2,
+		"from_date=1965-08-02":                    1,
+		"to_date=1965":                            2,
+		"to_date=1965-07":                         1,
+		"from_date=1965-08-01&to_date=1965-08-01": 1,
+		"fromData=1900&toData=1983":               1,
+	} {
+		r := callHandler(t, FilterBooksHandler, "GET", "/api/v1/filter?"+query, nil)
+		var books []Book
+		json.Unmarshal(r.Body.Bytes(), &books)
+		if r.Code != http.StatusOK || len(books) != expected {
+			t.Errorf("Expected %d books for %s, got %d: %s", expected, query, len(books), r.Body.String())
+		}
+	}
+
+	r := callHandler(t, FilterBooksHandler, "GET", "/api/v1/filter?from_date=last+year", nil)
+	if r.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a date that doesn't parse, got %d", http.StatusBadRequest, r.Code)
+	}
+}
+
 func databasePopulationHelper() {
 	db, err := sql.Open("sqlite3", testDB)
 	if err != nil {
@@ -296,7 +359,7 @@ func cleanBooksTable() error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	query := "DELETE FROM Books"
+	query := "DELETE FROM BookRevisions; DELETE FROM Books"
 
 	_, err = db.Exec(query)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,48 +17,43 @@ type Collection struct {
 	Name         string `json:"name"`
 	Description  string `json:"description"`
 	Books        []Book `json:"books"`
+	// DeletedAt is set while the collection is in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+// CollectionRequest is the body of a request creating a collection. Books are added to it
+// afterwards, and the server fills in the rest, so those fields aren't known in a request.
+type CollectionRequest struct {
+	Name        string `json:"name" validate:"required,max=200,line"`
+	Description string `json:"description" validate:"required,max=2000,text"`
+}
+
+// CollectionPath is the path of a single collection
+const CollectionPath = "/api/v1/collections/{id}"
+
 type CollectionResponse struct {
 	CollectionID string `json:"collection_id,omitempty"`
-	Message      string `json:"message,omitempty"`
 	Status       string `json:"status"`
 	Code         int    `json:"code"`
 }
 
 func AddCollectionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
-	db, err := sql.Open("sqlite3", injectedDB)
+	db, err := openDB(r.Context(), injectedDB)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
-	// Parse request body
-	var collection Collection
-	err = json.NewDecoder(r.Body).Decode(&collection)
-	if err != nil {
-		response := CollectionResponse{
-			Status: "error",
-			Code:   http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
+	// Parse and validate the request body, see the rules on CollectionRequest
+	var request CollectionRequest
+	if !decodeRequest(w, r, &request) {
 		return
 	}
+	collection := Collection{Name: request.Name, Description: request.Description}
 
-	if collection.Description == "" || collection.Name == "" {
-		response := CollectionResponse{
-			Status:  "error",
-			Message: "Collections must have at least a name and description.",
-			Code:    http.StatusBadRequest,
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 	// Check if the collection already exists
-	checkCollectionQuery := `SELECT collection_id FROM Collections WHERE name = ?;`
+	checkCollectionQuery := `SELECT collection_id FROM Collections WHERE name = ? AND deleted_at IS NULL;`
 	var existingCollectionID int64
 	err = db.QueryRow(checkCollectionQuery, collection.Name).Scan(&existingCollectionID)
 	if err == nil {
@@ -72,33 +68,48 @@ func AddCollectionHandler(w http.ResponseWriter, r *http.Request, injectedDB str
 		return
 	} else if err != sql.ErrNoRows {
 		// Error occurred during the database query
-		response := CollectionResponse{
-			Status: "error",
-			Code:   http.StatusInternalServerError,
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err)
 		return
 	}
 
-	// Save the collection to the database
+	// Save the collection to the database, together with its audit entry
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
 	insertCollectionQuery := `INSERT INTO Collections (name, description) VALUES (?, ?);`
 
-	result, err := db.Exec(insertCollectionQuery, collection.Name, collection.Description)
+	result, err := tx.Exec(insertCollectionQuery, collection.Name, collection.Description)
 	if err != nil {
-		response := CollectionResponse{
-			Status: "error",
-			Code:   http.StatusInternalServerError,
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err)
 		return
 	}
 
 	collectionID, _ := result.LastInsertId()
+	collection.CollectionID = strconv.FormatInt(collectionID, 10)
+
+	err = recordAudit(tx, actorFrom(r), AuditCreate, AuditCollection, collection.CollectionID, nil, collection)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordEvent(tx, EventCollectionCreated, collection.CollectionID, collection)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	notifyEvents()
 
 	response := CollectionResponse{
-		CollectionID: strconv.FormatInt(collectionID, 10),
+		CollectionID: collection.CollectionID,
 		Status:       "success",
 		Code:         http.StatusOK,
 	}
@@ -108,18 +119,22 @@ func AddCollectionHandler(w http.ResponseWriter, r *http.Request, injectedDB str
 }
 
 func GetCollectionsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
-	db, err := sql.Open("sqlite3", injectedDB)
+	db, err := openDB(r.Context(), injectedDB)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
-	// Query the database to get all collections
-	query := "SELECT collection_id, name, description FROM Collections"
+	// Query the database to get all collections, leaving out the trash unless asked for it
+	deleted := includeDeleted(r)
+	query := "SELECT collection_id, name, description, deleted_at FROM Collections"
+	if !deleted {
+		query += " WHERE deleted_at IS NULL"
+	}
 	rows, err := db.Query(query)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer rows.Close()
@@ -128,17 +143,24 @@ func GetCollectionsHandler(w http.ResponseWriter, r *http.Request, injectedDB st
 	var collections []Collection
 	for rows.Next() {
 		var collection Collection
-		err := rows.Scan(&collection.CollectionID, &collection.Name, &collection.Description)
+		var deletedAt sql.NullTime
+		err := rows.Scan(&collection.CollectionID, &collection.Name, &collection.Description, &deletedAt)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, r, err)
 			return
 		}
+		if deletedAt.Valid {
+			collection.DeletedAt = &deletedAt.Time
+		}
 
 		// Query the database to get books associated with the collection
 		bookQuery := "SELECT b.book_id, b.title, b.author FROM Books b INNER JOIN CollectionBooks cb ON b.book_id = cb.book_id WHERE cb.collection_id = ?"
+		if !deleted {
+			bookQuery += " AND b.deleted_at IS NULL"
+		}
 		bookRows, err := db.Query(bookQuery, collection.CollectionID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, r, err)
 			return
 		}
 		defer bookRows.Close()
@@ -149,7 +171,7 @@ func GetCollectionsHandler(w http.ResponseWriter, r *http.Request, injectedDB st
 			var book Book
 			err := bookRows.Scan(&book.BookID, &book.Title, &book.Author)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeServerError(w, r, err)
 				return
 			}
 			books = append(books, book)
@@ -164,7 +186,7 @@ func GetCollectionsHandler(w http.ResponseWriter, r *http.Request, injectedDB st
 	// Check for any errors during row iteration
 	err = rows.Err()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 
@@ -175,52 +197,38 @@ func GetCollectionsHandler(w http.ResponseWriter, r *http.Request, injectedDB st
 }
 
 func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
-	db, err := sql.Open("sqlite3", injectedDB)
+	db, err := openDB(r.Context(), injectedDB)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer db.Close()
 
 	var collectionToBookData struct {
-		CollectionID string   `json:"collection_id"`
-		BookIDs      []string `json:"book_ids"`
+		CollectionID string   `json:"collection_id" validate:"required,id"`
+		BookIDs      []string `json:"book_ids" validate:"required,id"`
 	}
-
-	err = json.NewDecoder(r.Body).Decode(&collectionToBookData)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if !decodeRequest(w, r, &collectionToBookData) {
 		return
 	}
 
 	// Check if the collection exists
 	var existingCollectionID string
-	err = db.QueryRow("SELECT collection_id FROM Collections WHERE collection_id = ?;", collectionToBookData.CollectionID).Scan(&existingCollectionID)
+	err = db.QueryRow("SELECT collection_id FROM Collections WHERE collection_id = ? AND deleted_at IS NULL;", collectionToBookData.CollectionID).Scan(&existingCollectionID)
 	if err == sql.ErrNoRows {
-		response := Response{
-			Status:  "error",
-			Code:    http.StatusNotFound,
-			Message: "Collection not found",
-		}
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		writeProblem(w, r, http.StatusNotFound, CodeCollectionNotFound, "Collection not found")
 		return
 	} else if err != nil {
-		response := Response{
-			Status: "error",
-			Code:   http.StatusInternalServerError,
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(response)
+		writeServerError(w, r, err)
 		return
 	}
 
 	// Check if the books exist
 	var existingBooks []string
-	checkBooksQuery := fmt.Sprintf("SELECT book_id FROM Books WHERE book_id IN ('%s');", strings.Join(collectionToBookData.BookIDs, "','"))
-	rows, err := db.Query(checkBooksQuery)
+	checkBooksQuery := "SELECT book_id FROM Books WHERE book_id IN (" + placeholders(len(collectionToBookData.BookIDs)) + ") AND deleted_at IS NULL;"
+	rows, err := db.Query(checkBooksQuery, stringArgs(collectionToBookData.BookIDs)...)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 
@@ -230,7 +238,7 @@ func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request, injected
 		var bookID string
 		err := rows.Scan(&bookID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeServerError(w, r, err)
 			return
 		}
 		existingBooks = append(existingBooks, bookID)
@@ -252,32 +260,52 @@ func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request, injected
 	}
 
 	if len(missingBooks) > 0 {
-		response := Response{
-			Status:  "error",
-			Message: fmt.Sprintf("Books not found: %s", strings.Join(missingBooks, ", ")),
-			Code:    http.StatusNotFound,
-		}
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(response)
+		writeProblem(w, r, http.StatusNotFound, CodeBookNotFound, fmt.Sprintf("Books not found: %s", strings.Join(missingBooks, ", ")))
 		return
 	}
 
+	// The audit entry records the collection's books before and after the write
+	before, err := collectionBookIDs(db, collectionToBookData.CollectionID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
 	// Insert books into the collection
 	insertQuery := `INSERT INTO CollectionBooks (collection_id, book_id) VALUES (?, ?);`
 	for _, bookID := range collectionToBookData.BookIDs {
-		_, err := db.Exec(insertQuery, collectionToBookData.CollectionID, bookID)
+		_, err := tx.Exec(insertQuery, collectionToBookData.CollectionID, bookID)
 		if err != nil {
-			response := Response{
-				Status:  "error",
-				Message: fmt.Sprintf("Failed to write %s into database", bookID),
-				Code:    http.StatusInternalServerError,
-			}
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(response)
+			writeServerError(w, r, err)
 			return
 		}
 	}
 
+	after := collectionBooks{BookIDs: append(append([]string{}, before.BookIDs...), collectionToBookData.BookIDs...)}
+	err = recordAudit(tx, actorFrom(r), AuditAddBooks, AuditCollection, collectionToBookData.CollectionID, before, after)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordEvent(tx, EventCollectionBookAdded, collectionToBookData.CollectionID, collectionToBookData)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	notifyEvents()
+
 	response := Response{
 		Status: "success",
 		Code:   http.StatusOK,
@@ -286,3 +314,89 @@ func AddBookToCollectionHandler(w http.ResponseWriter, r *http.Request, injected
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
+
+// DeleteCollectionHandler moves the collection with the ID in the path to the trash, where it
+// can be restored with its books until it's purged. The books themselves aren't touched.
+func DeleteCollectionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var collection Collection
+	collectionID := pathParam(r.URL.Path, CollectionPath, "id")
+	err = tx.QueryRow("SELECT collection_id, name, description FROM Collections WHERE collection_id = ? AND deleted_at IS NULL;", collectionID).Scan(&collection.CollectionID, &collection.Name, &collection.Description)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeCollectionNotFound, "Collection not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Collections SET deleted_at = ? WHERE collection_id = ?;", now().UTC(), collection.CollectionID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = recordAudit(tx, actorFrom(r), AuditDelete, AuditCollection, collection.CollectionID, collection, nil)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = recordEvent(tx, EventCollectionDeleted, collection.CollectionID, map[string]string{"collection_id": collection.CollectionID})
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	notifyEvents()
+
+	response := CollectionResponse{
+		CollectionID: collection.CollectionID,
+		Status:       "success",
+		Code:         http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// collectionBooks is what the audit log records about a collection's membership
+type collectionBooks struct {
+	BookIDs []string `json:"book_ids"`
+}
+
+// collectionBookIDs returns the IDs of the books already in a collection
+func collectionBookIDs(db *sql.DB, collectionID string) (collectionBooks, error) {
+	members := collectionBooks{BookIDs: make([]string, 0)}
+	rows, err := db.Query("SELECT book_id FROM CollectionBooks WHERE collection_id = ? ORDER BY rowid;", collectionID)
+	if err != nil {
+		return members, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bookID string
+		err := rows.Scan(&bookID)
+		if err != nil {
+			return members, err
+		}
+		members.BookIDs = append(members.BookIDs, bookID)
+	}
+	return members, rows.Err()
+}
@@ -12,7 +12,7 @@ import (
 
 func TestAddCollectionHandlerSuccess(t *testing.T) {
 	// Create a sample collection payload
-	collection := Collection{
+	collection := CollectionRequest{
 		Name:        "My Collection",
 		Description: "A collection of my favorite books",
 	}
@@ -58,7 +58,7 @@ func TestAddCollectionHandlerSuccess(t *testing.T) {
 
 func TestAddCollectionHandlerFail(t *testing.T) {
 	// Create a sample collection payload with missing fields
-	collection := Collection{}
+	collection := CollectionRequest{}
 	payload, _ := json.Marshal(collection)
 
 	// Create a request with the sample payload
@@ -77,28 +77,28 @@ func TestAddCollectionHandlerFail(t *testing.T) {
 	}
 
 	// Check the response body
-	var response CollectionResponse
+	var response Problem
 	err = json.Unmarshal(r.Body.Bytes(), &response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedResponse := CollectionResponse{
-		Status:  "error",
-		Message: "Collections must have at least a name and description.",
-		Code:    http.StatusBadRequest,
+	expectedResponse := Problem{
+		Status: http.StatusBadRequest,
+		Code:   CodeValidationFailed,
+		Detail: "name is required; description is required",
 	}
 
 	if response.Status != expectedResponse.Status {
-		t.Errorf("Expected status %s, got %s", expectedResponse.Status, response.Status)
+		t.Errorf("Expected status %d, got %d", expectedResponse.Status, response.Status)
 	}
 
 	if response.Code != expectedResponse.Code {
-		t.Errorf("Expected code %d, got %d", expectedResponse.Code, response.Code)
+		t.Errorf("Expected code %s, got %s", expectedResponse.Code, response.Code)
 	}
 
-	if response.Message != expectedResponse.Message {
-		t.Errorf("Expected message %s, got %s", response.Message, expectedResponse.Message)
+	if response.Detail != expectedResponse.Detail {
+		t.Errorf("Expected detail %s, got %s", expectedResponse.Detail, response.Detail)
 	}
 }
 
@@ -254,28 +254,28 @@ func TestAddBookToCollectionHandlerCollectionNotFound(t *testing.T) {
 	}
 
 	// Check the response body
-	var response Response
+	var response Problem
 	err = json.Unmarshal(r.Body.Bytes(), &response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedResponse := Response{
-		Status:  "error",
-		Message: "Collection not found",
-		Code:    http.StatusNotFound,
+	expectedResponse := Problem{
+		Status: http.StatusNotFound,
+		Code:   CodeCollectionNotFound,
+		Detail: "Collection not found",
 	}
 
 	if response.Status != expectedResponse.Status {
-		t.Errorf("Expected status %s, got %s", expectedResponse.Status, response.Status)
+		t.Errorf("Expected status %d, got %d", expectedResponse.Status, response.Status)
 	}
 
 	if response.Code != expectedResponse.Code {
-		t.Errorf("Expected code %d, got %d", expectedResponse.Code, response.Code)
+		t.Errorf("Expected code %s, got %s", expectedResponse.Code, response.Code)
 	}
 
-	if response.Message != expectedResponse.Message {
-		t.Errorf("Expected message %s, got %s", response.Message, expectedResponse.Message)
+	if response.Detail != expectedResponse.Detail {
+		t.Errorf("Expected detail %s, got %s", expectedResponse.Detail, response.Detail)
 	}
 }
 
@@ -314,28 +314,28 @@ func TestAddBookToCollectionHandlerBookNotFound(t *testing.T) {
 	}
 
 	// Check the response body
-	var response Response
+	var response Problem
 	err = json.Unmarshal(r.Body.Bytes(), &response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	expectedResponse := Response{
-		Status:  "error",
-		Message: "Books not found: 999",
-		Code:    http.StatusNotFound,
+	expectedResponse := Problem{
+		Status: http.StatusNotFound,
+		Code:   CodeBookNotFound,
+		Detail: "Books not found: 999",
 	}
 
 	if response.Status != expectedResponse.Status {
-		t.Errorf("Expected status %s, got %s", expectedResponse.Status, response.Status)
+		t.Errorf("Expected status %d, got %d", expectedResponse.Status, response.Status)
 	}
 
 	if response.Code != expectedResponse.Code {
-		t.Errorf("Expected code %d, got %d", expectedResponse.Code, response.Code)
+		t.Errorf("Expected code %s, got %s", expectedResponse.Code, response.Code)
 	}
 
-	if response.Message != expectedResponse.Message {
-		t.Errorf("Expected message %s, got %s", expectedResponse.Message, response.Message)
+	if response.Detail != expectedResponse.Detail {
+		t.Errorf("Expected detail %s, got %s", expectedResponse.Detail, response.Detail)
 	}
 }
 
@@ -380,7 +380,7 @@ func cleanCollectionsFromTestDatabase() error {
 		log.Fatal(err)
 	}
 
-	query := "DELETE FROM Collections"
+	query := "DELETE FROM CollectionBooks; DELETE FROM Collections"
 
 	_, err = db.Exec(query)
 	if err != nil {
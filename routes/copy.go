@@ -0,0 +1,410 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Copy statuses. A Book is the bibliographic record, a Copy is a physical item on the shelf.
+const (
+	CopyAvailable = "available"
+	CopyOnLoan    = "on_loan"
+	// CopyOnHoldShelf copies are set aside for the patron whose hold is ready for pickup
+	CopyOnHoldShelf = "on_hold"
+	CopyLost        = "lost"
+	CopyInRepair    = "in_repair"
+)
+
+// copyConditions are the conditions a copy can be recorded in, best first
+var copyConditions = []string{"new", "good", "fair", "poor", "damaged"}
+
+// CopyPath is the path of a single copy, looked up by its barcode
+const CopyPath = "/api/v1/copies/{barcode}"
+
+type Copy struct {
+	CopyID        string `json:"copy_id,omitempty"`
+	BookID        string `json:"book_id"`
+	Title         string `json:"title,omitempty"`
+	Barcode       string `json:"barcode"`
+	Branch        string `json:"branch"`
+	ShelfLocation string `json:"shelf_location"`
+	Condition     string `json:"condition"`
+	Status        string `json:"status,omitempty"`
+}
+
+type CopyResponse struct {
+	CopyID string `json:"copy_id,omitempty"`
+	Status string `json:"status"`
+	Code   int    `json:"code"`
+}
+
+// AddCopyHandler adds a physical copy of a book to the inventory. Every copy needs a barcode
+// that is unique across all branches.
+func AddCopyHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	// Parse request body
+	var bookCopy Copy
+	err = json.NewDecoder(r.Body).Decode(&bookCopy)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if bookCopy.BookID == "" || bookCopy.Barcode == "" {
+		writeValidationProblem(w, r, "Request to add a copy must include a book_id and a barcode.",
+			requiredFields("book_id", bookCopy.BookID, "barcode", bookCopy.Barcode)...)
+		return
+	}
+
+	if bookCopy.Condition == "" {
+		bookCopy.Condition = "good"
+	}
+	if !validCopyCondition(bookCopy.Condition) {
+		writeValidationProblem(w, r, "Copy condition must be one of "+strings.Join(copyConditions, ", "),
+			FieldError{Field: "condition", Message: "must be one of " + strings.Join(copyConditions, ", ")})
+		return
+	}
+
+	// Check if the book exists
+	var existingBookID string
+	err = db.QueryRow("SELECT book_id FROM Books WHERE book_id = ? AND deleted_at IS NULL;", bookCopy.BookID).Scan(&existingBookID)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeBookNotFound, "Book not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// Check if the barcode is already on another copy
+	var existingCopyID int64
+	err = db.QueryRow("SELECT copy_id FROM Copies WHERE barcode = ?;", bookCopy.Barcode).Scan(&existingCopyID)
+	if err == nil {
+		problem := newProblem(r, http.StatusConflict, CodeBarcodeTaken, "A copy with this barcode already exists")
+		problem.Extensions = map[string]interface{}{"copy_id": strconv.FormatInt(existingCopyID, 10)}
+		problem.write(w)
+		return
+	} else if err != sql.ErrNoRows {
+		writeServerError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	insertCopyQuery := `INSERT INTO Copies (book_id, barcode, branch, shelf_location, condition, status) VALUES (?, ?, ?, ?, ?, ?);`
+	result, err := tx.Exec(insertCopyQuery, bookCopy.BookID, bookCopy.Barcode, bookCopy.Branch, bookCopy.ShelfLocation, bookCopy.Condition, CopyAvailable)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	copyID, _ := result.LastInsertId()
+	bookCopy.CopyID = strconv.FormatInt(copyID, 10)
+	bookCopy.Status = CopyAvailable
+
+	err = recordAudit(tx, actorFrom(r), AuditCreate, AuditCopy, bookCopy.CopyID, nil, bookCopy)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// A new copy can go straight to a patron waiting for the book
+	err = promoteHolds(tx, bookCopy.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := CopyResponse{
+		CopyID: bookCopy.CopyID,
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetCopiesHandler lists copies, optionally filtered by book_id, branch, shelf_location and status.
+func GetCopiesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	queryParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Incorrectly formatted copy parameters")
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	query := copySelectQuery + " WHERE 1=1"
+	args := make([]interface{}, 0)
+
+	// The column names come from this fixed list, never from the request
+	for _, column := range []string{"book_id", "branch", "shelf_location", "status"} {
+		if value := queryParams.Get(column); value != "" {
+			query += " AND c." + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	query += " ORDER BY c.branch, c.shelf_location, c.barcode"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	copies := make([]Copy, 0)
+	for rows.Next() {
+		bookCopy, err := scanCopy(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		copies = append(copies, bookCopy)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(copies)
+}
+
+// GetCopyHandler looks up a single copy by the barcode in the path.
+func GetCopyHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	bookCopy, ok := findCopy(w, r, db, pathParam(r.URL.Path, CopyPath, "barcode"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bookCopy)
+}
+
+// UpdateCopyHandler changes the branch, shelf location, condition or status of the copy with
+// the barcode in the path. Fields left out of the request are kept. The status can only be
+// set to available, lost or in_repair, and a copy on loan or on the hold shelf can only be
+// marked lost, its other changes go through checkout, returns and holds.
+func UpdateCopyHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var update struct {
+		Branch        *string `json:"branch"`
+		ShelfLocation *string `json:"shelf_location"`
+		Condition     *string `json:"condition"`
+		Status        *string `json:"status"`
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if update.Condition != nil && !validCopyCondition(*update.Condition) {
+		writeValidationProblem(w, r, "Copy condition must be one of "+strings.Join(copyConditions, ", "),
+			FieldError{Field: "condition", Message: "must be one of " + strings.Join(copyConditions, ", ")})
+		return
+	}
+
+	if update.Status != nil && *update.Status != CopyAvailable && *update.Status != CopyLost && *update.Status != CopyInRepair {
+		writeValidationProblem(w, r, "Copy status can only be set to available, lost or in_repair",
+			FieldError{Field: "status", Message: "must be available, lost or in_repair"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// The copy is read in the transaction, so a checkout can't slip in between the check and
+	// the update
+	bookCopy, ok := findCopy(w, r, tx, pathParam(r.URL.Path, CopyPath, "barcode"))
+	if !ok {
+		return
+	}
+
+	// A copy out on loan or on the hold shelf can be marked lost, but its other changes of
+	// status wait until it's returned or picked up
+	if update.Status != nil && *update.Status != CopyLost && (bookCopy.Status == CopyOnLoan || bookCopy.Status == CopyOnHoldShelf) {
+		problem := newProblem(r, http.StatusConflict, CodeCopyInCirculation, "Copy is "+bookCopy.Status+", it can only be marked lost until it is returned or picked up")
+		problem.Extensions = map[string]interface{}{"copy_id": bookCopy.CopyID}
+		problem.write(w)
+		return
+	}
+
+	// Only the fields sent are set, so two updates of different fields don't undo each other
+	before := bookCopy
+	var columns []string
+	var args []interface{}
+	if update.Branch != nil {
+		bookCopy.Branch = *update.Branch
+		columns, args = append(columns, "branch = ?"), append(args, bookCopy.Branch)
+	}
+	if update.ShelfLocation != nil {
+		bookCopy.ShelfLocation = *update.ShelfLocation
+		columns, args = append(columns, "shelf_location = ?"), append(args, bookCopy.ShelfLocation)
+	}
+	if update.Condition != nil {
+		bookCopy.Condition = *update.Condition
+		columns, args = append(columns, "condition = ?"), append(args, bookCopy.Condition)
+	}
+	if update.Status != nil {
+		bookCopy.Status = *update.Status
+		columns, args = append(columns, "status = ?"), append(args, bookCopy.Status)
+	}
+
+	if len(columns) > 0 {
+		// The status it was read with guards the update, a copy checked out or put on the hold
+		// shelf since then is left alone
+		updateCopyQuery := "UPDATE Copies SET " + strings.Join(columns, ", ") + " WHERE copy_id = ? AND status = ?;"
+		result, err := tx.Exec(updateCopyQuery, append(args, bookCopy.CopyID, before.Status)...)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		if updated == 0 {
+			problem := newProblem(r, http.StatusConflict, CodeCopyChanged, "Copy was changed by another request, fetch it and try again")
+			problem.Extensions = map[string]interface{}{"copy_id": bookCopy.CopyID}
+			problem.write(w)
+			return
+		}
+	}
+
+	err = recordAudit(tx, actorFrom(r), AuditUpdate, AuditCopy, bookCopy.CopyID, before, bookCopy)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// A copy lost while it was out ends its loan, and one lost from the hold shelf hands its
+	// hold on to the next copy
+	if bookCopy.Status == CopyLost && before.Status == CopyOnLoan {
+		err = closeLostLoan(tx, bookCopy.CopyID)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+	if bookCopy.Status == CopyLost && before.Status == CopyOnHoldShelf {
+		err = requeueLostCopyHold(tx, bookCopy)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	// A copy back from repair, or found again, goes to the next patron waiting for it
+	if bookCopy.Status == CopyAvailable {
+		err = promoteHolds(tx, bookCopy.BookID)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := CopyResponse{
+		CopyID: bookCopy.CopyID,
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// copySelectQuery selects the columns scanCopy expects. Copies added before barcodes were
+// required have a NULL barcode.
+const copySelectQuery = `SELECT c.copy_id, c.book_id, b.title, COALESCE(c.barcode, ''), c.branch, c.shelf_location, c.condition, c.status
+	FROM Copies c
+	INNER JOIN Books b ON b.book_id = c.book_id`
+
+func scanCopy(row rowScanner) (Copy, error) {
+	var bookCopy Copy
+	err := row.Scan(&bookCopy.CopyID, &bookCopy.BookID, &bookCopy.Title, &bookCopy.Barcode, &bookCopy.Branch, &bookCopy.ShelfLocation, &bookCopy.Condition, &bookCopy.Status)
+	return bookCopy, err
+}
+
+// findCopy looks up a copy by barcode. If there isn't one it writes the error response itself
+// and returns false, so the caller should just return.
+func findCopy(w http.ResponseWriter, r *http.Request, db rowQueryer, barcode string) (Copy, bool) {
+	bookCopy, err := scanCopy(db.QueryRow(copySelectQuery+" WHERE c.barcode = ?;", barcode))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeCopyNotFound, "Copy not found")
+		return bookCopy, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return bookCopy, false
+	}
+
+	return bookCopy, true
+}
+
+func validCopyCondition(condition string) bool {
+	for _, c := range copyConditions {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAddCopyHandlerSuccess(t *testing.T) {
+	cleanBooksTable()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+
+	payload, _ := json.Marshal(Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "31234000000017", Branch: "Main", ShelfLocation: "SF HER"})
+	req, err := http.NewRequest("POST", "/api/v1/copies", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+
+	AddCopyHandler(r, req, testDB)
+
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var response CopyResponse
+	err = json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.CopyID == "" {
+		t.Error("Expected a copy_id in the response")
+	}
+}
+
+func TestAddCopyHandlerBookNotFound(t *testing.T) {
+	cleanBooksTable()
+
+	payload, _ := json.Marshal(Copy{BookID: "999", Barcode: "31234000000025"})
+	req, err := http.NewRequest("POST", "/api/v1/copies", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+
+	AddCopyHandler(r, req, testDB)
+
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestAddCopyHandlerValidation(t *testing.T) {
+	cleanBooksTable()
+	cleanCirculationTables()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	insertBarcodedCopy(Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "31234000000017"})
+
+	cases := []struct {
+		copy     Copy
+		expected int
+	}{
+		{Copy{BookID: strconv.FormatInt(bookID, 10)}, http.StatusBadRequest},
+		{Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "31234000000033", Condition: "soggy"}, http.StatusBadRequest},
+		{Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "31234000000017"}, http.StatusConflict},
+	}
+
+	for _, c := range cases {
+		r := callHandler(t, AddCopyHandler, "POST", "/api/v1/copies", c.copy)
+		if r.Code != c.expected {
+			t.Errorf("%+v: expected status code %d, got %d", c.copy, c.expected, r.Code)
+		}
+	}
+}
+
+func TestGetCopyHandlerByBarcode(t *testing.T) {
+	cleanBooksTable()
+	cleanCirculationTables()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	insertBarcodedCopy(Copy{BookID: strconv.FormatInt(bookID, 10), Barcode: "31234000000017", Branch: "Main", ShelfLocation: "SF HER"})
+
+	r := callHandler(t, GetCopyHandler, "GET", "/api/v1/copies/31234000000017", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var bookCopy Copy
+	err := json.Unmarshal(r.Body.Bytes(), &bookCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Copy{CopyID: bookCopy.CopyID, BookID: strconv.FormatInt(bookID, 10), Title: "Dune", Barcode: "31234000000017", Branch: "Main", ShelfLocation: "SF HER", Condition: "good", Status: CopyAvailable}
+	if bookCopy != expected {
+		t.Errorf("Expected %+v, got %+v", expected, bookCopy)
+	}
+
+	r = callHandler(t, GetCopyHandler, "GET", "/api/v1/copies/00000000000000", nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestUpdateCopyHandler(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 0)
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "31234000000017"})
+
+	r := callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/31234000000017", map[string]string{"status": CopyInRepair, "condition": "damaged"})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	// Nothing to lend while the only copy is in repair
+	r = callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronID, "book_id": bookID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+
+	callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/31234000000017", map[string]string{"status": CopyAvailable})
+	r = callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronID, "barcode": "31234000000017"})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	// On loan copies change status through returns, not by hand
+	r = callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/31234000000017", map[string]string{"status": CopyInRepair})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestUpdateCopyHandlerLostOnLoan(t *testing.T) {
+	defer func() { now = time.Now }()
+	patronID, bookID := circulationFixture(t, 0)
+	cleanFinePolicies()
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "31234000000017"})
+	checkedOutAt := time.Now()
+	now = func() time.Time { return checkedOutAt }
+	loan := checkout(t, patronID, bookID)
+
+	// A copy that's never brought back is marked lost, which ends its loan and charges the
+	// fine it's run up
+	now = func() time.Time { return checkedOutAt.Add(LoanPeriod + 4*24*time.Hour + time.Hour) }
+	r := callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/31234000000017", map[string]string{"status": CopyLost})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	r = callHandler(t, GetLoansHandler, "GET", "/api/v1/loans?patron_id="+patronID, nil)
+	var loans []Loan
+	json.Unmarshal(r.Body.Bytes(), &loans)
+	if len(loans) != 1 || loans[0].LoanID != loan.LoanID || !loans[0].Lost || loans[0].ReturnedAt == nil {
+		t.Errorf("Expected the loan to be closed as lost, got %+v", loans)
+	}
+	summary := getFines(t, patronID)
+	if summary.BalanceCents != 100 || len(summary.Entries) != 1 || summary.Entries[0].Pending {
+		t.Errorf("Expected 4 days of fines to be posted, got %+v", summary)
+	}
+
+	// It doesn't run up any more, and the book, with only a lost copy, can be deleted
+	now = func() time.Time { return checkedOutAt.Add(LoanPeriod + 10*24*time.Hour) }
+	if summary := getFines(t, patronID); summary.BalanceCents != 100 {
+		t.Errorf("Expected no more fines once the copy is lost, got %d", summary.BalanceCents)
+	}
+	now = time.Now
+	r = callHandler(t, DeleteBookHandler, "DELETE", "/api/v1/books/"+bookID, nil)
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected the book to be deleted, got %d %s", r.Code, r.Body.String())
+	}
+}
+
+func TestUpdateCopyHandlerLostOnHoldShelf(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 0)
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "1"})
+	hold := placeHold(t, patronID, bookID)
+	spare, _ := insertBarcodedCopy(Copy{BookID: bookID, Barcode: "2"})
+
+	// The hold the lost copy was set aside for gets the next copy
+	r := callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/1", map[string]string{"status": CopyLost})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	holds := getHolds(t, "/api/v1/holds?book_id="+bookID)
+	if len(holds) != 1 || holds[0].HoldID != hold.HoldID || holds[0].Status != HoldReady || holds[0].CopyID != strconv.FormatInt(spare, 10) {
+		t.Errorf("Expected the hold to be ready with the other copy, got %+v", holds)
+	}
+}
+
+func TestGetBooksHandlerCopyCounts(t *testing.T) {
+	_, bookID := circulationFixture(t, 0)
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "1"})
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "2"})
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "3"})
+	callHandler(t, UpdateCopyHandler, "PATCH", "/api/v1/copies/3", map[string]string{"status": CopyLost})
+
+	r := callHandler(t, FilterBooksHandler, "GET", "/api/v1/filter?title=The+Hobbit", nil)
+
+	var books []Book
+	err := json.Unmarshal(r.Body.Bytes(), &books)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(books) != 1 || books[0].Availability == nil {
+		t.Fatalf("Expected one book with availability, got %+v", books)
+	}
+	availability := books[0].Availability
+	if availability.TotalCopies != 3 || availability.CopiesByStatus[CopyAvailable] != 2 || availability.CopiesByStatus[CopyLost] != 1 {
+		t.Errorf("Expected 2 available and 1 lost copy, got %+v", *availability)
+	}
+}
+
+func insertBookWithID(book Book) (int64, error) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO Books (title, author, genre) VALUES (?, ?, ?)", book.Title, book.Author, book.Genre)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func insertCopy(bookID int64) (int64, error) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO Copies (book_id, status) VALUES (?, ?)", bookID, CopyAvailable)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func insertBarcodedCopy(bookCopy Copy) (int64, error) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO Copies (book_id, barcode, branch, shelf_location, status) VALUES (?, ?, ?, ?, ?)", bookCopy.BookID, bookCopy.Barcode, bookCopy.Branch, bookCopy.ShelfLocation, CopyAvailable)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
@@ -0,0 +1,303 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Event types in the change feed
+const (
+	EventBookCreated         = "book.created"
+	EventBookUpdated         = "book.updated"
+	EventBookDeleted         = "book.deleted"
+	EventBookRestored        = "book.restored"
+	EventCollectionCreated   = "collection.created"
+	EventCollectionBookAdded = "collection.book_added"
+	EventCollectionDeleted   = "collection.deleted"
+	EventCollectionRestored  = "collection.restored"
+)
+
+// eventTypes lists every event type, for validating subscriptions to them
+var eventTypes = []string{
+	EventBookCreated, EventBookUpdated, EventBookDeleted, EventBookRestored,
+	EventCollectionCreated, EventCollectionBookAdded, EventCollectionDeleted, EventCollectionRestored,
+}
+
+// eventBatchSize is how many events a stream reads from the log at a time
+const eventBatchSize = 100
+
+// eventHeartbeat is how often an idle stream sends a comment to keep proxies from closing it.
+// The log is also checked then, for events written by another process.
+var eventHeartbeat = 15 * time.Second
+
+// Event is an entry in the change feed. IDs only ever increase, so a client can resume from
+// the last ID it saw.
+type Event struct {
+	EventID   int64           `json:"event_id"`
+	Type      string          `json:"type"`
+	EntityID  string          `json:"entity_id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// recordEvent appends an event to the log and queues its webhook deliveries. Pass the
+// transaction that made the change so the event is only kept if the change is, and call
+// notifyEvents once it's committed.
+func recordEvent(db execer, eventType, entityID string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	insertEventQuery := `INSERT INTO Events (type, entity_id, payload, created_at) VALUES (?, ?, ?, ?);`
+	result, err := db.Exec(insertEventQuery, eventType, entityID, string(data), now().UTC())
+	if err != nil {
+		return err
+	}
+
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return queueWebhookDeliveries(db, eventID, eventType)
+}
+
+// eventBroker wakes up the streams waiting for new events, or for the log to be replaced by
+// a restore
+type eventBroker struct {
+	mu       sync.Mutex
+	changed  chan struct{}
+	done     chan struct{}
+	replaced chan struct{}
+}
+
+var events eventBroker
+
+// wait returns a channel that's closed the next time events are written
+func (b *eventBroker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return b.changed
+}
+
+// restored returns a channel that's closed the next time a backup replaces the log
+func (b *eventBroker) restored() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.replaced == nil {
+		b.replaced = make(chan struct{})
+	}
+	return b.replaced
+}
+
+func (b *eventBroker) restore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.replaced != nil {
+		close(b.replaced)
+		b.replaced = nil
+	}
+}
+
+// closed returns a channel that's closed once the server shuts down
+func (b *eventBroker) closed() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		b.done = make(chan struct{})
+	}
+	return b.done
+}
+
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done == nil {
+		b.done = make(chan struct{})
+	}
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+}
+
+func (b *eventBroker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// notifyEvents tells every open stream that there are new events in the log
+func notifyEvents() {
+	events.notify()
+}
+
+// restartEventStreams moves every open stream to the end of a log a backup was just restored
+// over, whose event IDs go back to what they were when it was taken
+func restartEventStreams() {
+	events.restore()
+}
+
+// CloseEventStreams ends every open event stream, and any opened after, so a server shutting
+// down doesn't wait on them. Clients reconnect to another server with Last-Event-ID.
+func CloseEventStreams() {
+	events.close()
+}
+
+// StreamEventsHandler streams the change feed as Server-Sent Events. A client resuming a
+// stream sends the Last-Event-ID header, or last_event_id in the query, and gets every event
+// after it from the log before the live ones. Without either the stream starts from now;
+// last_event_id=0 replays the whole log. An ID past the end of the log, from before a backup
+// was restored, starts from now too, and when a backup is restored open streams move to the
+// end of the restored log. Either way the stream sends an id line without an event, so the
+// client resumes from there.
+func StreamEventsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeServerError(w, r, errors.New("the response writer can't be flushed"))
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastID int64
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Last-Event-ID must be an event ID")
+			return
+		}
+	}
+	restored := events.restored()
+	endID, err := lastEventIDOf(db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	moved := lastID > endID
+	if lastEventID == "" || moved {
+		lastID = endID
+	}
+
+	// A stream lasts longer than the server's write timeout, it's ended by the client or the
+	// server shutting down instead
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if moved {
+		fmt.Fprintf(w, "id: %d\n\n", lastID)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	closed := events.closed()
+
+	for {
+		// Start waiting before reading the log, so an event written in between isn't missed
+		changed := events.wait()
+
+		for {
+			batch, err := eventsAfter(db, lastID)
+			if err != nil {
+				// Too late for an error status, end the stream and let the client reconnect
+				logger(r).Error("event stream failed", "error", err)
+				return
+			}
+			for _, event := range batch {
+				data, err := json.Marshal(event)
+				if err != nil {
+					logger(r).Error("event stream failed", "error", err)
+					return
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.EventID, event.Type, data)
+				lastID = event.EventID
+			}
+			flusher.Flush()
+			if len(batch) < eventBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			return
+		case <-changed:
+		case <-restored:
+			restored = events.restored()
+			lastID, err = lastEventIDOf(db)
+			if err != nil {
+				logger(r).Error("event stream failed", "error", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\n\n", lastID)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// lastEventIDOf returns the ID of the last event in the log, 0 if it's empty
+func lastEventIDOf(db *sql.DB) (int64, error) {
+	var lastID int64
+	err := db.QueryRow("SELECT COALESCE(MAX(event_id), 0) FROM Events;").Scan(&lastID)
+	return lastID, err
+}
+
+// eventsAfter reads the next batch of events after lastID from the log
+func eventsAfter(db *sql.DB, lastID int64) ([]Event, error) {
+	rows, err := db.Query("SELECT event_id, type, entity_id, payload, created_at FROM Events WHERE event_id > ? ORDER BY event_id LIMIT ?;", lastID, eventBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batch := make([]Event, 0)
+	for rows.Next() {
+		var event Event
+		var payload string
+		err := rows.Scan(&event.EventID, &event.Type, &event.EntityID, &payload, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		event.Payload = json.RawMessage(payload)
+		batch = append(batch, event)
+	}
+	return batch, rows.Err()
+}
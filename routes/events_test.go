@@ -0,0 +1,216 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventStream reads Server-Sent Events from a running StreamEventsHandler
+type eventStream struct {
+	lines  *bufio.Scanner
+	cancel context.CancelFunc
+}
+
+func openEventStream(t *testing.T, lastEventID string) *eventStream {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		StreamEventsHandler(w, r, testDB)
+	}))
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got status %d and %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	stream := &eventStream{lines: bufio.NewScanner(resp.Body), cancel: cancel}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	return stream
+}
+
+// next returns the next event on the stream, failing the test if none arrives in time
+func (s *eventStream) next(t *testing.T) Event {
+	timer := time.AfterFunc(5*time.Second, s.cancel)
+	defer timer.Stop()
+
+	var id, eventType string
+	for s.lines.Scan() {
+		line := s.lines.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var event Event
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strconv.FormatInt(event.EventID, 10) != id || event.Type != eventType {
+				t.Errorf("Expected the id and event fields to match the data, got %s %s and %+v", id, eventType, event)
+			}
+			return event
+		}
+	}
+	t.Fatal("Expected another event before the stream ended")
+	return Event{}
+}
+
+// nextID returns the ID of the next id line sent without an event, which moves where the
+// client resumes from
+func (s *eventStream) nextID(t *testing.T) int64 {
+	timer := time.AfterFunc(5*time.Second, s.cancel)
+	defer timer.Stop()
+
+	id := ""
+	for s.lines.Scan() {
+		line := s.lines.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			id = ""
+		case line == "" && id != "":
+			lastID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return lastID
+		}
+	}
+	t.Fatal("Expected an id line before the stream ended")
+	return 0
+}
+
+func lastEventID(t *testing.T) int64 {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var id int64
+	err = db.QueryRow("SELECT COALESCE(MAX(event_id), 0) FROM Events;").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestStreamEventsHandlerLive(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+
+	// Without a Last-Event-ID the stream starts from now
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815"})
+	stream := openEventStream(t, "")
+
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	var book Response
+	json.Unmarshal(r.Body.Bytes(), &book)
+
+	event := stream.next(t)
+	if event.Type != EventBookCreated || event.EntityID != book.BookID {
+		t.Fatalf("Expected %s for book %s, got %s for %s", EventBookCreated, book.BookID, event.Type, event.EntityID)
+	}
+	var created Book
+	json.Unmarshal(event.Payload, &created)
+	if created.Title != "Dune" {
+		t.Errorf("Expected the payload to be the new book, got %s", event.Payload)
+	}
+
+	callHandler(t, UpdateBookHandler, "PATCH", "/api/v1/books/"+book.BookID, map[string]string{"edition": "2nd"})
+	if event := stream.next(t); event.Type != EventBookUpdated {
+		t.Errorf("Expected %s, got %s", EventBookUpdated, event.Type)
+	}
+
+	r = callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Deserts", Description: "Sand"})
+	var collection CollectionResponse
+	json.Unmarshal(r.Body.Bytes(), &collection)
+	callHandler(t, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": collection.CollectionID, "book_ids": []string{book.BookID}})
+
+	if event := stream.next(t); event.Type != EventCollectionCreated {
+		t.Errorf("Expected %s, got %s", EventCollectionCreated, event.Type)
+	}
+	event = stream.next(t)
+	if event.Type != EventCollectionBookAdded || event.EntityID != collection.CollectionID {
+		t.Errorf("Expected %s for collection %s, got %s for %s", EventCollectionBookAdded, collection.CollectionID, event.Type, event.EntityID)
+	}
+	if !strings.Contains(string(event.Payload), `"book_ids":["`+book.BookID+`"]`) {
+		t.Errorf("Expected the payload to name the added book, got %s", event.Payload)
+	}
+}
+
+func TestStreamEventsHandlerResumes(t *testing.T) {
+	cleanBooksTable()
+	start := lastEventID(t)
+
+	titles := []string{"Dune", "Emma", "Ulysses"}
+	for i, title := range titles {
+		callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: title, Author: "Author " + strconv.Itoa(i), PublishedDate: "1900"})
+	}
+
+	// Having seen the first event, the client gets the rest from the log
+	stream := openEventStream(t, strconv.FormatInt(start+1, 10))
+	for _, title := range titles[1:] {
+		event := stream.next(t)
+		var book Book
+		json.Unmarshal(event.Payload, &book)
+		if event.Type != EventBookCreated || book.Title != title {
+			t.Errorf("Expected %s for %s, got %s for %s", EventBookCreated, title, event.Type, book.Title)
+		}
+	}
+}
+
+func TestStreamEventsHandlerBadLastEventID(t *testing.T) {
+	r := callHandler(t, StreamEventsHandler, "GET", "/api/v1/events?last_event_id=yesterday", nil)
+	if r.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, r.Code)
+	}
+}
+
+func TestStreamEventsHandlerAfterRestore(t *testing.T) {
+	cleanBooksTable()
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815"})
+	end := lastEventID(t)
+
+	// A client resuming from past the end of the log, as it would after a restore, is moved to
+	// the end
+	stream := openEventStream(t, strconv.FormatInt(end+100, 10))
+	if id := stream.nextID(t); id != end {
+		t.Errorf("Expected the stream to move to %d, got %d", end, id)
+	}
+
+	// So is an open stream when a backup is restored, and events carry on from there
+	restartEventStreams()
+	if id := stream.nextID(t); id != end {
+		t.Errorf("Expected the stream to move to %d after the restore, got %d", end, id)
+	}
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	if event := stream.next(t); event.EventID != end+1 {
+		t.Errorf("Expected event %d next, got %d", end+1, event.EventID)
+	}
+}
@@ -0,0 +1,512 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Kinds of fine ledger entries. Assessed entries are charges and have positive amounts,
+// payments and waivers are credits and have negative amounts, so a patron's balance is
+// just the sum of their entries.
+const (
+	FineAssessed = "assessed"
+	FinePayment  = "payment"
+	FineWaiver   = "waiver"
+)
+
+// FinePolicy decides how much an overdue loan costs. The policy with an empty genre is the
+// default, a policy for a specific genre overrides it for books in that genre.
+type FinePolicy struct {
+	Genre          string `json:"genre" validate:"max=100,line"`
+	DailyRateCents int    `json:"daily_rate_cents" validate:"min=0"`
+	GraceDays      int    `json:"grace_days" validate:"min=0"`
+	CapCents       int    `json:"cap_cents" validate:"min=0"`
+}
+
+// Fine returns the total fine in cents for a loan that is overdue by the given duration.
+// Only whole days count, the first GraceDays of them are free, and a CapCents of zero
+// means the fine keeps growing.
+func (policy FinePolicy) Fine(overdue time.Duration) int {
+	days := int(overdue/(24*time.Hour)) - policy.GraceDays
+	if days <= 0 {
+		return 0
+	}
+
+	fine := days * policy.DailyRateCents
+	if policy.CapCents > 0 && fine > policy.CapCents {
+		fine = policy.CapCents
+	}
+	return fine
+}
+
+// Fine is an entry on a patron's fine ledger. A pending entry is a charge an overdue loan has
+// run up that the AssessFines job hasn't posted yet, it has no FineID.
+type Fine struct {
+	FineID      string    `json:"fine_id,omitempty"`
+	PatronID    string    `json:"patron_id"`
+	LoanID      string    `json:"loan_id,omitempty"`
+	Kind        string    `json:"kind"`
+	AmountCents int       `json:"amount_cents"`
+	Note        string    `json:"note,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Pending     bool      `json:"pending,omitempty"`
+}
+
+type FinesSummary struct {
+	PatronID     string `json:"patron_id"`
+	BalanceCents int    `json:"balance_cents"`
+	Entries      []Fine `json:"entries"`
+}
+
+type FineResponse struct {
+	FineID       string `json:"fine_id,omitempty"`
+	BalanceCents int    `json:"balance_cents"`
+	Status       string `json:"status"`
+	Code         int    `json:"code"`
+}
+
+// Paths of the per-patron fine endpoints, {id} is the patron_id
+const (
+	FinesPath      = "/api/v1/patrons/{id}/fines"
+	PayFinesPath   = "/api/v1/patrons/{id}/fines/pay"
+	WaiveFinesPath = "/api/v1/patrons/{id}/fines/waive"
+)
+
+// GetFinesHandler returns a patron's fine ledger, newest entry first, along with the balance
+// they owe. Fines overdue loans have run up since the last assessment are listed as pending
+// entries and counted in the balance, but only the AssessFines job, or a payment or waiver,
+// posts them.
+func GetFinesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	patronID := pathParam(r.URL.Path, FinesPath, "id")
+	if !findPatron(w, r, db, patronID) {
+		return
+	}
+
+	policies, err := loadFinePolicies(db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	current := now().UTC()
+	charges, err := accruedFines(db, policies, patronID, current)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	rows, err := db.Query("SELECT fine_id, patron_id, loan_id, kind, amount_cents, note, created_at FROM Fines WHERE patron_id = ? ORDER BY created_at DESC, fine_id DESC;", patronID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	summary := FinesSummary{
+		PatronID: patronID,
+		Entries:  make([]Fine, 0),
+	}
+	for _, c := range charges {
+		summary.BalanceCents += c.amount
+		summary.Entries = append(summary.Entries, Fine{PatronID: patronID, LoanID: c.loanID, Kind: FineAssessed, AmountCents: c.amount, Note: "Overdue", CreatedAt: current, Pending: true})
+	}
+	for rows.Next() {
+		var fine Fine
+		var loanID sql.NullString
+		err := rows.Scan(&fine.FineID, &fine.PatronID, &loanID, &fine.Kind, &fine.AmountCents, &fine.Note, &fine.CreatedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		fine.LoanID = loanID.String
+		summary.BalanceCents += fine.AmountCents
+		summary.Entries = append(summary.Entries, fine)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// PayFinesHandler records a payment against a patron's balance. Patrons can't pay more than
+// they owe.
+func PayFinesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	patronID := pathParam(r.URL.Path, PayFinesPath, "id")
+	if !findPatron(w, r, db, patronID) {
+		return
+	}
+
+	var payment struct {
+		AmountCents int    `json:"amount_cents" validate:"min=1"`
+		Note        string `json:"note" validate:"max=500,line"`
+	}
+	if !decodeRequest(w, r, &payment) {
+		return
+	}
+
+	creditFines(w, r, db, patronID, "", FinePayment, payment.AmountCents, payment.Note)
+}
+
+// WaiveFinesHandler forgives part of a patron's balance. With a loan_id and no amount_cents
+// it waives whatever is still owed for that loan.
+func WaiveFinesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	patronID := pathParam(r.URL.Path, WaiveFinesPath, "id")
+	if !findPatron(w, r, db, patronID) {
+		return
+	}
+
+	var waiver struct {
+		LoanID      string `json:"loan_id" validate:"id"`
+		AmountCents int    `json:"amount_cents" validate:"min=0"`
+		Note        string `json:"note" validate:"max=500,line"`
+	}
+	if !decodeRequest(w, r, &waiver) {
+		return
+	}
+
+	// Without an amount, the waiver is for what the loan owes
+	if waiver.AmountCents == 0 && waiver.LoanID == "" {
+		writeValidationProblem(w, r, "amount_cents must be positive, or loan_id given",
+			FieldError{Field: "amount_cents", Message: "must be positive, or loan_id given"})
+		return
+	}
+
+	creditFines(w, r, db, patronID, waiver.LoanID, FineWaiver, waiver.AmountCents, waiver.Note)
+}
+
+// GetFinePoliciesHandler lists the default fine policy and every per-genre override.
+func GetFinePoliciesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	policies, err := loadFinePolicies(db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	list := make([]FinePolicy, 0, len(policies))
+	for _, policy := range policies {
+		list = append(list, policy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Genre < list[j].Genre })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// SetFinePolicyHandler creates or replaces the fine policy for a genre, or the default
+// policy when the genre is empty. New rates apply from the next assessment onwards and
+// don't reduce fines that were already assessed.
+func SetFinePolicyHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var policy FinePolicy
+	if !decodeRequest(w, r, &policy) {
+		return
+	}
+
+	upsertPolicyQuery := `INSERT INTO FinePolicies (genre, daily_rate_cents, grace_days, cap_cents) VALUES (?, ?, ?, ?)
+		ON CONFLICT (genre) DO UPDATE SET daily_rate_cents = excluded.daily_rate_cents, grace_days = excluded.grace_days, cap_cents = excluded.cap_cents;`
+	_, err = db.Exec(upsertPolicyQuery, policy.Genre, policy.DailyRateCents, policy.GraceDays, policy.CapCents)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := Response{
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// AssessFines scans every overdue loan and charges whatever its fine has grown to since the
+// last scan. It is run on a schedule by the server, and running it twice in a row is harmless.
+func AssessFines(injectedDB string) error {
+	return traceJob("AssessFines", injectedDB, assessFines)
+}
+
+func assessFines(db *sql.DB) error {
+	policies, err := loadFinePolicies(db)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = postFines(tx, policies, "", now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fineCharge is what an overdue loan has run up since its fines were last assessed
+type fineCharge struct {
+	loanID, patronID string
+	amount           int
+}
+
+// accruedFines returns the charges of a patron's overdue loans, or with an empty patronID of
+// everyone's, that aren't on the ledger yet. It only reads. The days since a loan was last
+// assessed are priced with the policy in effect now, the ones before keep the price they were
+// charged at, so a new rate only applies from the next assessment onwards.
+func accruedFines(db queryer, policies map[string]FinePolicy, patronID string, current time.Time) ([]fineCharge, error) {
+	// Loans still out past their due date, and loans that came back late, with the total and
+	// the time of their last assessment. The last entry is joined rather than selected in a
+	// subquery, so its created_at is read as a DATETIME.
+	overdueLoansQuery := `SELECT l.loan_id, l.patron_id, COALESCE(b.genre, ''), l.due_date, l.returned_at,
+		(SELECT COALESCE(SUM(f.amount_cents), 0) FROM Fines f WHERE f.loan_id = l.loan_id AND f.kind = ?), last.created_at
+		FROM Loans l
+		LEFT JOIN Copies c ON c.copy_id = l.copy_id
+		LEFT JOIN Books b ON b.book_id = c.book_id
+		LEFT JOIN Fines last ON last.fine_id = (SELECT f.fine_id FROM Fines f WHERE f.loan_id = l.loan_id AND f.kind = ? ORDER BY f.created_at DESC, f.fine_id DESC LIMIT 1)
+		WHERE l.due_date < ? AND (l.returned_at IS NULL OR l.returned_at > l.due_date) AND (? = '' OR l.patron_id = ?);`
+	rows, err := db.Query(overdueLoansQuery, FineAssessed, FineAssessed, current, patronID, patronID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []fineCharge
+	for rows.Next() {
+		var loanID, patronID, genre string
+		var dueDate time.Time
+		var returnedAt, assessedAt sql.NullTime
+		var assessed int
+		err := rows.Scan(&loanID, &patronID, &genre, &dueDate, &returnedAt, &assessed, &assessedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		end := current
+		if returnedAt.Valid {
+			end = returnedAt.Time
+		}
+
+		policy, ok := policies[genre]
+		if !ok {
+			policy = policies[""]
+		}
+
+		// Only the days since the last assessment are charged, so fines already on the ledger
+		// aren't charged twice or repriced. The cap is on the loan's whole fine.
+		fine := policy.Fine(end.Sub(dueDate))
+		if assessedAt.Valid && assessedAt.Time.Before(end) {
+			fine -= policy.Fine(assessedAt.Time.Sub(dueDate))
+		} else if assessedAt.Valid {
+			fine = 0
+		}
+		if policy.CapCents > 0 && assessed+fine > policy.CapCents {
+			fine = policy.CapCents - assessed
+		}
+		if fine > 0 {
+			charges = append(charges, fineCharge{loanID, patronID, fine})
+		}
+	}
+	return charges, rows.Err()
+}
+
+// postFines charges a patron's overdue loans, or with an empty patronID everyone's, what
+// they've run up since the last assessment
+func postFines(tx *sql.Tx, policies map[string]FinePolicy, patronID string, current time.Time) error {
+	charges, err := accruedFines(tx, policies, patronID, current)
+	if err != nil {
+		return err
+	}
+	for _, c := range charges {
+		_, err = tx.Exec("INSERT INTO Fines (patron_id, loan_id, kind, amount_cents, note, created_at) VALUES (?, ?, ?, ?, ?, ?);", c.patronID, c.loanID, FineAssessed, c.amount, "Overdue", current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFinePolicies returns every fine policy keyed by genre, the default is under ""
+func loadFinePolicies(db queryer) (map[string]FinePolicy, error) {
+	rows, err := db.Query("SELECT genre, daily_rate_cents, grace_days, cap_cents FROM FinePolicies ORDER BY genre;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[string]FinePolicy)
+	for rows.Next() {
+		var policy FinePolicy
+		err := rows.Scan(&policy.Genre, &policy.DailyRateCents, &policy.GraceDays, &policy.CapCents)
+		if err != nil {
+			return nil, err
+		}
+		policies[policy.Genre] = policy
+	}
+
+	return policies, rows.Err()
+}
+
+// creditFines records a payment or waiver of amount cents and writes the response. An amount
+// of 0 credits whatever is still owed for loanID. The patron's fines are brought up to date in
+// the same transaction, so the credit is weighed against what they owe now. Credits can't take
+// a balance below zero, and a credit for a loan, which has to be one of the patron's, can't
+// be more than is owed for it.
+func creditFines(w http.ResponseWriter, r *http.Request, db *sql.DB, patronID, loanID, kind string, amount int, note string) {
+	policies, err := loadFinePolicies(db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if loanID != "" {
+		var loanPatronID string
+		err = tx.QueryRow("SELECT patron_id FROM Loans WHERE loan_id = ?;", loanID).Scan(&loanPatronID)
+		if err == sql.ErrNoRows || (err == nil && loanPatronID != patronID) {
+			writeProblem(w, r, http.StatusNotFound, CodeLoanNotFound, "Loan not found for this patron")
+			return
+		} else if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	err = postFines(tx, policies, patronID, now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if loanID != "" {
+		var owed int
+		err = tx.QueryRow("SELECT COALESCE(SUM(amount_cents), 0) FROM Fines WHERE patron_id = ? AND loan_id = ?;", patronID, loanID).Scan(&owed)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		if owed <= 0 {
+			writeProblem(w, r, http.StatusConflict, CodeNothingOwed, "Nothing is owed for this loan")
+			return
+		}
+		if amount == 0 {
+			amount = owed
+		} else if amount > owed {
+			problem := newProblem(r, http.StatusConflict, CodeOverpayment, "Amount is more than is owed for this loan")
+			problem.Extensions = map[string]interface{}{"loan_balance_cents": owed}
+			problem.write(w)
+			return
+		}
+	}
+
+	var balance int
+	err = tx.QueryRow("SELECT COALESCE(SUM(amount_cents), 0) FROM Fines WHERE patron_id = ?;", patronID).Scan(&balance)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if amount > balance {
+		problem := newProblem(r, http.StatusConflict, CodeOverpayment, "Amount is more than the patron owes")
+		problem.Extensions = map[string]interface{}{"balance_cents": balance}
+		problem.write(w)
+		return
+	}
+
+	var loan interface{}
+	if loanID != "" {
+		loan = loanID
+	}
+
+	result, err := tx.Exec("INSERT INTO Fines (patron_id, loan_id, kind, amount_cents, note, created_at) VALUES (?, ?, ?, ?, ?, ?);", patronID, loan, kind, -amount, note, now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	fineID, _ := result.LastInsertId()
+
+	response := FineResponse{
+		FineID:       strconv.FormatInt(fineID, 10),
+		BalanceCents: balance - amount,
+		Status:       "success",
+		Code:         http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// findPatron checks that a patron exists. If not it writes the error response itself and
+// returns false, so the caller should just return.
+func findPatron(w http.ResponseWriter, r *http.Request, db *sql.DB, patronID string) bool {
+	var existingPatronID string
+	err := db.QueryRow("SELECT patron_id FROM Patrons WHERE patron_id = ?;", patronID).Scan(&existingPatronID)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodePatronNotFound, "Patron not found")
+		return false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFinePolicyFine(t *testing.T) {
+	policy := FinePolicy{DailyRateCents: 25, GraceDays: 2, CapCents: 500}
+	day := 24 * time.Hour
+
+	cases := []struct {
+		overdue  time.Duration
+		expected int
+	}{
+		{0, 0},
+		{2*day + time.Hour, 0},
+		{3 * day, 25},
+		{10*day + 23*time.Hour, 200},
+		{100 * day, 500},
+	}
+
+	for _, c := range cases {
+		fine := policy.Fine(c.overdue)
+		if fine != c.expected {
+			t.Errorf("Overdue by %v: expected %d cents, got %d", c.overdue, c.expected, fine)
+		}
+	}
+}
+
+// overdueFixture checks out a copy of a Fantasy book and moves the clock the given number of
+// days past the due date. The caller must reset now.
+func overdueFixture(t *testing.T, daysLate int) (patronID string, loan LoanResponse) {
+	patronID, bookID := circulationFixture(t, 1)
+	cleanFinePolicies()
+
+	checkedOutAt := time.Now()
+	now = func() time.Time { return checkedOutAt }
+	loan = checkout(t, patronID, bookID)
+
+	late := checkedOutAt.Add(LoanPeriod + time.Duration(daysLate)*24*time.Hour + time.Hour)
+	now = func() time.Time { return late }
+
+	return patronID, loan
+}
+
+func getFines(t *testing.T, patronID string) FinesSummary {
+	r := callHandler(t, GetFinesHandler, "GET", "/api/v1/patrons/"+patronID+"/fines", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var summary FinesSummary
+	err := json.Unmarshal(r.Body.Bytes(), &summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestAssessFinesChargesOnlyTheDifference(t *testing.T) {
+	patronID, _ := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+
+	// Running the job twice at the same time must not charge twice
+	for i := 0; i < 2; i++ {
+		err := AssessFines(testDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary := getFines(t, patronID)
+	if summary.BalanceCents != 100 || len(summary.Entries) != 1 {
+		t.Errorf("Expected one charge of 100 cents, got %+v", summary)
+	}
+
+	// Two days later only the extra two days are charged
+	later := now().Add(48 * time.Hour)
+	now = func() time.Time { return later }
+
+	// Listing fines shows the extra days as pending, without charging them
+	for i := 0; i < 2; i++ {
+		summary = getFines(t, patronID)
+		if summary.BalanceCents != 150 || len(summary.Entries) != 2 || summary.Entries[0].AmountCents != 50 || !summary.Entries[0].Pending || summary.Entries[0].FineID != "" {
+			t.Errorf("Expected a pending charge of 50 cents, got %+v", summary)
+		}
+	}
+
+	err := AssessFines(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary = getFines(t, patronID)
+	if summary.BalanceCents != 150 || len(summary.Entries) != 2 || summary.Entries[0].Pending || summary.Entries[0].FineID == "" {
+		t.Errorf("Expected the job to charge the 50 cents, got %+v", summary)
+	}
+}
+
+func TestAssessFinesGenreOverride(t *testing.T) {
+	patronID, _ := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+
+	r := callHandler(t, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", FinePolicy{Genre: "Fantasy", DailyRateCents: 100, GraceDays: 1})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	summary := getFines(t, patronID)
+	if summary.BalanceCents != 300 {
+		t.Errorf("Expected a balance of 300 cents, got %d", summary.BalanceCents)
+	}
+}
+
+func TestAssessFinesNewRateAppliesForward(t *testing.T) {
+	patronID, _ := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+	err := AssessFines(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The four days already assessed keep their 25 cents, the two after the raise cost a dollar
+	callHandler(t, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", FinePolicy{Genre: "Fantasy", DailyRateCents: 100, CapCents: 1000})
+	later := now().Add(48 * time.Hour)
+	now = func() time.Time { return later }
+	if summary := getFines(t, patronID); summary.BalanceCents != 300 {
+		t.Errorf("Expected a balance of 300 cents, got %d", summary.BalanceCents)
+	}
+
+	// A lower cap than what's been charged doesn't take anything back, or charge more
+	callHandler(t, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", FinePolicy{Genre: "Fantasy", DailyRateCents: 100, CapCents: 50})
+	if summary := getFines(t, patronID); summary.BalanceCents != 100 {
+		t.Errorf("Expected the balance to stay at 100 cents, got %d", summary.BalanceCents)
+	}
+}
+
+func TestAssessFinesStopsAtReturn(t *testing.T) {
+	patronID, loan := overdueFixture(t, 2)
+	defer func() { now = time.Now }()
+
+	callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+
+	later := now().Add(10 * 24 * time.Hour)
+	now = func() time.Time { return later }
+
+	summary := getFines(t, patronID)
+	if summary.BalanceCents != 50 {
+		t.Errorf("Expected a balance of 50 cents, got %d", summary.BalanceCents)
+	}
+}
+
+func TestPayFinesHandler(t *testing.T) {
+	patronID, _ := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+
+	// Paying more than is owed is a conflict
+	r := callHandler(t, PayFinesHandler, "POST", "/api/v1/patrons/"+patronID+"/fines/pay", map[string]int{"amount_cents": 1000})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+
+	r = callHandler(t, PayFinesHandler, "POST", "/api/v1/patrons/"+patronID+"/fines/pay", map[string]int{"amount_cents": 60})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var response FineResponse
+	err := json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.BalanceCents != 40 {
+		t.Errorf("Expected a balance of 40 cents, got %d", response.BalanceCents)
+	}
+}
+
+func TestWaiveFinesHandlerWholeLoan(t *testing.T) {
+	patronID, loan := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+
+	r := callHandler(t, WaiveFinesHandler, "POST", "/api/v1/patrons/"+patronID+"/fines/waive", map[string]string{"loan_id": loan.LoanID, "note": "Book was in the returns bin"})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	summary := getFines(t, patronID)
+	if summary.BalanceCents != 0 || summary.Entries[0].Kind != FineWaiver {
+		t.Errorf("Expected the fine to be waived, got %+v", summary)
+	}
+}
+
+func TestWaiveFinesHandlerLoanAmount(t *testing.T) {
+	patronID, loan := overdueFixture(t, 4)
+	defer func() { now = time.Now }()
+	otherID, err := insertPatron(Patron{Name: "Frodo Baggins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO Fines (patron_id, kind, amount_cents, note, created_at) VALUES (?, ?, 500, 'Damaged cover', ?);", patronID, FineAssessed, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A waiver for the loan can't forgive more than the 100 cents it owes, even though the
+	// patron owes more
+	r := callHandler(t, WaiveFinesHandler, "POST", "/api/v1/patrons/"+patronID+"/fines/waive", map[string]interface{}{"loan_id": loan.LoanID, "amount_cents": 300})
+	problem := decodeProblem(t, r, http.StatusConflict, CodeOverpayment)
+	if problem.Extensions["loan_balance_cents"] != float64(100) {
+		t.Errorf("Expected the loan's balance in the problem, got %+v", problem.Extensions)
+	}
+
+	// Nor can it be for another patron's loan
+	r = callHandler(t, WaiveFinesHandler, "POST", "/api/v1/patrons/"+strconv.FormatInt(otherID, 10)+"/fines/waive", map[string]interface{}{"loan_id": loan.LoanID, "amount_cents": 50})
+	decodeProblem(t, r, http.StatusNotFound, CodeLoanNotFound)
+
+	r = callHandler(t, WaiveFinesHandler, "POST", "/api/v1/patrons/"+patronID+"/fines/waive", map[string]interface{}{"loan_id": loan.LoanID, "amount_cents": 60})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	if summary := getFines(t, patronID); summary.BalanceCents != 540 {
+		t.Errorf("Expected a balance of 540 cents, got %d", summary.BalanceCents)
+	}
+}
+
+func TestGetFinesHandlerPatronNotFound(t *testing.T) {
+	cleanCirculationTables()
+
+	r := callHandler(t, GetFinesHandler, "GET", "/api/v1/patrons/999/fines", nil)
+
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+// cleanFinePolicies removes every per-genre override, leaving the default policy
+func cleanFinePolicies() error {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM FinePolicies WHERE genre != '';")
+	return err
+}
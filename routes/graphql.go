@@ -0,0 +1,436 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+)
+
+// GraphQLPath serves books, collections and authors as one GraphQL graph, so a client can get
+// a collection with its books and their availability in a single request
+const GraphQLPath = "/graphql"
+
+// graphqlRequest is the body of a GraphQL request over HTTP
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlContext is what the resolvers of a single request share
+type graphqlContext struct {
+	db         *sql.DB
+	r          *http.Request
+	injectedDB string
+	loaders    *graphqlLoaders
+}
+
+type graphqlContextKey struct{}
+
+func graphqlFrom(p graphql.ResolveParams) *graphqlContext {
+	return p.Context.Value(graphqlContextKey{}).(*graphqlContext)
+}
+
+// GraphQLHandler runs the query in the body of a POST against graphqlSchema
+func GraphQLHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	var request graphqlRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Query == "" {
+		writeGraphQLError(w, http.StatusBadRequest, "Request must be a JSON object with a query")
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	gc := &graphqlContext{db: db, r: r, injectedDB: injectedDB, loaders: newGraphQLLoaders(db)}
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  request.Query,
+		OperationName:  request.OperationName,
+		VariableValues: request.Variables,
+		Context:        context.WithValue(r.Context(), graphqlContextKey{}, gc),
+	})
+
+	// A query that doesn't parse or validate isn't run at all, there's no data to answer with.
+	// Nor is there when a field that can't be null is over the rate limit.
+	status := http.StatusOK
+	if result.Data == nil && result.HasErrors() {
+		status = http.StatusBadRequest
+		for _, err := range result.Errors {
+			if err.Extensions["status"] == http.StatusTooManyRequests {
+				status = http.StatusTooManyRequests
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeGraphQLError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": message}},
+	})
+}
+
+var graphqlSchema = newGraphQLSchema()
+
+func newGraphQLSchema() graphql.Schema {
+	availabilityType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Availability",
+		Fields: graphql.Fields{
+			"totalCopies":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: availabilityField(func(a *Availability) interface{} { return a.TotalCopies })},
+			"availableCopies": &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Resolve: availabilityField(func(a *Availability) interface{} { return a.AvailableCopies })},
+		},
+	})
+
+	// The types refer to each other, so their fields are filled in once they all exist
+	bookType := graphql.NewObject(graphql.ObjectConfig{Name: "Book", Fields: graphql.Fields{}})
+	authorType := graphql.NewObject(graphql.ObjectConfig{Name: "Author", Fields: graphql.Fields{}})
+	collectionType := graphql.NewObject(graphql.ObjectConfig{Name: "Collection", Fields: graphql.Fields{}})
+	books := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookType)))
+	collections := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(collectionType)))
+
+	bookFields := graphql.Fields{
+		"id":            &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: bookField(func(b Book) interface{} { return b.BookID })},
+		"title":         &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: bookField(func(b Book) interface{} { return b.Title })},
+		"author":        &graphql.Field{Type: graphql.NewNonNull(authorType), Resolve: bookField(func(b Book) interface{} { return b.Author })},
+		"publishedDate": &graphql.Field{Type: graphql.String, Resolve: bookField(func(b Book) interface{} { return b.PublishedDate })},
+		"edition":       &graphql.Field{Type: graphql.String, Resolve: bookField(func(b Book) interface{} { return b.Edition })},
+		"description":   &graphql.Field{Type: graphql.String, Resolve: bookField(func(b Book) interface{} { return b.Description })},
+		"genre":         &graphql.Field{Type: graphql.String, Resolve: bookField(func(b Book) interface{} { return b.Genre })},
+		"deleted":       &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: bookField(func(b Book) interface{} { return b.DeletedAt != nil })},
+		"availability": &graphql.Field{
+			Type: graphql.NewNonNull(availabilityType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlFrom(p).loaders.availability.load(p.Source.(Book).BookID), nil
+			},
+		},
+		"collections": &graphql.Field{
+			Type:        collections,
+			Description: "The collections the book is in",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlFrom(p).loaders.bookCollections.load(p.Source.(Book).BookID), nil
+			},
+		},
+	}
+	for name, field := range bookFields {
+		bookType.AddFieldConfig(name, field)
+	}
+
+	authorType.AddFieldConfig("name", &graphql.Field{
+		Type:    graphql.NewNonNull(graphql.String),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(string), nil },
+	})
+	authorType.AddFieldConfig("books", &graphql.Field{
+		Type: books,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return graphqlFrom(p).loaders.authorBooks.load(p.Source.(string)), nil
+		},
+	})
+
+	collectionFields := graphql.Fields{
+		"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: collectionField(func(c Collection) interface{} { return c.CollectionID })},
+		"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String), Resolve: collectionField(func(c Collection) interface{} { return c.Name })},
+		"description": &graphql.Field{Type: graphql.String, Resolve: collectionField(func(c Collection) interface{} { return c.Description })},
+		"deleted":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Resolve: collectionField(func(c Collection) interface{} { return c.DeletedAt != nil })},
+		"books": &graphql.Field{
+			Type: books,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphqlFrom(p).loaders.collectionBooks.load(p.Source.(Collection).CollectionID), nil
+			},
+		},
+	}
+	for name, field := range collectionFields {
+		collectionType.AddFieldConfig(name, field)
+	}
+
+	includeDeletedArg := &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false, Description: "Include the trash"}
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: rateLimitedFields(graphql.Fields{
+			"books": &graphql.Field{
+				Type:        books,
+				Description: "Books matching every argument given, like /api/v1/filter",
+				Args: graphql.FieldConfigArgument{
+					"title":          &graphql.ArgumentConfig{Type: graphql.String},
+					"author":         &graphql.ArgumentConfig{Type: graphql.String},
+					"genre":          &graphql.ArgumentConfig{Type: graphql.String},
+					"fromDate":       &graphql.ArgumentConfig{Type: graphql.String, Description: "YYYY, YYYY-MM or YYYY-MM-DD"},
+					"toDate":         &graphql.ArgumentConfig{Type: graphql.String, Description: "YYYY, YYYY-MM or YYYY-MM-DD, the whole period is included"},
+					"includeDeleted": includeDeletedArg,
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					filter := bookFilter{IncludeDeleted: p.Args["includeDeleted"].(bool)}
+					filter.Title, _ = p.Args["title"].(string)
+					filter.Author, _ = p.Args["author"].(string)
+					filter.Genre, _ = p.Args["genre"].(string)
+					filter.FromDate, _ = p.Args["fromDate"].(string)
+					filter.ToDate, _ = p.Args["toDate"].(string)
+					query, args, err := filter.query()
+					if err != nil {
+						return nil, err
+					}
+					return selectBooks(graphqlFrom(p).db, query, args...)
+				},
+			},
+			"book": &graphql.Field{
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlFrom(p).loaders.books.load(p.Args["id"].(string)), nil
+				},
+			},
+			"collections": &graphql.Field{
+				Type: collections,
+				Args: graphql.FieldConfigArgument{"includeDeleted": includeDeletedArg},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					query := collectionSelectQuery
+					if !p.Args["includeDeleted"].(bool) {
+						query += " WHERE deleted_at IS NULL"
+					}
+					return selectCollections(graphqlFrom(p).db, query)
+				},
+			},
+			"collection": &graphql.Field{
+				Type: collectionType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlFrom(p).loaders.collections.load(p.Args["id"].(string)), nil
+				},
+			},
+			"authors": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(authorType))),
+				Description: "Everyone with a book in the catalog",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return selectStrings(graphqlFrom(p).db, "SELECT DISTINCT author FROM Books WHERE deleted_at IS NULL ORDER BY author;")
+				},
+			},
+			"author": &graphql.Field{
+				Type: authorType,
+				Args: graphql.FieldConfigArgument{"name": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					authors, err := selectStrings(graphqlFrom(p).db, "SELECT DISTINCT author FROM Books WHERE author = ? AND deleted_at IS NULL;", p.Args["name"])
+					if err != nil || len(authors) == 0 {
+						return nil, err
+					}
+					return authors[0], nil
+				},
+			},
+		}),
+	})
+
+	// Mutations go through the REST handlers, so they're validated, audited and sent to the
+	// change feed the same way
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: rateLimitedFields(graphql.Fields{
+			"addBook": &graphql.Field{
+				Type:        graphql.NewNonNull(bookType),
+				Description: "Adds a book, or returns the one with the same title and author",
+				Args: graphql.FieldConfigArgument{
+					"book": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewInputObject(graphql.InputObjectConfig{
+						Name: "BookInput",
+						Fields: graphql.InputObjectConfigFieldMap{
+							"title":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+							"author":        &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+							"publishedDate": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+							"edition":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+							"description":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+							"genre":         &graphql.InputObjectFieldConfig{Type: graphql.String},
+						},
+					}))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					input := p.Args["book"].(map[string]interface{})
+					var book BookRequest
+					book.Title, _ = input["title"].(string)
+					book.Author, _ = input["author"].(string)
+					book.PublishedDate, _ = input["publishedDate"].(string)
+					book.Edition, _ = input["edition"].(string)
+					book.Description, _ = input["description"].(string)
+					book.Genre, _ = input["genre"].(string)
+
+					var response Response
+					err := graphqlFrom(p).write(AddBookHandler, "/api/v1/books", book, &response)
+					if err != nil {
+						return nil, err
+					}
+					return graphqlFrom(p).loaders.books.load(response.BookID), nil
+				},
+			},
+			"addCollection": &graphql.Field{
+				Type:        graphql.NewNonNull(collectionType),
+				Description: "Adds a collection, or returns the one with the same name",
+				Args: graphql.FieldConfigArgument{
+					"name":        &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"description": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					collection := CollectionRequest{Name: p.Args["name"].(string), Description: p.Args["description"].(string)}
+					var response CollectionResponse
+					err := graphqlFrom(p).write(AddCollectionHandler, "/api/v1/collections", collection, &response)
+					if err != nil {
+						return nil, err
+					}
+					return graphqlFrom(p).loaders.collections.load(response.CollectionID), nil
+				},
+			},
+			"addBooksToCollection": &graphql.Field{
+				Type: graphql.NewNonNull(collectionType),
+				Args: graphql.FieldConfigArgument{
+					"collectionId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"bookIds":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID)))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					request := map[string]interface{}{"collection_id": p.Args["collectionId"], "book_ids": p.Args["bookIds"]}
+					err := graphqlFrom(p).write(AddBookToCollectionHandler, "/api/v1/booksToCollection", request, nil)
+					if err != nil {
+						return nil, err
+					}
+					return graphqlFrom(p).loaders.collections.load(p.Args["collectionId"].(string)), nil
+				},
+			},
+		}),
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// graphqlRoutes are the HTTP routes the root fields of the schema stand for. Each one in a
+// request is rate limited as a request to its route, like a gRPC call, so a query or a batch
+// of mutations costs what the same requests to the REST API would.
+var graphqlRoutes = map[string]string{
+	"books":                "GET /api/v1/books",
+	"book":                 "GET /api/v1/books/{id}",
+	"collections":          "GET /api/v1/collections",
+	"collection":           "GET /api/v1/collections",
+	"authors":              "GET /api/v1/books",
+	"author":               "GET /api/v1/filter",
+	"addBook":              "POST /api/v1/books",
+	"addCollection":        "POST /api/v1/collections",
+	"addBooksToCollection": "POST /api/v1/booksToCollection",
+}
+
+// rateLimitedFields has the resolvers of root fields take a request to their route in
+// graphqlRoutes first, a field over the limit resolves to the error instead
+func rateLimitedFields(fields graphql.Fields) graphql.Fields {
+	for name, field := range fields {
+		route, resolve := graphqlRoutes[name], field.Resolve
+		if route == "" {
+			panic("routes: GraphQL field " + name + " has no route to be rate limited as")
+		}
+		field.Resolve = func(p graphql.ResolveParams) (interface{}, error) {
+			err := takeRoute(p.Context, route)
+			if err != nil {
+				return nil, err
+			}
+			return resolve(p)
+		}
+	}
+	return fields
+}
+
+func bookField(field func(Book) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return field(p.Source.(Book)), nil
+	}
+}
+
+func collectionField(field func(Collection) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return field(p.Source.(Collection)), nil
+	}
+}
+
+func availabilityField(field func(*Availability) interface{}) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return field(p.Source.(*Availability)), nil
+	}
+}
+
+// write calls a REST handler with payload as if it had been POSTed to path by the same client,
+// see invokeHandler
+func (gc *graphqlContext) write(handler func(http.ResponseWriter, *http.Request, string), path string, payload, out interface{}) error {
+	err := invokeHandler(gc.r.Context(), gc.r.Header, gc.r.RemoteAddr, handler, gc.injectedDB, http.MethodPost, path, payload, out)
+	if err != nil {
+		return err
+	}
+
+	// What the mutation returns is read after the write, not from before it
+	gc.loaders.clear()
+	return nil
+}
+
+// collectionSelectQuery selects the columns selectCollections expects
+const collectionSelectQuery = "SELECT collection_id, name, description, deleted_at FROM Collections"
+
+func selectCollections(db *sql.DB, query string, args ...interface{}) ([]Collection, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := make([]Collection, 0)
+	for rows.Next() {
+		var collection Collection
+		var deletedAt sql.NullTime
+		err := rows.Scan(&collection.CollectionID, &collection.Name, &collection.Description, &deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		if deletedAt.Valid {
+			collection.DeletedAt = &deletedAt.Time
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+func selectStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		err := rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// placeholders returns n comma separated ?s, for an IN list
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
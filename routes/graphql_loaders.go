@@ -0,0 +1,216 @@
+package routes
+
+import (
+	"database/sql"
+)
+
+// batchLoader collects the keys a GraphQL request asks for and loads them in one query. load
+// hands the executor a thunk instead of a value, and the executor only calls thunks once every
+// field at the same depth has been resolved, so by the time the first one runs the keys of its
+// siblings are pending too. Without it a list of 50 collections would take 50 queries for
+// their books.
+type batchLoader[K comparable, V any] struct {
+	fetch   func(keys []K) (map[K]V, error)
+	pending []K
+	results map[K]V
+	failed  map[K]error
+	// batches counts the fetches, for the tests
+	batches int
+}
+
+func newBatchLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{fetch: fetch, results: make(map[K]V), failed: make(map[K]error)}
+}
+
+func (l *batchLoader[K, V]) load(key K) func() (interface{}, error) {
+	if _, ok := l.results[key]; !ok {
+		l.pending = append(l.pending, key)
+	}
+
+	return func() (interface{}, error) {
+		if len(l.pending) > 0 {
+			l.run()
+		}
+		if err, ok := l.failed[key]; ok {
+			return nil, err
+		}
+		value, ok := l.results[key]
+		if !ok {
+			return nil, nil
+		}
+		return value, nil
+	}
+}
+
+func (l *batchLoader[K, V]) run() {
+	keys := make([]K, 0, len(l.pending))
+	seen := make(map[K]bool)
+	for _, key := range l.pending {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	l.pending = nil
+	l.batches++
+
+	results, err := l.fetch(keys)
+	for _, key := range keys {
+		if err != nil {
+			l.failed[key] = err
+		} else if value, ok := results[key]; ok {
+			l.results[key] = value
+		}
+	}
+}
+
+// clear forgets what's been loaded, after a write has changed it
+func (l *batchLoader[K, V]) clear() {
+	l.results = make(map[K]V)
+	l.failed = make(map[K]error)
+}
+
+// graphqlLoaders are the loaders of a single GraphQL request
+type graphqlLoaders struct {
+	books           *batchLoader[string, Book]
+	collections     *batchLoader[string, Collection]
+	availability    *batchLoader[string, *Availability]
+	collectionBooks *batchLoader[string, []Book]
+	bookCollections *batchLoader[string, []Collection]
+	authorBooks     *batchLoader[string, []Book]
+}
+
+func newGraphQLLoaders(db *sql.DB) *graphqlLoaders {
+	return &graphqlLoaders{
+		books: newBatchLoader(func(bookIDs []string) (map[string]Book, error) {
+			books, err := selectBooks(db, bookSelectQuery+" WHERE book_id IN ("+placeholders(len(bookIDs))+");", stringArgs(bookIDs)...)
+			byID := make(map[string]Book, len(books))
+			for _, book := range books {
+				byID[book.BookID] = book
+			}
+			return byID, err
+		}),
+
+		collections: newBatchLoader(func(collectionIDs []string) (map[string]Collection, error) {
+			collections, err := selectCollections(db, collectionSelectQuery+" WHERE collection_id IN ("+placeholders(len(collectionIDs))+");", stringArgs(collectionIDs)...)
+			byID := make(map[string]Collection, len(collections))
+			for _, collection := range collections {
+				byID[collection.CollectionID] = collection
+			}
+			return byID, err
+		}),
+
+		availability: newBatchLoader(func(bookIDs []string) (map[string]*Availability, error) {
+			books := make([]Book, len(bookIDs))
+			for i, bookID := range bookIDs {
+				books[i].BookID = bookID
+			}
+			err := loadAvailability(db, books)
+			byID := make(map[string]*Availability, len(books))
+			for _, book := range books {
+				byID[book.BookID] = book.Availability
+			}
+			return byID, err
+		}),
+
+		collectionBooks: newBatchLoader(func(collectionIDs []string) (map[string][]Book, error) {
+			byCollection := make(map[string][]Book, len(collectionIDs))
+			for _, collectionID := range collectionIDs {
+				byCollection[collectionID] = []Book{}
+			}
+			members, err := db.Query("SELECT cb.collection_id, cb.book_id FROM CollectionBooks cb INNER JOIN Books b ON b.book_id = cb.book_id WHERE b.deleted_at IS NULL AND cb.collection_id IN ("+placeholders(len(collectionIDs))+") ORDER BY cb.book_id;", stringArgs(collectionIDs)...)
+			if err != nil {
+				return nil, err
+			}
+			pairs, err := scanPairs(members)
+			if err != nil {
+				return nil, err
+			}
+
+			books, err := selectBooks(db, bookSelectQuery+" WHERE book_id IN (SELECT book_id FROM CollectionBooks WHERE collection_id IN ("+placeholders(len(collectionIDs))+"));", stringArgs(collectionIDs)...)
+			if err != nil {
+				return nil, err
+			}
+			byID := make(map[string]Book, len(books))
+			for _, book := range books {
+				byID[book.BookID] = book
+			}
+			for _, pair := range pairs {
+				byCollection[pair[0]] = append(byCollection[pair[0]], byID[pair[1]])
+			}
+			return byCollection, nil
+		}),
+
+		bookCollections: newBatchLoader(func(bookIDs []string) (map[string][]Collection, error) {
+			byBook := make(map[string][]Collection, len(bookIDs))
+			for _, bookID := range bookIDs {
+				byBook[bookID] = []Collection{}
+			}
+			members, err := db.Query("SELECT cb.book_id, cb.collection_id FROM CollectionBooks cb INNER JOIN Collections c ON c.collection_id = cb.collection_id WHERE c.deleted_at IS NULL AND cb.book_id IN ("+placeholders(len(bookIDs))+") ORDER BY cb.collection_id;", stringArgs(bookIDs)...)
+			if err != nil {
+				return nil, err
+			}
+			pairs, err := scanPairs(members)
+			if err != nil {
+				return nil, err
+			}
+
+			collections, err := selectCollections(db, collectionSelectQuery+" WHERE collection_id IN (SELECT collection_id FROM CollectionBooks WHERE book_id IN ("+placeholders(len(bookIDs))+"));", stringArgs(bookIDs)...)
+			if err != nil {
+				return nil, err
+			}
+			byID := make(map[string]Collection, len(collections))
+			for _, collection := range collections {
+				byID[collection.CollectionID] = collection
+			}
+			for _, pair := range pairs {
+				byBook[pair[0]] = append(byBook[pair[0]], byID[pair[1]])
+			}
+			return byBook, nil
+		}),
+
+		authorBooks: newBatchLoader(func(authors []string) (map[string][]Book, error) {
+			books, err := selectBooks(db, bookSelectQuery+" WHERE deleted_at IS NULL AND author IN ("+placeholders(len(authors))+") ORDER BY book_id;", stringArgs(authors)...)
+			byAuthor := make(map[string][]Book, len(authors))
+			for _, author := range authors {
+				byAuthor[author] = []Book{}
+			}
+			for _, book := range books {
+				byAuthor[book.Author] = append(byAuthor[book.Author], book)
+			}
+			return byAuthor, err
+		}),
+	}
+}
+
+func (loaders *graphqlLoaders) clear() {
+	loaders.books.clear()
+	loaders.collections.clear()
+	loaders.availability.clear()
+	loaders.collectionBooks.clear()
+	loaders.bookCollections.clear()
+	loaders.authorBooks.clear()
+}
+
+// batches is how many times the loaders have gone to the database, each time with one or two
+// queries however many keys were asked for
+func (loaders *graphqlLoaders) batches() int {
+	return loaders.books.batches + loaders.collections.batches + loaders.availability.batches +
+		loaders.collectionBooks.batches + loaders.bookCollections.batches + loaders.authorBooks.batches
+}
+
+// scanPairs reads rows of two ID columns
+func scanPairs(rows *sql.Rows) ([][2]string, error) {
+	defer rows.Close()
+
+	var pairs [][2]string
+	for rows.Next() {
+		var pair [2]string
+		err := rows.Scan(&pair[0], &pair[1])
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, rows.Err()
+}
@@ -0,0 +1,188 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+// runGraphQL runs query the way GraphQLHandler does and returns its data along with the loaders,
+// so tests can see how often they went to the database
+func runGraphQL(t *testing.T, query string) (map[string]interface{}, *graphqlLoaders) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r, _ := http.NewRequest("POST", GraphQLPath, nil)
+	gc := &graphqlContext{db: db, r: r, injectedDB: testDB, loaders: newGraphQLLoaders(db)}
+	result := graphql.Do(graphql.Params{
+		Schema:        graphqlSchema,
+		RequestString: query,
+		Context:       context.WithValue(context.Background(), graphqlContextKey{}, gc),
+	})
+	if result.HasErrors() {
+		t.Fatalf("Expected %s to run, got %v", query, result.Errors)
+	}
+
+	// Round trip through JSON to compare the data the way a client sees it
+	var data map[string]interface{}
+	body, _ := json.Marshal(result.Data)
+	json.Unmarshal(body, &data)
+	return data, gc.loaders
+}
+
+func TestGraphQLCollectionsAreBatched(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	cleanCirculationTables()
+
+	// Ten collections of three books each, all by two authors
+	for c := 0; c < 10; c++ {
+		r := callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Shelf " + strconv.Itoa(c), Description: "Books"})
+		var collection CollectionResponse
+		json.Unmarshal(r.Body.Bytes(), &collection)
+
+		var bookIDs []string
+		for b := 0; b < 3; b++ {
+			r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Book " + strconv.Itoa(c*3+b), Author: "Author " + strconv.Itoa(b%2), PublishedDate: "1965"})
+			var book Response
+			json.Unmarshal(r.Body.Bytes(), &book)
+			bookIDs = append(bookIDs, book.BookID)
+		}
+		callHandler(t, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": collection.CollectionID, "book_ids": bookIDs})
+	}
+
+	data, loaders := runGraphQL(t, `{
+		collections {
+			name
+			books {
+				title
+				availability { totalCopies }
+				author { name books { title } }
+				collections { name }
+			}
+		}
+	}`)
+
+	collections := data["collections"].([]interface{})
+	if len(collections) != 10 {
+		t.Fatalf("Expected 10 collections, got %d", len(collections))
+	}
+	for _, c := range collections {
+		books := c.(map[string]interface{})["books"].([]interface{})
+		if len(books) != 3 {
+			t.Fatalf("Expected 3 books in every collection, got %v", c)
+		}
+		book := books[0].(map[string]interface{})
+		author := book["author"].(map[string]interface{})
+		if author["name"] != "Author 0" || len(author["books"].([]interface{})) != 20 {
+			t.Errorf("Expected the first book's author to have written 20 books, got %v", author)
+		}
+		if len(book["collections"].([]interface{})) != 1 {
+			t.Errorf("Expected the book to be in its collection, got %v", book["collections"])
+		}
+	}
+
+	// One batch each for the books, their availability, authors and collections, however many
+	// collections there are
+	if loaders.batches() != 4 {
+		t.Errorf("Expected 4 batches, got %d", loaders.batches())
+	}
+}
+
+func TestGraphQLBooksFilter(t *testing.T) {
+	cleanBooksTable()
+	for _, book := range []Book{
+		{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815", Genre: "Romance"},
+		{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Genre: "Science Fiction"},
+		{Title: "Persuasion", Author: "Jane Austen", PublishedDate: "1817", Genre: "Romance"},
+	} {
+		callHandler(t, AddBookHandler, "POST", "/api/v1/books", book)
+	}
+
+	data, _ := runGraphQL(t, `{
+		austen: books(author: "Jane Austen", toDate: "1815") { title }
+		modern: books(fromDate: "1900") { title publishedDate }
+		authors { name }
+	}`)
+	if austen := data["austen"].([]interface{}); len(austen) != 1 || austen[0].(map[string]interface{})["title"] != "Emma" {
+		t.Errorf("Expected only Emma, got %v", austen)
+	}
+	if modern := data["modern"].([]interface{}); len(modern) != 1 || modern[0].(map[string]interface{})["title"] != "Dune" {
+		t.Errorf("Expected only Dune, got %v", modern)
+	}
+	if authors := data["authors"].([]interface{}); len(authors) != 2 {
+		t.Errorf("Expected 2 authors, got %v", authors)
+	}
+}
+
+func TestGraphQLHandlerMutations(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+
+	post := func(query string) (int, map[string]interface{}) {
+		r := callHandlerAs(t, "librarian", GraphQLHandler, "POST", GraphQLPath, graphqlRequest{Query: query})
+		var result map[string]interface{}
+		json.Unmarshal(r.Body.Bytes(), &result)
+		return r.Code, result
+	}
+
+	code, result := post(`mutation {
+		dune: addBook(book: {title: "Dune", author: "Frank Herbert", publishedDate: "1965"}) { id title }
+		deserts: addCollection(name: "Deserts", description: "Sand") { id }
+	}`)
+	if code != http.StatusOK || result["errors"] != nil {
+		t.Fatalf("Expected the mutations to succeed, got %d %v", code, result)
+	}
+	data := result["data"].(map[string]interface{})
+	bookID := data["dune"].(map[string]interface{})["id"].(string)
+	collectionID := data["deserts"].(map[string]interface{})["id"].(string)
+
+	code, result = post(`mutation { addBooksToCollection(collectionId: "` + collectionID + `", bookIds: ["` + bookID + `"]) { name books { title } } }`)
+	collection := result["data"].(map[string]interface{})["addBooksToCollection"].(map[string]interface{})
+	if code != http.StatusOK || len(collection["books"].([]interface{})) != 1 {
+		t.Errorf("Expected the collection to have the book, got %d %v", code, result)
+	}
+
+	// The REST handler's validation applies
+	_, result = post(`mutation { addBook(book: {title: "Emma", author: "Jane Austen", publishedDate: "someday"}) { id } }`)
+	errs, _ := result["errors"].([]interface{})
+	if len(errs) != 1 || !strings.Contains(errs[0].(map[string]interface{})["message"].(string), "published_date") {
+		t.Errorf("Expected the handler's error, got %v", result)
+	}
+	if extensions, _ := errs[0].(map[string]interface{})["extensions"].(map[string]interface{}); extensions["code"] != CodeValidationFailed {
+		t.Errorf("Expected the problem's code in the extensions, got %v", errs[0])
+	}
+
+	// And so does its audit log, newest first
+	r := callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?entity=book&entity_id="+bookID, nil)
+	var entries []AuditEntry
+	json.Unmarshal(r.Body.Bytes(), &entries)
+	if len(entries) == 0 || entries[0].Actor != "librarian" || entries[0].Action != AuditCreate {
+		t.Errorf("Expected the book to be added by librarian, got %+v", entries)
+	}
+}
+
+func TestGraphQLHandlerBadRequests(t *testing.T) {
+	for _, body := range []interface{}{
+		"not an object",
+		graphqlRequest{},
+		graphqlRequest{Query: "{ books { isbn } }"},
+		graphqlRequest{Query: "{ books("},
+	} {
+		r := callHandler(t, GraphQLHandler, "POST", GraphQLPath, body)
+		var result map[string]interface{}
+		json.Unmarshal(r.Body.Bytes(), &result)
+		if r.Code != http.StatusBadRequest || result["errors"] == nil {
+			t.Errorf("Expected status code %d with errors for %v, got %d %s", http.StatusBadRequest, body, r.Code, r.Body.String())
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"bookManagement/librarypb"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcActorKey is the metadata key of who a gRPC call claims to be made by, the X-Actor header
+// of the HTTP API
+const grpcActorKey = "x-actor"
+
+// grpcAuthorizationKey is the metadata key of a gRPC call's bearer token, the Authorization
+// header of the HTTP API
+const grpcAuthorizationKey = "authorization"
+
+// grpcRequestIDKey is the metadata key of a gRPC call's request ID, see RequestIDHeader
+const grpcRequestIDKey = "x-request-id"
+
+// grpcRoutes are the HTTP routes the gRPC methods stand for, their calls are rate limited as
+// requests to them
+var grpcRoutes = map[string]string{
+	librarypb.BookService_AddBook_FullMethodName:                    "POST /api/v1/books",
+	librarypb.BookService_GetBook_FullMethodName:                    "GET /api/v1/books/{id}",
+	librarypb.BookService_ListBooks_FullMethodName:                  "GET /api/v1/books",
+	librarypb.BookService_FilterBooks_FullMethodName:                "GET /api/v1/filter",
+	librarypb.CollectionService_CreateCollection_FullMethodName:     "POST /api/v1/collections",
+	librarypb.CollectionService_AddBooksToCollection_FullMethodName: "POST /api/v1/booksToCollection",
+}
+
+// listBooksBatch is how many books ListBooks reads before sending them, their availability is
+// looked up a batch at a time
+const listBooksBatch = 100
+
+// NewGRPCServer returns a gRPC server with the BookService and CollectionService of
+// librarypb/library.proto, each call opening injectedDB. Calls are traced like HTTP requests,
+// continuing the trace in their traceparent metadata.
+func NewGRPCServer(injectedDB string, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(traceUnaryCall), grpc.ChainStreamInterceptor(traceStreamCall)}, opts...)
+	server := grpc.NewServer(opts...)
+	librarypb.RegisterBookServiceServer(server, &bookService{injectedDB: injectedDB})
+	librarypb.RegisterCollectionServiceServer(server, &collectionService{injectedDB: injectedDB})
+	return server
+}
+
+type bookService struct {
+	librarypb.UnimplementedBookServiceServer
+	injectedDB string
+}
+
+func (s *bookService) AddBook(ctx context.Context, req *librarypb.AddBookRequest) (*librarypb.Book, error) {
+	book := BookRequest{
+		Title:         req.GetBook().GetTitle(),
+		Author:        req.GetBook().GetAuthor(),
+		PublishedDate: req.GetBook().GetPublishedDate(),
+		Edition:       req.GetBook().GetEdition(),
+		Description:   req.GetBook().GetDescription(),
+		Genre:         req.GetBook().GetGenre(),
+	}
+	var response Response
+	err := invokeHandler(ctx, grpcHeader(ctx), grpcPeer(ctx), AddBookHandler, s.injectedDB, http.MethodPost, "/api/v1/books", book, &response)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return s.GetBook(ctx, &librarypb.GetBookRequest{BookId: response.BookID})
+}
+
+func (s *bookService) GetBook(ctx context.Context, req *librarypb.GetBookRequest) (*librarypb.Book, error) {
+	var book Book
+	err := invokeHandler(ctx, grpcHeader(ctx), grpcPeer(ctx), GetBookHandler, s.injectedDB, http.MethodGet, "/api/v1/books/"+url.PathEscape(req.GetBookId()), nil, &book)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return bookMessage(book), nil
+}
+
+func (s *bookService) ListBooks(req *librarypb.ListBooksRequest, stream librarypb.BookService_ListBooksServer) error {
+	db, err := openDB(stream.Context(), s.injectedDB)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer db.Close()
+
+	query := bookSelectQuery
+	if !req.GetIncludeDeleted() {
+		query += " WHERE deleted_at IS NULL"
+	}
+	rows, err := db.QueryContext(stream.Context(), query+" ORDER BY book_id;")
+	if err != nil {
+		return grpcError(err)
+	}
+	defer rows.Close()
+
+	send := func(books []Book) error {
+		err := loadAvailability(db, books)
+		if err != nil {
+			return grpcError(err)
+		}
+		for _, book := range books {
+			err := stream.Send(bookMessage(book))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	books := make([]Book, 0, listBooksBatch)
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return grpcError(err)
+		}
+		books = append(books, book)
+		if len(books) == listBooksBatch {
+			err := send(books)
+			if err != nil {
+				return err
+			}
+			books = books[:0]
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return grpcError(err)
+	}
+	return send(books)
+}
+
+func (s *bookService) FilterBooks(ctx context.Context, req *librarypb.FilterBooksRequest) (*librarypb.FilterBooksResponse, error) {
+	filter := bookFilter{
+		Title:          req.GetTitle(),
+		Author:         req.GetAuthor(),
+		Genre:          req.GetGenre(),
+		FromDate:       req.GetFromDate(),
+		ToDate:         req.GetToDate(),
+		IncludeDeleted: req.GetIncludeDeleted(),
+	}
+	query, args, err := filter.query()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	db, err := openDB(ctx, s.injectedDB)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer db.Close()
+
+	books, err := selectBooks(db, query, args...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	err = loadAvailability(db, books)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	response := &librarypb.FilterBooksResponse{}
+	for _, book := range books {
+		response.Books = append(response.Books, bookMessage(book))
+	}
+	return response, nil
+}
+
+type collectionService struct {
+	librarypb.UnimplementedCollectionServiceServer
+	injectedDB string
+}
+
+func (s *collectionService) CreateCollection(ctx context.Context, req *librarypb.CreateCollectionRequest) (*librarypb.Collection, error) {
+	collection := CollectionRequest{Name: req.GetName(), Description: req.GetDescription()}
+	var response CollectionResponse
+	err := invokeHandler(ctx, grpcHeader(ctx), grpcPeer(ctx), AddCollectionHandler, s.injectedDB, http.MethodPost, "/api/v1/collections", collection, &response)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return s.collection(ctx, response.CollectionID)
+}
+
+func (s *collectionService) AddBooksToCollection(ctx context.Context, req *librarypb.AddBooksToCollectionRequest) (*librarypb.Collection, error) {
+	request := map[string]interface{}{"collection_id": req.GetCollectionId(), "book_ids": req.GetBookIds()}
+	err := invokeHandler(ctx, grpcHeader(ctx), grpcPeer(ctx), AddBookToCollectionHandler, s.injectedDB, http.MethodPost, "/api/v1/booksToCollection", request, nil)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return s.collection(ctx, req.GetCollectionId())
+}
+
+// collection reads a collection back after a write, with the books in it
+func (s *collectionService) collection(ctx context.Context, collectionID string) (*librarypb.Collection, error) {
+	db, err := openDB(ctx, s.injectedDB)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	defer db.Close()
+
+	// A collection in the trash is as gone as it is to the HTTP API
+	collections, err := selectCollections(db, collectionSelectQuery+" WHERE collection_id = ? AND deleted_at IS NULL;", collectionID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if len(collections) == 0 {
+		return nil, status.Error(codes.NotFound, "Collection not found")
+	}
+	books, err := selectBooks(db, bookSelectQuery+" WHERE deleted_at IS NULL AND book_id IN (SELECT book_id FROM CollectionBooks WHERE collection_id = ?) ORDER BY book_id;", collectionID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	collection := &librarypb.Collection{
+		CollectionId: collections[0].CollectionID,
+		Name:         collections[0].Name,
+		Description:  collections[0].Description,
+	}
+	for _, book := range books {
+		collection.Books = append(collection.Books, bookMessage(book))
+	}
+	return collection, nil
+}
+
+// RequireGRPCToken is RequireToken for the gRPC API. A call needs "authorization: Bearer <token>"
+// metadata for one of tokens, and the audit log names the token's actor, whatever x-actor the
+// call was made with. Other calls fail with Unauthenticated.
+func RequireGRPCToken(tokens map[string]string) []grpc.ServerOption {
+	authenticate := func(ctx context.Context) (context.Context, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		actor, ok := tokenActor(tokens, metadataCarrier(md).Get(grpcAuthorizationKey))
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "A valid bearer token is required")
+		}
+		return withPrincipal(ctx, actor), nil
+	}
+
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := authenticate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := authenticate(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+		}),
+	}
+}
+
+// grpcPeer is the address a gRPC call connected from, the RemoteAddr of the requests it makes
+// through REST handlers
+func grpcPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcHeader is the HTTP header a gRPC call acts with when it goes through a REST handler
+func grpcHeader(ctx context.Context) http.Header {
+	header := make(http.Header)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if actor := md.Get(grpcActorKey); len(actor) > 0 {
+		header.Set(ActorHeader, actor[0])
+	}
+	// A caller's request ID is logged with any failure, as it is over HTTP
+	if id := md.Get(grpcRequestIDKey); len(id) > 0 {
+		header.Set(RequestIDHeader, id[0])
+	}
+	return header
+}
+
+// grpcError maps a REST handler's answer to the gRPC status with the same meaning, anything
+// else is an internal error
+func grpcError(err error) error {
+	var handlerErr *handlerError
+	if !errors.As(err, &handlerErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	switch handlerErr.status {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, handlerErr.message)
+	case http.StatusNotFound:
+		return status.Error(codes.NotFound, handlerErr.message)
+	case http.StatusConflict:
+		return status.Error(codes.FailedPrecondition, handlerErr.message)
+	}
+	return status.Error(codes.Internal, handlerErr.message)
+}
+
+func bookMessage(book Book) *librarypb.Book {
+	message := &librarypb.Book{
+		BookId:        book.BookID,
+		Title:         book.Title,
+		Author:        book.Author,
+		PublishedDate: book.PublishedDate,
+		Edition:       book.Edition,
+		Description:   book.Description,
+		Genre:         book.Genre,
+		Deleted:       book.DeletedAt != nil,
+	}
+	if book.Availability != nil {
+		message.Availability = &librarypb.Availability{
+			TotalCopies:     int32(book.Availability.TotalCopies),
+			AvailableCopies: int32(book.Availability.AvailableCopies),
+			CopiesByStatus:  make(map[string]int32, len(book.Availability.CopiesByStatus)),
+		}
+		for copyStatus, count := range book.Availability.CopiesByStatus {
+			message.Availability.CopiesByStatus[copyStatus] = int32(count)
+		}
+	}
+	return message
+}
+
+// traceUnaryCall starts a span for a gRPC call, see startGRPCSpan
+func traceUnaryCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startGRPCSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endSpan(span, err)
+	return resp, err
+}
+
+func traceStreamCall(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startGRPCSpan(stream.Context(), info.FullMethod)
+	err := handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	endSpan(span, err)
+	return err
+}
+
+// startGRPCSpan starts the span of a call to method, continuing the trace in the call's
+// traceparent metadata if there is one
+func startGRPCSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	return tracer.Start(ctx, strings.TrimPrefix(method, "/"), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("rpc.system", "grpc"),
+	))
+}
+
+// contextStream is a server stream with the context an interceptor made for the call, like one
+// with the call's span
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
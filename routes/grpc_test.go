@@ -0,0 +1,198 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"bookManagement/librarypb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves NewGRPCServer in memory with opts and returns a connection to it
+func dialGRPC(t *testing.T, opts ...grpc.ServerOption) *grpc.ClientConn {
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(testDB, opts...)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCBookService(t *testing.T) {
+	cleanCirculationTables()
+	cleanBooksTable()
+	books := librarypb.NewBookServiceClient(dialGRPC(t))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), grpcActorKey, "cataloguer")
+
+	dune, err := books.AddBook(ctx, &librarypb.AddBookRequest{Book: &librarypb.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Genre: "Science Fiction"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dune.BookId == "" || dune.Title != "Dune" || dune.Availability == nil {
+		t.Errorf("Expected the added book with its availability, got %v", dune)
+	}
+	_, err = insertBarcodedCopy(Copy{BookID: dune.BookId, Barcode: "G-1", Branch: "Main"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := books.GetBook(ctx, &librarypb.GetBookRequest{BookId: dune.BookId})
+	if err != nil || got.Availability.GetAvailableCopies() != 1 {
+		t.Errorf("Expected the book with its copy, got %v, %v", got, err)
+	}
+
+	// The HTTP handlers' answers map to codes
+	_, err = books.GetBook(ctx, &librarypb.GetBookRequest{BookId: "999999"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected %s, got %v", codes.NotFound, err)
+	}
+	_, err = books.AddBook(ctx, &librarypb.AddBookRequest{Book: &librarypb.Book{Title: "Emma"}})
+	if status.Code(err) != codes.InvalidArgument || status.Convert(err).Message() != "author is required; published_date is required" {
+		t.Errorf("Expected %s with the handler's message, got %v", codes.InvalidArgument, err)
+	}
+	_, err = books.FilterBooks(ctx, &librarypb.FilterBooksRequest{FromDate: "last year"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected %s for a date that doesn't parse, got %v", codes.InvalidArgument, err)
+	}
+
+	// Without a token the actor is where the call came from, the metadata only says who it claims to be
+	r := callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?entity=book&entity_id="+dune.BookId, nil)
+	var entries []AuditEntry
+	json.Unmarshal(r.Body.Bytes(), &entries)
+	if len(entries) == 0 || entries[0].Actor != "bufconn" || entries[0].ClaimedActor != "cataloguer" {
+		t.Errorf("Expected the book to be added from bufconn claiming to be cataloguer, got %+v", entries)
+	}
+
+	filtered, err := books.FilterBooks(ctx, &librarypb.FilterBooksRequest{Genre: "Science Fiction", FromDate: "1960", ToDate: "1965"})
+	if err != nil || len(filtered.Books) != 1 || filtered.Books[0].BookId != dune.BookId {
+		t.Errorf("Expected the filter to find Dune, got %v, %v", filtered, err)
+	}
+}
+
+func TestGRPCListBooksStreams(t *testing.T) {
+	cleanBooksTable()
+	books := librarypb.NewBookServiceClient(dialGRPC(t))
+
+	// More than a batch, so the stream spans several
+	total := listBooksBatch + 5
+	for i := 0; i < total; i++ {
+		callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Book " + strconv.Itoa(i), Author: "Author", PublishedDate: "2000"})
+	}
+
+	stream, err := books.ListBooks(context.Background(), &librarypb.ListBooksRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := 0
+	for {
+		book, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if book.Title != "Book "+strconv.Itoa(received) || book.Availability == nil {
+			t.Errorf("Expected Book %d with its availability, got %v", received, book)
+		}
+		received++
+	}
+	if received != total {
+		t.Errorf("Expected %d books, got %d", total, received)
+	}
+}
+
+func TestGRPCCollectionService(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	conn := dialGRPC(t)
+	books := librarypb.NewBookServiceClient(conn)
+	collections := librarypb.NewCollectionServiceClient(conn)
+	ctx := context.Background()
+
+	dune, err := books.AddBook(ctx, &librarypb.AddBookRequest{Book: &librarypb.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collection, err := collections.CreateCollection(ctx, &librarypb.CreateCollectionRequest{Name: "Deserts", Description: "Sand"})
+	if err != nil || collection.CollectionId == "" || len(collection.Books) != 0 {
+		t.Fatalf("Expected an empty collection, got %v, %v", collection, err)
+	}
+	_, err = collections.CreateCollection(ctx, &librarypb.CreateCollectionRequest{Name: "Oceans"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected %s for a collection without a description, got %v", codes.InvalidArgument, err)
+	}
+
+	collection, err = collections.AddBooksToCollection(ctx, &librarypb.AddBooksToCollectionRequest{CollectionId: collection.CollectionId, BookIds: []string{dune.BookId}})
+	if err != nil || len(collection.Books) != 1 || collection.Books[0].Title != "Dune" {
+		t.Errorf("Expected the collection with Dune in it, got %v, %v", collection, err)
+	}
+	_, err = collections.AddBooksToCollection(ctx, &librarypb.AddBooksToCollectionRequest{CollectionId: "999999", BookIds: []string{dune.BookId}})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected %s for a missing collection, got %v", codes.NotFound, err)
+	}
+
+	// Nor is a collection in the trash found
+	callHandler(t, DeleteCollectionHandler, "DELETE", "/api/v1/collections/"+collection.CollectionId, nil)
+	_, err = (&collectionService{injectedDB: testDB}).collection(ctx, collection.CollectionId)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected %s for a deleted collection, got %v", codes.NotFound, err)
+	}
+}
+
+func TestRequireGRPCToken(t *testing.T) {
+	cleanBooksTable()
+	books := librarypb.NewBookServiceClient(dialGRPC(t, RequireGRPCToken(map[string]string{"s3cret": "ada"})...))
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		metadata.AppendToOutgoingContext(context.Background(), grpcAuthorizationKey, "Bearer wrong"),
+		metadata.AppendToOutgoingContext(context.Background(), grpcAuthorizationKey, "s3cret"),
+	} {
+		_, err := books.AddBook(ctx, &librarypb.AddBookRequest{Book: &librarypb.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"}})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected %s without a valid token, got %v", codes.Unauthenticated, err)
+		}
+		stream, err := books.ListBooks(ctx, &librarypb.ListBooksRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected streams to need a token too, got %v", err)
+		}
+	}
+
+	// The token's actor is who the audit log names, whatever the call claims
+	ctx := metadata.AppendToOutgoingContext(context.Background(), grpcAuthorizationKey, "Bearer s3cret", grpcActorKey, "mallory")
+	_, err := books.AddBook(ctx, &librarypb.AddBookRequest{Book: &librarypb.Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?actor=ada&entity=book", nil)
+	if !strings.Contains(r.Body.String(), `"title":"Dune"`) {
+		t.Errorf("Expected the book to be added by ada, got %s", r.Body.String())
+	}
+	r = callHandler(t, GetAuditLogHandler, "GET", "/api/v1/audit?actor=mallory", nil)
+	if strings.Contains(r.Body.String(), "Dune") {
+		t.Errorf("Expected nothing to be added by mallory, got %s", r.Body.String())
+	}
+}
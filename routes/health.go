@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Paths of the probes an orchestrator polls. They're outside /api/v1 and never need a token.
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	VersionPath = "/version"
+)
+
+// Commit and BuildTime describe the build, and are set when it's linked:
+//
+//	go build -ldflags "-X bookManagement/routes.Commit=$(git rev-parse HEAD) -X bookManagement/routes.BuildTime=$(date -u +%FT%TZ)"
+//
+// Left empty, they're read from the VCS stamp go build adds to a binary built in a git checkout.
+var Commit, BuildTime string
+
+// Health is the answer of the probes when the server is up, or ready
+type Health struct {
+	Status        string `json:"status"`
+	SchemaVersion int    `json:"schema_version,omitempty"`
+}
+
+// Version describes the running build. SchemaVersion is the version its migrations bring the
+// database to.
+type Version struct {
+	Commit        string `json:"commit"`
+	BuildTime     string `json:"build_time"`
+	GoVersion     string `json:"go_version"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// HealthzHandler answers as long as the process can serve requests, without touching the
+// database, so a database outage doesn't get the server restarted
+func HealthzHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	writeHealth(w, Health{Status: "ok"})
+}
+
+// ReadyzHandler answers 200 once the database can be queried and has had every migration of
+// this build applied, and 503 until then. A database a newer build has migrated further is
+// ready too, migrations only add to the schema. A database file that isn't there isn't
+// created, it's unavailable.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), existingDatabase(injectedDB))
+	if err == nil {
+		defer db.Close()
+		err = db.PingContext(r.Context())
+	}
+	var version int
+	if err == nil {
+		version, err = schemaVersion(db)
+	}
+	if err != nil {
+		logger(r).Warn("database unavailable", "error", err)
+		writeProblem(w, r, http.StatusServiceUnavailable, CodeDatabaseUnavailable, "The database can't be queried")
+		return
+	}
+
+	if version < len(migrations) {
+		problem := newProblem(r, http.StatusServiceUnavailable, CodeSchemaOutdated, fmt.Sprintf("The database is at schema version %d, this server needs %d", version, len(migrations)))
+		problem.Extensions = map[string]interface{}{"schema_version": version}
+		problem.write(w)
+		return
+	}
+	writeHealth(w, Health{Status: "ready", SchemaVersion: version})
+}
+
+// existingDatabase is the DSN dsn with SQLite's mode=rw, which opens the database like dsn
+// but fails if its file is missing instead of creating an empty one. A DSN that sets a mode
+// already is kept.
+func existingDatabase(dsn string) string {
+	if strings.Contains(dsn, "mode=") {
+		return dsn
+	}
+	// SQLite only reads URI parameters from a file: URI
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&mode=rw"
+	}
+	return dsn + "?mode=rw"
+}
+
+// VersionHandler answers with the commit and build time of the running build
+func VersionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	version := Version{
+		Commit:        Commit,
+		BuildTime:     BuildTime,
+		GoVersion:     runtime.Version(),
+		SchemaVersion: len(migrations),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && version.Commit == "":
+				version.Commit = setting.Value
+			case setting.Key == "vcs.time" && version.BuildTime == "":
+				version.BuildTime = setting.Value
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(version)
+}
+
+func writeHealth(w http.ResponseWriter, health Health) {
+	// Probes are polled, an answer from a cache would hide an outage
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(health)
+}
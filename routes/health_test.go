@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	var health Health
+	r := callHandler(t, ReadyzHandler, "GET", ReadyzPath, nil)
+	json.Unmarshal(r.Body.Bytes(), &health)
+	if r.Code != http.StatusOK || health.Status != "ready" || health.SchemaVersion != len(migrations) {
+		t.Fatalf("Expected the test database to be ready, got %d %s", r.Code, r.Body.String())
+	}
+
+	// Until it's migrated a database isn't ready, and says which version it's at
+	injectedDB := filepath.Join(t.TempDir(), "library.db")
+	err := os.WriteFile(injectedDB, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRecorder()
+	ReadyzHandler(r, httptest.NewRequest("GET", ReadyzPath, nil), injectedDB)
+	var problem Problem
+	json.Unmarshal(r.Body.Bytes(), &problem)
+	if r.Code != http.StatusServiceUnavailable || problem.Code != CodeSchemaOutdated || problem.Extensions["schema_version"] != float64(0) {
+		t.Errorf("Expected an unmigrated database not to be ready, got %d %s", r.Code, r.Body.String())
+	}
+
+	// Nor is one that can't be opened
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	r = httptest.NewRecorder()
+	ReadyzHandler(r, httptest.NewRequest("GET", ReadyzPath, nil), t.TempDir())
+	problem = Problem{}
+	json.Unmarshal(r.Body.Bytes(), &problem)
+	if r.Code != http.StatusServiceUnavailable || problem.Code != CodeDatabaseUnavailable {
+		t.Errorf("Expected a database that can't be opened not to be ready, got %d %s", r.Code, r.Body.String())
+	}
+
+	// Or one that isn't there, which the check doesn't create
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	r = httptest.NewRecorder()
+	ReadyzHandler(r, httptest.NewRequest("GET", ReadyzPath, nil), missing)
+	problem = Problem{}
+	json.Unmarshal(r.Body.Bytes(), &problem)
+	if r.Code != http.StatusServiceUnavailable || problem.Code != CodeDatabaseUnavailable {
+		t.Errorf("Expected a missing database not to be ready, got %d %s", r.Code, r.Body.String())
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected the missing database not to be created, got %v", err)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(commit, buildTime string) { Commit, BuildTime = commit, buildTime }(Commit, BuildTime)
+	Commit, BuildTime = "80d4f0f", "2024-05-01T10:15:00Z"
+
+	var version Version
+	r := callHandler(t, VersionHandler, "GET", VersionPath, nil)
+	json.Unmarshal(r.Body.Bytes(), &version)
+	if r.Code != http.StatusOK || version.Commit != "80d4f0f" || version.BuildTime != "2024-05-01T10:15:00Z" || version.SchemaVersion != len(migrations) || version.GoVersion == "" {
+		t.Errorf("Expected the build set at link time, got %d %s", r.Code, r.Body.String())
+	}
+}
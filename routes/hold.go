@@ -0,0 +1,554 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Hold statuses. A hold waits in its book's queue until a copy comes back, is then ready for
+// pickup with the copy set aside, and ends up fulfilled, cancelled or expired.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+// HoldPickupPeriod is how long a copy stays on the hold shelf before the hold expires and the
+// copy moves on to the next patron in the queue.
+const HoldPickupPeriod = 7 * 24 * time.Hour
+
+type Hold struct {
+	HoldID    string     `json:"hold_id"`
+	BookID    string     `json:"book_id"`
+	Title     string     `json:"title"`
+	PatronID  string     `json:"patron_id"`
+	Position  int        `json:"position,omitempty"`
+	Status    string     `json:"status"`
+	CopyID    string     `json:"copy_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadyAt   *time.Time `json:"ready_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type HoldResponse struct {
+	HoldID     string `json:"hold_id,omitempty"`
+	HoldStatus string `json:"hold_status,omitempty"`
+	Position   int    `json:"position,omitempty"`
+	Status     string `json:"status"`
+	Code       int    `json:"code"`
+}
+
+// PlaceHoldHandler puts a patron at the back of a book's hold queue. If a copy is on the
+// shelf the hold is ready for pickup straight away.
+func PlaceHoldHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var holdData struct {
+		PatronID string `json:"patron_id" validate:"required,id"`
+		BookID   string `json:"book_id" validate:"required,id"`
+	}
+	if !decodeRequest(w, r, &holdData) {
+		return
+	}
+
+	// Check if the patron and the book exist
+	var patronCount, bookCount int
+	err = db.QueryRow("SELECT (SELECT COUNT(*) FROM Patrons WHERE patron_id = ?), (SELECT COUNT(*) FROM Books WHERE book_id = ? AND deleted_at IS NULL);", holdData.PatronID, holdData.BookID).Scan(&patronCount, &bookCount)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if patronCount == 0 {
+		writeProblem(w, r, http.StatusNotFound, CodePatronNotFound, "Patron not found")
+		return
+	}
+	if bookCount == 0 {
+		writeProblem(w, r, http.StatusNotFound, CodeBookNotFound, "Book not found")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// A patron only needs one place in the queue for a book
+	var existingHoldID int64
+	err = tx.QueryRow("SELECT hold_id FROM Holds WHERE patron_id = ? AND book_id = ? AND status IN (?, ?);", holdData.PatronID, holdData.BookID, HoldWaiting, HoldReady).Scan(&existingHoldID)
+	if err == nil {
+		problem := newProblem(r, http.StatusConflict, CodeHoldExists, "Patron already has a hold on this book")
+		problem.Extensions = map[string]interface{}{"hold_id": strconv.FormatInt(existingHoldID, 10)}
+		problem.write(w)
+		return
+	} else if err != sql.ErrNoRows {
+		writeServerError(w, r, err)
+		return
+	}
+
+	insertHoldQuery := `INSERT INTO Holds (book_id, patron_id, position, status, created_at)
+		VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM Holds WHERE book_id = ? AND status = ?), ?, ?);`
+	result, err := tx.Exec(insertHoldQuery, holdData.BookID, holdData.PatronID, holdData.BookID, HoldWaiting, HoldWaiting, now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	holdID, _ := result.LastInsertId()
+
+	err = promoteHolds(tx, holdData.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	hold, err := scanHold(tx.QueryRow(holdSelectQuery+" WHERE h.hold_id = ?;", holdID))
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := HoldResponse{
+		HoldID:     hold.HoldID,
+		HoldStatus: hold.Status,
+		Position:   hold.Position,
+		Status:     "success",
+		Code:       http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetHoldsHandler lists holds filtered by book_id, patron_id and status. Holds ready for
+// pickup come first, then waiting holds in queue order.
+func GetHoldsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	queryParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Incorrectly formatted hold parameters")
+		return
+	}
+
+	bookID := queryParams.Get("book_id")
+	patronID := queryParams.Get("patron_id")
+	status := queryParams.Get("status")
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	// Pickup windows that lapsed since the last scheduled run show up as expired, the
+	// ExpireHolds job will end them and hand the copies on
+	query := "SELECT * FROM (" + holdListQuery + ") h WHERE 1=1"
+	args := []interface{}{HoldReady, now().UTC(), HoldExpired}
+
+	if bookID != "" {
+		query += " AND h.book_id = ?"
+		args = append(args, bookID)
+	}
+	if patronID != "" {
+		query += " AND h.patron_id = ?"
+		args = append(args, patronID)
+	}
+	if status != "" {
+		query += " AND h.status = ?"
+		args = append(args, status)
+	}
+	// Ready holds first, then the queue in order, then holds that are over
+	query += " ORDER BY h.book_id, CASE h.status WHEN ? THEN 0 WHEN ? THEN 1 ELSE 2 END, h.position, h.created_at DESC"
+	args = append(args, HoldReady, HoldWaiting)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	holds := make([]Hold, 0)
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		holds = append(holds, hold)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(holds)
+}
+
+// CancelHoldHandler removes a hold from its queue. If a copy was set aside for it, the copy
+// moves on to the next patron.
+func CancelHoldHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var holdData struct {
+		HoldID string `json:"hold_id" validate:"required,id"`
+	}
+	if !decodeRequest(w, r, &holdData) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	hold, ok := findActiveHold(w, r, tx, holdData.HoldID)
+	if !ok {
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Holds SET status = ? WHERE hold_id = ?;", HoldCancelled, hold.HoldID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = releaseHoldCopy(tx, hold)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := HoldResponse{
+		HoldID:     hold.HoldID,
+		HoldStatus: HoldCancelled,
+		Status:     "success",
+		Code:       http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ReorderHoldHandler moves a waiting hold to a new 1-based position in its book's queue,
+// shifting the holds in between up or down by one.
+func ReorderHoldHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var holdData struct {
+		HoldID   string `json:"hold_id" validate:"required,id"`
+		Position int    `json:"position" validate:"min=1"`
+	}
+	if !decodeRequest(w, r, &holdData) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	hold, ok := findActiveHold(w, r, tx, holdData.HoldID)
+	if !ok {
+		return
+	}
+
+	if hold.Status != HoldWaiting {
+		writeProblem(w, r, http.StatusConflict, CodeHoldNotWaiting, "Only waiting holds can be reordered")
+		return
+	}
+
+	queue, err := holdQueue(tx, hold.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// Take the hold out of the queue and put it back in at the new position
+	reordered := make([]string, 0, len(queue))
+	for _, holdID := range queue {
+		if holdID != hold.HoldID {
+			reordered = append(reordered, holdID)
+		}
+	}
+	position := holdData.Position
+	if position > len(queue) {
+		position = len(queue)
+	}
+	reordered = append(reordered[:position-1], append([]string{hold.HoldID}, reordered[position-1:]...)...)
+
+	for i, holdID := range reordered {
+		_, err = tx.Exec("UPDATE Holds SET position = ? WHERE hold_id = ?;", i+1, holdID)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := HoldResponse{
+		HoldID:     hold.HoldID,
+		HoldStatus: HoldWaiting,
+		Position:   position,
+		Status:     "success",
+		Code:       http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExpireHolds ends every ready hold whose pickup window has passed and hands the copies on to
+// the next patrons in line. It is run on a schedule by the server.
+func ExpireHolds(injectedDB string) error {
+	return traceJob("ExpireHolds", injectedDB, expireHolds)
+}
+
+func expireHolds(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(holdSelectQuery+" WHERE h.status = ? AND h.expires_at <= ?;", HoldReady, now().UTC())
+	if err != nil {
+		return err
+	}
+
+	var expired []Hold
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, hold)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, hold := range expired {
+		_, err = tx.Exec("UPDATE Holds SET status = ? WHERE hold_id = ?;", HoldExpired, hold.HoldID)
+		if err != nil {
+			return err
+		}
+		err = releaseHoldCopy(tx, hold)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// promoteHolds sets aside available copies of a book for the patrons at the front of its
+// hold queue, until either runs out. Call it whenever a copy becomes available or the queue
+// changes, so an available copy never sits on the shelf while someone is waiting for it.
+func promoteHolds(tx *sql.Tx, bookID string) error {
+	for {
+		var copyID, holdID int64
+		err := tx.QueryRow("SELECT copy_id FROM Copies WHERE book_id = ? AND status = ? ORDER BY copy_id LIMIT 1;", bookID, CopyAvailable).Scan(&copyID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow("SELECT hold_id FROM Holds WHERE book_id = ? AND status = ? ORDER BY position, hold_id LIMIT 1;", bookID, HoldWaiting).Scan(&holdID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		readyAt := now().UTC()
+		_, err = tx.Exec("UPDATE Holds SET status = ?, copy_id = ?, position = 0, ready_at = ?, expires_at = ? WHERE hold_id = ?;", HoldReady, copyID, readyAt, readyAt.Add(HoldPickupPeriod), holdID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE Copies SET status = ? WHERE copy_id = ?;", CopyOnHoldShelf, copyID)
+		if err != nil {
+			return err
+		}
+
+		err = renumberHolds(tx, bookID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// releaseHoldCopy puts the copy set aside for a hold that is no longer active back on the
+// shelf, where the next waiting hold picks it up. Waiting holds just leave the queue.
+func releaseHoldCopy(tx *sql.Tx, hold Hold) error {
+	if hold.CopyID != "" && hold.Status == HoldReady {
+		_, err := tx.Exec("UPDATE Copies SET status = ? WHERE copy_id = ? AND status = ?;", CopyAvailable, hold.CopyID, CopyOnHoldShelf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := renumberHolds(tx, hold.BookID)
+	if err != nil {
+		return err
+	}
+
+	return promoteHolds(tx, hold.BookID)
+}
+
+// requeueLostCopyHold puts the hold a lost copy was set aside for back at the front of its
+// book's queue, where the next available copy is set aside for it instead
+func requeueLostCopyHold(tx *sql.Tx, bookCopy Copy) error {
+	_, err := tx.Exec("UPDATE Holds SET status = ?, copy_id = NULL, position = 0, ready_at = NULL, expires_at = NULL WHERE copy_id = ? AND status = ?;", HoldWaiting, bookCopy.CopyID, HoldReady)
+	if err != nil {
+		return err
+	}
+
+	err = renumberHolds(tx, bookCopy.BookID)
+	if err != nil {
+		return err
+	}
+
+	return promoteHolds(tx, bookCopy.BookID)
+}
+
+// holdQueue returns the IDs of a book's waiting holds, front of the queue first
+func holdQueue(tx *sql.Tx, bookID string) ([]string, error) {
+	rows, err := tx.Query("SELECT hold_id FROM Holds WHERE book_id = ? AND status = ? ORDER BY position, hold_id;", bookID, HoldWaiting)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queue []string
+	for rows.Next() {
+		var holdID string
+		err := rows.Scan(&holdID)
+		if err != nil {
+			return nil, err
+		}
+		queue = append(queue, holdID)
+	}
+
+	return queue, rows.Err()
+}
+
+// renumberHolds closes the gaps left in a queue when holds leave it, so positions always run 1..n
+func renumberHolds(tx *sql.Tx, bookID string) error {
+	queue, err := holdQueue(tx, bookID)
+	if err != nil {
+		return err
+	}
+
+	for i, holdID := range queue {
+		_, err = tx.Exec("UPDATE Holds SET position = ? WHERE hold_id = ?;", i+1, holdID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// holdSelectQuery selects the columns scanHold expects
+const holdSelectQuery = `SELECT h.hold_id, h.book_id, b.title, h.patron_id, h.position, h.status, h.copy_id, h.created_at, h.ready_at, h.expires_at
+	FROM Holds h
+	INNER JOIN Books b ON b.book_id = h.book_id`
+
+// holdListQuery selects the columns of holdSelectQuery, with a ready hold whose pickup window
+// has passed as expired, so listing holds doesn't have to write. Its arguments are HoldReady,
+// the time now and HoldExpired.
+const holdListQuery = `SELECT h.hold_id, h.book_id, b.title, h.patron_id, h.position,
+		CASE WHEN h.status = ? AND h.expires_at <= ? THEN ? ELSE h.status END AS status,
+		h.copy_id, h.created_at, h.ready_at, h.expires_at
+	FROM Holds h
+	INNER JOIN Books b ON b.book_id = h.book_id`
+
+func scanHold(row rowScanner) (Hold, error) {
+	var hold Hold
+	var copyID sql.NullString
+	var readyAt, expiresAt sql.NullTime
+	err := row.Scan(&hold.HoldID, &hold.BookID, &hold.Title, &hold.PatronID, &hold.Position, &hold.Status, &copyID, &hold.CreatedAt, &readyAt, &expiresAt)
+	hold.CopyID = copyID.String
+	if readyAt.Valid {
+		hold.ReadyAt = &readyAt.Time
+	}
+	if expiresAt.Valid {
+		hold.ExpiresAt = &expiresAt.Time
+	}
+	return hold, err
+}
+
+// findActiveHold looks up a hold that is still waiting or ready. If there isn't one it writes
+// the error response itself and returns false, so the caller should just return.
+func findActiveHold(w http.ResponseWriter, r *http.Request, tx *sql.Tx, holdID string) (Hold, bool) {
+	hold, err := scanHold(tx.QueryRow(holdSelectQuery+" WHERE h.hold_id = ?;", holdID))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeHoldNotFound, "Hold not found")
+		return hold, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return hold, false
+	}
+
+	if hold.Status != HoldWaiting && hold.Status != HoldReady {
+		writeProblem(w, r, http.StatusConflict, CodeHoldInactive, "Hold is no longer active")
+		return hold, false
+	}
+
+	return hold, true
+}
@@ -0,0 +1,208 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// holdFixture sets up a book with one copy that is already on loan, and returns the loan
+// along with the given number of extra patrons who can queue for the book
+func holdFixture(t *testing.T, patrons int) (loan LoanResponse, bookID string, patronIDs []string) {
+	borrowerID, bookID := circulationFixture(t, 1)
+	loan = checkout(t, borrowerID, bookID)
+
+	for i := 0; i < patrons; i++ {
+		patronID, err := insertPatron(Patron{Name: "Patron " + strconv.Itoa(i+1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		patronIDs = append(patronIDs, strconv.FormatInt(patronID, 10))
+	}
+
+	return loan, bookID, patronIDs
+}
+
+func placeHold(t *testing.T, patronID, bookID string) HoldResponse {
+	r := callHandler(t, PlaceHoldHandler, "POST", "/api/v1/holds", map[string]string{"patron_id": patronID, "book_id": bookID})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	var response HoldResponse
+	err := json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func getHolds(t *testing.T, target string) []Hold {
+	r := callHandler(t, GetHoldsHandler, "GET", target, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var holds []Hold
+	err := json.Unmarshal(r.Body.Bytes(), &holds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return holds
+}
+
+func TestPlaceHoldHandlerQueuesInOrder(t *testing.T) {
+	_, bookID, patronIDs := holdFixture(t, 2)
+
+	for i, patronID := range patronIDs {
+		response := placeHold(t, patronID, bookID)
+		if response.HoldStatus != HoldWaiting || response.Position != i+1 {
+			t.Errorf("Expected a waiting hold at position %d, got %s at %d", i+1, response.HoldStatus, response.Position)
+		}
+	}
+
+	// Queueing twice for the same book is a conflict
+	r := callHandler(t, PlaceHoldHandler, "POST", "/api/v1/holds", map[string]string{"patron_id": patronIDs[0], "book_id": bookID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestPlaceHoldHandlerReadyWhenCopyOnShelf(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 1)
+
+	response := placeHold(t, patronID, bookID)
+
+	if response.HoldStatus != HoldReady {
+		t.Errorf("Expected hold status %s, got %s", HoldReady, response.HoldStatus)
+	}
+}
+
+func TestReturnLoanHandlerReadiesFirstHold(t *testing.T) {
+	loan, bookID, patronIDs := holdFixture(t, 2)
+	first := placeHold(t, patronIDs[0], bookID)
+	placeHold(t, patronIDs[1], bookID)
+
+	callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+
+	holds := getHolds(t, "/api/v1/holds?book_id="+bookID)
+	if len(holds) != 2 {
+		t.Fatalf("Expected 2 holds, got %d", len(holds))
+	}
+	if holds[0].HoldID != first.HoldID || holds[0].Status != HoldReady || holds[0].ExpiresAt == nil {
+		t.Errorf("Expected the first hold to be ready for pickup, got %+v", holds[0])
+	}
+	if holds[1].Status != HoldWaiting || holds[1].Position != 1 {
+		t.Errorf("Expected the second hold to be at the front of the queue, got %+v", holds[1])
+	}
+
+	// The copy on the hold shelf is only for the first patron
+	r := callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronIDs[1], "book_id": bookID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+
+	checkout(t, patronIDs[0], bookID)
+
+	holds = getHolds(t, "/api/v1/holds?patron_id="+patronIDs[0])
+	if len(holds) != 1 || holds[0].Status != HoldFulfilled {
+		t.Errorf("Expected the first hold to be fulfilled, got %+v", holds)
+	}
+}
+
+func TestCancelHoldHandlerPassesCopyOn(t *testing.T) {
+	loan, bookID, patronIDs := holdFixture(t, 2)
+	first := placeHold(t, patronIDs[0], bookID)
+	second := placeHold(t, patronIDs[1], bookID)
+	callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+
+	r := callHandler(t, CancelHoldHandler, "POST", "/api/v1/holds/cancel", map[string]string{"hold_id": first.HoldID})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	holds := getHolds(t, "/api/v1/holds?status=ready")
+	if len(holds) != 1 || holds[0].HoldID != second.HoldID {
+		t.Errorf("Expected the second hold to be ready, got %+v", holds)
+	}
+
+	// Cancelling twice is a conflict
+	r = callHandler(t, CancelHoldHandler, "POST", "/api/v1/holds/cancel", map[string]string{"hold_id": first.HoldID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestReorderHoldHandler(t *testing.T) {
+	_, bookID, patronIDs := holdFixture(t, 3)
+	var holdIDs []string
+	for _, patronID := range patronIDs {
+		holdIDs = append(holdIDs, placeHold(t, patronID, bookID).HoldID)
+	}
+
+	r := callHandler(t, ReorderHoldHandler, "POST", "/api/v1/holds/reorder", map[string]interface{}{"hold_id": holdIDs[2], "position": 1})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	expectedOrder := []string{holdIDs[2], holdIDs[0], holdIDs[1]}
+	holds := getHolds(t, "/api/v1/holds?book_id="+bookID+"&status=waiting")
+	for i, hold := range holds {
+		if hold.HoldID != expectedOrder[i] || hold.Position != i+1 {
+			t.Errorf("Expected hold %s at position %d, got %s at %d", expectedOrder[i], i+1, hold.HoldID, hold.Position)
+		}
+	}
+}
+
+func TestExpireHolds(t *testing.T) {
+	loan, bookID, patronIDs := holdFixture(t, 2)
+	first := placeHold(t, patronIDs[0], bookID)
+	second := placeHold(t, patronIDs[1], bookID)
+	callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+
+	// Nobody picks the copy up within the pickup window
+	later := time.Now().Add(HoldPickupPeriod + time.Hour)
+	now = func() time.Time { return later }
+	defer func() { now = time.Now }()
+
+	// Listings show the lapsed hold as expired before the job has run, without ending it
+	holds := getHolds(t, "/api/v1/holds?book_id="+bookID+"&status="+HoldExpired)
+	if len(holds) != 1 || holds[0].HoldID != first.HoldID {
+		t.Errorf("Expected the first hold to be listed as expired, got %v", holds)
+	}
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	var stored string
+	db.QueryRow("SELECT status FROM Holds WHERE hold_id = ?;", first.HoldID).Scan(&stored)
+	if stored != HoldReady {
+		t.Errorf("Expected listing holds not to write, got %s", stored)
+	}
+
+	err := ExpireHolds(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holds = getHolds(t, "/api/v1/holds?book_id="+bookID)
+	statuses := map[string]string{}
+	for _, hold := range holds {
+		statuses[hold.HoldID] = hold.Status
+	}
+	if statuses[first.HoldID] != HoldExpired || statuses[second.HoldID] != HoldReady {
+		t.Errorf("Expected the first hold to expire and the second to be ready, got %v", statuses)
+	}
+}
+
+func TestRenewLoanHandlerBlockedByHold(t *testing.T) {
+	loan, bookID, patronIDs := holdFixture(t, 1)
+	placeHold(t, patronIDs[0], bookID)
+
+	r := callHandler(t, RenewLoanHandler, "POST", "/api/v1/loans/renew", map[string]string{"loan_id": loan.LoanID})
+
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
@@ -0,0 +1,402 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Inventory session statuses. Scans can only be submitted while a session is open.
+const (
+	InventoryOpen   = "open"
+	InventoryClosed = "closed"
+)
+
+// Paths of the inventory endpoints, {id} is the session_id
+const (
+	InventoryScansPath  = "/api/v1/inventory/sessions/{id}/scans"
+	InventoryReportPath = "/api/v1/inventory/sessions/{id}/report"
+	InventoryClosePath  = "/api/v1/inventory/sessions/{id}/close"
+)
+
+// InventorySession is a stocktake of one branch, or of a single shelf location in it when
+// ShelfLocation is set.
+type InventorySession struct {
+	SessionID     string     `json:"session_id"`
+	Branch        string     `json:"branch"`
+	ShelfLocation string     `json:"shelf_location"`
+	Status        string     `json:"status"`
+	Scanned       int        `json:"scanned"`
+	StartedAt     time.Time  `json:"started_at"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+}
+
+type InventoryResponse struct {
+	SessionID string `json:"session_id,omitempty"`
+	Scanned   int    `json:"scanned,omitempty"`
+	Status    string `json:"status"`
+	Code      int    `json:"code"`
+}
+
+// InventoryItem is one line of a reconciliation report. Fields that don't apply, like the
+// catalog details of a barcode we've never seen, are left empty.
+type InventoryItem struct {
+	Barcode               string `json:"barcode"`
+	CopyID                string `json:"copy_id,omitempty"`
+	BookID                string `json:"book_id,omitempty"`
+	Title                 string `json:"title,omitempty"`
+	CopyStatus            string `json:"copy_status,omitempty"`
+	ExpectedBranch        string `json:"expected_branch,omitempty"`
+	ExpectedShelfLocation string `json:"expected_shelf_location,omitempty"`
+	ScannedShelfLocation  string `json:"scanned_shelf_location,omitempty"`
+	Reason                string `json:"reason,omitempty"`
+}
+
+// InventoryReport compares what was scanned in a session with the catalog. Missing copies
+// should be on the audited shelves but weren't scanned, misplaced copies were scanned
+// somewhere other than where the catalog puts them, and unexpected barcodes either aren't in
+// the catalog at all or belong to copies that shouldn't be on a shelf, like ones on loan.
+type InventoryReport struct {
+	Session    InventorySession `json:"session"`
+	Expected   int              `json:"expected"`
+	Found      int              `json:"found"`
+	Missing    []InventoryItem  `json:"missing"`
+	Misplaced  []InventoryItem  `json:"misplaced"`
+	Unexpected []InventoryItem  `json:"unexpected"`
+}
+
+// StartInventoryHandler opens a stocktake session for a branch, optionally limited to one
+// shelf location.
+func StartInventoryHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var session InventorySession
+	err = json.NewDecoder(r.Body).Decode(&session)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if session.Branch == "" {
+		writeValidationProblem(w, r, "Inventory sessions must include a branch.", requiredFields("branch", session.Branch)...)
+		return
+	}
+
+	insertSessionQuery := `INSERT INTO InventorySessions (branch, shelf_location, status, started_at) VALUES (?, ?, ?, ?);`
+	result, err := db.Exec(insertSessionQuery, session.Branch, session.ShelfLocation, InventoryOpen, now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	sessionID, _ := result.LastInsertId()
+
+	response := InventoryResponse{
+		SessionID: strconv.FormatInt(sessionID, 10),
+		Status:    "success",
+		Code:      http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetInventorySessionsHandler lists every stocktake session, newest first.
+func GetInventorySessionsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(inventorySessionSelectQuery + " ORDER BY s.started_at DESC, s.session_id DESC;")
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]InventorySession, 0)
+	for rows.Next() {
+		session, err := scanInventorySession(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		sessions = append(sessions, session)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// SubmitInventoryScansHandler records a batch of scanned barcodes. The shelf_location says
+// where the batch was scanned and defaults to the session's, when neither is set copies are
+// only checked against the branch. Scanning a barcode again just moves it to where it was
+// scanned last.
+func SubmitInventoryScansHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var batch struct {
+		ShelfLocation string   `json:"shelf_location"`
+		Barcodes      []string `json:"barcodes"`
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if len(batch.Barcodes) == 0 {
+		writeValidationProblem(w, r, "Scan batches must include at least one barcode.",
+			FieldError{Field: "barcodes", Message: "must have at least one barcode"})
+		return
+	}
+
+	session, ok := findInventorySession(w, r, db, pathParam(r.URL.Path, InventoryScansPath, "id"))
+	if !ok {
+		return
+	}
+
+	if session.Status != InventoryOpen {
+		problem := newProblem(r, http.StatusConflict, CodeSessionClosed, "Inventory session is closed")
+		problem.Extensions = map[string]interface{}{"session_id": session.SessionID}
+		problem.write(w)
+		return
+	}
+
+	if batch.ShelfLocation == "" {
+		batch.ShelfLocation = session.ShelfLocation
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	scannedAt := now().UTC()
+	upsertScanQuery := `INSERT INTO InventoryScans (session_id, barcode, shelf_location, scanned_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (session_id, barcode) DO UPDATE SET shelf_location = excluded.shelf_location, scanned_at = excluded.scanned_at;`
+	scanned := 0
+	for _, barcode := range batch.Barcodes {
+		if barcode == "" {
+			continue
+		}
+		_, err = tx.Exec(upsertScanQuery, session.SessionID, barcode, batch.ShelfLocation, scannedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		scanned++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := InventoryResponse{
+		SessionID: session.SessionID,
+		Scanned:   scanned,
+		Status:    "success",
+		Code:      http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// CloseInventoryHandler ends a session so no more scans can be added to it. The report is
+// still available afterwards.
+func CloseInventoryHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	session, ok := findInventorySession(w, r, db, pathParam(r.URL.Path, InventoryClosePath, "id"))
+	if !ok {
+		return
+	}
+
+	_, err = db.Exec("UPDATE InventorySessions SET status = ?, closed_at = ? WHERE session_id = ? AND status = ?;", InventoryClosed, now().UTC(), session.SessionID, InventoryOpen)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := InventoryResponse{
+		SessionID: session.SessionID,
+		Status:    "success",
+		Code:      http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// InventoryReportHandler reconciles a session's scans against the catalog.
+func InventoryReportHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	session, ok := findInventorySession(w, r, db, pathParam(r.URL.Path, InventoryReportPath, "id"))
+	if !ok {
+		return
+	}
+
+	report := InventoryReport{
+		Session:    session,
+		Missing:    make([]InventoryItem, 0),
+		Misplaced:  make([]InventoryItem, 0),
+		Unexpected: make([]InventoryItem, 0),
+	}
+
+	// Every copy the catalog says is on the audited shelves, joined with its scan if there was one
+	expectedQuery := `SELECT COALESCE(c.barcode, ''), c.copy_id, c.book_id, b.title, c.status, c.branch, c.shelf_location, s.shelf_location
+		FROM Copies c
+		INNER JOIN Books b ON b.book_id = c.book_id
+		LEFT JOIN InventoryScans s ON s.barcode = c.barcode AND s.session_id = ?
+		WHERE c.branch = ? AND (? = '' OR c.shelf_location = ?) AND c.status = ?
+		ORDER BY c.shelf_location, c.barcode;`
+	rows, err := db.Query(expectedQuery, session.SessionID, session.Branch, session.ShelfLocation, session.ShelfLocation, CopyAvailable)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item InventoryItem
+		var scannedShelfLocation sql.NullString
+		err := rows.Scan(&item.Barcode, &item.CopyID, &item.BookID, &item.Title, &item.CopyStatus, &item.ExpectedBranch, &item.ExpectedShelfLocation, &scannedShelfLocation)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+
+		report.Expected++
+		if !scannedShelfLocation.Valid {
+			item.Reason = "Not scanned"
+			report.Missing = append(report.Missing, item)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// Every scan, joined with its copy if the barcode is in the catalog
+	scannedQuery := `SELECT s.barcode, s.shelf_location, c.copy_id, c.book_id, b.title, c.status, c.branch, c.shelf_location
+		FROM InventoryScans s
+		LEFT JOIN Copies c ON c.barcode = s.barcode
+		LEFT JOIN Books b ON b.book_id = c.book_id
+		WHERE s.session_id = ?
+		ORDER BY s.shelf_location, s.barcode;`
+	scanRows, err := db.Query(scannedQuery, session.SessionID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer scanRows.Close()
+
+	for scanRows.Next() {
+		var item InventoryItem
+		var copyID, bookID, title, copyStatus, branch, shelfLocation sql.NullString
+		err := scanRows.Scan(&item.Barcode, &item.ScannedShelfLocation, &copyID, &bookID, &title, &copyStatus, &branch, &shelfLocation)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		item.CopyID, item.BookID, item.Title, item.CopyStatus = copyID.String, bookID.String, title.String, copyStatus.String
+		item.ExpectedBranch, item.ExpectedShelfLocation = branch.String, shelfLocation.String
+
+		switch {
+		case !copyID.Valid:
+			item.Reason = "Barcode is not in the catalog"
+			report.Unexpected = append(report.Unexpected, item)
+		case item.CopyStatus != CopyAvailable:
+			item.Reason = "Copy is " + item.CopyStatus
+			report.Unexpected = append(report.Unexpected, item)
+		case item.ExpectedBranch != session.Branch || (item.ScannedShelfLocation != "" && item.ExpectedShelfLocation != item.ScannedShelfLocation):
+			item.Reason = "Copy belongs somewhere else"
+			report.Misplaced = append(report.Misplaced, item)
+		default:
+			report.Found++
+		}
+	}
+
+	err = scanRows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// inventorySessionSelectQuery selects the columns scanInventorySession expects
+const inventorySessionSelectQuery = `SELECT s.session_id, s.branch, s.shelf_location, s.status,
+	(SELECT COUNT(*) FROM InventoryScans i WHERE i.session_id = s.session_id), s.started_at, s.closed_at
+	FROM InventorySessions s`
+
+func scanInventorySession(row rowScanner) (InventorySession, error) {
+	var session InventorySession
+	var closedAt sql.NullTime
+	err := row.Scan(&session.SessionID, &session.Branch, &session.ShelfLocation, &session.Status, &session.Scanned, &session.StartedAt, &closedAt)
+	if closedAt.Valid {
+		session.ClosedAt = &closedAt.Time
+	}
+	return session, err
+}
+
+// findInventorySession looks up a session. If there isn't one it writes the error response
+// itself and returns false, so the caller should just return.
+func findInventorySession(w http.ResponseWriter, r *http.Request, db *sql.DB, sessionID string) (InventorySession, bool) {
+	session, err := scanInventorySession(db.QueryRow(inventorySessionSelectQuery+" WHERE s.session_id = ?;", sessionID))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeSessionNotFound, "Inventory session not found")
+		return session, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return session, false
+	}
+
+	return session, true
+}
@@ -0,0 +1,126 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"testing"
+)
+
+func startInventory(t *testing.T, branch, shelfLocation string) string {
+	r := callHandler(t, StartInventoryHandler, "POST", "/api/v1/inventory/sessions", map[string]string{"branch": branch, "shelf_location": shelfLocation})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var response InventoryResponse
+	err := json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.SessionID
+}
+
+func TestInventoryReportHandler(t *testing.T) {
+	cleanInventoryTables()
+	patronID, bookID := circulationFixture(t, 0)
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "A", Branch: "Main", ShelfLocation: "SF1"})
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "B", Branch: "Main", ShelfLocation: "SF1"})
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "C", Branch: "Main", ShelfLocation: "SF2"})
+	insertBarcodedCopy(Copy{BookID: bookID, Barcode: "D", Branch: "Main", ShelfLocation: "SF1"})
+	callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronID, "barcode": "D"})
+
+	sessionID := startInventory(t, "Main", "SF1")
+
+	// Scanned in two batches, A is scanned twice
+	batches := [][]string{{"A", "C"}, {"D", "UNKNOWN", "A"}}
+	for _, barcodes := range batches {
+		r := callHandler(t, SubmitInventoryScansHandler, "POST", "/api/v1/inventory/sessions/"+sessionID+"/scans", map[string]interface{}{"barcodes": barcodes})
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+		}
+	}
+
+	r := callHandler(t, InventoryReportHandler, "GET", "/api/v1/inventory/sessions/"+sessionID+"/report", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var report InventoryReport
+	err := json.Unmarshal(r.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Session.Scanned != 4 || report.Expected != 2 || report.Found != 1 {
+		t.Errorf("Expected 4 scanned, 2 expected and 1 found, got %d, %d and %d", report.Session.Scanned, report.Expected, report.Found)
+	}
+
+	barcodes := func(items []InventoryItem) []string {
+		list := make([]string, 0)
+		for _, item := range items {
+			list = append(list, item.Barcode)
+		}
+		return list
+	}
+
+	expected := map[string][]string{
+		"missing":    {"B"},
+		"misplaced":  {"C"},
+		"unexpected": {"D", "UNKNOWN"},
+	}
+	actual := map[string][]string{
+		"missing":    barcodes(report.Missing),
+		"misplaced":  barcodes(report.Misplaced),
+		"unexpected": barcodes(report.Unexpected),
+	}
+	for list, barcodes := range expected {
+		if len(actual[list]) != len(barcodes) {
+			t.Errorf("Expected %s %v, got %v", list, barcodes, actual[list])
+			continue
+		}
+		for i := range barcodes {
+			if actual[list][i] != barcodes[i] {
+				t.Errorf("Expected %s %v, got %v", list, barcodes, actual[list])
+				break
+			}
+		}
+	}
+}
+
+func TestCloseInventoryHandlerStopsScans(t *testing.T) {
+	cleanInventoryTables()
+	sessionID := startInventory(t, "Main", "")
+
+	r := callHandler(t, CloseInventoryHandler, "POST", "/api/v1/inventory/sessions/"+sessionID+"/close", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	r = callHandler(t, SubmitInventoryScansHandler, "POST", "/api/v1/inventory/sessions/"+sessionID+"/scans", map[string]interface{}{"barcodes": []string{"A"}})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestInventoryReportHandlerSessionNotFound(t *testing.T) {
+	cleanInventoryTables()
+
+	r := callHandler(t, InventoryReportHandler, "GET", "/api/v1/inventory/sessions/999/report", nil)
+
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func cleanInventoryTables() error {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM InventoryScans; DELETE FROM InventorySessions;")
+	return err
+}
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// handlerError is a REST handler's answer other than a 200, with the detail of its problem
+type handlerError struct {
+	status  int
+	message string
+	problem Problem
+}
+
+func (e *handlerError) Error() string {
+	return e.message
+}
+
+// Extensions are the problem's code and field errors, GraphQL answers with them
+func (e *handlerError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"code": e.problem.Code, "status": e.status}
+	if len(e.problem.Errors) > 0 {
+		extensions["errors"] = e.problem.Errors
+	}
+	return extensions
+}
+
+// bufferedResponse is the http.ResponseWriter invokeHandler calls a handler with
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+// invokeHandler calls a REST handler in process, with payload as the JSON body of a request to
+// path with header from remoteAddr, and decodes its answer into out if it's given. The GraphQL and gRPC APIs
+// write through it, so what the REST API validates, audits and sends to the change feed, they
+// do too. An answer other than a 200 is returned as a *handlerError with its problem.
+func invokeHandler(ctx context.Context, header http.Header, remoteAddr string, handler func(http.ResponseWriter, *http.Request, string), injectedDB, method, path string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.RemoteAddr = remoteAddr
+
+	w := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	handler(w, req, injectedDB)
+	if w.status != http.StatusOK {
+		var problem Problem
+		json.Unmarshal(w.body.Bytes(), &problem)
+		message := problem.Detail
+		if message == "" {
+			message = http.StatusText(w.status)
+		}
+		return &handlerError{status: w.status, message: message, problem: problem}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(w.body.Bytes(), out)
+}
@@ -0,0 +1,458 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Circulation rules. A loan is due LoanPeriod after checkout, and can be renewed up to
+// MaxRenewals times, each renewal pushing the due date to LoanPeriod from the renewal.
+const (
+	LoanPeriod  = 21 * 24 * time.Hour
+	MaxRenewals = 2
+)
+
+// now is swapped out in tests so due dates can be checked without waiting three weeks
+var now = time.Now
+
+type Loan struct {
+	LoanID string `json:"loan_id"`
+	// CopyID is left out once the copy has been purged with its book, the rest of the loan
+	// is kept as the patron's history
+	CopyID       string     `json:"copy_id,omitempty"`
+	BookID       string     `json:"book_id"`
+	Title        string     `json:"title"`
+	Barcode      string     `json:"barcode"`
+	PatronID     string     `json:"patron_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	DueDate      time.Time  `json:"due_date"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty"`
+	Renewals     int        `json:"renewals"`
+	// Lost is set on a loan ended by marking its copy lost, ReturnedAt is when that was
+	Lost bool `json:"lost,omitempty"`
+}
+
+type LoanResponse struct {
+	LoanID  string     `json:"loan_id,omitempty"`
+	DueDate *time.Time `json:"due_date,omitempty"`
+	Status  string     `json:"status"`
+	Code    int        `json:"code"`
+}
+
+// CheckoutHandler lends a copy of a book to a patron. The request names either a specific
+// copy by its copy_id or barcode, or a book_id in which case the first available copy of
+// that book is used.
+func CheckoutHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var checkout struct {
+		PatronID string `json:"patron_id" validate:"required,id"`
+		BookID   string `json:"book_id" validate:"id"`
+		CopyID   string `json:"copy_id" validate:"id"`
+		Barcode  string `json:"barcode" validate:"line"`
+	}
+	if !decodeRequest(w, r, &checkout) {
+		return
+	}
+
+	// Which copy to lend can be said three ways, one of them is needed
+	if checkout.BookID == "" && checkout.CopyID == "" && checkout.Barcode == "" {
+		writeValidationProblem(w, r, "book_id is required when there's no copy_id or barcode",
+			FieldError{Field: "book_id", Message: "is required when there's no copy_id or barcode"})
+		return
+	}
+
+	// Check if the patron exists
+	var existingPatronID string
+	err = db.QueryRow("SELECT patron_id FROM Patrons WHERE patron_id = ?;", checkout.PatronID).Scan(&existingPatronID)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodePatronNotFound, "Patron not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Find the copy to lend out. A copy set aside for one of this patron's holds comes
+	// first, otherwise any available copy of the book will do.
+	var copyID int64
+	var copyStatus string
+	if checkout.CopyID != "" {
+		err = tx.QueryRow("SELECT copy_id, status FROM Copies WHERE copy_id = ?;", checkout.CopyID).Scan(&copyID, &copyStatus)
+	} else if checkout.Barcode != "" {
+		err = tx.QueryRow("SELECT copy_id, status FROM Copies WHERE barcode = ?;", checkout.Barcode).Scan(&copyID, &copyStatus)
+	} else {
+		pickCopyQuery := `SELECT c.copy_id, c.status FROM Copies c
+			LEFT JOIN Holds h ON h.copy_id = c.copy_id AND h.status = ? AND h.patron_id = ?
+			WHERE c.book_id = ?
+			ORDER BY h.hold_id IS NULL, c.status != ?, c.copy_id LIMIT 1;`
+		err = tx.QueryRow(pickCopyQuery, HoldReady, checkout.PatronID, checkout.BookID, CopyAvailable).Scan(&copyID, &copyStatus)
+	}
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeCopyNotFound, "No copies found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// A copy on the hold shelf can only go to the patron it was set aside for
+	var holdID int64
+	if copyStatus == CopyOnHoldShelf {
+		err = tx.QueryRow("SELECT hold_id FROM Holds WHERE copy_id = ? AND status = ? AND patron_id = ?;", copyID, HoldReady, checkout.PatronID).Scan(&holdID)
+		if err != nil && err != sql.ErrNoRows {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	if copyStatus != CopyAvailable && holdID == 0 {
+		writeProblem(w, r, http.StatusConflict, CodeNoCopyAvailable, "No copies available for checkout")
+		return
+	}
+
+	if holdID != 0 {
+		_, err = tx.Exec("UPDATE Holds SET status = ? WHERE hold_id = ?;", HoldFulfilled, holdID)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	checkedOutAt := now().UTC()
+	dueDate := checkedOutAt.Add(LoanPeriod)
+
+	_, err = tx.Exec("UPDATE Copies SET status = ? WHERE copy_id = ?;", CopyOnLoan, copyID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	insertLoanQuery := `INSERT INTO Loans (copy_id, patron_id, checked_out_at, due_date) VALUES (?, ?, ?, ?);`
+	result, err := tx.Exec(insertLoanQuery, copyID, checkout.PatronID, checkedOutAt, dueDate)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	loanID, _ := result.LastInsertId()
+
+	response := LoanResponse{
+		LoanID:  strconv.FormatInt(loanID, 10),
+		DueDate: &dueDate,
+		Status:  "success",
+		Code:    http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ReturnLoanHandler checks a loaned copy back in and makes it available again, or sets it
+// aside for the next patron in the hold queue.
+func ReturnLoanHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var loanData struct {
+		LoanID string `json:"loan_id" validate:"required,id"`
+	}
+	if !decodeRequest(w, r, &loanData) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	loan, ok := findOpenLoan(w, r, tx, loanData.LoanID)
+	if !ok {
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Loans SET returned_at = ? WHERE loan_id = ?;", now().UTC(), loan.LoanID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE Copies SET status = ? WHERE copy_id = ?;", CopyAvailable, loan.CopyID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// The returned copy goes straight to the hold shelf if anyone is queued for the book
+	err = promoteHolds(tx, loan.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := LoanResponse{
+		LoanID: loan.LoanID,
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// RenewLoanHandler extends the due date of an open loan, as long as it hasn't already been
+// renewed MaxRenewals times and nobody has a hold waiting on the book.
+func RenewLoanHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var loanData struct {
+		LoanID string `json:"loan_id" validate:"required,id"`
+	}
+	if !decodeRequest(w, r, &loanData) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	loan, ok := findOpenLoan(w, r, tx, loanData.LoanID)
+	if !ok {
+		return
+	}
+
+	if loan.Renewals >= MaxRenewals {
+		writeProblem(w, r, http.StatusConflict, CodeRenewalLimit, fmt.Sprintf("Loan has already been renewed the maximum of %d times", MaxRenewals))
+		return
+	}
+
+	// Patrons queued for the book get it back on time instead
+	var waitingHolds int
+	err = tx.QueryRow("SELECT COUNT(*) FROM Holds WHERE book_id = ? AND status = ?;", loan.BookID, HoldWaiting).Scan(&waitingHolds)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if waitingHolds > 0 {
+		writeProblem(w, r, http.StatusConflict, CodeRenewalBlocked, "Loan can't be renewed while other patrons are waiting for the book")
+		return
+	}
+
+	dueDate := now().UTC().Add(LoanPeriod)
+
+	_, err = tx.Exec("UPDATE Loans SET due_date = ?, renewals = renewals + 1 WHERE loan_id = ?;", dueDate, loan.LoanID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := LoanResponse{
+		LoanID:  loan.LoanID,
+		DueDate: &dueDate,
+		Status:  "success",
+		Code:    http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetLoansHandler lists loans, optionally filtered by patron_id and book_id. Passing
+// status=current only returns copies that are still out, status=returned only the history.
+func GetLoansHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	queryParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Incorrectly formatted loan parameters")
+		return
+	}
+
+	patronID := queryParams.Get("patron_id")
+	bookID := queryParams.Get("book_id")
+	status := queryParams.Get("status")
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	query := loanSelectQuery + " WHERE 1=1"
+	args := make([]interface{}, 0)
+
+	if patronID != "" {
+		query += " AND l.patron_id = ?"
+		args = append(args, patronID)
+	}
+	if bookID != "" {
+		query += " AND (c.book_id = ? OR (l.copy_id IS NULL AND l.book_id = ?))"
+		args = append(args, bookID, bookID)
+	}
+	switch status {
+	case "":
+	case "current":
+		query += " AND l.returned_at IS NULL"
+	case "returned":
+		query += " AND l.returned_at IS NOT NULL"
+	default:
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Loan status must be one of current or returned")
+		return
+	}
+	query += " ORDER BY l.checked_out_at DESC, l.loan_id DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	loans := make([]Loan, 0)
+	for rows.Next() {
+		loan, err := scanLoan(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		loans = append(loans, loan)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(loans)
+}
+
+// loanSelectQuery selects the columns scanLoan expects, joined with the copy and book so
+// callers can filter on either. A loan whose copy has been purged reads the book, title and
+// barcode it kept instead.
+const loanSelectQuery = `SELECT l.loan_id, COALESCE(l.copy_id, ''), COALESCE(c.book_id, l.book_id), COALESCE(b.title, l.title),
+		COALESCE(c.barcode, l.barcode, ''), l.patron_id, l.checked_out_at, l.due_date, l.returned_at, l.renewals, l.lost
+	FROM Loans l
+	LEFT JOIN Copies c ON c.copy_id = l.copy_id
+	LEFT JOIN Books b ON b.book_id = c.book_id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryer is the part of *sql.DB and *sql.Tx that reads rows
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// rowQueryer is the part of *sql.DB and *sql.Tx that reads a single row
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func scanLoan(row rowScanner) (Loan, error) {
+	var loan Loan
+	var returnedAt sql.NullTime
+	err := row.Scan(&loan.LoanID, &loan.CopyID, &loan.BookID, &loan.Title, &loan.Barcode, &loan.PatronID, &loan.CheckedOutAt, &loan.DueDate, &returnedAt, &loan.Renewals, &loan.Lost)
+	if returnedAt.Valid {
+		loan.ReturnedAt = &returnedAt.Time
+	}
+	return loan, err
+}
+
+// closeLostLoan ends the open loan of a copy that's been marked lost, and posts the fines the
+// patron has run up until now, which is as late as the loan gets
+func closeLostLoan(tx *sql.Tx, copyID string) error {
+	var patronID string
+	err := tx.QueryRow("SELECT patron_id FROM Loans WHERE copy_id = ? AND returned_at IS NULL;", copyID).Scan(&patronID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	current := now().UTC()
+	_, err = tx.Exec("UPDATE Loans SET returned_at = ?, lost = 1 WHERE copy_id = ? AND returned_at IS NULL;", current, copyID)
+	if err != nil {
+		return err
+	}
+
+	policies, err := loadFinePolicies(tx)
+	if err != nil {
+		return err
+	}
+	return postFines(tx, policies, patronID, current)
+}
+
+// findOpenLoan looks up a loan that hasn't been returned yet. If there isn't one it writes
+// the error response itself and returns false, so the caller should just return.
+func findOpenLoan(w http.ResponseWriter, r *http.Request, tx *sql.Tx, loanID string) (Loan, bool) {
+	loan, err := scanLoan(tx.QueryRow(loanSelectQuery+" WHERE l.loan_id = ?;", loanID))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeLoanNotFound, "Loan not found")
+		return loan, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return loan, false
+	}
+
+	if loan.ReturnedAt != nil {
+		writeProblem(w, r, http.StatusConflict, CodeLoanReturned, "Loan has already been returned")
+		return loan, false
+	}
+
+	return loan, true
+}
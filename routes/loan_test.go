@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// circulationFixture sets up a patron and a book with the given number of copies
+func circulationFixture(t *testing.T, copies int) (patronID, bookID string) {
+	cleanCirculationTables()
+	cleanBooksTable()
+
+	book, err := insertBookWithID(Book{Title: "The Hobbit", Author: "J.R.R. Tolkien", Genre: "Fantasy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < copies; i++ {
+		_, err := insertCopy(book)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	patron, err := insertPatron(Patron{Name: "Bilbo Baggins"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strconv.FormatInt(patron, 10), strconv.FormatInt(book, 10)
+}
+
+// callHandler sends payload as the JSON body of a request to handler and returns the recorder
+func callHandler(t *testing.T, handler func(http.ResponseWriter, *http.Request, string), method, target string, payload interface{}) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+
+	req, err := http.NewRequest(method, target, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+	handler(r, req, testDB)
+	return r
+}
+
+func checkout(t *testing.T, patronID, bookID string) LoanResponse {
+	r := callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronID, "book_id": bookID})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	var response LoanResponse
+	err := json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestCheckoutHandlerSuccess(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 1)
+
+	checkedOutAt := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return checkedOutAt }
+	defer func() { now = time.Now }()
+
+	response := checkout(t, patronID, bookID)
+
+	if response.LoanID == "" {
+		t.Error("Expected a loan_id in the response")
+	}
+
+	expectedDueDate := checkedOutAt.Add(LoanPeriod)
+	if response.DueDate == nil || !response.DueDate.Equal(expectedDueDate) {
+		t.Errorf("Expected due date %v, got %v", expectedDueDate, response.DueDate)
+	}
+}
+
+func TestCheckoutHandlerNoCopiesAvailable(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 1)
+	checkout(t, patronID, bookID)
+
+	r := callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": patronID, "book_id": bookID})
+
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestCheckoutHandlerPatronNotFound(t *testing.T) {
+	_, bookID := circulationFixture(t, 1)
+
+	r := callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]string{"patron_id": "999", "book_id": bookID})
+
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestReturnLoanHandler(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 1)
+	loan := checkout(t, patronID, bookID)
+
+	r := callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	// Returning twice is a conflict
+	r = callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+
+	// The copy can go out again once it's back
+	checkout(t, patronID, bookID)
+}
+
+func TestRenewLoanHandlerLimit(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 1)
+	loan := checkout(t, patronID, bookID)
+
+	for i := 0; i < MaxRenewals; i++ {
+		r := callHandler(t, RenewLoanHandler, "POST", "/api/v1/loans/renew", map[string]string{"loan_id": loan.LoanID})
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+		}
+	}
+
+	r := callHandler(t, RenewLoanHandler, "POST", "/api/v1/loans/renew", map[string]string{"loan_id": loan.LoanID})
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestGetLoansHandlerCurrentAndHistory(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 2)
+	first := checkout(t, patronID, bookID)
+	checkout(t, patronID, bookID)
+	callHandler(t, ReturnLoanHandler, "POST", "/api/v1/loans/return", map[string]string{"loan_id": first.LoanID})
+
+	expectedCounts := map[string]int{
+		"/api/v1/loans?patron_id=" + patronID:                     2,
+		"/api/v1/loans?patron_id=" + patronID + "&status=current": 1,
+		"/api/v1/loans?book_id=" + bookID + "&status=returned":    1,
+		"/api/v1/loans?patron_id=999":                             0,
+	}
+
+	for target, expected := range expectedCounts {
+		r := callHandler(t, GetLoansHandler, "GET", target, nil)
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+		}
+
+		var loans []Loan
+		err := json.Unmarshal(r.Body.Bytes(), &loans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(loans) != expected {
+			t.Errorf("%s: expected %d loans, got %d", target, expected, len(loans))
+		}
+	}
+}
+
+func TestGetBooksHandlerAvailability(t *testing.T) {
+	patronID, bookID := circulationFixture(t, 2)
+	checkout(t, patronID, bookID)
+
+	r := callHandler(t, GetBooksHandler, "GET", "/api/v1/books", nil)
+
+	var books []Book
+	err := json.Unmarshal(r.Body.Bytes(), &books)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(books) != 1 || books[0].Availability == nil {
+		t.Fatalf("Expected one book with availability, got %+v", books)
+	}
+	if books[0].Availability.TotalCopies != 2 || books[0].Availability.AvailableCopies != 1 {
+		t.Errorf("Expected 1 of 2 copies available, got %+v", *books[0].Availability)
+	}
+}
@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LogRequests gives every request an ID, see requestID, sends it back in the X-Request-ID
+// header, and writes an access log entry with slog once the request's been answered. The
+// entry has the route that matched, the status, how long the answer took and how many bytes
+// it was, the code of the problem if it was one, and the trace ID if it's traced. Requests
+// are logged at info, failures are also logged at error by writeServerError with what went
+// wrong. The request is counted in the metrics too, see MetricsHandler.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := &accessLog{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		latency := time.Since(start)
+		observeRequest(r.Method, entry.route, recorder.status(), latency)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", entry.route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status()),
+			slog.Float64("latency_ms", float64(latency.Microseconds())/1000),
+			slog.Int64("bytes", recorder.bytes),
+			slog.String("request_id", id),
+		}
+		if entry.code != "" {
+			attrs = append(attrs, slog.String("code", entry.code))
+		}
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// accessLog is what LogRequests learns about a request from further in, the router and the
+// problem it's answered with
+type accessLog struct {
+	route string
+	code  string
+}
+
+type accessLogKey struct{}
+
+// accessLogFrom returns the access log entry of r, or nil if r isn't being logged
+func accessLogFrom(r *http.Request) *accessLog {
+	entry, _ := r.Context().Value(accessLogKey{}).(*accessLog)
+	return entry
+}
+
+// logger is the logger for messages about r, they carry its request ID, method and path so
+// they can be matched with its access log entry, and its trace ID if it's traced
+func logger(r *http.Request) *slog.Logger {
+	log := slog.Default().With("request_id", requestID(r), "method", r.Method, "path", r.URL.Path)
+	if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+		log = log.With("trace_id", span.TraceID().String())
+	}
+	return log
+}
+
+// statusRecorder remembers the status a handler answers with and counts the bytes of the
+// answer. It passes Flush through, which the event stream needs.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+func (s *statusRecorder) status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
@@ -0,0 +1,171 @@
+package routes
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsPath is where the server's metrics are scraped from, in the Prometheus text format
+const MetricsPath = "/metrics"
+
+// metrics holds what's counted while the server runs. The catalog gauges aren't in it, they're
+// read from the database on every scrape, see MetricsHandler.
+var metrics = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "books_http_requests_total",
+		Help: "HTTP requests answered, by method, route pattern and status. The route is empty for paths no route matches.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "books_http_request_duration_seconds",
+		Help:    "How long HTTP requests took to answer, by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "books_db_query_duration_seconds",
+		Help:    "How long database statements took, by operation and table.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"query"})
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "books_db_errors_total",
+		Help: "Database statements that failed, by operation and table. Finding no rows isn't a failure.",
+	}, []string{"query"})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpRequestDuration, dbQueryDuration, dbErrors,
+	)
+}
+
+// observeRequest counts a request LogRequests has answered
+func observeRequest(method, route string, status int, latency time.Duration) {
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(latency.Seconds())
+}
+
+// observeQuery records how long the query named name took since start, and counts it as an
+// error if it failed. tracedConn calls it for every statement, named by queryName.
+func observeQuery(name string, start time.Time, err error) {
+	dbQueryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		dbErrors.WithLabelValues(name).Inc()
+	}
+}
+
+// queryName names a statement by what it does and the table it does it to, like
+// "select_books" or "insert_copies", so the metrics have a label per kind of statement rather
+// than per SQL string. A query's table is the first after a FROM that isn't a subquery.
+func queryName(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	operation := strings.ToLower(fields[0])
+	after := ""
+	switch operation {
+	case "select", "delete":
+		after = "from"
+	case "insert":
+		after = "into"
+	case "update":
+		after = "update"
+	default:
+		return operation
+	}
+	for i := 0; i < len(fields)-1; i++ {
+		if !strings.EqualFold(fields[i], after) {
+			continue
+		}
+		table := strings.ToLower(strings.Trim(fields[i+1], "(),;"))
+		if table != "" && table != "select" {
+			return operation + "_" + table
+		}
+	}
+	return operation
+}
+
+// catalogStats are the catalog gauges, counted when the metrics are scraped. Books and
+// collections in the trash aren't counted.
+type catalogStats struct {
+	books       int
+	collections int
+	genres      map[string]int
+}
+
+var (
+	catalogBooksDesc       = prometheus.NewDesc("books_catalog_books", "Books in the catalog.", nil, nil)
+	catalogCollectionsDesc = prometheus.NewDesc("books_catalog_collections", "Collections in the catalog.", nil, nil)
+	catalogGenreDesc       = prometheus.NewDesc("books_catalog_books_by_genre", "Books in the catalog, by genre. Books without one have an empty genre.", []string{"genre"}, nil)
+)
+
+func (stats *catalogStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- catalogBooksDesc
+	ch <- catalogCollectionsDesc
+	ch <- catalogGenreDesc
+}
+
+func (stats *catalogStats) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(catalogBooksDesc, prometheus.GaugeValue, float64(stats.books))
+	ch <- prometheus.MustNewConstMetric(catalogCollectionsDesc, prometheus.GaugeValue, float64(stats.collections))
+	for genre, count := range stats.genres {
+		ch <- prometheus.MustNewConstMetric(catalogGenreDesc, prometheus.GaugeValue, float64(count), genre)
+	}
+}
+
+// readCatalogStats counts the books and collections in the catalog
+func readCatalogStats(db *sql.DB) (*catalogStats, error) {
+	stats := &catalogStats{genres: make(map[string]int)}
+	err := db.QueryRow("SELECT (SELECT COUNT(*) FROM Books WHERE deleted_at IS NULL), (SELECT COUNT(*) FROM Collections WHERE deleted_at IS NULL);").Scan(&stats.books, &stats.collections)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT genre, COUNT(*) FROM Books WHERE deleted_at IS NULL GROUP BY genre;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var genre string
+		var count int
+		err := rows.Scan(&genre, &count)
+		if err != nil {
+			return nil, err
+		}
+		stats.genres[genre] = count
+	}
+	return stats, rows.Err()
+}
+
+// MetricsHandler serves the request and database metrics, the Go runtime's and the process's,
+// and the catalog gauges read from the database as it's scraped
+func MetricsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	stats, err := readCatalogStats(db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	catalog := prometheus.NewRegistry()
+	catalog.MustRegister(stats)
+
+	promhttp.HandlerFor(prometheus.Gatherers{metrics, catalog}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
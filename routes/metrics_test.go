@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	t.Cleanup(func() {
+		cleanBooksTable()
+		cleanCollectionsFromTestDatabase()
+	})
+
+	var dune, trashed Response
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965", Genre: "Science Fiction"})
+	json.Unmarshal(r.Body.Bytes(), &dune)
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815"})
+	r = callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Solaris", Author: "Stanisław Lem", PublishedDate: "1961", Genre: "Science Fiction"})
+	json.Unmarshal(r.Body.Bytes(), &trashed)
+	callHandler(t, DeleteBookHandler, "DELETE", "/api/v1/books/"+trashed.BookID, nil)
+	callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Classics", Description: "Old books"})
+
+	router := NewServeMux(testDB)
+	serve(router, "GET", "/api/v1/books/"+dune.BookID, nil)
+	r = serve(router, "GET", MetricsPath, nil)
+	if r.Code != http.StatusOK || !strings.HasPrefix(r.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("Expected the metrics as text, got %d %s", r.Code, r.Header().Get("Content-Type"))
+	}
+
+	// Books in the trash aren't counted, a book without a genre has an empty one
+	for _, want := range []string{
+		"books_catalog_books 2\n",
+		"books_catalog_collections 1\n",
+		`books_catalog_books_by_genre{genre="Science Fiction"} 1`,
+		`books_catalog_books_by_genre{genre=""} 1`,
+		`books_http_requests_total{method="GET",route="/api/v1/books/{id}",status="200"}`,
+		`books_http_request_duration_seconds_bucket{method="GET",route="/api/v1/books/{id}",le="+Inf"}`,
+		`books_db_query_duration_seconds_count{query="insert_books"}`,
+		`books_db_query_duration_seconds_count{query="select_books"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(r.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics, got\n%s", want, r.Body.String())
+		}
+	}
+}
+
+func TestObserveQuery(t *testing.T) {
+	before := testutil.ToFloat64(dbErrors.WithLabelValues("test_query"))
+	observeQuery("test_query", time.Now(), nil)
+	observeQuery("test_query", time.Now(), sql.ErrNoRows)
+	observeQuery("test_query", time.Now(), errors.New("database is locked"))
+
+	// Finding nothing isn't a failure
+	if errs := testutil.ToFloat64(dbErrors.WithLabelValues("test_query")) - before; errs != 1 {
+		t.Errorf("Expected 1 failed query, got %v", errs)
+	}
+}
+
+func TestQueryName(t *testing.T) {
+	for query, name := range map[string]string{
+		bookSelectQuery + " WHERE book_id = ?;":                               "select_books",
+		"SELECT * FROM (" + holdListQuery + ") h WHERE 1=1":                   "select_holds",
+		"SELECT (SELECT COUNT(*) FROM Copies WHERE book_id = ?), (SELECT 1);": "select_copies",
+		"INSERT INTO Fines (patron_id) VALUES (?);":                           "insert_fines",
+		"\n\tUPDATE Copies SET status = ? WHERE copy_id = ?;":                 "update_copies",
+		"DELETE FROM CollectionBooks WHERE book_id = ?;":                      "delete_collectionbooks",
+		"PRAGMA user_version;":                                                "pragma",
+	} {
+		if got := queryName(query); got != name {
+			t.Errorf("Expected %q to be named %s, got %s", query, name, got)
+		}
+	}
+}
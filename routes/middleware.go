@@ -0,0 +1,128 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Recover answers a request whose handler panics with a 500, logging the panic and its stack
+// under the request ID, so one bad request can't take the server down
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// The handler meant to drop the connection, net/http does that
+				panic(recovered)
+			}
+			logger(r).Error("handler panicked", "panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+			writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitBody stops reading a request's body after limit bytes, so a client can't make the
+// server hold an endless one in memory. A handler decoding a longer body answers 413.
+func LimitBody(limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireToken only lets through requests with an "Authorization: Bearer <token>" header for
+// one of tokens, which maps each token to the actor it stands for. The audit log names that
+// actor, whatever X-Actor the request was sent with, so it says who was really let in. Other
+// requests are answered 401. CORS preflight requests don't carry credentials and are let
+// through.
+func RequireToken(tokens map[string]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPreflight(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if actor, ok := tokenActor(tokens, r.Header.Get("Authorization")); ok {
+				next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), actor)))
+				return
+			}
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookManagement"`)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "A valid bearer token is required")
+		})
+	}
+}
+
+// tokenActor returns the actor of the token in authorization, a "Bearer <token>" header or
+// metadata value, if it's one of tokens. Tokens are compared in constant time, so how long a
+// wrong one takes doesn't tell how much of it was right.
+func tokenActor(tokens map[string]string, authorization string) (string, bool) {
+	sent, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for token, actor := range tokens {
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1 {
+			return actor, true
+		}
+	}
+	return "", false
+}
+
+// CORSMaxAge is how long a browser may cache the answer to a CORS preflight request
+const CORSMaxAge = 10 * time.Minute
+
+// CORS lets pages from origins call the API from a browser, "*" allowing any origin. It
+// answers preflight requests itself, for the methods and headers the API takes, and adds
+// the allowed origin to every other answer. Requests from other origins are served without
+// CORS headers, so the browser keeps the answer from the page.
+func CORS(origins ...string) Middleware {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			header.Add("Vary", "Origin")
+			if allowed["*"] {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if isPreflight(r) {
+				header.Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE")
+				header.Set("Access-Control-Allow-Headers", strings.Join([]string{"Authorization", "Content-Type", ActorHeader, RequestIDHeader}, ", "))
+				header.Set("Access-Control-Max-Age", fmt.Sprint(int(CORSMaxAge.Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			header.Set("Access-Control-Expose-Headers", strings.Join([]string{RequestIDHeader, "Allow", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"}, ", "))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isPreflight reports whether r is a browser asking whether it may make a cross-origin request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,131 @@
+package routes
+
+import "net/http"
+
+// NewServeMux routes every endpoint of the API to its handler, each handler opening
+// injectedDB. main serves it, and tests can run the whole API in an httptest.Server.
+// Every request is traced, logged and recovered from panics, and apiMiddleware, like RequireToken,
+// wraps the endpoints of the API only. More middleware for every request can be added with Use.
+func NewServeMux(injectedDB string, apiMiddleware ...Middleware) *Router {
+	router := NewRouter()
+	router.Use(TraceRequests, LogRequests, Recover)
+	handle := handleWith(injectedDB)
+
+	api := router.Group("/api/v1", apiMiddleware...)
+
+	// api/v1/books endpoints, a single book and its revision history
+	api.Post("/books", handle(AddBookHandler))
+	api.Get("/books", handle(GetBooksHandler))
+	api.Get("/books/{id}", handle(GetBookHandler))
+	api.Patch("/books/{id}", handle(UpdateBookHandler))
+	api.Delete("/books/{id}", handle(DeleteBookHandler))
+	api.Get("/books/{id}/revisions", handle(GetBookRevisionsHandler))
+	api.Get("/books/{id}/revisions/{rev}", handle(GetBookRevisionHandler))
+	api.Post("/books/{id}/revisions/{rev}:restore", handle(RestoreBookRevisionHandler))
+	api.Get("/books/{id}/diff", handle(BookDiffHandler))
+	api.Get("/filter", handle(FilterBooksHandler))
+
+	// api/v1/collection endpoints
+	api.Post("/collections", handle(AddCollectionHandler))
+	api.Get("/collections", handle(GetCollectionsHandler))
+	api.Delete("/collections/{id}", handle(DeleteCollectionHandler))
+	api.Post("/booksToCollection", handle(AddBookToCollectionHandler))
+
+	// api/v1/patrons endpoints, with each patron's fine ledger, payments and waivers
+	api.Post("/patrons", handle(AddPatronHandler))
+	api.Get("/patrons", handle(GetPatronsHandler))
+	api.Get("/patrons/{id}/fines", handle(GetFinesHandler))
+	api.Post("/patrons/{id}/fines/pay", handle(PayFinesHandler))
+	api.Post("/patrons/{id}/fines/waive", handle(WaiveFinesHandler))
+
+	// api/v1/fines/policies endpoint, the daily rate, grace period and cap used for fines
+	api.Post("/fines/policies", handle(SetFinePolicyHandler))
+	api.Get("/fines/policies", handle(GetFinePoliciesHandler))
+
+	// api/v1/copies endpoints, the physical copies of each book that can be lent out, looked
+	// up and updated by barcode
+	api.Post("/copies", handle(AddCopyHandler))
+	api.Get("/copies", handle(GetCopiesHandler))
+	api.Get("/copies/{barcode}", handle(GetCopyHandler))
+	api.Patch("/copies/{barcode}", handle(UpdateCopyHandler))
+
+	// api/v1/loans endpoints, POST checks a copy out and GET lists current loans and loan history
+	api.Post("/loans", handle(CheckoutHandler))
+	api.Get("/loans", handle(GetLoansHandler))
+	api.Post("/loans/return", handle(ReturnLoanHandler))
+	api.Post("/loans/renew", handle(RenewLoanHandler))
+
+	// api/v1/holds endpoints, POST joins the hold queue for a book and GET lists holds
+	api.Post("/holds", handle(PlaceHoldHandler))
+	api.Get("/holds", handle(GetHoldsHandler))
+	api.Post("/holds/cancel", handle(CancelHoldHandler))
+	api.Post("/holds/reorder", handle(ReorderHoldHandler))
+
+	// api/v1/inventory endpoints, stocktake sessions that compare scanned shelves with the catalog
+	api.Post("/inventory/sessions", handle(StartInventoryHandler))
+	api.Get("/inventory/sessions", handle(GetInventorySessionsHandler))
+	api.Post("/inventory/sessions/{id}/scans", handle(SubmitInventoryScansHandler))
+	api.Get("/inventory/sessions/{id}/report", handle(InventoryReportHandler))
+	api.Post("/inventory/sessions/{id}/close", handle(CloseInventoryHandler))
+
+	// api/v1/audit endpoint, who changed what in the catalog and when
+	api.Get("/audit", handle(GetAuditLogHandler))
+
+	// api/v1/events endpoint, a Server-Sent Events stream of catalog changes
+	api.Get("/events", handle(StreamEventsHandler))
+
+	// api/v1/webhooks endpoints, subscriptions to the change feed and their delivery log
+	api.Post("/webhooks", handle(AddWebhookHandler))
+	api.Get("/webhooks", handle(GetWebhooksHandler))
+	api.Get("/webhooks/{id}", handle(GetWebhookHandler))
+	api.Patch("/webhooks/{id}", handle(UpdateWebhookHandler))
+	api.Delete("/webhooks/{id}", handle(DeleteWebhookHandler))
+	api.Get("/webhooks/{id}/deliveries", handle(GetWebhookDeliveriesHandler))
+	api.Get("/webhooks/dead-letters", handle(GetDeadLettersHandler))
+	api.Post("/webhooks/deliveries/{id}:redeliver", handle(RedeliverWebhookHandler))
+
+	// api/v1/trash endpoints, deleted books and collections that can still be restored
+	api.Get("/trash", handle(GetTrashHandler))
+	api.Post("/trash/{entity}/{id}:restore", handle(RestoreTrashHandler))
+
+	// api/v1/openapi.json endpoint, the OpenAPI 3 description of every endpoint here
+	router.Get(OpenAPIPath, handle(OpenAPIHandler))
+
+	// healthz, readyz and version endpoints, for the orchestrator's probes
+	router.Get(HealthzPath, handle(HealthzHandler))
+	router.Get(ReadyzPath, handle(ReadyzHandler))
+	router.Get(VersionPath, handle(VersionHandler))
+
+	// Endpoints outside /api/v1 that still need a token when the API does
+	outside := router.Group("", apiMiddleware...)
+
+	// graphql endpoint, books, collections and authors as a single graph
+	outside.Post(GraphQLPath, handle(GraphQLHandler))
+
+	// metrics endpoint, for Prometheus to scrape
+	outside.Get(MetricsPath, handle(MetricsHandler))
+
+	return router
+}
+
+// MountAdmin adds the admin endpoints to a router from NewServeMux, behind middleware of their
+// own and not the API's, which should include a RequireToken with tokens other than the API's.
+// A server that doesn't call it has no admin endpoints.
+func MountAdmin(router *Router, injectedDB string, middleware ...Middleware) {
+	handle := handleWith(injectedDB)
+	admin := router.Group("/api/v1/admin", middleware...)
+
+	// api/v1/admin/backups endpoints, POST takes a backup while the server keeps running
+	admin.Post("/backups", handle(CreateBackupHandler))
+	admin.Get("/backups", handle(GetBackupsHandler))
+	admin.Post("/backups/{name}:restore", handle(RestoreBackupHandler))
+}
+
+// handleWith adapts handlers taking the database to the router
+func handleWith(injectedDB string) func(func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, injectedDB)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package routes
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPIPath serves the OpenAPI 3 description of every endpoint
+const OpenAPIPath = "/api/v1/openapi.json"
+
+// openAPISpec is kept next to the handlers it describes, openapi_test.go checks their
+// responses against it
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,496 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonObject = map[string]interface{}
+
+func loadOpenAPISpec(t *testing.T) jsonObject {
+	var spec jsonObject
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatalf("openapi.json isn't valid JSON: %v", err)
+	}
+	return spec
+}
+
+// resolveRef follows a local "#/components/..." reference, returning nil if it doesn't resolve
+func resolveRef(spec jsonObject, ref string) jsonObject {
+	var node interface{} = spec
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(jsonObject)
+		if !ok {
+			return nil
+		}
+		node = object[part]
+	}
+	object, _ := node.(jsonObject)
+	return object
+}
+
+func deref(spec jsonObject, node jsonObject) jsonObject {
+	for node != nil && node["$ref"] != nil {
+		node = resolveRef(spec, node["$ref"].(string))
+	}
+	return node
+}
+
+// validateSchema checks value against a schema, returning what doesn't match. It covers the
+// part of OpenAPI the spec uses, and is stricter than OpenAPI in one way: properties an
+// object schema doesn't list are errors unless it allows additionalProperties, so fields
+// added to a response can't go undocumented.
+func validateSchema(spec, schema jsonObject, value interface{}, at string) []string {
+	schema = deref(spec, schema)
+	if schema == nil {
+		return []string{at + ": schema doesn't resolve"}
+	}
+	if value == nil {
+		if schema["type"] == nil || schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + ": null isn't allowed"}
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(jsonObject)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %v", at, value)}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required %s", at, name))
+			}
+		}
+		properties, _ := schema["properties"].(jsonObject)
+		for name, property := range object {
+			if propertySchema, ok := properties[name].(jsonObject); ok {
+				problems = append(problems, validateSchema(spec, propertySchema, property, at+"."+name)...)
+			} else if additional, ok := schema["additionalProperties"].(jsonObject); ok {
+				problems = append(problems, validateSchema(spec, additional, property, at+"."+name)...)
+			} else if schema["additionalProperties"] != true {
+				problems = append(problems, fmt.Sprintf("%s: %s isn't in the spec", at, name))
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %v", at, value)}
+		}
+		items, _ := schema["items"].(jsonObject)
+		for i, item := range array {
+			problems = append(problems, validateSchema(spec, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected a string, got %v", at, value)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q isn't a date-time", at, s))
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return []string{fmt.Sprintf("%s: expected an integer, got %v", at, value)}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{fmt.Sprintf("%s: expected a number, got %v", at, value)}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expected a boolean, got %v", at, value)}
+		}
+	}
+
+	if values, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range values {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v isn't one of %v", at, value, values))
+		}
+	}
+	return problems
+}
+
+// apiCheck calls handlers and checks their responses against the operations in the spec
+type apiCheck struct {
+	t          *testing.T
+	spec       jsonObject
+	injectedDB string
+	covered    map[string]bool
+}
+
+// call sends payload to handler as a request for the operation at method and the spec's
+// path template, fails the test if the response isn't documented there, and decodes the
+// body into out if it's given
+func (check *apiCheck) call(handler func(http.ResponseWriter, *http.Request, string), method, template, target string, payload, out interface{}) int {
+	t := check.t
+	t.Helper()
+
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+	req := httptest.NewRequest(method, target, &body)
+	r := httptest.NewRecorder()
+	handler(r, req, check.injectedDB)
+
+	pathItem, _ := check.spec["paths"].(jsonObject)[template].(jsonObject)
+	operation, _ := pathItem[strings.ToLower(method)].(jsonObject)
+	if operation == nil {
+		t.Fatalf("%s %s isn't in the spec", method, template)
+	}
+	check.covered[operation["operationId"].(string)] = true
+
+	response, _ := operation["responses"].(jsonObject)[strconv.Itoa(r.Code)].(jsonObject)
+	response = deref(check.spec, response)
+	if response == nil {
+		t.Fatalf("%s %s answered %d, which isn't in the spec: %s", method, target, r.Code, r.Body.String())
+	}
+
+	// Errors are problem details, everything else is plain JSON
+	content, _ := response["content"].(jsonObject)
+	mediaType := "application/json"
+	if _, ok := content[ProblemContentType]; ok {
+		mediaType = ProblemContentType
+		if r.Header().Get("Content-Type") != ProblemContentType {
+			t.Errorf("%s %s answered %d as %q, not %s", method, target, r.Code, r.Header().Get("Content-Type"), ProblemContentType)
+		}
+	}
+	if media, ok := content[mediaType].(jsonObject); ok {
+		var value interface{}
+		err := json.Unmarshal(r.Body.Bytes(), &value)
+		if err != nil {
+			t.Fatalf("%s %s answered %d with a body that isn't JSON: %q", method, target, r.Code, r.Body.String())
+		}
+		for _, problem := range validateSchema(check.spec, media["schema"].(jsonObject), value, "body") {
+			t.Errorf("%s %s answered %d with %s", method, target, r.Code, problem)
+		}
+	}
+
+	if out != nil {
+		json.Unmarshal(r.Body.Bytes(), out)
+	}
+	return r.Code
+}
+
+// expect is call for when the test depends on the status
+func (check *apiCheck) expect(status int, handler func(http.ResponseWriter, *http.Request, string), method, template, target string, payload, out interface{}) {
+	check.t.Helper()
+	if code := check.call(handler, method, template, target, payload, out); code != status {
+		check.t.Fatalf("Expected %s %s to answer %d, got %d", method, target, status, code)
+	}
+}
+
+func TestOpenAPISpecIsWellFormed(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	if spec["openapi"] != "3.0.3" {
+		t.Errorf("Expected an OpenAPI 3.0.3 document, got %v", spec["openapi"])
+	}
+
+	// Every reference resolves
+	var walk func(node interface{}, at string)
+	walk = func(node interface{}, at string) {
+		switch node := node.(type) {
+		case jsonObject:
+			if ref, ok := node["$ref"].(string); ok && resolveRef(spec, ref) == nil {
+				t.Errorf("%s: %s doesn't resolve", at, ref)
+			}
+			for key, child := range node {
+				walk(child, at+"/"+key)
+			}
+		case []interface{}:
+			for i, child := range node {
+				walk(child, fmt.Sprintf("%s[%d]", at, i))
+			}
+		}
+	}
+	walk(spec, "#")
+
+	// Every path parameter is declared, and operation IDs are unique
+	placeholder := regexp.MustCompile(`\{([^}]+)\}`)
+	operationIDs := make(map[string]string)
+	for path, item := range spec["paths"].(jsonObject) {
+		pathItem := item.(jsonObject)
+		declared := make(map[string]bool)
+		parameters, _ := pathItem["parameters"].([]interface{})
+		for _, parameter := range parameters {
+			parameter := deref(spec, parameter.(jsonObject))
+			if parameter["in"] == "path" {
+				declared[parameter["name"].(string)] = true
+			}
+		}
+		for _, match := range placeholder.FindAllStringSubmatch(path, -1) {
+			if !declared[match[1]] {
+				t.Errorf("%s: path parameter %s isn't declared", path, match[1])
+			}
+		}
+
+		for method, operation := range pathItem {
+			if method == "parameters" {
+				continue
+			}
+			id, _ := operation.(jsonObject)["operationId"].(string)
+			if other, ok := operationIDs[id]; ok || id == "" {
+				t.Errorf("%s %s: operationId %q is missing or already used by %s", method, path, id, other)
+			}
+			operationIDs[id] = method + " " + path
+		}
+	}
+
+	// Every path the handlers match on is described
+	for _, path := range []string{
+		BookPath, BookRevisionsPath, BookRevisionPath, BookRestorePath, BookDiffPath, CollectionPath, CopyPath,
+		FinesPath, PayFinesPath, WaiveFinesPath, InventoryScansPath, InventoryReportPath, InventoryClosePath,
+		TrashRestorePath, BackupRestorePath, WebhookPath, WebhookDeliveriesPath, WebhookDeadLetterPath,
+		WebhookRedeliverPath, OpenAPIPath, GraphQLPath, MetricsPath, HealthzPath, ReadyzPath, VersionPath,
+	} {
+		if spec["paths"].(jsonObject)[path] == nil {
+			t.Errorf("%s isn't in the spec", path)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	r := callHandler(t, OpenAPIHandler, "GET", OpenAPIPath, nil)
+	if r.Code != http.StatusOK || r.Header().Get("Content-Type") != "application/json" || !bytes.Equal(r.Body.Bytes(), openAPISpec) {
+		t.Errorf("Expected the spec as JSON, got %d %s", r.Code, r.Header().Get("Content-Type"))
+	}
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	router := NewServeMux(testDB)
+	MountAdmin(router, testDB)
+	routes := make(map[string]bool)
+	for _, route := range router.Routes() {
+		routes[route] = true
+	}
+
+	for path, item := range loadOpenAPISpec(t)["paths"].(jsonObject) {
+		for method := range item.(jsonObject) {
+			if method == "parameters" {
+				continue
+			}
+			operation := strings.ToUpper(method) + " " + path
+			if !routes[operation] {
+				t.Errorf("%s is in the spec but not routed", operation)
+			}
+			delete(routes, operation)
+		}
+	}
+	for route := range routes {
+		t.Errorf("%s is routed but not in the spec", route)
+	}
+}
+
+// TestHandlersMatchOpenAPISpec walks through the API, checking every response against the
+// spec, and fails if any operation in the spec was left out
+func TestHandlersMatchOpenAPISpec(t *testing.T) {
+	cleanCirculationTables()
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	cleanInventoryTables()
+	cleanFinePolicies()
+	cleanWebhookTables()
+	t.Cleanup(cleanWebhookTables)
+
+	check := &apiCheck{t: t, spec: loadOpenAPISpec(t), injectedDB: testDB, covered: make(map[string]bool)}
+	check.call(OpenAPIHandler, "GET", OpenAPIPath, OpenAPIPath, nil, nil)
+	check.expect(200, MetricsHandler, "GET", MetricsPath, MetricsPath, nil, nil)
+	check.expect(200, HealthzHandler, "GET", HealthzPath, HealthzPath, nil, nil)
+	check.expect(200, ReadyzHandler, "GET", ReadyzPath, ReadyzPath, nil, nil)
+	check.expect(200, VersionHandler, "GET", VersionPath, VersionPath, nil, nil)
+
+	// Books and their revisions
+	var book Response
+	check.expect(200, AddBookHandler, "POST", "/api/v1/books", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Genre: "Science Fiction"}, &book)
+	check.expect(400, AddBookHandler, "POST", "/api/v1/books", "/api/v1/books", Book{Title: "Dune"}, nil)
+	check.expect(200, GetBooksHandler, "GET", "/api/v1/books", "/api/v1/books", nil, nil)
+
+	bookPath := "/api/v1/books/" + book.BookID
+	check.expect(200, GetBookHandler, "GET", BookPath, bookPath, nil, nil)
+	check.expect(404, GetBookHandler, "GET", BookPath, "/api/v1/books/999999", nil, nil)
+	check.expect(200, UpdateBookHandler, "PATCH", BookPath, bookPath, map[string]string{"edition": "2nd"}, nil)
+	check.expect(400, UpdateBookHandler, "PATCH", BookPath, bookPath, map[string]string{"published_date": "someday"}, nil)
+	check.expect(200, GetBookRevisionsHandler, "GET", BookRevisionsPath, bookPath+"/revisions", nil, nil)
+	check.expect(200, GetBookRevisionHandler, "GET", BookRevisionPath, bookPath+"/revisions/1", nil, nil)
+	check.expect(404, GetBookRevisionHandler, "GET", BookRevisionPath, bookPath+"/revisions/99", nil, nil)
+	check.expect(200, BookDiffHandler, "GET", BookDiffPath, bookPath+"/diff?from=1", nil, nil)
+	check.expect(400, BookDiffHandler, "GET", BookDiffPath, bookPath+"/diff", nil, nil)
+	check.expect(200, RestoreBookRevisionHandler, "POST", BookRestorePath, bookPath+"/revisions/1:restore", nil, nil)
+
+	// The documented date range filters
+	var filtered []Book
+	check.expect(200, FilterBooksHandler, "GET", "/api/v1/filter", "/api/v1/filter?from_date=1960-01-01&to_date=1970-12-31", nil, &filtered)
+	if len(filtered) != 1 {
+		t.Errorf("Expected from_date and to_date to find the book, got %v", filtered)
+	}
+	check.expect(200, FilterBooksHandler, "GET", "/api/v1/filter", "/api/v1/filter?from_date=1970-01-01", nil, &filtered)
+	if len(filtered) != 0 {
+		t.Errorf("Expected from_date to leave the book out, got %v", filtered)
+	}
+
+	// Collections
+	var collection CollectionResponse
+	check.expect(200, AddCollectionHandler, "POST", "/api/v1/collections", "/api/v1/collections", CollectionRequest{Name: "Deserts", Description: "Sand"}, &collection)
+	check.expect(400, AddCollectionHandler, "POST", "/api/v1/collections", "/api/v1/collections", CollectionRequest{}, nil)
+	check.expect(200, GetCollectionsHandler, "GET", "/api/v1/collections", "/api/v1/collections", nil, nil)
+	check.expect(200, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": collection.CollectionID, "book_ids": []string{book.BookID}}, nil)
+	check.expect(400, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", "/api/v1/booksToCollection", "not an object", nil)
+	check.expect(200, GetCollectionsHandler, "GET", "/api/v1/collections", "/api/v1/collections", nil, nil)
+
+	// Patrons, copies and loans
+	var patron, otherPatron PatronResponse
+	check.expect(200, AddPatronHandler, "POST", "/api/v1/patrons", "/api/v1/patrons", Patron{Name: "Paul Atreides"}, &patron)
+	check.expect(200, AddPatronHandler, "POST", "/api/v1/patrons", "/api/v1/patrons", Patron{Name: "Chani"}, &otherPatron)
+	check.expect(400, AddPatronHandler, "POST", "/api/v1/patrons", "/api/v1/patrons", Patron{}, nil)
+	check.expect(200, GetPatronsHandler, "GET", "/api/v1/patrons", "/api/v1/patrons", nil, nil)
+
+	newCopy := Copy{BookID: book.BookID, Barcode: "SPEC-1", Branch: "Main", Condition: "good"}
+	check.expect(200, AddCopyHandler, "POST", "/api/v1/copies", "/api/v1/copies", newCopy, nil)
+	check.expect(409, AddCopyHandler, "POST", "/api/v1/copies", "/api/v1/copies", newCopy, nil)
+	check.expect(200, GetCopiesHandler, "GET", "/api/v1/copies", "/api/v1/copies?book_id="+book.BookID, nil, nil)
+	check.expect(200, GetCopyHandler, "GET", CopyPath, "/api/v1/copies/SPEC-1", nil, nil)
+	check.expect(404, GetCopyHandler, "GET", CopyPath, "/api/v1/copies/NOPE", nil, nil)
+	check.expect(200, UpdateCopyHandler, "PATCH", CopyPath, "/api/v1/copies/SPEC-1", map[string]string{"shelf_location": "A1"}, nil)
+
+	var loan LoanResponse
+	check.expect(200, CheckoutHandler, "POST", "/api/v1/loans", "/api/v1/loans", map[string]string{"patron_id": patron.PatronID, "barcode": "SPEC-1"}, &loan)
+	check.expect(200, GetLoansHandler, "GET", "/api/v1/loans", "/api/v1/loans?status=current", nil, nil)
+	check.expect(400, GetLoansHandler, "GET", "/api/v1/loans", "/api/v1/loans?status=overdue", nil, nil)
+	check.expect(200, RenewLoanHandler, "POST", "/api/v1/loans/renew", "/api/v1/loans/renew", map[string]string{"loan_id": loan.LoanID}, nil)
+
+	// Holds, while the only copy is out
+	var hold HoldResponse
+	check.expect(200, PlaceHoldHandler, "POST", "/api/v1/holds", "/api/v1/holds", map[string]string{"patron_id": otherPatron.PatronID, "book_id": book.BookID}, &hold)
+	check.expect(409, PlaceHoldHandler, "POST", "/api/v1/holds", "/api/v1/holds", map[string]string{"patron_id": otherPatron.PatronID, "book_id": book.BookID}, nil)
+	check.expect(200, GetHoldsHandler, "GET", "/api/v1/holds", "/api/v1/holds?book_id="+book.BookID, nil, nil)
+	check.expect(200, ReorderHoldHandler, "POST", "/api/v1/holds/reorder", "/api/v1/holds/reorder", map[string]interface{}{"hold_id": hold.HoldID, "position": 1}, nil)
+	check.expect(200, CancelHoldHandler, "POST", "/api/v1/holds/cancel", "/api/v1/holds/cancel", map[string]string{"hold_id": hold.HoldID}, nil)
+	check.expect(200, ReturnLoanHandler, "POST", "/api/v1/loans/return", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID}, nil)
+	check.expect(409, ReturnLoanHandler, "POST", "/api/v1/loans/return", "/api/v1/loans/return", map[string]string{"loan_id": loan.LoanID}, nil)
+
+	// Fines
+	finesPath := "/api/v1/patrons/" + patron.PatronID + "/fines"
+	check.expect(200, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", "/api/v1/fines/policies", FinePolicy{Genre: "Science Fiction", DailyRateCents: 10, CapCents: 500}, nil)
+	check.expect(400, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", "/api/v1/fines/policies", FinePolicy{DailyRateCents: -1}, nil)
+	check.expect(200, GetFinePoliciesHandler, "GET", "/api/v1/fines/policies", "/api/v1/fines/policies", nil, nil)
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO Fines (patron_id, loan_id, kind, amount_cents, note, created_at) VALUES (?, ?, ?, 300, '', ?);", patron.PatronID, loan.LoanID, FineAssessed, now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check.expect(200, GetFinesHandler, "GET", FinesPath, finesPath, nil, nil)
+	check.expect(404, GetFinesHandler, "GET", FinesPath, "/api/v1/patrons/999999/fines", nil, nil)
+	check.expect(200, PayFinesHandler, "POST", PayFinesPath, finesPath+"/pay", map[string]int{"amount_cents": 100}, nil)
+	check.expect(409, PayFinesHandler, "POST", PayFinesPath, finesPath+"/pay", map[string]int{"amount_cents": 1000}, nil)
+	check.expect(200, WaiveFinesHandler, "POST", WaiveFinesPath, finesPath+"/waive", map[string]interface{}{"loan_id": loan.LoanID, "amount_cents": 200}, nil)
+
+	// Stocktake
+	var session InventoryResponse
+	check.expect(200, StartInventoryHandler, "POST", "/api/v1/inventory/sessions", "/api/v1/inventory/sessions", InventorySession{Branch: "Main"}, &session)
+	check.expect(400, StartInventoryHandler, "POST", "/api/v1/inventory/sessions", "/api/v1/inventory/sessions", InventorySession{}, nil)
+	check.expect(200, GetInventorySessionsHandler, "GET", "/api/v1/inventory/sessions", "/api/v1/inventory/sessions", nil, nil)
+	sessionPath := "/api/v1/inventory/sessions/" + session.SessionID
+	scans := map[string]interface{}{"shelf_location": "B2", "barcodes": []string{"SPEC-1", "UNKNOWN-1"}}
+	check.expect(200, SubmitInventoryScansHandler, "POST", InventoryScansPath, sessionPath+"/scans", scans, nil)
+	check.expect(200, InventoryReportHandler, "GET", InventoryReportPath, sessionPath+"/report", nil, nil)
+	check.expect(200, CloseInventoryHandler, "POST", InventoryClosePath, sessionPath+"/close", nil, nil)
+	check.expect(409, SubmitInventoryScansHandler, "POST", InventoryScansPath, sessionPath+"/scans", scans, nil)
+
+	// Trash, once the copy is written off
+	check.expect(409, DeleteBookHandler, "DELETE", BookPath, bookPath, nil, nil)
+	check.expect(200, UpdateCopyHandler, "PATCH", CopyPath, "/api/v1/copies/SPEC-1", map[string]string{"status": CopyLost}, nil)
+	check.expect(200, DeleteBookHandler, "DELETE", BookPath, bookPath, nil, nil)
+	check.expect(200, DeleteCollectionHandler, "DELETE", CollectionPath, "/api/v1/collections/"+collection.CollectionID, nil, nil)
+	check.expect(404, DeleteCollectionHandler, "DELETE", CollectionPath, "/api/v1/collections/"+collection.CollectionID, nil, nil)
+	check.expect(200, GetTrashHandler, "GET", "/api/v1/trash", "/api/v1/trash", nil, nil)
+	check.expect(200, GetBooksHandler, "GET", "/api/v1/books", "/api/v1/books?include_deleted=true", nil, nil)
+	check.expect(200, RestoreTrashHandler, "POST", TrashRestorePath, "/api/v1/trash/books/"+book.BookID+":restore", nil, nil)
+	check.expect(404, RestoreTrashHandler, "POST", TrashRestorePath, "/api/v1/trash/books/"+book.BookID+":restore", nil, nil)
+
+	// Audit log and change feed
+	check.expect(200, GetAuditLogHandler, "GET", "/api/v1/audit", "/api/v1/audit?entity=book&entity_id="+book.BookID, nil, nil)
+	check.expect(400, GetAuditLogHandler, "GET", "/api/v1/audit", "/api/v1/audit?limit=0", nil, nil)
+	check.expect(400, StreamEventsHandler, "GET", "/api/v1/events", "/api/v1/events?last_event_id=yesterday", nil, nil)
+
+	// Webhooks
+	var webhook WebhookResponse
+	check.expect(200, AddWebhookHandler, "POST", "/api/v1/webhooks", "/api/v1/webhooks", WebhookSubscription{URL: "https://example.com/hook", EventTypes: []string{EventBookUpdated}}, &webhook)
+	check.expect(400, AddWebhookHandler, "POST", "/api/v1/webhooks", "/api/v1/webhooks", WebhookSubscription{URL: "example.com"}, nil)
+	check.expect(200, GetWebhooksHandler, "GET", "/api/v1/webhooks", "/api/v1/webhooks", nil, nil)
+	webhookPath := "/api/v1/webhooks/" + webhook.SubscriptionID
+	check.expect(200, GetWebhookHandler, "GET", WebhookPath, webhookPath, nil, nil)
+	check.expect(200, UpdateBookHandler, "PATCH", BookPath, bookPath, map[string]string{"genre": "Fiction"}, nil)
+	check.expect(200, UpdateWebhookHandler, "PATCH", WebhookPath, webhookPath, map[string]bool{"active": false}, nil)
+	check.expect(200, GetWebhookDeliveriesHandler, "GET", WebhookDeliveriesPath, webhookPath+"/deliveries", nil, nil)
+	check.expect(400, GetWebhookDeliveriesHandler, "GET", WebhookDeliveriesPath, webhookPath+"/deliveries?status=lost", nil, nil)
+	check.expect(200, GetDeadLettersHandler, "GET", WebhookDeadLetterPath, WebhookDeadLetterPath, nil, nil)
+	check.expect(404, RedeliverWebhookHandler, "POST", WebhookRedeliverPath, "/api/v1/webhooks/deliveries/999999:redeliver", nil, nil)
+	check.expect(200, DeleteWebhookHandler, "DELETE", WebhookPath, webhookPath, nil, nil)
+	check.expect(404, GetWebhookHandler, "GET", WebhookPath, webhookPath, nil, nil)
+
+	// GraphQL
+	check.expect(200, GraphQLHandler, "POST", GraphQLPath, GraphQLPath, graphqlRequest{Query: "{ book(id: \"" + book.BookID + "\") { title author { name } availability { totalCopies } } }"}, nil)
+	check.expect(400, GraphQLHandler, "POST", GraphQLPath, GraphQLPath, graphqlRequest{Query: "{ books { isbn } }"}, nil)
+
+	// Backups, on a database of their own so nothing is written next to the test database
+	backups := &apiCheck{t: t, spec: check.spec, injectedDB: filepath.Join(t.TempDir(), "library.db"), covered: check.covered}
+	err = MigrateDatabase(backups.injectedDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backup Backup
+	backups.expect(200, CreateBackupHandler, "POST", "/api/v1/admin/backups", "/api/v1/admin/backups", nil, &backup)
+	backups.expect(200, GetBackupsHandler, "GET", "/api/v1/admin/backups", "/api/v1/admin/backups", nil, nil)
+	time.Sleep(2 * time.Millisecond)
+	backups.expect(200, RestoreBackupHandler, "POST", BackupRestorePath, "/api/v1/admin/backups/"+backup.Name+":restore", nil, nil)
+	backups.expect(404, RestoreBackupHandler, "POST", BackupRestorePath, "/api/v1/admin/backups/missing.db:restore", nil, nil)
+
+	// A database that hasn't been migrated isn't ready
+	unmigrated := &apiCheck{t: t, spec: check.spec, injectedDB: filepath.Join(t.TempDir(), "new.db"), covered: check.covered}
+	unmigrated.expect(503, ReadyzHandler, "GET", ReadyzPath, ReadyzPath, nil, nil)
+
+	var missed []string
+	for _, item := range check.spec["paths"].(jsonObject) {
+		for method, operation := range item.(jsonObject) {
+			if method == "parameters" {
+				continue
+			}
+			if id := operation.(jsonObject)["operationId"].(string); !check.covered[id] {
+				missed = append(missed, id)
+			}
+		}
+	}
+	sort.Strings(missed)
+	if len(missed) > 0 {
+		t.Errorf("Expected every operation in the spec to be checked, missed %v", missed)
+	}
+}
@@ -0,0 +1,38 @@
+package routes
+
+import "strings"
+
+// MatchPath checks a request path against a pattern like "/api/v1/patrons/{id}/fines" and
+// returns the values of the {placeholders}. Placeholders match exactly one non-empty segment,
+// less any literal suffix that follows them in the pattern, like the ":restore" of "{rev}:restore".
+func MatchPath(path, pattern string) (map[string]string, bool) {
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(pathSegments) != len(patternSegments) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, segment := range patternSegments {
+		end := strings.Index(segment, "}")
+		if strings.HasPrefix(segment, "{") && end > 0 {
+			suffix := segment[end+1:]
+			value := strings.TrimSuffix(pathSegments[i], suffix)
+			if value == "" || !strings.HasSuffix(pathSegments[i], suffix) {
+				return nil, false
+			}
+			params[segment[1:end]] = value
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// pathParam returns a single placeholder value from the request path, or "" if the path
+// doesn't match the pattern
+func pathParam(path, pattern, name string) string {
+	params, _ := MatchPath(path, pattern)
+	return params[name]
+}
@@ -0,0 +1,33 @@
+package routes
+
+import "testing"
+
+func TestMatchPath(t *testing.T) {
+	cases := []struct {
+		path     string
+		pattern  string
+		expected map[string]string
+	}{
+		{"/api/v1/patrons/7/fines", FinesPath, map[string]string{"id": "7"}},
+		{"/api/v1/patrons/7/fines/", FinesPath, map[string]string{"id": "7"}},
+		{"/api/v1/patrons/7/fines/pay", FinesPath, nil},
+		{"/api/v1/patrons//fines", FinesPath, nil},
+		{"/api/v1/books", "/api/v1/books", map[string]string{}},
+		{"/api/v1/books/3/revisions/2:restore", BookRestorePath, map[string]string{"id": "3", "rev": "2"}},
+		{"/api/v1/books/3/revisions/2", BookRestorePath, nil},
+		{"/api/v1/books/3/revisions/:restore", BookRestorePath, nil},
+	}
+
+	for _, c := range cases {
+		params, ok := MatchPath(c.path, c.pattern)
+		if ok != (c.expected != nil) {
+			t.Errorf("%s against %s: expected match %v, got %v", c.path, c.pattern, c.expected != nil, ok)
+			continue
+		}
+		for name, value := range c.expected {
+			if params[name] != value {
+				t.Errorf("%s against %s: expected %s=%s, got %s", c.path, c.pattern, name, value, params[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type Patron struct {
+	PatronID  string    `json:"patron_id,omitempty"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+type PatronResponse struct {
+	PatronID string `json:"patron_id,omitempty"`
+	Status   string `json:"status"`
+	Code     int    `json:"code"`
+}
+
+func AddPatronHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	// Parse request body
+	var patron Patron
+	err = json.NewDecoder(r.Body).Decode(&patron)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if patron.Name == "" {
+		writeValidationProblem(w, r, "Patrons must have at least a name.", requiredFields("name", patron.Name)...)
+		return
+	}
+
+	insertPatronQuery := `INSERT INTO Patrons (name, email, created_at) VALUES (?, ?, ?);`
+	result, err := db.Exec(insertPatronQuery, patron.Name, patron.Email, now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	patronID, _ := result.LastInsertId()
+
+	response := PatronResponse{
+		PatronID: strconv.FormatInt(patronID, 10),
+		Status:   "success",
+		Code:     http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetPatronsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT patron_id, name, email, created_at FROM Patrons")
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	patrons := make([]Patron, 0)
+	for rows.Next() {
+		var patron Patron
+		err := rows.Scan(&patron.PatronID, &patron.Name, &patron.Email, &patron.CreatedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		patrons = append(patrons, patron)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(patrons)
+}
@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddPatronHandlerSuccess(t *testing.T) {
+	patron := Patron{
+		Name:  "Arthur Dent",
+		Email: "arthur@example.com",
+	}
+	payload, _ := json.Marshal(patron)
+
+	req, err := http.NewRequest("POST", "/api/v1/patrons", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+
+	AddPatronHandler(r, req, testDB)
+
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var response PatronResponse
+	err = json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Status != "success" {
+		t.Errorf("Expected status %s, got %s", "success", response.Status)
+	}
+
+	if response.PatronID == "" {
+		t.Error("Expected a patron_id in the response")
+	}
+}
+
+func TestAddPatronHandlerFail(t *testing.T) {
+	payload, _ := json.Marshal(Patron{Email: "nobody@example.com"})
+
+	req, err := http.NewRequest("POST", "/api/v1/patrons", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+
+	AddPatronHandler(r, req, testDB)
+
+	if r.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, r.Code)
+	}
+
+	var response Problem
+	err = json.Unmarshal(r.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedMessage := "Patrons must have at least a name."
+	if response.Detail != expectedMessage {
+		t.Errorf("Expected detail %s, got %s", expectedMessage, response.Detail)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Field != "name" {
+		t.Errorf("Expected the name field to be named, got %+v", response.Errors)
+	}
+}
+
+func TestGetPatronsHandler(t *testing.T) {
+	cleanCirculationTables()
+	insertPatron(Patron{Name: "Arthur Dent"})
+	insertPatron(Patron{Name: "Ford Prefect"})
+
+	req, err := http.NewRequest("GET", "/api/v1/patrons", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRecorder()
+
+	GetPatronsHandler(r, req, testDB)
+
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var patrons []Patron
+	err = json.Unmarshal(r.Body.Bytes(), &patrons)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patrons) != 2 {
+		t.Errorf("Expected %d patrons, got %d", 2, len(patrons))
+	}
+}
+
+func insertPatron(patron Patron) (int64, error) {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec("INSERT INTO Patrons (name, email, created_at) VALUES (?, ?, ?)", patron.Name, patron.Email, now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// cleanCirculationTables empties every table that tracks who has which copy
+func cleanCirculationTables() error {
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM Fines; DELETE FROM Holds; DELETE FROM Loans; DELETE FROM Copies; DELETE FROM Patrons;")
+	return err
+}
@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ProblemContentType is the media type every error answer is sent with, see RFC 7807
+const ProblemContentType = "application/problem+json"
+
+// RequestIDHeader carries the ID of a request. A caller can send one, otherwise it's made up,
+// and either way it's echoed back and put in the problem, so a failure can be found in the logs.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID taken from a caller, a longer one is replaced
+const maxRequestIDLength = 128
+
+// Problem is the body of every answer other than a 2xx, an RFC 7807 problem detail. Code is the
+// stable, machine readable reason, clients should switch on it rather than on Detail, which is
+// for people and may be reworded. Errors lists the fields of a request that failed validation.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	// Extensions are more members of the problem, like the copy_id of the copy that already has
+	// a barcode. They're written next to the standard members.
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// FieldError is a field of a request that failed validation, Field is its JSON name
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Codes of the problems the API answers with. They're part of the API, once published a code
+// keeps its meaning.
+const (
+	CodeMalformedRequest    = "malformed_request"
+	CodeRequestTooLarge     = "request_too_large"
+	CodeInvalidParameter    = "invalid_parameter"
+	CodeValidationFailed    = "validation_failed"
+	CodeRouteNotFound       = "route_not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeUnauthorized        = "unauthorized"
+	CodeInternal            = "internal_error"
+	CodeBookNotFound        = "book_not_found"
+	CodeRevisionNotFound    = "revision_not_found"
+	CodeCollectionNotFound  = "collection_not_found"
+	CodeCopyNotFound        = "copy_not_found"
+	CodePatronNotFound      = "patron_not_found"
+	CodeHoldNotFound        = "hold_not_found"
+	CodeLoanNotFound        = "loan_not_found"
+	CodeSessionNotFound     = "inventory_session_not_found"
+	CodeWebhookNotFound     = "webhook_not_found"
+	CodeDeliveryNotFound    = "delivery_not_found"
+	CodeBackupNotFound      = "backup_not_found"
+	CodeNotInTrash          = "not_in_trash"
+	CodeBookInUse           = "book_in_use"
+	CodeBarcodeTaken        = "barcode_taken"
+	CodeCopyInCirculation   = "copy_in_circulation"
+	CodeCopyChanged         = "copy_changed"
+	CodeNoCopyAvailable     = "no_copy_available"
+	CodeLoanReturned        = "loan_returned"
+	CodeRenewalLimit        = "renewal_limit_reached"
+	CodeRenewalBlocked      = "renewal_blocked"
+	CodeHoldExists          = "hold_exists"
+	CodeHoldInactive        = "hold_inactive"
+	CodeHoldNotWaiting      = "hold_not_waiting"
+	CodeNothingOwed         = "nothing_owed"
+	CodeOverpayment         = "overpayment"
+	CodeSessionClosed       = "inventory_session_closed"
+	CodeDeliveryQueued      = "delivery_queued"
+	CodeBackupTooNew        = "backup_too_new"
+	CodeDatabaseUnavailable = "database_unavailable"
+	CodeSchemaOutdated      = "schema_outdated"
+	CodeRateLimited         = "rate_limited"
+	CodeQuotaExceeded       = "quota_exceeded"
+)
+
+// MarshalJSON writes the Extensions next to the standard members
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type problem Problem
+	body, err := json.Marshal(problem(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return body, err
+	}
+
+	members := make(map[string]interface{}, len(p.Extensions))
+	for name, value := range p.Extensions {
+		members[name] = value
+	}
+	var standard map[string]interface{}
+	err = json.Unmarshal(body, &standard)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range standard {
+		members[name] = value
+	}
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON reads the members it doesn't know into Extensions
+func (p *Problem) UnmarshalJSON(data []byte) error {
+	type problem Problem
+	err := json.Unmarshal(data, (*problem)(p))
+	if err != nil {
+		return err
+	}
+
+	var members map[string]interface{}
+	err = json.Unmarshal(data, &members)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"type", "title", "status", "detail", "instance", "code", "request_id", "errors"} {
+		delete(members, name)
+	}
+	p.Extensions = nil
+	if len(members) > 0 {
+		p.Extensions = members
+	}
+	return nil
+}
+
+// newProblem is the problem for an answer of status to r, the title is the status text
+func newProblem(r *http.Request, status int, code, detail string) *Problem {
+	if entry := accessLogFrom(r); entry != nil {
+		entry.code = code
+	}
+	return &Problem{
+		Type:      "/problems/" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: requestID(r),
+	}
+}
+
+// write sends the problem, with the request ID in the header too
+func (p *Problem) write(w http.ResponseWriter) {
+	if p.RequestID != "" {
+		w.Header().Set(RequestIDHeader, p.RequestID)
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeProblem answers r with a problem
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	newProblem(r, status, code, detail).write(w)
+}
+
+// writeBodyError answers r when its body couldn't be decoded, with a 413 if it's over the
+// LimitBody limit and a 400 otherwise
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge, fmt.Sprintf("Request body is over the limit of %d bytes", tooLarge.Limit))
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, CodeMalformedRequest, "Request body isn't valid JSON")
+}
+
+// writeValidationProblem answers r with a 400 listing the fields that failed validation
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, detail string, errs ...FieldError) {
+	problem := newProblem(r, http.StatusBadRequest, CodeValidationFailed, detail)
+	problem.Errors = errs
+	problem.write(w)
+}
+
+// writeServerError logs err with the request ID and answers r with a 500. What went wrong stays
+// in the log, the answer only says that something did.
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	logger(r).Error("request failed", "error", err)
+	writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "")
+}
+
+// requestID is the ID of r, the caller's if it sent a usable one. One that's made up is set on
+// r, so every problem written for the request has the same one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if validRequestID(id) {
+		return id
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id = hex.EncodeToString(b)
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Set(RequestIDHeader, id)
+	return id
+}
+
+// validRequestID checks a caller's request ID is printable ASCII and not too long, it's
+// written to the logs and headers as is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// notFound answers a request for a path the API doesn't have
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, CodeRouteNotFound, "No endpoint at "+r.URL.Path)
+}
+
+// methodNotAllowed answers a request with a method its endpoint doesn't take
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" isn't allowed on "+r.URL.Path)
+}
+
+// requiredFields is a FieldError for each of the named values that's empty, it's given pairs of
+// a field's JSON name and its value
+func requiredFields(namesAndValues ...string) []FieldError {
+	var errs []FieldError
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		if namesAndValues[i+1] == "" {
+			errs = append(errs, FieldError{Field: namesAndValues[i], Message: "is required"})
+		}
+	}
+	return errs
+}
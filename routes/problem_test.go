@@ -0,0 +1,112 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodeProblem checks r is a problem with status and code and returns it
+func decodeProblem(t *testing.T, r *httptest.ResponseRecorder, status int, code string) Problem {
+	t.Helper()
+	if r.Code != status || r.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Expected a %d problem, got %d %s: %s", status, r.Code, r.Header().Get("Content-Type"), r.Body.String())
+	}
+	var problem Problem
+	err := json.Unmarshal(r.Body.Bytes(), &problem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problem.Status != status || problem.Code != code || problem.Type != "/problems/"+code || problem.Title != http.StatusText(status) {
+		t.Errorf("Expected a %d %s problem, got %+v", status, code, problem)
+	}
+	return problem
+}
+
+func TestProblemRequestID(t *testing.T) {
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", "not a book")
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeMalformedRequest)
+	if problem.Instance != "/api/v1/books" || problem.RequestID == "" || r.Header().Get(RequestIDHeader) != problem.RequestID {
+		t.Errorf("Expected the path and a made up request ID, got %+v with header %q", problem, r.Header().Get(RequestIDHeader))
+	}
+
+	// A caller's ID is kept, unless it isn't fit for a header or log line
+	for sent, kept := range map[string]bool{"req-42": true, "two words": false, strings.Repeat("x", maxRequestIDLength+1): false} {
+		req := httptest.NewRequest("GET", "/api/v1/books/999999", nil)
+		req.Header.Set(RequestIDHeader, sent)
+		r := httptest.NewRecorder()
+		GetBookHandler(r, req, testDB)
+
+		problem := decodeProblem(t, r, http.StatusNotFound, CodeBookNotFound)
+		if (problem.RequestID == sent) != kept || r.Header().Get(RequestIDHeader) != problem.RequestID {
+			t.Errorf("Expected request ID %q to be kept: %v, got %q", sent, kept, problem.RequestID)
+		}
+	}
+}
+
+func TestProblemFieldErrors(t *testing.T) {
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Author: "Jane Austen", PublishedDate: "1815"})
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "title", Message: "is required"}) {
+		t.Errorf("Expected the title to be missing, got %+v", problem.Errors)
+	}
+
+	r = callHandler(t, ReorderHoldHandler, "POST", "/api/v1/holds/reorder", map[string]interface{}{"position": 0})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 2 || problem.Errors[0].Field != "hold_id" || problem.Errors[1].Field != "position" {
+		t.Errorf("Expected hold_id and position to be named, got %+v", problem.Errors)
+	}
+}
+
+func TestProblemExtensions(t *testing.T) {
+	cleanInventoryTables()
+	cleanBooksTable()
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	var book Response
+	json.Unmarshal(r.Body.Bytes(), &book)
+	callHandler(t, AddCopyHandler, "POST", "/api/v1/copies", Copy{BookID: book.BookID, Barcode: "P-1"})
+
+	// The copy that already has the barcode is named next to the standard members
+	r = callHandler(t, AddCopyHandler, "POST", "/api/v1/copies", Copy{BookID: book.BookID, Barcode: "P-1"})
+	problem := decodeProblem(t, r, http.StatusConflict, CodeBarcodeTaken)
+	var members map[string]interface{}
+	json.Unmarshal(r.Body.Bytes(), &members)
+	if problem.Extensions["copy_id"] == nil || members["copy_id"] != problem.Extensions["copy_id"] || members["code"] != CodeBarcodeTaken {
+		t.Errorf("Expected copy_id as a member of the problem, got %s", r.Body.String())
+	}
+}
+
+func TestServerErrorsDontLeak(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	// A directory can't be opened as a database
+	req := httptest.NewRequest("GET", "/api/v1/books", nil)
+	r := httptest.NewRecorder()
+	GetBooksHandler(r, req, t.TempDir())
+
+	problem := decodeProblem(t, r, http.StatusInternalServerError, CodeInternal)
+	if problem.Detail != "" || strings.Contains(r.Body.String(), "database") {
+		t.Errorf("Expected nothing about the failure in the answer, got %s", r.Body.String())
+	}
+	if !strings.Contains(logged.String(), problem.RequestID) || !strings.Contains(logged.String(), "database") {
+		t.Errorf("Expected the failure to be logged with the request ID, got %q", logged.String())
+	}
+}
+
+func TestServeMuxProblems(t *testing.T) {
+	mux := NewServeMux(testDB)
+
+	r := httptest.NewRecorder()
+	mux.ServeHTTP(r, httptest.NewRequest("GET", "/api/v1/nothing", nil))
+	decodeProblem(t, r, http.StatusNotFound, CodeRouteNotFound)
+
+	r = httptest.NewRecorder()
+	mux.ServeHTTP(r, httptest.NewRequest("PUT", "/api/v1/books", nil))
+	decodeProblem(t, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+}
@@ -0,0 +1,331 @@
+package routes
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimit lets a client make Rate requests a second on average, in bursts of up to Burst.
+// It's a token bucket: a client starts with Burst tokens, each request takes one, and they're
+// refilled at Rate a second. A Rate of 0 doesn't limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Quota is how many requests a client can make in a Period, counted from its first one. A
+// Requests of 0 doesn't limit.
+type Quota struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimits are the limits a RateLimiter holds each client to. Reads are GET requests and
+// writes the rest, and Routes has the limits of single routes, keyed like "GET /api/v1/books",
+// which replace those. A route with a limit of its own has a bucket of its own, the others
+// share the read or the write bucket. Every request, whatever its route, counts towards the
+// client's Quota.
+type RateLimits struct {
+	Read, Write RateLimit
+	Routes      map[string]RateLimit
+	Quota       Quota
+	// Tokens are the API tokens, see RequireToken. A client with one of them is told apart by
+	// its token, any other by the IP address it connects from, so a client guessing tokens is
+	// limited like one without.
+	Tokens map[string]string
+	// TokenQuotas are the Quota.Requests of clients with the tokens in them, in place of
+	// Quota's
+	TokenQuotas map[string]int
+}
+
+// rateLimitSweep is how often buckets that have filled up again, and quotas whose period is
+// over, are forgotten, so a client that went away doesn't take memory for good
+const rateLimitSweep = time.Minute
+
+// RateLimiter turns away clients making requests faster than their RateLimits allow, over
+// HTTP and gRPC alike. A client has the same buckets and quota on both, a gRPC method counting
+// as the HTTP route it stands for, so it can't get around a limit by switching.
+type RateLimiter struct {
+	limits RateLimits
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[bucketKey]*bucket
+	quotas  map[string]*quotaWindow
+	swept   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter holding clients to limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[bucketKey]*bucket),
+		quotas:  make(map[string]*quotaWindow),
+	}
+}
+
+// bucketKey is a client's bucket for a route with a limit of its own, or for "read" or "write"
+type bucketKey struct {
+	client string
+	route  string
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	at     time.Time
+}
+
+// quotaWindow is the requests a client has made in the period that ends at ends
+type quotaWindow struct {
+	used int
+	ends time.Time
+}
+
+// verdict is what the limiter made of a request. Limit is the rate it was held to, and
+// Remaining the whole requests left in its bucket. Wait is how long until it could be made,
+// 0 if it could be now, and Quota says whether it's the quota that was used up.
+type verdict struct {
+	limit     RateLimit
+	remaining int
+	wait      time.Duration
+	quota     bool
+}
+
+// rateLimitedClient is who sent a request Limit let through, and to which limiter, so a
+// handler doing the work of other routes, like GraphQL, can be charged for each with takeRoute
+type rateLimitedClient struct {
+	limiter       *RateLimiter
+	authorization string
+	addr          string
+}
+
+type rateLimitContextKey struct{}
+
+// Limit answers 429 to a client that's used up its limit, with a Retry-After header saying in
+// how many seconds it can try again. Every answer it lets through has the client's limit, the
+// requests it has left, and the seconds until it has them all back, in RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers. It's middleware for a group, it needs the
+// route a request matched, and it goes before RequireToken.
+func (limiter *RateLimiter) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := limiter.take(r.Header.Get("Authorization"), r.RemoteAddr, r.Method+" "+matchedRoute(r))
+		header := w.Header()
+		for name, value := range v.headers() {
+			header.Set(name, value)
+		}
+		if v.wait > 0 {
+			writeProblem(w, r, http.StatusTooManyRequests, v.code(), v.detail())
+			return
+		}
+		client := rateLimitedClient{limiter: limiter, authorization: r.Header.Get("Authorization"), addr: r.RemoteAddr}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitContextKey{}, client)))
+	})
+}
+
+// takeRoute takes a request to route from the client of a request Limit let through with ctx,
+// as if it had been made too. Over the limit it returns a *handlerError with the problem Limit
+// would have answered with. Without a limiter it takes nothing.
+func takeRoute(ctx context.Context, route string) error {
+	client, ok := ctx.Value(rateLimitContextKey{}).(rateLimitedClient)
+	if !ok {
+		return nil
+	}
+	v := client.limiter.take(client.authorization, client.addr, route)
+	if v.wait > 0 {
+		problem := Problem{Status: http.StatusTooManyRequests, Code: v.code(), Detail: v.detail()}
+		return &handlerError{status: problem.Status, message: problem.Detail, problem: problem}
+	}
+	return nil
+}
+
+// GRPCOptions has the limiter hold gRPC calls to the limits of the HTTP routes their methods
+// stand for. A call over its limit fails with ResourceExhausted, and the headers Limit sets
+// are sent as metadata. They go before RequireGRPCToken.
+func (limiter *RateLimiter) GRPCOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			err := limiter.takeCall(ctx, info.FullMethod, func(md metadata.MD) error { return grpc.SetHeader(ctx, md) })
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			err := limiter.takeCall(stream.Context(), info.FullMethod, stream.SetHeader)
+			if err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+// takeCall takes a request for the gRPC call to method, setting its headers with setHeader
+func (limiter *RateLimiter) takeCall(ctx context.Context, method string, setHeader func(metadata.MD) error) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	addr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	v := limiter.take(metadataCarrier(md).Get(grpcAuthorizationKey), addr, grpcRoutes[method])
+	if headers := v.headers(); len(headers) > 0 {
+		setHeader(metadata.New(headers))
+	}
+	if v.wait > 0 {
+		return status.Error(codes.ResourceExhausted, v.detail())
+	}
+	return nil
+}
+
+// take decides on a request to route, like "GET /api/v1/books", from the client with the
+// authorization header or metadata that connected from addr
+func (limiter *RateLimiter) take(authorization, addr, route string) verdict {
+	client, quota := limiter.clientOf(authorization, addr)
+	key := bucketKey{client: client, route: "write"}
+	limit := limiter.limits.Write
+	if routeLimit, ok := limiter.limits.Routes[route]; ok {
+		key.route, limit = route, routeLimit
+	} else if strings.HasPrefix(route, http.MethodGet+" ") {
+		key.route, limit = "read", limiter.limits.Read
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.now()
+	limiter.sweep(now)
+
+	// Neither the bucket nor the quota is taken from unless both allow the request
+	v := verdict{limit: limit}
+	var b *bucket
+	if limit.Rate > 0 {
+		b = limiter.buckets[key]
+		if b == nil {
+			b = &bucket{limit: limit, tokens: float64(limit.Burst), at: now}
+			limiter.buckets[key] = b
+		}
+		b.refill(now)
+		v.remaining = int(b.tokens)
+		if b.tokens < 1 {
+			v.wait = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+			return v
+		}
+	}
+	var window *quotaWindow
+	if quota.Requests > 0 {
+		window = limiter.quotas[client]
+		if window == nil || !now.Before(window.ends) {
+			window = &quotaWindow{ends: now.Add(quota.Period)}
+			limiter.quotas[client] = window
+		}
+		if window.used >= quota.Requests {
+			v.wait, v.quota = window.ends.Sub(now), true
+			return v
+		}
+	}
+
+	if b != nil {
+		b.tokens--
+		v.remaining = int(b.tokens)
+	}
+	if window != nil {
+		window.used++
+	}
+	return v
+}
+
+// clientOf tells who sent a request, by its bearer token if it's one of the API tokens,
+// otherwise by the IP address it connected from, and returns the client's quota.
+// X-Forwarded-For isn't trusted, a client could set it to anything.
+func (limiter *RateLimiter) clientOf(authorization, addr string) (string, Quota) {
+	quota := limiter.limits.Quota
+	if _, ok := tokenActor(limiter.limits.Tokens, authorization); ok {
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if requests, ok := limiter.limits.TokenQuotas[token]; ok {
+			quota.Requests = requests
+		}
+		return "token " + token, quota
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return "ip " + host, quota
+}
+
+// sweep forgets the buckets that are full and the quotas whose period is over, a client's
+// next request starts new ones
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.swept) < rateLimitSweep {
+		return
+	}
+	limiter.swept = now
+	for key, b := range limiter.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+	for client, window := range limiter.quotas {
+		if !now.Before(window.ends) {
+			delete(limiter.quotas, client)
+		}
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.at).Seconds()*b.limit.Rate)
+	b.at = now
+}
+
+// headers are the RateLimit headers of the verdict, and Retry-After if the request was turned
+// away. There are no RateLimit headers for a route whose rate isn't limited.
+func (v verdict) headers() map[string]string {
+	headers := make(map[string]string)
+	if v.limit.Rate > 0 {
+		headers["RateLimit-Limit"] = strconv.Itoa(v.limit.Burst)
+		headers["RateLimit-Remaining"] = strconv.Itoa(v.remaining)
+		headers["RateLimit-Reset"] = strconv.Itoa(seconds(float64(v.limit.Burst-v.remaining) / v.limit.Rate))
+	}
+	if v.wait > 0 {
+		headers["Retry-After"] = strconv.Itoa(seconds(v.wait.Seconds()))
+	}
+	return headers
+}
+
+func (v verdict) code() string {
+	if v.quota {
+		return CodeQuotaExceeded
+	}
+	return CodeRateLimited
+}
+
+func (v verdict) detail() string {
+	if v.quota {
+		return "Request quota used up, try again in " + strconv.Itoa(seconds(v.wait.Seconds())) + "s"
+	}
+	return "Too many requests, try again in " + strconv.Itoa(seconds(v.wait.Seconds())) + "s"
+}
+
+// seconds rounds a wait up to whole seconds, as Retry-After and RateLimit-Reset take
+func seconds(wait float64) int {
+	return int(math.Ceil(wait))
+}
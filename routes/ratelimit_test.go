@@ -0,0 +1,238 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bookManagement/librarypb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// limitedRouter serves a few routes behind a rate limiter whose clock is *now, and a token
+// check after it
+func limitedRouter(limits RateLimits, now *time.Time) (*Router, *RateLimiter) {
+	limiter := NewRateLimiter(limits)
+	limiter.now = func() time.Time { return *now }
+	router := NewRouter()
+	api := router.Group("/api", limiter.Limit)
+	if limits.Tokens != nil {
+		api.Use(RequireToken(limits.Tokens))
+	}
+	api.Get("/books", named("books"))
+	api.Get("/books/{id}", named("book"))
+	api.Post("/books", named("added"))
+	router.Get("/healthz", named("ok"))
+	return router, limiter
+}
+
+// request sends a request from the client at addr, with a bearer token if there is one
+func request(router *Router, method, target, addr, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = addr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+	return r
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	router, _ := limitedRouter(RateLimits{
+		Read:   RateLimit{Rate: 1, Burst: 2},
+		Write:  RateLimit{Rate: 0.5, Burst: 1},
+		Routes: map[string]RateLimit{"GET /api/books": {Rate: 0.1, Burst: 1}},
+	}, &now)
+
+	for i, remaining := range []string{"1", "0"} {
+		r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "")
+		if r.Code != http.StatusOK || r.Header().Get("RateLimit-Limit") != "2" || r.Header().Get("RateLimit-Remaining") != remaining {
+			t.Fatalf("Expected read %d to be let through with %s left, got %d %v", i+1, remaining, r.Code, r.Header())
+		}
+	}
+	r := request(router, "GET", "/api/books/1", "192.0.2.1:5000", "")
+	decodeProblem(t, r, http.StatusTooManyRequests, CodeRateLimited)
+	if r.Header().Get("Retry-After") != "1" || r.Header().Get("RateLimit-Remaining") != "0" || r.Header().Get("RateLimit-Reset") != "2" {
+		t.Errorf("Expected to be told to retry in a second, got %v", r.Header())
+	}
+
+	// Writes, a route with a limit of its own, other clients and paths outside the group all
+	// have buckets of their own
+	for _, req := range []struct{ method, target, addr string }{
+		{"POST", "/api/books", "192.0.2.1:4000"},
+		{"GET", "/api/books", "192.0.2.1:4000"},
+		{"GET", "/api/books/1", "198.51.100.7:4000"},
+		{"GET", "/healthz", "192.0.2.1:4000"},
+	} {
+		if r := request(router, req.method, req.target, req.addr, ""); r.Code != http.StatusOK {
+			t.Errorf("Expected %s %s from %s to be let through, got %d", req.method, req.target, req.addr, r.Code)
+		}
+	}
+	if r := request(router, "GET", "/api/books", "192.0.2.1:4000", ""); r.Code != http.StatusTooManyRequests || r.Header().Get("Retry-After") != "10" {
+		t.Errorf("Expected the route's own limit, got %d %v", r.Code, r.Header())
+	}
+
+	// A token is refilled every second
+	now = now.Add(time.Second)
+	if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", ""); r.Code != http.StatusOK || r.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected a read to be let through a second later, got %d %v", r.Code, r.Header())
+	}
+}
+
+func TestRateLimiterByToken(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	router, limiter := limitedRouter(RateLimits{Read: RateLimit{Rate: 1, Burst: 1}, Tokens: map[string]string{"s3cret": "ada", "t0ken": "sync"}}, &now)
+
+	// Clients behind the same address are told apart by their tokens
+	for _, token := range []string{"s3cret", "t0ken"} {
+		if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", token); r.Code != http.StatusOK {
+			t.Errorf("Expected the first read with %s to be let through, got %d", token, r.Code)
+		}
+	}
+	if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "s3cret"); r.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second read with the same token to be limited, got %d", r.Code)
+	}
+
+	// Wrong tokens are limited by address before they're checked, each guess isn't a new client
+	if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "guess1"); r.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the first guess to be checked, got %d", r.Code)
+	}
+	r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "guess2")
+	decodeProblem(t, r, http.StatusTooManyRequests, CodeRateLimited)
+
+	// Buckets that have filled up again are forgotten
+	now = now.Add(rateLimitSweep)
+	request(router, "GET", "/api/books/1", "192.0.2.1:4000", "s3cret")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected only the bucket just used to be kept, got %d", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterQuota(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	router, _ := limitedRouter(RateLimits{
+		Read:        RateLimit{Rate: 100, Burst: 100},
+		Quota:       Quota{Requests: 2, Period: time.Hour},
+		Tokens:      map[string]string{"s3cret": "ada"},
+		TokenQuotas: map[string]int{"s3cret": 3},
+	}, &now)
+
+	// Every request counts, whatever its route or method, and whether or not it's let in
+	request(router, "GET", "/api/books", "192.0.2.1:4000", "")
+	request(router, "POST", "/api/books", "192.0.2.1:4000", "")
+	r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "")
+	decodeProblem(t, r, http.StatusTooManyRequests, CodeQuotaExceeded)
+	if r.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected to be told to retry when the period is over, got %v", r.Header())
+	}
+
+	// A token can have a quota of its own
+	for i := 0; i < 3; i++ {
+		if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "s3cret"); r.Code != http.StatusOK {
+			t.Fatalf("Expected request %d with the token to be in its quota, got %d", i+1, r.Code)
+		}
+	}
+	if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "s3cret"); r.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the token's quota to be used up, got %d", r.Code)
+	}
+
+	// A new period starts with the whole quota
+	now = now.Add(time.Hour)
+	if r := request(router, "GET", "/api/books/1", "192.0.2.1:4000", "s3cret"); r.Code != http.StatusOK {
+		t.Errorf("Expected the quota back after the period, got %d", r.Code)
+	}
+}
+
+func TestRateLimiterGRPC(t *testing.T) {
+	cleanBooksTable()
+	limiter := NewRateLimiter(RateLimits{
+		Read:   RateLimit{Rate: 100, Burst: 100},
+		Routes: map[string]RateLimit{"GET /api/v1/books": {Rate: 0.01, Burst: 1}},
+	})
+	books := librarypb.NewBookServiceClient(dialGRPC(t, limiter.GRPCOptions()...))
+
+	// ListBooks is held to the limit of the listing it stands for
+	var header metadata.MD
+	stream, err := books.ListBooks(context.Background(), &librarypb.ListBooksRequest{}, grpc.Header(&header))
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err != nil && err != io.EOF {
+		t.Fatalf("Expected the first listing to be let through, got %v", err)
+	}
+	if len(header.Get("ratelimit-remaining")) == 0 || header.Get("ratelimit-remaining")[0] != "0" {
+		t.Errorf("Expected the limit in the headers, got %v", header)
+	}
+	stream, err = books.ListBooks(context.Background(), &librarypb.ListBooksRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the second listing to be limited, got %v", err)
+	}
+	_, err = books.FilterBooks(context.Background(), &librarypb.FilterBooksRequest{Genre: "Poetry"})
+	if err != nil {
+		t.Errorf("Expected other reads to be let through, got %v", err)
+	}
+}
+
+func TestRateLimiterGraphQL(t *testing.T) {
+	cleanBooksTable()
+	limiter := NewRateLimiter(RateLimits{
+		Read:  RateLimit{Rate: 100, Burst: 100},
+		Write: RateLimit{Rate: 100, Burst: 100},
+		Routes: map[string]RateLimit{
+			"GET /api/v1/books":  {Rate: 0.01, Burst: 1},
+			"POST /api/v1/books": {Rate: 0.01, Burst: 1},
+		},
+	})
+	router := NewServeMux(testDB, limiter.Limit)
+	graphql := func(query string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", GraphQLPath, strings.NewReader(`{"query": `+strconv.Quote(query)+`}`))
+		req.RemoteAddr = "192.0.2.1:4000"
+		r := httptest.NewRecorder()
+		router.ServeHTTP(r, req)
+		var result map[string]interface{}
+		json.Unmarshal(r.Body.Bytes(), &result)
+		return r, result
+	}
+
+	// A books query is held to the limit of the listing it stands for, once the listing has
+	// used it up the query is turned away
+	if r := request(router, "GET", "/api/v1/books", "192.0.2.1:4000", ""); r.Code != http.StatusOK {
+		t.Fatalf("Expected the listing to be let through, got %d", r.Code)
+	}
+	r, result := graphql("{ books { title } }")
+	errs, _ := result["errors"].([]interface{})
+	if r.Code != http.StatusTooManyRequests || len(errs) != 1 || errs[0].(map[string]interface{})["extensions"].(map[string]interface{})["code"] != CodeRateLimited {
+		t.Errorf("Expected the books query to be limited, got %d %s", r.Code, r.Body.String())
+	}
+	if r, _ := graphql("{ collections { name } }"); r.Code != http.StatusOK {
+		t.Errorf("Expected other queries to be let through, got %d %s", r.Code, r.Body.String())
+	}
+
+	// Every mutation counts, a batch of them isn't a single write
+	r, result = graphql(`mutation {
+		dune: addBook(book: {title: "Dune", author: "Frank Herbert", publishedDate: "1965"}) { id }
+		emma: addBook(book: {title: "Emma", author: "Jane Austen", publishedDate: "1815"}) { id }
+	}`)
+	errs, _ = result["errors"].([]interface{})
+	if len(errs) != 1 || !strings.Contains(r.Body.String(), "Too many requests") {
+		t.Errorf("Expected the second addBook to be limited, got %d %s", r.Code, r.Body.String())
+	}
+	if books := countBooksIn(t, testDB); books != 1 {
+		t.Errorf("Expected one book to be added, got %d", books)
+	}
+}
@@ -0,0 +1,295 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// AuditRestore is the audit action for rolling a book back to an earlier revision
+const AuditRestore = "restore"
+
+// Paths of a book's revision history
+const (
+	BookRevisionsPath = "/api/v1/books/{id}/revisions"
+	BookRevisionPath  = "/api/v1/books/{id}/revisions/{rev}"
+	BookRestorePath   = "/api/v1/books/{id}/revisions/{rev}:restore"
+	BookDiffPath      = "/api/v1/books/{id}/diff"
+)
+
+// BookRevision is the state of a book after one write. Revisions are numbered from 1 per book
+// and never change, restoring an old revision adds a new one with its contents.
+type BookRevision struct {
+	Revision int `json:"revision"`
+	Book
+	Actor     string    `json:"actor"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BookDiff struct {
+	BookID string                 `json:"book_id"`
+	From   int                    `json:"from"`
+	To     int                    `json:"to"`
+	Diff   map[string]FieldChange `json:"diff"`
+}
+
+// GetBookRevisionsHandler lists every revision of a book, newest first
+func GetBookRevisionsHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	bookID := pathParam(r.URL.Path, BookRevisionsPath, "id")
+	rows, err := db.Query(bookRevisionSelectQuery+" WHERE book_id = ? ORDER BY revision DESC;", bookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	revisions := make([]BookRevision, 0)
+	for rows.Next() {
+		revision, err := scanBookRevision(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// Every book has at least the revision it was added with
+	if len(revisions) == 0 {
+		writeProblem(w, r, http.StatusNotFound, CodeBookNotFound, "Book not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// GetBookRevisionHandler returns a single revision of a book
+func GetBookRevisionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	params, _ := MatchPath(r.URL.Path, BookRevisionPath)
+	revision, ok := findBookRevision(w, r, db, params["id"], params["rev"])
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revision)
+}
+
+// BookDiffHandler compares the from and to revisions of a book. to defaults to the latest.
+func BookDiffHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	queryParams, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil || queryParams.Get("from") == "" {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Diffing a book needs the from revision")
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	bookID := pathParam(r.URL.Path, BookDiffPath, "id")
+	to := queryParams.Get("to")
+	if to == "" {
+		err = db.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM BookRevisions WHERE book_id = ?;", bookID).Scan(&to)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	from, ok := findBookRevision(w, r, db, bookID, queryParams.Get("from"))
+	if !ok {
+		return
+	}
+	target, ok := findBookRevision(w, r, db, bookID, to)
+	if !ok {
+		return
+	}
+
+	_, fromFields, err := auditSnapshot(from.Book)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	_, toFields, err := auditSnapshot(target.Book)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	diff := BookDiff{
+		BookID: bookID,
+		From:   from.Revision,
+		To:     target.Revision,
+		Diff:   diffFields(fromFields, toFields),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(diff)
+}
+
+// RestoreBookRevisionHandler puts a book back the way it was at an earlier revision. The
+// restore is itself recorded as a new revision, so it can be undone the same way.
+func RestoreBookRevisionHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	params, _ := MatchPath(r.URL.Path, BookRestorePath)
+	if _, ok := findBookRevision(w, r, db, params["id"], params["rev"]); !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, ok := findBook(w, r, tx, params["id"])
+	if !ok {
+		return
+	}
+
+	restoreBookQuery := `UPDATE Books SET (title, author, published_date, edition, description, genre) =
+		(SELECT title, author, published_date, edition, description, genre FROM BookRevisions WHERE book_id = ? AND revision = ?)
+		WHERE book_id = ?;`
+	_, err = tx.Exec(restoreBookQuery, params["id"], params["rev"], params["id"])
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	revision, ok := recordBookChange(w, tx, r, AuditRestore, before)
+	if !ok {
+		return
+	}
+
+	response := Response{
+		Status:   "success",
+		Code:     http.StatusOK,
+		BookID:   before.BookID,
+		Revision: revision,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// recordBookChange stores a new revision, audit entry and book.updated event for a book that tx
+// has just written to, then commits. If that fails it writes the error response itself and returns false.
+func recordBookChange(w http.ResponseWriter, tx *sql.Tx, r *http.Request, action string, before Book) (int, bool) {
+	after, err := scanBook(tx.QueryRow(bookSelectQuery+" WHERE book_id = ?;", before.BookID))
+	if err != nil {
+		writeServerError(w, r, err)
+		return 0, false
+	}
+
+	revision, err := recordBookRevision(tx, r, before.BookID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return 0, false
+	}
+
+	err = recordAudit(tx, actorFrom(r), action, AuditBook, before.BookID, before, after)
+	if err != nil {
+		writeServerError(w, r, err)
+		return 0, false
+	}
+
+	err = recordEvent(tx, EventBookUpdated, before.BookID, after)
+	if err != nil {
+		writeServerError(w, r, err)
+		return 0, false
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return 0, false
+	}
+	notifyEvents()
+
+	return revision, true
+}
+
+// recordBookRevision copies the book as it now stands in tx into a new revision and returns
+// the revision's number
+func recordBookRevision(tx *sql.Tx, r *http.Request, bookID string) (int, error) {
+	var revision int
+	err := tx.QueryRow("SELECT COALESCE(MAX(revision), 0) + 1 FROM BookRevisions WHERE book_id = ?;", bookID).Scan(&revision)
+	if err != nil {
+		return 0, err
+	}
+
+	insertRevisionQuery := `INSERT INTO BookRevisions (book_id, revision, title, author, published_date, edition, description, genre, actor, created_at)
+		SELECT book_id, ?, title, author, published_date, edition, description, genre, ?, ? FROM Books WHERE book_id = ?;`
+	_, err = tx.Exec(insertRevisionQuery, revision, actorFrom(r).name, now().UTC(), bookID)
+	return revision, err
+}
+
+// bookRevisionSelectQuery selects the columns scanBookRevision expects
+const bookRevisionSelectQuery = `SELECT revision, book_id, title, author, published_date, edition, description, genre, actor, created_at FROM BookRevisions`
+
+func scanBookRevision(row rowScanner) (BookRevision, error) {
+	var revision BookRevision
+	err := row.Scan(&revision.Revision, &revision.BookID, &revision.Title, &revision.Author, &revision.PublishedDate, &revision.Edition, &revision.Description, &revision.Genre, &revision.Actor, &revision.CreatedAt)
+	return revision, err
+}
+
+// findBookRevision looks up one revision of a book. If there isn't one it writes the error
+// response itself and returns false, so the caller should just return.
+func findBookRevision(w http.ResponseWriter, r *http.Request, db *sql.DB, bookID, rev string) (BookRevision, bool) {
+	var revision BookRevision
+	number, err := strconv.Atoi(rev)
+	if err != nil {
+		// Anything that isn't a number can't name a revision
+		err = sql.ErrNoRows
+	} else {
+		revision, err = scanBookRevision(db.QueryRow(bookRevisionSelectQuery+" WHERE book_id = ? AND revision = ?;", bookID, number))
+	}
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeRevisionNotFound, "Book revision not found")
+		return revision, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return revision, false
+	}
+
+	return revision, true
+}
@@ -0,0 +1,213 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// bookHistoryFixture adds a book and edits it twice, leaving it at revision 3
+func bookHistoryFixture(t *testing.T) string {
+	cleanBooksTable()
+
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965-08-01", Genre: "Science Fiction"})
+	var added Response
+	json.Unmarshal(r.Body.Bytes(), &added)
+	if added.Revision != 1 {
+		t.Fatalf("Expected a new book to be at revision 1, got %d", added.Revision)
+	}
+
+	edits := []map[string]string{
+		{"title": "Dune Messiah"},
+		{"genre": "Space Opera", "published_date": "1969"},
+	}
+	for i, edit := range edits {
+		r := callHandler(t, UpdateBookHandler, "PATCH", "/api/v1/books/"+added.BookID, edit)
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+		}
+
+		var response Response
+		json.Unmarshal(r.Body.Bytes(), &response)
+		if response.Revision != i+2 {
+			t.Errorf("Expected edit %d to make revision %d, got %d", i+1, i+2, response.Revision)
+		}
+	}
+
+	return added.BookID
+}
+
+func getBook(t *testing.T, bookID string) Book {
+	r := callHandler(t, GetBookHandler, "GET", "/api/v1/books/"+bookID, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var book Book
+	err := json.Unmarshal(r.Body.Bytes(), &book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return book
+}
+
+func TestUpdateBookHandlerKeepsMissingFields(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	book := getBook(t, bookID)
+	if book.Title != "Dune Messiah" || book.Author != "Frank Herbert" || book.Genre != "Space Opera" {
+		t.Errorf("Expected Dune Messiah by Frank Herbert in Space Opera, got %s by %s in %s", book.Title, book.Author, book.Genre)
+	}
+	if !strings.HasPrefix(book.PublishedDate, "1969-01-01") {
+		t.Errorf("Expected the published date to be 1969-01-01, got %s", book.PublishedDate)
+	}
+}
+
+func TestUpdateBookHandlerErrors(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	cases := []struct {
+		target   string
+		payload  map[string]string
+		expected int
+	}{
+		{"/api/v1/books/999", map[string]string{"title": "Missing"}, http.StatusNotFound},
+		{"/api/v1/books/" + bookID, map[string]string{"title": ""}, http.StatusBadRequest},
+		{"/api/v1/books/" + bookID, map[string]string{"published_date": "last year"}, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		r := callHandler(t, UpdateBookHandler, "PATCH", c.target, c.payload)
+		if r.Code != c.expected {
+			t.Errorf("Expected status code %d for %v, got %d", c.expected, c.payload, r.Code)
+		}
+	}
+}
+
+func TestGetBookRevisionsHandler(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	r := callHandler(t, GetBookRevisionsHandler, "GET", "/api/v1/books/"+bookID+"/revisions", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var revisions []BookRevision
+	err := json.Unmarshal(r.Body.Bytes(), &revisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	titles := []string{"Dune Messiah", "Dune Messiah", "Dune"}
+	if len(revisions) != len(titles) {
+		t.Fatalf("Expected %d revisions, got %d", len(titles), len(revisions))
+	}
+	for i, title := range titles {
+		if revisions[i].Revision != len(titles)-i || revisions[i].Title != title {
+			t.Errorf("Expected revision %d to be %s, got revision %d %s", len(titles)-i, title, revisions[i].Revision, revisions[i].Title)
+		}
+	}
+
+	r = callHandler(t, GetBookRevisionsHandler, "GET", "/api/v1/books/999/revisions", nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown book, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestGetBookRevisionHandler(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	r := callHandler(t, GetBookRevisionHandler, "GET", "/api/v1/books/"+bookID+"/revisions/1", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var revision BookRevision
+	json.Unmarshal(r.Body.Bytes(), &revision)
+	if revision.Revision != 1 || revision.Title != "Dune" || revision.Actor != "anonymous" {
+		t.Errorf("Expected revision 1 of Dune by anonymous, got revision %d of %s by %s", revision.Revision, revision.Title, revision.Actor)
+	}
+
+	for _, rev := range []string{"4", "first"} {
+		r := callHandler(t, GetBookRevisionHandler, "GET", "/api/v1/books/"+bookID+"/revisions/"+rev, nil)
+		if r.Code != http.StatusNotFound {
+			t.Errorf("Expected status code %d for revision %s, got %d", http.StatusNotFound, rev, r.Code)
+		}
+	}
+}
+
+func TestBookDiffHandler(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"from=1&to=2", []string{"title"}},
+		{"from=1&to=3", []string{"genre", "published_date", "title"}},
+		// to defaults to the latest revision
+		{"from=2", []string{"genre", "published_date"}},
+		{"from=3&to=1", []string{"genre", "published_date", "title"}},
+	}
+
+	for _, c := range cases {
+		r := callHandler(t, BookDiffHandler, "GET", "/api/v1/books/"+bookID+"/diff?"+c.query, nil)
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d for %s, got %d", http.StatusOK, c.query, r.Code)
+		}
+
+		var diff BookDiff
+		json.Unmarshal(r.Body.Bytes(), &diff)
+		if len(diff.Diff) != len(c.expected) {
+			t.Errorf("Expected %s to change %v, got %v", c.query, c.expected, diff.Diff)
+		}
+		for _, field := range c.expected {
+			if _, ok := diff.Diff[field]; !ok {
+				t.Errorf("Expected %s to change %s, got %v", c.query, field, diff.Diff)
+			}
+		}
+	}
+
+	r := callHandler(t, BookDiffHandler, "GET", "/api/v1/books/"+bookID+"/diff?from=1&to=9", nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown revision, got %d", http.StatusNotFound, r.Code)
+	}
+	r = callHandler(t, BookDiffHandler, "GET", "/api/v1/books/"+bookID+"/diff", nil)
+	if r.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d without a from revision, got %d", http.StatusBadRequest, r.Code)
+	}
+}
+
+func TestRestoreBookRevisionHandler(t *testing.T) {
+	bookID := bookHistoryFixture(t)
+
+	r := callHandlerAs(t, "restorer", RestoreBookRevisionHandler, "POST", "/api/v1/books/"+bookID+"/revisions/1:restore", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var response Response
+	json.Unmarshal(r.Body.Bytes(), &response)
+	if response.Revision != 4 {
+		t.Errorf("Expected the restore to make revision 4, got %d", response.Revision)
+	}
+
+	book := getBook(t, bookID)
+	if book.Title != "Dune" || book.Genre != "Science Fiction" || !strings.HasPrefix(book.PublishedDate, "1965-08-01") {
+		t.Errorf("Expected the book to be back to its first revision, got %+v", book)
+	}
+
+	entries := auditLog(t, "actor=restorer&entity=book&entity_id="+bookID)
+	if len(entries) == 0 || entries[0].Action != AuditRestore {
+		t.Fatalf("Expected the restore to be audited, got %v", entries)
+	}
+	if entries[0].Diff["title"].Before != "Dune Messiah" || entries[0].Diff["title"].After != "Dune" {
+		t.Errorf("Expected the audited title to go from Dune Messiah to Dune, got %v", entries[0].Diff["title"])
+	}
+
+	r = callHandler(t, RestoreBookRevisionHandler, "POST", "/api/v1/books/"+bookID+"/revisions/9:restore", nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an unknown revision, got %d", http.StatusNotFound, r.Code)
+	}
+}
@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Middleware wraps a handler with behaviour shared by many endpoints, like logging or auth
+type Middleware func(http.Handler) http.Handler
+
+// Router sends a request to the handler registered for its method and path. Paths are
+// patterns like BookPath whose {placeholders} match a segment each, see MatchPath. When
+// several patterns match a path the most specific wins, so "/webhooks/dead-letters" is
+// preferred to "/webhooks/{id}" and "{rev}:restore" to "{rev}" whatever order they're
+// registered in. A path that matches but not with the request's method is answered 405
+// with an Allow header listing the methods it takes.
+type Router struct {
+	prefix     string
+	middleware []Middleware
+	parent     *Router
+	// routes is shared by a router and all its groups
+	routes *[]route
+}
+
+type route struct {
+	method  string
+	pattern string
+	handler http.Handler
+	group   *Router
+}
+
+// NewRouter returns a router with no routes
+func NewRouter() *Router {
+	return &Router{routes: new([]route)}
+}
+
+// Use adds middleware to the router. On the router from NewRouter it wraps every request,
+// including the ones answered 404 or 405, and on a group only the group's routes. The first
+// middleware added is the outermost.
+func (router *Router) Use(middleware ...Middleware) {
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// Group returns a router for the paths under prefix. Its routes are served by router, after
+// router's middleware and then the group's own.
+func (router *Router) Group(prefix string, middleware ...Middleware) *Router {
+	return &Router{
+		prefix:     router.prefix + prefix,
+		middleware: middleware,
+		parent:     router,
+		routes:     router.routes,
+	}
+}
+
+// Handle registers handler for requests with method to the path pattern under the router's
+// prefix. Registering the same method and pattern twice panics.
+func (router *Router) Handle(method, pattern string, handler http.Handler) {
+	pattern = router.prefix + pattern
+	for _, existing := range *router.routes {
+		if existing.method == method && existing.pattern == pattern {
+			panic("routes: " + method + " " + pattern + " is already registered")
+		}
+	}
+	*router.routes = append(*router.routes, route{method: method, pattern: pattern, handler: handler, group: router})
+}
+
+// HandleFunc is Handle for a function
+func (router *Router) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	router.Handle(method, pattern, handler)
+}
+
+func (router *Router) Get(pattern string, handler http.HandlerFunc) {
+	router.Handle(http.MethodGet, pattern, handler)
+}
+
+func (router *Router) Post(pattern string, handler http.HandlerFunc) {
+	router.Handle(http.MethodPost, pattern, handler)
+}
+
+func (router *Router) Patch(pattern string, handler http.HandlerFunc) {
+	router.Handle(http.MethodPatch, pattern, handler)
+}
+
+func (router *Router) Delete(pattern string, handler http.HandlerFunc) {
+	router.Handle(http.MethodDelete, pattern, handler)
+}
+
+// ServeHTTP finds the route for r and serves it through the middleware of the route's
+// groups, answering with a problem if there's no route
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wrap(http.HandlerFunc(router.dispatch), router.middleware).ServeHTTP(w, r)
+}
+
+func (router *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	pattern := ""
+	for _, candidate := range *router.routes {
+		if _, ok := MatchPath(r.URL.Path, candidate.pattern); ok && (pattern == "" || moreSpecific(candidate.pattern, pattern)) {
+			pattern = candidate.pattern
+		}
+	}
+	if pattern == "" {
+		notFound(w, r)
+		return
+	}
+	if entry := accessLogFrom(r); entry != nil {
+		entry.route = pattern
+	}
+	nameSpan(r, pattern)
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, pattern))
+
+	var allowed []string
+	for _, candidate := range *router.routes {
+		if candidate.pattern != pattern {
+			continue
+		}
+		if candidate.method == r.Method {
+			// The root's middleware has already run
+			handler := candidate.handler
+			for group := candidate.group; group.parent != nil; group = group.parent {
+				handler = wrap(handler, group.middleware)
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+		allowed = append(allowed, candidate.method)
+	}
+
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	methodNotAllowed(w, r)
+}
+
+type routeKey struct{}
+
+// matchedRoute returns the pattern of the route r matched, for the middleware of groups, which
+// runs once it has. It's empty for the router's own middleware.
+func matchedRoute(r *http.Request) string {
+	pattern, _ := r.Context().Value(routeKey{}).(string)
+	return pattern
+}
+
+// Routes lists the method and pattern of every route, like "GET /api/v1/books/{id}", in the
+// order they were registered
+func (router *Router) Routes() []string {
+	var routes []string
+	for _, route := range *router.routes {
+		routes = append(routes, route.method+" "+route.pattern)
+	}
+	return routes
+}
+
+// wrap applies middleware to handler, the first being the outermost
+func wrap(handler http.Handler, middleware []Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// moreSpecific reports whether pattern a should be preferred to pattern b when a path
+// matches both. At the first segment where they differ a literal beats a placeholder, and a
+// placeholder with a literal suffix beats one without.
+func moreSpecific(a, b string) bool {
+	aSegments := strings.Split(strings.Trim(a, "/"), "/")
+	bSegments := strings.Split(strings.Trim(b, "/"), "/")
+	for i := range aSegments {
+		if i >= len(bSegments) {
+			break
+		}
+		aRank, bRank := segmentRank(aSegments[i]), segmentRank(bSegments[i])
+		if aRank != bRank {
+			return aRank > bRank
+		}
+	}
+	return false
+}
+
+func segmentRank(segment string) int {
+	end := strings.Index(segment, "}")
+	switch {
+	case !strings.HasPrefix(segment, "{") || end < 0:
+		return 2
+	case end < len(segment)-1:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,260 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// named answers with its name, so a test can tell which route served a request
+func named(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}
+}
+
+// serve sends a request through handler and returns the answer
+func serve(handler http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	r := httptest.NewRecorder()
+	handler.ServeHTTP(r, req)
+	return r
+}
+
+func TestRouterPrefersSpecificPatterns(t *testing.T) {
+	router := NewRouter()
+	api := router.Group("/api/v1")
+	api.Get("/webhooks/{id}", named("webhook"))
+	api.Get("/webhooks/dead-letters", named("dead letters"))
+	api.Post("/books/{id}/revisions/{rev}:restore", named("restore"))
+	api.Get("/books/{id}/revisions/{rev}", named("revision"))
+
+	for target, want := range map[string]string{
+		"GET /api/v1/webhooks/7":                       "webhook",
+		"GET /api/v1/webhooks/dead-letters":            "dead letters",
+		"GET /api/v1/books/3/revisions/2":              "revision",
+		"POST /api/v1/books/3/revisions/2:restore":     "restore",
+		"GET /api/v1/books/3/revisions/2:restore":      "405",
+		"GET /api/v1/books/3/revisions/2:restore/more": "404",
+	} {
+		method, path, _ := strings.Cut(target, " ")
+		r := serve(router, method, path, nil)
+		got := r.Body.String()
+		if r.Code != http.StatusOK {
+			got = http.StatusText(r.Code)
+			want = http.StatusText(map[string]int{"404": http.StatusNotFound, "405": http.StatusMethodNotAllowed}[want])
+		}
+		if got != want {
+			t.Errorf("%s: expected %s, got %s", target, want, got)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	router := NewServeMux(testDB)
+
+	r := serve(router, "PUT", "/api/v1/books/1", nil)
+	decodeProblem(t, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+	if r.Header().Get("Allow") != "DELETE, GET, PATCH" {
+		t.Errorf("Expected the book's methods to be allowed, got %q", r.Header().Get("Allow"))
+	}
+
+	// Endpoints that used to take any method only take the one they're for
+	r = serve(router, "DELETE", "/api/v1/filter", nil)
+	decodeProblem(t, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+	r = serve(router, "GET", "/api/v1/booksToCollection", nil)
+	decodeProblem(t, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+	if r.Header().Get("Allow") != "POST" {
+		t.Errorf("Expected only POST to be allowed, got %q", r.Header().Get("Allow"))
+	}
+}
+
+func TestRouterMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	router := NewRouter()
+	router.Use(trace("root"))
+	api := router.Group("/api", trace("api"))
+	admin := api.Group("/admin", trace("admin"))
+	admin.Get("/backups", named("backups"))
+	router.Get("/open", named("open"))
+	// Added after the routes, it still applies to them
+	api.Use(trace("api 2"))
+
+	for target, want := range map[string]string{
+		"/api/admin/backups": "root api api 2 admin",
+		"/open":              "root",
+		"/api/nothing":       "root",
+	} {
+		calls = nil
+		serve(router, "GET", target, nil)
+		if strings.Join(calls, " ") != want {
+			t.Errorf("%s: expected middleware %s, got %v", target, want, calls)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	router := NewRouter()
+	router.Use(Recover)
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) { panic("shelf collapsed") })
+
+	r := serve(router, "GET", "/panic", nil)
+	problem := decodeProblem(t, r, http.StatusInternalServerError, CodeInternal)
+	if strings.Contains(r.Body.String(), "shelf") || !strings.Contains(logged.String(), "shelf collapsed") || !strings.Contains(logged.String(), problem.RequestID) {
+		t.Errorf("Expected the panic in the log only, got %s and %q", r.Body.String(), logged.String())
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+
+	router := NewServeMux(testDB)
+	r := serve(router, "GET", "/api/v1/books/999999", http.Header{RequestIDHeader: {"req-7"}})
+	if r.Header().Get(RequestIDHeader) != "req-7" {
+		t.Errorf("Expected the request ID back, got %q", r.Header().Get(RequestIDHeader))
+	}
+
+	var entry struct {
+		Msg       string  `json:"msg"`
+		Method    string  `json:"method"`
+		Route     string  `json:"route"`
+		Path      string  `json:"path"`
+		Status    int     `json:"status"`
+		LatencyMS float64 `json:"latency_ms"`
+		Bytes     int     `json:"bytes"`
+		RequestID string  `json:"request_id"`
+		Code      string  `json:"code"`
+	}
+	err := json.Unmarshal(logged.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Expected a JSON log entry, got %q", logged.String())
+	}
+	if entry.Msg != "request" || entry.Method != "GET" || entry.Route != BookPath || entry.Path != "/api/v1/books/999999" || entry.Status != http.StatusNotFound || entry.Code != CodeBookNotFound || entry.Bytes != r.Body.Len() || entry.RequestID != "req-7" || entry.LatencyMS < 0 {
+		t.Errorf("Expected the request to be logged, got %q", logged.String())
+	}
+
+	// Without an ID from the caller one is made up, and sent back
+	logged.Reset()
+	r = serve(router, "GET", "/api/v1/books", nil)
+	id := r.Header().Get(RequestIDHeader)
+	if id == "" || !strings.Contains(logged.String(), `"request_id":"`+id+`"`) {
+		t.Errorf("Expected the made up request ID %q to be logged, got %q", id, logged.String())
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	cleanBooksTable()
+	router := NewServeMux(testDB, RequireToken(map[string]string{"s3cret": "ada"}))
+
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer wrong"}}, {"Authorization": {"s3cret"}}} {
+		r := serve(router, "GET", "/api/v1/books", header)
+		decodeProblem(t, r, http.StatusUnauthorized, CodeUnauthorized)
+		if !strings.HasPrefix(r.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("Expected a bearer challenge, got %q", r.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// The token's actor is who the audit log names, whatever the request claims
+	req := httptest.NewRequest("POST", "/api/v1/books", strings.NewReader(`{"title": "Dune", "author": "Frank Herbert", "published_date": "1965"}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set(ActorHeader, "mallory")
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	r = serve(router, "GET", "/api/v1/audit?actor=ada&entity=book", http.Header{"Authorization": {"Bearer s3cret"}})
+	if !strings.Contains(r.Body.String(), `"title":"Dune"`) {
+		t.Errorf("Expected the change to be made by ada, got %s", r.Body.String())
+	}
+	r = serve(router, "GET", "/api/v1/audit?actor=mallory", http.Header{"Authorization": {"Bearer s3cret"}})
+	if strings.Contains(r.Body.String(), "Dune") {
+		t.Errorf("Expected nothing to be made by mallory, got %s", r.Body.String())
+	}
+
+	// The description of the API isn't behind the token
+	r = serve(router, "GET", OpenAPIPath, nil)
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected the OpenAPI document without a token, got %d", r.Code)
+	}
+}
+
+func TestMountAdmin(t *testing.T) {
+	// Without admin tokens there are no admin endpoints
+	r := serve(NewServeMux(testDB), "GET", "/api/v1/admin/backups", nil)
+	decodeProblem(t, r, http.StatusNotFound, CodeRouteNotFound)
+
+	// With them, an API token doesn't get in
+	router := NewServeMux(testDB, RequireToken(map[string]string{"s3cret": "ada"}))
+	MountAdmin(router, testDB, RequireToken(map[string]string{"r00t": "admin"}))
+	r = serve(router, "GET", "/api/v1/admin/backups", http.Header{"Authorization": {"Bearer s3cret"}})
+	decodeProblem(t, r, http.StatusUnauthorized, CodeUnauthorized)
+	if r = serve(router, "GET", "/api/v1/admin/backups", http.Header{"Authorization": {"Bearer r00t"}}); r.Code != http.StatusOK {
+		t.Errorf("Expected the admin token to get in, got %d %s", r.Code, r.Body.String())
+	}
+	if r = serve(router, "GET", "/api/v1/books", http.Header{"Authorization": {"Bearer r00t"}}); r.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the admin token not to be an API token, got %d", r.Code)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	router := NewServeMux(testDB, RequireToken(map[string]string{"s3cret": "ada"}))
+	router.Use(CORS("https://catalog.example.org"))
+
+	// A preflight is answered without a token
+	r := serve(router, "OPTIONS", "/api/v1/books", http.Header{"Origin": {"https://catalog.example.org"}, "Access-Control-Request-Method": {"POST"}})
+	if r.Code != http.StatusNoContent || r.Header().Get("Access-Control-Allow-Origin") != "https://catalog.example.org" || !strings.Contains(r.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("Expected the preflight to be allowed, got %d %v", r.Code, r.Header())
+	}
+
+	r = serve(router, "GET", "/api/v1/books", http.Header{"Origin": {"https://catalog.example.org"}})
+	if r.Code != http.StatusUnauthorized || r.Header().Get("Access-Control-Allow-Origin") != "https://catalog.example.org" {
+		t.Errorf("Expected the origin to be allowed to read the answer, got %d %v", r.Code, r.Header())
+	}
+
+	r = serve(router, "OPTIONS", "/api/v1/books", http.Header{"Origin": {"https://evil.example"}, "Access-Control-Request-Method": {"POST"}})
+	if r.Header().Get("Access-Control-Allow-Origin") != "" || r.Code == http.StatusNoContent {
+		t.Errorf("Expected another origin not to be allowed, got %d %v", r.Code, r.Header())
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	router := NewServeMux(testDB)
+	router.Use(LimitBody(1 << 10))
+
+	req := httptest.NewRequest("POST", "/api/v1/books", strings.NewReader(`{"title": "`+strings.Repeat("a", 1<<10)+`"}`))
+	r := httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+	decodeProblem(t, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge)
+
+	// Handlers that decode their bodies themselves answer the same way
+	req = httptest.NewRequest("POST", "/api/v1/patrons", strings.NewReader(`{"name": "`+strings.Repeat("a", 1<<10)+`"}`))
+	r = httptest.NewRecorder()
+	router.ServeHTTP(r, req)
+	decodeProblem(t, r, http.StatusRequestEntityTooLarge, CodeRequestTooLarge)
+}
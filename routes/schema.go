@@ -0,0 +1,285 @@
+package routes
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations holds every change to the database schema, in the order they were made.
+// A database at schema version N has had the first N migrations applied; the version is
+// tracked with SQLite's user_version pragma so we never run the same migration twice.
+// Only ever append to this list, never edit an entry that has shipped.
+var migrations = []string{
+	// 1: the original catalog tables. These use IF NOT EXISTS because databases created
+	// before we tracked schema versions already have them.
+	`CREATE TABLE IF NOT EXISTS Books (
+		book_id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL,
+		author TEXT NOT NULL,
+		published_date DATE NOT NULL DEFAULT '',
+		edition TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		genre TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS Collections (
+		collection_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS CollectionBooks (
+		collection_id INTEGER NOT NULL REFERENCES Collections(collection_id),
+		book_id INTEGER NOT NULL REFERENCES Books(book_id)
+	);`,
+
+	// 2: circulation. Every physical copy of a book can be lent to one patron at a time.
+	`CREATE TABLE Patrons (
+		patron_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE Copies (
+		copy_id INTEGER PRIMARY KEY,
+		book_id INTEGER NOT NULL REFERENCES Books(book_id),
+		status TEXT NOT NULL DEFAULT 'available'
+	);
+	CREATE INDEX idx_copies_book_id ON Copies(book_id);
+	CREATE TABLE Loans (
+		loan_id INTEGER PRIMARY KEY,
+		copy_id INTEGER NOT NULL REFERENCES Copies(copy_id),
+		patron_id INTEGER NOT NULL REFERENCES Patrons(patron_id),
+		checked_out_at DATETIME NOT NULL,
+		due_date DATETIME NOT NULL,
+		returned_at DATETIME,
+		renewals INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX idx_loans_copy_id ON Loans(copy_id);
+	CREATE INDEX idx_loans_patron_id ON Loans(patron_id);`,
+
+	// 3: holds. Waiting holds form a queue per book ordered by position, a ready hold has a
+	// copy set aside for pickup until expires_at.
+	`CREATE TABLE Holds (
+		hold_id INTEGER PRIMARY KEY,
+		book_id INTEGER NOT NULL REFERENCES Books(book_id),
+		patron_id INTEGER NOT NULL REFERENCES Patrons(patron_id),
+		position INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'waiting',
+		copy_id INTEGER REFERENCES Copies(copy_id),
+		created_at DATETIME NOT NULL,
+		ready_at DATETIME,
+		expires_at DATETIME
+	);
+	CREATE INDEX idx_holds_book_id ON Holds(book_id, status, position);
+	CREATE INDEX idx_holds_patron_id ON Holds(patron_id);`,
+
+	// 4: fines. FinePolicies with an empty genre is the default policy, 25 cents a day capped
+	// at $10. Fines is a ledger, charges are positive and payments and waivers negative.
+	`CREATE TABLE FinePolicies (
+		genre TEXT PRIMARY KEY,
+		daily_rate_cents INTEGER NOT NULL,
+		grace_days INTEGER NOT NULL DEFAULT 0,
+		cap_cents INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO FinePolicies (genre, daily_rate_cents, grace_days, cap_cents) VALUES ('', 25, 0, 1000);
+	CREATE TABLE Fines (
+		fine_id INTEGER PRIMARY KEY,
+		patron_id INTEGER NOT NULL REFERENCES Patrons(patron_id),
+		loan_id INTEGER REFERENCES Loans(loan_id),
+		kind TEXT NOT NULL,
+		amount_cents INTEGER NOT NULL,
+		note TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_fines_patron_id ON Fines(patron_id);
+	CREATE INDEX idx_fines_loan_id ON Fines(loan_id);`,
+
+	// 5: copy inventory. Copies from before this migration have no barcode, the unique index
+	// still allows any number of NULLs.
+	`ALTER TABLE Copies ADD COLUMN barcode TEXT;
+	ALTER TABLE Copies ADD COLUMN branch TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Copies ADD COLUMN shelf_location TEXT NOT NULL DEFAULT '';
+	ALTER TABLE Copies ADD COLUMN condition TEXT NOT NULL DEFAULT 'good';
+	CREATE UNIQUE INDEX idx_copies_barcode ON Copies(barcode);
+	CREATE INDEX idx_copies_location ON Copies(branch, shelf_location);`,
+
+	// 6: stocktakes. Each barcode is recorded once per session, where it was scanned last.
+	`CREATE TABLE InventorySessions (
+		session_id INTEGER PRIMARY KEY,
+		branch TEXT NOT NULL,
+		shelf_location TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		started_at DATETIME NOT NULL,
+		closed_at DATETIME
+	);
+	CREATE TABLE InventoryScans (
+		scan_id INTEGER PRIMARY KEY,
+		session_id INTEGER NOT NULL REFERENCES InventorySessions(session_id),
+		barcode TEXT NOT NULL,
+		shelf_location TEXT NOT NULL DEFAULT '',
+		scanned_at DATETIME NOT NULL
+	);
+	CREATE UNIQUE INDEX idx_inventory_scans_barcode ON InventoryScans(session_id, barcode);`,
+
+	// 7: audit log. The triggers keep it append-only, entries can't be edited or removed.
+	`CREATE TABLE AuditLog (
+		audit_id INTEGER PRIMARY KEY,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		entity TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		before_json TEXT,
+		after_json TEXT,
+		diff_json TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_audit_log_entity ON AuditLog(entity, entity_id);
+	CREATE INDEX idx_audit_log_created_at ON AuditLog(created_at);
+	CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON AuditLog
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;
+	CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON AuditLog
+	BEGIN
+		SELECT RAISE(ABORT, 'the audit log is append-only');
+	END;`,
+
+	// 8: book revisions. Books that already exist start their history at revision 1.
+	`CREATE TABLE BookRevisions (
+		book_id INTEGER NOT NULL REFERENCES Books(book_id),
+		revision INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		author TEXT NOT NULL,
+		published_date DATE NOT NULL DEFAULT '',
+		edition TEXT NOT NULL DEFAULT '',
+		description TEXT NOT NULL DEFAULT '',
+		genre TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (book_id, revision)
+	);
+	INSERT INTO BookRevisions (book_id, revision, title, author, published_date, edition, description, genre, actor, created_at)
+		SELECT book_id, 1, title, author, published_date, edition, description, genre, 'anonymous', CURRENT_TIMESTAMP FROM Books;`,
+
+	// 9: soft deletes. A deleted_at puts the book or collection in the trash until it's
+	// restored or purged.
+	`ALTER TABLE Books ADD COLUMN deleted_at DATETIME;
+	ALTER TABLE Collections ADD COLUMN deleted_at DATETIME;
+	CREATE INDEX idx_books_deleted_at ON Books(deleted_at);
+	CREATE INDEX idx_collections_deleted_at ON Collections(deleted_at);`,
+
+	// 10: the change feed. AUTOINCREMENT so event IDs are never reused, clients resume from them.
+	`CREATE TABLE Events (
+		event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 11: webhooks. Every event a subscription wants gets a delivery, which is retried until it
+	// succeeds or is dead-lettered, with a row in WebhookAttempts for each try.
+	`CREATE TABLE WebhookSubscriptions (
+		subscription_id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		event_types TEXT NOT NULL DEFAULT '',
+		active BOOLEAN NOT NULL DEFAULT 1,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE WebhookDeliveries (
+		delivery_id INTEGER PRIMARY KEY,
+		subscription_id INTEGER NOT NULL REFERENCES WebhookSubscriptions(subscription_id),
+		event_id INTEGER NOT NULL REFERENCES Events(event_id),
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL,
+		delivered_at DATETIME
+	);
+	CREATE INDEX idx_webhook_deliveries_due ON WebhookDeliveries(status, next_attempt_at);
+	CREATE TABLE WebhookAttempts (
+		attempt_id INTEGER PRIMARY KEY,
+		delivery_id INTEGER NOT NULL REFERENCES WebhookDeliveries(delivery_id),
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		duration_ms INTEGER NOT NULL,
+		attempted_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_webhook_attempts_delivery ON WebhookAttempts(delivery_id);`,
+
+	// 12: lost loans. A loan whose copy is marked lost while it's out is closed with lost set,
+	// its returned_at is when the copy was marked lost.
+	`ALTER TABLE Loans ADD COLUMN lost BOOLEAN NOT NULL DEFAULT 0;`,
+
+	// 13: loan history outlives the copy. When a trashed book's copies are purged, their loans
+	// keep the book, title and barcode they were for and lose the copy_id, so copy_id can be
+	// NULL. SQLite can't drop a NOT NULL, so the table is rebuilt.
+	`CREATE TABLE LoansNew (
+		loan_id INTEGER PRIMARY KEY,
+		copy_id INTEGER REFERENCES Copies(copy_id),
+		patron_id INTEGER NOT NULL REFERENCES Patrons(patron_id),
+		checked_out_at DATETIME NOT NULL,
+		due_date DATETIME NOT NULL,
+		returned_at DATETIME,
+		renewals INTEGER NOT NULL DEFAULT 0,
+		lost BOOLEAN NOT NULL DEFAULT 0,
+		book_id INTEGER,
+		title TEXT,
+		barcode TEXT
+	);
+	INSERT INTO LoansNew (loan_id, copy_id, patron_id, checked_out_at, due_date, returned_at, renewals, lost)
+		SELECT loan_id, copy_id, patron_id, checked_out_at, due_date, returned_at, renewals, lost FROM Loans;
+	DROP TABLE Loans;
+	ALTER TABLE LoansNew RENAME TO Loans;
+	CREATE INDEX idx_loans_copy_id ON Loans(copy_id);
+	CREATE INDEX idx_loans_patron_id ON Loans(patron_id);`,
+
+	// 14: claimed actors. The actor of an audit entry is who the request was authenticated as,
+	// the X-Actor it was sent with is kept apart as what it claimed.
+	`ALTER TABLE AuditLog ADD COLUMN claimed_actor TEXT NOT NULL DEFAULT '';`,
+}
+
+// MigrateDatabase brings the database at injectedDB up to the latest schema version,
+// creating it if it doesn't exist yet. Each migration runs in its own transaction.
+func MigrateDatabase(injectedDB string) error {
+	db, err := sql.Open("sqlite3", injectedDB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		// PRAGMA doesn't accept bound parameters, the version is always one of our own ints
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d;", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// schemaVersion returns the number of migrations that have been applied to db.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version;").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,28 @@
+package routes
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestMigrateDatabaseIsIdempotent(t *testing.T) {
+	// TestMain has already migrated the test database, running again must be a no-op
+	err := MigrateDatabase(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Expected schema version %d, got %d", len(migrations), version)
+	}
+}
@@ -0,0 +1,168 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans of the routes package. It's OpenTelemetry's global tracer, main
+// sets the provider exporting the spans, and until it does they're dropped.
+var tracer = otel.Tracer("bookManagement/routes")
+
+// TraceRequests starts a span for every request, continuing the trace in the W3C
+// traceparent header if there is one. The router names the span after the route that
+// matched, like "GET /api/v1/books/{id}", and the statements run on a database from openDB
+// are its children.
+func TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.RequestURI()),
+		))
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status()))
+		if recorder.status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status()))
+		}
+	})
+}
+
+// nameSpan names the span of r after the route that matched it
+func nameSpan(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(attribute.String("http.route", pattern))
+}
+
+// openDB opens injectedDB like sql.Open, and every statement run on it gets a span, a child
+// of the span in ctx. Handlers pass the request's context, so a slow request shows which of
+// its queries it was waiting on.
+func openDB(ctx context.Context, injectedDB string) (*sql.DB, error) {
+	return sql.OpenDB(&tracedConnector{dsn: injectedDB, ctx: ctx}), nil
+}
+
+// traceJob runs a scheduled job on injectedDB in a span of its own, named after the job
+func traceJob(name, injectedDB string, job func(db *sql.DB) error) error {
+	ctx, span := tracer.Start(context.Background(), name)
+	db, err := openDB(ctx, injectedDB)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+	defer db.Close()
+
+	err = job(db)
+	endSpan(span, err)
+	return err
+}
+
+// tracedConnector opens SQLite connections whose statements are traced
+type tracedConnector struct {
+	dsn string
+	ctx context.Context
+}
+
+func (c *tracedConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{SQLiteConn: conn.(*sqlite3.SQLiteConn), ctx: c.ctx}, nil
+}
+
+func (c *tracedConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
+
+// tracedConn starts a span for every query and exec, and records how long it took in the
+// metrics. Statements prepared on it aren't traced, the routes package runs its queries
+// directly.
+type tracedConn struct {
+	*sqlite3.SQLiteConn
+	ctx context.Context
+}
+
+// startSpan starts the span of a statement. The context the statement was run with is its
+// parent if it has a span, like a gRPC call's, otherwise the one the database was opened with.
+// Only the span comes from the database's context, a request going away doesn't interrupt
+// statements any more than it did before they were traced.
+func (c *tracedConn) startSpan(ctx context.Context, query string) trace.Span {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = c.ctx
+	}
+	operation, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	_, span := tracer.Start(ctx, strings.ToUpper(operation), trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("db.statement", query),
+	))
+	return span
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	span, start := c.startSpan(ctx, query), time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		endSpan(span, err)
+		observeQuery(queryName(query), start, err)
+		return nil, err
+	}
+	// Reading the rows is part of the query
+	return &tracedRows{Rows: rows, span: span, name: queryName(query), start: start}, nil
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	span, start := c.startSpan(ctx, query), time.Now()
+	result, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	endSpan(span, err)
+	observeQuery(queryName(query), start, err)
+	return result, err
+}
+
+// tracedRows ends the span of its query, and records how long it took, once they've been read
+type tracedRows struct {
+	driver.Rows
+	span  trace.Span
+	name  string
+	start time.Time
+	err   error
+}
+
+func (rows *tracedRows) Next(dest []driver.Value) error {
+	err := rows.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		rows.err = err
+	}
+	return err
+}
+
+func (rows *tracedRows) Close() error {
+	err := rows.Rows.Close()
+	endSpan(rows.span, rows.err)
+	observeQuery(rows.name, rows.start, rows.err)
+	return err
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
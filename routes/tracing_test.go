@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanExporter   = tracetest.NewInMemoryExporter()
+	installTracing sync.Once
+)
+
+// recordSpans has the spans of the routes package recorded in memory, from now on. The tracer
+// only takes the first provider it's given, so it's installed once for every test.
+func recordSpans() *tracetest.InMemoryExporter {
+	installTracing.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// spansOf returns the exported spans of the trace with traceID
+func spansOf(exporter *tracetest.InMemoryExporter, traceID string) []tracetest.SpanStub {
+	var spans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func attributeOf(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceRequests(t *testing.T) {
+	exporter := recordSpans()
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	t.Cleanup(func() { cleanCollectionsFromTestDatabase() })
+	callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Deserts", Description: "Sand"})
+	callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Oceans", Description: "Water"})
+
+	// The request continues the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	router := NewServeMux(testDB)
+	r := serve(router, "GET", "/api/v1/collections", http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected the collections, got %d", r.Code)
+	}
+
+	var server *tracetest.SpanStub
+	var statements []tracetest.SpanStub
+	for _, span := range spansOf(exporter, traceID) {
+		if span.SpanKind == trace.SpanKindServer {
+			server = &span
+		} else {
+			statements = append(statements, span)
+		}
+	}
+	if server == nil || server.Name != "GET /api/v1/collections" || server.Parent.SpanID().String() != "00f067aa0ba902b7" || attributeOf(*server, "http.status_code").AsInt64() != 200 {
+		t.Fatalf("Expected a span for the request named after its route, got %+v", server)
+	}
+
+	// Every statement is a child of the request, the query for the collections and one for
+	// the books of each
+	bookQueries := 0
+	for _, span := range statements {
+		if span.Parent.SpanID() != server.SpanContext.SpanID() || span.Name != "SELECT" || attributeOf(span, "db.system").AsString() != "sqlite" {
+			t.Errorf("Expected a SELECT under the request, got %s under %s", span.Name, span.Parent.SpanID())
+		}
+		if strings.Contains(attributeOf(span, "db.statement").AsString(), "CollectionBooks") {
+			bookQueries++
+		}
+	}
+	if len(statements) != 3 || bookQueries != 2 {
+		t.Errorf("Expected a span for each of the 3 queries, got %d", len(statements))
+	}
+}
+
+func TestTraceRequestFailures(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	exporter := recordSpans()
+	const traceID = "5bf92f3577b34da6a3ce929d0e0e4736"
+	router := NewRouter()
+	router.Use(TraceRequests, Recover)
+	router.Get("/panic", func(w http.ResponseWriter, r *http.Request) { panic("shelf collapsed") })
+	serve(router, "GET", "/panic", http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}})
+
+	spans := spansOf(exporter, traceID)
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error || attributeOf(spans[0], "http.status_code").AsInt64() != 500 {
+		t.Errorf("Expected the request's span to have failed, got %+v", spans)
+	}
+}
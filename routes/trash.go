@@ -0,0 +1,300 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TrashRetention is how long deleted books and collections can be restored before PurgeTrash
+// removes them for good
+const TrashRetention = 30 * 24 * time.Hour
+
+// TrashRestorePath restores a book or collection from the trash, entity is "books" or "collections"
+const TrashRestorePath = "/api/v1/trash/{entity}/{id}:restore"
+
+// trashTables maps the entities in TrashRestorePath to their table, ID column, audit entity and
+// the event restoring one sends
+var trashTables = map[string]struct{ table, idColumn, auditEntity, restoredEvent string }{
+	"books":       {"Books", "book_id", AuditBook, EventBookRestored},
+	"collections": {"Collections", "collection_id", AuditCollection, EventCollectionRestored},
+}
+
+type TrashItem struct {
+	Entity    string    `json:"entity"`
+	EntityID  string    `json:"entity_id"`
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// GetTrashHandler lists the deleted books and collections that can still be restored, most
+// recently deleted first
+func GetTrashHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	query := `SELECT 'books', book_id, title, deleted_at FROM Books WHERE deleted_at IS NOT NULL
+		UNION ALL
+		SELECT 'collections', collection_id, name, deleted_at FROM Collections WHERE deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC;`
+	rows, err := db.Query(query)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	items := make([]TrashItem, 0)
+	for rows.Next() {
+		var item TrashItem
+		// The column type is lost in the UNION, so the time comes back as text
+		var deletedAt string
+		err := rows.Scan(&item.Entity, &item.EntityID, &item.Name, &deletedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		item.DeletedAt, err = parseSQLiteTime(deletedAt)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		item.PurgeAt = item.DeletedAt.Add(TrashRetention)
+		items = append(items, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(items)
+}
+
+// RestoreTrashHandler takes a book or collection back out of the trash
+func RestoreTrashHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	params, _ := MatchPath(r.URL.Path, TrashRestorePath)
+	entity, ok := trashTables[params["entity"]]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// The table and column names come from trashTables, never from the request
+	var deletedAt time.Time
+	err = tx.QueryRow("SELECT deleted_at FROM "+entity.table+" WHERE "+entity.idColumn+" = ? AND deleted_at IS NOT NULL;", params["id"]).Scan(&deletedAt)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeNotInTrash, "Nothing to restore, it isn't in the trash")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE "+entity.table+" SET deleted_at = NULL WHERE "+entity.idColumn+" = ?;", params["id"])
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	type trashState struct {
+		DeletedAt *time.Time `json:"deleted_at"`
+	}
+	err = recordAudit(tx, actorFrom(r), AuditRestore, entity.auditEntity, params["id"], trashState{&deletedAt}, trashState{})
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = recordEvent(tx, entity.restoredEvent, params["id"], map[string]string{entity.idColumn: params["id"]})
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	notifyEvents()
+
+	response := Response{
+		Status: "success",
+		Code:   http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// PurgeTrash permanently removes books and collections that have been in the trash for longer
+// than TrashRetention. It's run periodically by the server.
+func PurgeTrash(injectedDB string) error {
+	return traceJob("PurgeTrash", injectedDB, purgeTrash)
+}
+
+// purgeTrash removes expired trash along with everything that only exists for it, a book's
+// revisions, holds and copies and either's collection memberships. A book can only be deleted
+// once its copies are lost, so those are purged with it. Their loans and fines are kept in the
+// patrons' history, and the copies in the audit log.
+func purgeTrash(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cutoff := now().UTC().Add(-TrashRetention)
+
+	rows, err := tx.Query(bookSelectQuery+" WHERE deleted_at <= ?;", cutoff)
+	if err != nil {
+		return err
+	}
+	var books []Book
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		books = append(books, book)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, book := range books {
+		err := purgeCopies(tx, book.BookID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM CollectionBooks WHERE book_id = ?;
+			DELETE FROM BookRevisions WHERE book_id = ?;
+			DELETE FROM Holds WHERE book_id = ?;
+			DELETE FROM Books WHERE book_id = ?;`, book.BookID, book.BookID, book.BookID, book.BookID)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(tx, systemActor, AuditPurge, AuditBook, book.BookID, book, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err = tx.Query("SELECT collection_id, name, description, deleted_at FROM Collections WHERE deleted_at <= ?;", cutoff)
+	if err != nil {
+		return err
+	}
+	var collections []Collection
+	for rows.Next() {
+		var collection Collection
+		var deletedAt time.Time
+		err := rows.Scan(&collection.CollectionID, &collection.Name, &collection.Description, &deletedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		collection.DeletedAt = &deletedAt
+		collections = append(collections, collection)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, collection := range collections {
+		_, err := tx.Exec(`DELETE FROM CollectionBooks WHERE collection_id = ?;
+			DELETE FROM Collections WHERE collection_id = ?;`, collection.CollectionID, collection.CollectionID)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(tx, systemActor, AuditPurge, AuditCollection, collection.CollectionID, collection, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// includeDeleted reports whether a listing should include the trash, with ?include_deleted=true
+func includeDeleted(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+	return include
+}
+
+// parseSQLiteTime parses a time the sqlite3 driver wrote, for the places it can't tell from
+// the column type that it should parse it itself
+func parseSQLiteTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02T15:04:05.999999999-07:00", "2006-01-02 15:04:05", time.RFC3339Nano} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// purgeCopies removes a book's copies. Their loans stay in the patrons' history, keeping the
+// book, title and barcode they were for, and their fines stay tied to them.
+func purgeCopies(tx *sql.Tx, bookID string) error {
+	rows, err := tx.Query(copySelectQuery+" WHERE c.book_id = ?;", bookID)
+	if err != nil {
+		return err
+	}
+	var copies []Copy
+	for rows.Next() {
+		bookCopy, err := scanCopy(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		copies = append(copies, bookCopy)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, bookCopy := range copies {
+		_, err := tx.Exec(`UPDATE Loans SET copy_id = NULL, book_id = ?, title = ?, barcode = ? WHERE copy_id = ?;
+			DELETE FROM Copies WHERE copy_id = ?;`, bookCopy.BookID, bookCopy.Title, bookCopy.Barcode, bookCopy.CopyID, bookCopy.CopyID)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(tx, systemActor, AuditPurge, AuditCopy, bookCopy.CopyID, bookCopy, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
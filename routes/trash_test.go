@@ -0,0 +1,249 @@
+package routes
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getTrash(t *testing.T) []TrashItem {
+	r := callHandler(t, GetTrashHandler, "GET", "/api/v1/trash", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var items []TrashItem
+	err := json.Unmarshal(r.Body.Bytes(), &items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func listBooks(t *testing.T, target string) []Book {
+	r := callHandler(t, GetBooksHandler, "GET", target, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	var books []Book
+	err := json.Unmarshal(r.Body.Bytes(), &books)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return books
+}
+
+func TestDeleteAndRestoreBook(t *testing.T) {
+	cleanCirculationTables()
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	insertBookWithID(Book{Title: "Emma", Author: "Jane Austen"})
+	id := strconv.FormatInt(bookID, 10)
+
+	r := callHandlerAs(t, "trash-book", DeleteBookHandler, "DELETE", "/api/v1/books/"+id, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	if books := listBooks(t, "/api/v1/books"); len(books) != 1 || books[0].Title != "Emma" {
+		t.Errorf("Expected only Emma to be listed, got %v", books)
+	}
+	if books := listBooks(t, "/api/v1/books?include_deleted=true"); len(books) != 2 {
+		t.Errorf("Expected both books with include_deleted, got %d", len(books))
+	}
+
+	r = callHandler(t, FilterBooksHandler, "GET", "/api/v1/filter?author=Frank+Herbert", nil)
+	var filtered []Book
+	json.Unmarshal(r.Body.Bytes(), &filtered)
+	if len(filtered) != 0 {
+		t.Errorf("Expected the filter to leave out deleted books, got %v", filtered)
+	}
+
+	r = callHandler(t, GetBookHandler, "GET", "/api/v1/books/"+id, nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a deleted book, got %d", http.StatusNotFound, r.Code)
+	}
+	r = callHandler(t, DeleteBookHandler, "DELETE", "/api/v1/books/"+id, nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d deleting twice, got %d", http.StatusNotFound, r.Code)
+	}
+
+	items := getTrash(t)
+	if len(items) != 1 || items[0].Entity != "books" || items[0].EntityID != id || items[0].Name != "Dune" {
+		t.Fatalf("Expected Dune in the trash, got %v", items)
+	}
+	if !items[0].PurgeAt.Equal(items[0].DeletedAt.Add(TrashRetention)) {
+		t.Errorf("Expected the purge date to be %s after the delete, got %s", TrashRetention, items[0].PurgeAt)
+	}
+
+	r = callHandlerAs(t, "trash-book", RestoreTrashHandler, "POST", "/api/v1/trash/books/"+id+":restore", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+	if books := listBooks(t, "/api/v1/books"); len(books) != 2 {
+		t.Errorf("Expected the restored book to be listed again, got %d books", len(books))
+	}
+	if items := getTrash(t); len(items) != 0 {
+		t.Errorf("Expected the trash to be empty, got %v", items)
+	}
+
+	entries := auditLog(t, "actor=trash-book&entity_id="+id)
+	if len(entries) != 2 || entries[0].Action != AuditRestore || entries[1].Action != AuditDelete {
+		t.Errorf("Expected a delete and a restore to be audited, got %v", entries)
+	}
+
+	r = callHandler(t, RestoreTrashHandler, "POST", "/api/v1/trash/books/"+id+":restore", nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d restoring a book that isn't deleted, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestDeleteBookHandlerWithCopies(t *testing.T) {
+	cleanCirculationTables()
+	cleanBooksTable()
+	bookID, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	insertCopy(bookID)
+
+	r := callHandler(t, DeleteBookHandler, "DELETE", "/api/v1/books/"+strconv.FormatInt(bookID, 10), nil)
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d, got %d", http.StatusConflict, r.Code)
+	}
+}
+
+func TestDeleteAndRestoreCollection(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+
+	r := callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Classics", Description: "Old books"})
+	var collection CollectionResponse
+	json.Unmarshal(r.Body.Bytes(), &collection)
+
+	r = callHandler(t, DeleteCollectionHandler, "DELETE", "/api/v1/collections/"+collection.CollectionID, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	r = callHandler(t, GetCollectionsHandler, "GET", "/api/v1/collections", nil)
+	var collections []Collection
+	json.Unmarshal(r.Body.Bytes(), &collections)
+	if len(collections) != 0 {
+		t.Errorf("Expected the deleted collection to be left out, got %v", collections)
+	}
+
+	r = callHandler(t, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": collection.CollectionID, "book_ids": []string{"1"}})
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d adding to a deleted collection, got %d", http.StatusNotFound, r.Code)
+	}
+
+	r = callHandler(t, RestoreTrashHandler, "POST", "/api/v1/trash/collections/"+collection.CollectionID+":restore", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+
+	r = callHandler(t, GetCollectionsHandler, "GET", "/api/v1/collections", nil)
+	json.Unmarshal(r.Body.Bytes(), &collections)
+	if len(collections) != 1 || collections[0].DeletedAt != nil {
+		t.Errorf("Expected the restored collection to be listed, got %v", collections)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	cleanCirculationTables()
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+
+	deleted := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return deleted }
+	defer func() { now = time.Now }()
+
+	purged, _ := insertBookWithID(Book{Title: "Dune", Author: "Frank Herbert"})
+	lost, _ := insertBookWithID(Book{Title: "Emma", Author: "Jane Austen"})
+	copyID, _ := insertBarcodedCopy(Copy{BookID: strconv.FormatInt(lost, 10), Barcode: "EMMA-1", Branch: "Main"})
+	patronID, _ := insertPatron(Patron{Name: "Harriet Smith"})
+	r := callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Classics", Description: "Old books"})
+	var collection CollectionResponse
+	json.Unmarshal(r.Body.Bytes(), &collection)
+
+	db, err := sql.Open("sqlite3", testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A book whose only copy was lost can be deleted, and the copy goes with it. The copy's
+	// loan and its fine are the patron's history and outlive it.
+	_, err = db.Exec("UPDATE Copies SET status = ? WHERE copy_id = ?;", CopyLost, copyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("INSERT INTO Loans (copy_id, patron_id, checked_out_at, due_date, returned_at, lost) VALUES (?, ?, ?, ?, ?, 1);",
+		copyID, patronID, deleted.AddDate(0, 0, -30), deleted.AddDate(0, 0, -9), deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loanID, _ := result.LastInsertId()
+	_, err = db.Exec("INSERT INTO Fines (patron_id, loan_id, kind, amount_cents, note, created_at) VALUES (?, ?, ?, 225, 'Overdue', ?);", patronID, loanID, FineAssessed, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/api/v1/books/" + strconv.FormatInt(purged, 10), "/api/v1/books/" + strconv.FormatInt(lost, 10)} {
+		r := callHandler(t, DeleteBookHandler, "DELETE", target, nil)
+		if r.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d deleting %s, got %d", http.StatusOK, target, r.Code)
+		}
+	}
+	callHandler(t, DeleteCollectionHandler, "DELETE", "/api/v1/collections/"+collection.CollectionID, nil)
+
+	// Nothing is old enough yet
+	now = func() time.Time { return deleted.Add(TrashRetention - time.Hour) }
+	err = PurgeTrash(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := getTrash(t); len(items) != 3 {
+		t.Fatalf("Expected 3 items to stay in the trash, got %d", len(items))
+	}
+
+	now = func() time.Time { return deleted.Add(TrashRetention) }
+	err = PurgeTrash(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if items := getTrash(t); len(items) != 0 {
+		t.Errorf("Expected the trash to be empty, got %v", items)
+	}
+
+	var books, copies int
+	db.QueryRow("SELECT COUNT(*) FROM Books WHERE book_id IN (?, ?);", purged, lost).Scan(&books)
+	db.QueryRow("SELECT COUNT(*) FROM Copies WHERE copy_id = ?;", copyID).Scan(&copies)
+	if books != 0 || copies != 0 {
+		t.Errorf("Expected the purged books and the lost copy to be gone, got %d books and %d copies", books, copies)
+	}
+	r = callHandler(t, GetLoansHandler, "GET", "/api/v1/loans?patron_id="+strconv.FormatInt(patronID, 10), nil)
+	var loans []Loan
+	json.Unmarshal(r.Body.Bytes(), &loans)
+	if len(loans) != 1 || loans[0].LoanID != strconv.FormatInt(loanID, 10) || loans[0].CopyID != "" || loans[0].BookID != strconv.FormatInt(lost, 10) ||
+		loans[0].Title != "Emma" || loans[0].Barcode != "EMMA-1" || !loans[0].Lost {
+		t.Errorf("Expected the lost loan to stay in the patron's history, got %+v", loans)
+	}
+	fines := getFines(t, strconv.FormatInt(patronID, 10))
+	if fines.BalanceCents != 225 || len(fines.Entries) != 1 || fines.Entries[0].LoanID != strconv.FormatInt(loanID, 10) {
+		t.Errorf("Expected the fine to stay tied to the loan, got %+v", fines)
+	}
+
+	if entries := auditLog(t, "action="+AuditPurge+"&entity=copy&entity_id="+strconv.FormatInt(copyID, 10)); len(entries) != 1 {
+		t.Errorf("Expected the copy's purge to be audited, got %v", entries)
+	}
+
+	entries := auditLog(t, "actor="+SystemActor+"&action="+AuditPurge+"&entity=book&entity_id="+strconv.FormatInt(purged, 10))
+	if len(entries) == 0 {
+		t.Error("Expected the purge to be audited")
+	}
+}
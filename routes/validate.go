@@ -0,0 +1,226 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// PublicationWindow is how far ahead of now a book's published_date can be, books are often
+// catalogued before they come out but a date further off is a typo
+const PublicationWindow = 365 * 24 * time.Hour
+
+// The rules a request field can be given in its `validate` tag, separated by commas:
+//
+//	required  not empty. On an update, where the field is a pointer, it can't be emptied. On a
+//	          []string, at least one element.
+//	max=N     at most N characters
+//	line      no control characters or line breaks
+//	text      no control characters but line breaks and tabs
+//	date      YYYY, YYYY-MM or YYYY-MM-DD, no later than PublicationWindow from now
+//	id        a record ID, digits only, when it's given. On a []string it applies to every element.
+//	min=N     on an integer, at least N
+//
+// Strings are trimmed of surrounding whitespace and normalized to NFC before they're checked,
+// and what's stored is the normalized value, so "Dune " and "Dune" are the same title.
+const validateTag = "validate"
+
+// decodeRequest reads r's JSON body into v, a pointer to a struct, and checks v against its
+// validate tags. Fields v doesn't have are rejected. It answers r with a problem listing
+// every field that failed and returns false if the request can't be used.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		writeValidationProblem(w, r, typeErr.Field+" must be "+jsonKind(typeErr.Type),
+			FieldError{Field: typeErr.Field, Message: "must be " + jsonKind(typeErr.Type)})
+		return false
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		writeValidationProblem(w, r, field+" isn't a known field",
+			FieldError{Field: field, Message: "isn't a known field"})
+		return false
+	default:
+		writeBodyError(w, r, err)
+		return false
+	}
+
+	errs := validate(v)
+	if len(errs) > 0 {
+		details := make([]string, len(errs))
+		for i, fieldErr := range errs {
+			details[i] = fieldErr.Field + " " + fieldErr.Message
+		}
+		writeValidationProblem(w, r, strings.Join(details, "; "), errs...)
+		return false
+	}
+	return true
+}
+
+// validate normalizes the string fields of v, a pointer to a struct, and returns the fields
+// that break their validate rules, in the order they're declared
+func validate(v interface{}) []FieldError {
+	value := reflect.ValueOf(v).Elem()
+	var errs []FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		rules := field.Tag.Get(validateTag)
+		if rules == "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		target := value.Field(i)
+		update := target.Kind() == reflect.Pointer
+		if update {
+			// Left out of an update, the stored value is kept
+			if target.IsNil() {
+				continue
+			}
+			target = target.Elem()
+		}
+
+		switch target.Kind() {
+		case reflect.String:
+			normalized := norm.NFC.String(strings.TrimSpace(target.String()))
+			target.SetString(normalized)
+			if message := checkRules(normalized, rules, update); message != "" {
+				errs = append(errs, FieldError{Field: name, Message: message})
+			}
+		case reflect.Int:
+			if message := checkIntRules(target.Int(), rules); message != "" {
+				errs = append(errs, FieldError{Field: name, Message: message})
+			}
+		case reflect.Slice:
+			if target.Len() == 0 && hasRule(rules, "required") {
+				errs = append(errs, FieldError{Field: name, Message: "must have at least one element"})
+				continue
+			}
+			for j := 0; j < target.Len(); j++ {
+				element := target.Index(j)
+				element.SetString(norm.NFC.String(strings.TrimSpace(element.String())))
+				if message := checkRules(element.String(), rules, update); message != "" {
+					errs = append(errs, FieldError{Field: name + "[" + strconv.Itoa(j) + "]", Message: message})
+					break
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkRules returns how value breaks the first of rules it breaks, or "" if it doesn't
+func checkRules(value, rules string, update bool) string {
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if value == "" && update {
+				return "can't be removed"
+			} else if value == "" {
+				return "is required"
+			}
+		case "max":
+			limit, _ := strconv.Atoi(arg)
+			if utf8.RuneCountInString(value) > limit {
+				return "must be at most " + arg + " characters"
+			}
+		case "line":
+			if strings.IndexFunc(value, disallowedInLine) >= 0 {
+				return "must not contain control characters or line breaks"
+			}
+		case "text":
+			if strings.IndexFunc(value, disallowedInText) >= 0 {
+				return "must not contain control characters"
+			}
+		case "date":
+			if value == "" {
+				continue
+			}
+			date, err := parseDate(value)
+			if err != nil {
+				return "must be YYYY, YYYY-MM or YYYY-MM-DD"
+			}
+			if date.After(now().Add(PublicationWindow)) {
+				return "can't be more than a year from now"
+			}
+		case "id":
+			if value != "" && strings.IndexFunc(value, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+				return "must be an ID"
+			}
+		default:
+			panic("routes: unknown validate rule " + name)
+		}
+	}
+	return ""
+}
+
+// checkIntRules is checkRules for an integer field
+func checkIntRules(value int64, rules string) string {
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "min":
+			limit, _ := strconv.ParseInt(arg, 10, 64)
+			if value < limit {
+				return "must be at least " + arg
+			}
+		default:
+			panic("routes: unknown validate rule " + name + " for an integer")
+		}
+	}
+	return ""
+}
+
+func hasRule(rules, rule string) bool {
+	for _, r := range strings.Split(rules, ",") {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// disallowedInText is true for control characters other than line breaks and tabs, and for
+// the bidirectional overrides that make text display in a different order than it's stored
+func disallowedInText(r rune) bool {
+	if r == '\n' || r == '\r' || r == '\t' {
+		return false
+	}
+	return unicode.IsControl(r) || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069') || r == utf8.RuneError
+}
+
+// disallowedInLine is disallowedInText without the exception for line breaks and tabs
+func disallowedInLine(r rune) bool {
+	return r == '\n' || r == '\r' || r == '\t' || r == '\u2028' || r == '\u2029' || disallowedInText(r)
+}
+
+// jsonKind names a Go type the way a JSON request would have to write it
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
@@ -0,0 +1,203 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateBookRules(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC) }
+
+	for _, test := range []struct {
+		name  string
+		book  BookRequest
+		field string
+		want  string
+	}{
+		{"missing title", BookRequest{Author: "Frank Herbert", PublishedDate: "1965"}, "title", "is required"},
+		{"blank title", BookRequest{Title: "  \t ", Author: "Frank Herbert", PublishedDate: "1965"}, "title", "is required"},
+		{"long title", BookRequest{Title: strings.Repeat("a", 301), Author: "Frank Herbert", PublishedDate: "1965"}, "title", "must be at most 300 characters"},
+		{"line break in author", BookRequest{Title: "Dune", Author: "Frank\nHerbert", PublishedDate: "1965"}, "author", "must not contain control characters or line breaks"},
+		{"bidi override in genre", BookRequest{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965", Genre: "Sci\u202eFi"}, "genre", "must not contain control characters or line breaks"},
+		{"control character in description", BookRequest{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965", Description: "Sand\x00"}, "description", "must not contain control characters"},
+		{"bad date", BookRequest{Title: "Dune", Author: "Frank Herbert", PublishedDate: "August 1965"}, "published_date", "must be YYYY, YYYY-MM or YYYY-MM-DD"},
+		{"far future date", BookRequest{Title: "Dune", Author: "Frank Herbert", PublishedDate: "2025-07"}, "published_date", "can't be more than a year from now"},
+	} {
+		errs := validate(&test.book)
+		if len(errs) != 1 || errs[0].Field != test.field || errs[0].Message != test.want {
+			t.Errorf("%s: expected %s %s, got %+v", test.name, test.field, test.want, errs)
+		}
+	}
+
+	// Line breaks are fine in a description, and a book due out within the window can be added
+	book := BookRequest{Title: "Dune Messiah", Author: "Frank Herbert", PublishedDate: "2025-05", Description: "Twelve years on.\nThe jihad."}
+	if errs := validate(&book); len(errs) != 0 {
+		t.Errorf("Expected the book to be valid, got %+v", errs)
+	}
+}
+
+func TestValidateNormalizes(t *testing.T) {
+	// An e and a combining acute accent compose to one character, and the spaces around are trimmed
+	book := BookRequest{Title: "  Cafe\u0301 ", Author: "Anne\u0301", PublishedDate: " 1999 "}
+	if errs := validate(&book); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if book.Title != "Caf\u00e9" || book.Author != "Ann\u00e9" || book.PublishedDate != "1999" {
+		t.Errorf("Expected the fields trimmed and composed, got %q %q %q", book.Title, book.Author, book.PublishedDate)
+	}
+
+	// Decomposed and composed spellings are the same book
+	cleanBooksTable()
+	var first, second Response
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Caf\u00e9 Society", Author: "Anon", PublishedDate: "1999"})
+	json.Unmarshal(r.Body.Bytes(), &first)
+	r = callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Cafe\u0301 Society ", Author: "Anon", PublishedDate: "1999"})
+	json.Unmarshal(r.Body.Bytes(), &second)
+	if first.BookID == "" || second.BookID != first.BookID {
+		t.Errorf("Expected the same book twice, got %s and %s", first.BookID, second.BookID)
+	}
+}
+
+func TestDecodeRequestReportsEveryField(t *testing.T) {
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: strings.Repeat("a", 301), PublishedDate: "soon"})
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	want := []FieldError{
+		{Field: "title", Message: "must be at most 300 characters"},
+		{Field: "author", Message: "is required"},
+		{Field: "published_date", Message: "must be YYYY, YYYY-MM or YYYY-MM-DD"},
+	}
+	if len(problem.Errors) != len(want) {
+		t.Fatalf("Expected %+v, got %+v", want, problem.Errors)
+	}
+	for i := range want {
+		if problem.Errors[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], problem.Errors[i])
+		}
+	}
+	if problem.Detail != "title must be at most 300 characters; author is required; published_date must be YYYY, YYYY-MM or YYYY-MM-DD" {
+		t.Errorf("Expected every field in the detail, got %q", problem.Detail)
+	}
+}
+
+func TestDecodeRequestRejectsUnknownFields(t *testing.T) {
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", map[string]string{"title": "Dune", "author": "Frank Herbert", "published_date": "1965", "isbn": "0441013597"})
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "isbn", Message: "isn't a known field"}) {
+		t.Errorf("Expected isbn to be rejected, got %+v", problem.Errors)
+	}
+
+	// The fields the server fills in can't be sent either
+	for _, field := range []string{"book_id", "deleted_at", "availability"} {
+		book := map[string]interface{}{"title": "Dune", "author": "Frank Herbert", "published_date": "1965", field: nil}
+		r = callHandler(t, AddBookHandler, "POST", "/api/v1/books", book)
+		problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+		if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: field, Message: "isn't a known field"}) {
+			t.Errorf("Expected %s to be rejected, got %+v", field, problem.Errors)
+		}
+	}
+	for _, field := range []string{"collection_id", "books", "deleted_at"} {
+		collection := map[string]interface{}{"name": "Classics", "description": "Old books", field: nil}
+		r = callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", collection)
+		problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+		if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: field, Message: "isn't a known field"}) {
+			t.Errorf("Expected %s to be rejected, got %+v", field, problem.Errors)
+		}
+	}
+
+	r = callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", map[string]interface{}{"name": 42, "description": "Numbers"})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "name", Message: "must be a string"}) {
+		t.Errorf("Expected name to need a string, got %+v", problem.Errors)
+	}
+
+	r = callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", "{")
+	decodeProblem(t, r, http.StatusBadRequest, CodeMalformedRequest)
+}
+
+func TestValidateUpdatesAndIDs(t *testing.T) {
+	cleanBooksTable()
+	r := callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	var book Response
+	json.Unmarshal(r.Body.Bytes(), &book)
+
+	// Fields left out of an update aren't checked, ones sent empty can't clear required fields
+	r = callHandler(t, UpdateBookHandler, "PATCH", "/api/v1/books/"+book.BookID, map[string]string{"title": " ", "published_date": ""})
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 2 || problem.Errors[0].Field != "title" || problem.Errors[0].Message != "can't be removed" || problem.Errors[1].Field != "published_date" {
+		t.Errorf("Expected title and published_date to be kept, got %+v", problem.Errors)
+	}
+	r = callHandler(t, UpdateBookHandler, "PATCH", "/api/v1/books/"+book.BookID, map[string]string{"genre": " Science Fiction "})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	r = callHandler(t, GetBookHandler, "GET", "/api/v1/books/"+book.BookID, nil)
+	var updated Book
+	json.Unmarshal(r.Body.Bytes(), &updated)
+	if r.Code != http.StatusOK || updated.Genre != "Science Fiction" || updated.Title != "Dune" {
+		t.Errorf("Expected the trimmed genre, got %d %+v", r.Code, updated)
+	}
+
+	// IDs are digits, so they can't change the query they end up in
+	r = callHandler(t, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": "1", "book_ids": []string{book.BookID, "1') OR ('1"}})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "book_ids[1]", Message: "must be an ID"}) {
+		t.Errorf("Expected the second book ID to be rejected, got %+v", problem.Errors)
+	}
+	r = callHandler(t, AddBookToCollectionHandler, "POST", "/api/v1/booksToCollection", map[string]interface{}{"collection_id": "1", "book_ids": []string{}})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "book_ids", Message: "must have at least one element"}) {
+		t.Errorf("Expected no book IDs to be rejected, got %+v", problem.Errors)
+	}
+}
+
+func TestCirculationRequestsRejectUnknownFields(t *testing.T) {
+	patronID, _ := insertPatron(Patron{Name: "Unknown Fields"})
+	patron := strconv.FormatInt(patronID, 10)
+
+	// A misspelled field is refused rather than read as left out
+	for _, test := range []struct {
+		handler func(http.ResponseWriter, *http.Request, string)
+		target  string
+		body    map[string]interface{}
+		field   string
+	}{
+		{CheckoutHandler, "/api/v1/loans", map[string]interface{}{"patronId": patron, "book_id": "1"}, "patronId"},
+		{ReturnLoanHandler, "/api/v1/loans/return", map[string]interface{}{"loan_id": "1", "copy_id": "1"}, "copy_id"},
+		{RenewLoanHandler, "/api/v1/loans/renew", map[string]interface{}{"loanId": "1"}, "loanId"},
+		{PlaceHoldHandler, "/api/v1/holds", map[string]interface{}{"patron_id": patron, "bookId": "1"}, "bookId"},
+		{CancelHoldHandler, "/api/v1/holds/cancel", map[string]interface{}{"hold_id": "1", "reason": "changed my mind"}, "reason"},
+		{ReorderHoldHandler, "/api/v1/holds/reorder", map[string]interface{}{"hold_id": "1", "pos": 1}, "pos"},
+		{PayFinesHandler, "/api/v1/patrons/" + patron + "/fines/pay", map[string]interface{}{"amount": 100}, "amount"},
+		{WaiveFinesHandler, "/api/v1/patrons/" + patron + "/fines/waive", map[string]interface{}{"loan_id": "1", "reason": "flood"}, "reason"},
+		{SetFinePolicyHandler, "/api/v1/fines/policies", map[string]interface{}{"genre": "Poetry", "daily_rate": 10}, "daily_rate"},
+	} {
+		r := callHandler(t, test.handler, "POST", test.target, test.body)
+		problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+		if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: test.field, Message: "isn't a known field"}) {
+			t.Errorf("%s: expected %s to be rejected, got %+v", test.target, test.field, problem.Errors)
+		}
+	}
+
+	// And the fields that are known are checked
+	r := callHandler(t, ReorderHoldHandler, "POST", "/api/v1/holds/reorder", map[string]interface{}{"hold_id": "1 OR 1", "position": 0})
+	problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	want := []FieldError{{Field: "hold_id", Message: "must be an ID"}, {Field: "position", Message: "must be at least 1"}}
+	if len(problem.Errors) != 2 || problem.Errors[0] != want[0] || problem.Errors[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, problem.Errors)
+	}
+	r = callHandler(t, CheckoutHandler, "POST", "/api/v1/loans", map[string]interface{}{"patron_id": patron})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "book_id" {
+		t.Errorf("Expected a book_id, copy_id or barcode to be needed, got %+v", problem.Errors)
+	}
+	r = callHandler(t, SetFinePolicyHandler, "POST", "/api/v1/fines/policies", map[string]interface{}{"genre": "Poetry", "daily_rate_cents": -5})
+	problem = decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+	if len(problem.Errors) != 1 || problem.Errors[0] != (FieldError{Field: "daily_rate_cents", Message: "must be at least 0"}) {
+		t.Errorf("Expected a negative rate to be refused, got %+v", problem.Errors)
+	}
+}
@@ -0,0 +1,781 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Webhook delivery statuses. A delivery is pending until the receiver accepts it, and dead
+// once it has failed WebhookMaxAttempts times in a row.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// Headers sent with every webhook. The signature is an HMAC-SHA256 of the timestamp, a dot and
+// the body, keyed with the subscription's secret, see SignWebhook.
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// WebhookMaxAttempts is how many times a delivery is tried before it's dead-lettered
+const WebhookMaxAttempts = 8
+
+// WebhookRetryBase is the wait before the first retry, it doubles with every failed attempt
+const WebhookRetryBase = 30 * time.Second
+
+// webhookBatchSize is how many due deliveries DeliverWebhooks sends per run
+const webhookBatchSize = 50
+
+// webhookLogLimit is how many deliveries the delivery log and dead-letter list return
+const webhookLogLimit = 100
+
+const (
+	WebhookPath           = "/api/v1/webhooks/{id}"
+	WebhookDeliveriesPath = "/api/v1/webhooks/{id}/deliveries"
+	WebhookDeadLetterPath = "/api/v1/webhooks/dead-letters"
+	WebhookRedeliverPath  = "/api/v1/webhooks/deliveries/{id}:redeliver"
+)
+
+// webhookClient sends the deliveries. Receivers that take longer than the timeout count as
+// failed and are retried. It only connects to addresses webhookAddressAllowed allows, checked
+// once the receiver's name is resolved so a name can't be pointed elsewhere after it was
+// subscribed, and it doesn't follow redirects, a redirect is a failed delivery.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var errWebhookAddress = errors.New("webhook receiver is on a loopback, link-local, private or other non-global address")
+
+// webhookDeniedPrefixes are the address ranges that aren't reachable on the public internet,
+// from the IANA special-purpose registries. Webhooks aren't sent to any of them.
+var webhookDeniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local, the cloud metadata service among them
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and the broadcast address
+	netip.MustParsePrefix("::/96"),           // unspecified, loopback and IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, Teredo among them
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("fec0::/10"),       // site-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// webhookNAT64Prefix is the well-known NAT64 prefix, its addresses stand for the IPv4 address
+// in their last 32 bits
+var webhookNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// webhookAddressAllowed says whether webhooks can be sent to ip. Addresses in any of
+// webhookDeniedPrefixes are refused, so a webhook can't be used to reach the server's own
+// network. IPv4 addresses written as IPv6, mapped or through NAT64, are checked as the IPv4
+// address they stand for. Tests replace it to deliver to local receivers.
+var webhookAddressAllowed = func(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	if webhookNAT64Prefix.Contains(addr) {
+		embedded := addr.As16()
+		addr = netip.AddrFrom4([4]byte(embedded[12:]))
+	}
+	for _, prefix := range webhookDeniedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhookSubscription is a URL that's sent the events of the given types, or every event if
+// EventTypes is empty. The secret is only returned when the subscription is created.
+type WebhookSubscription struct {
+	SubscriptionID string    `json:"subscription_id,omitempty"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"secret,omitempty"`
+	EventTypes     []string  `json:"event_types"`
+	Active         bool      `json:"active"`
+	CreatedAt      time.Time `json:"created_at,omitempty"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID     string           `json:"delivery_id"`
+	SubscriptionID string           `json:"subscription_id"`
+	EventID        int64            `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+	Log            []WebhookAttempt `json:"log"`
+}
+
+// WebhookAttempt is one try at a delivery, with the receiver's status code or the error that
+// stopped it from answering
+type WebhookAttempt struct {
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	DurationMS  int64     `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+type WebhookResponse struct {
+	SubscriptionID string `json:"subscription_id,omitempty"`
+	DeliveryID     string `json:"delivery_id,omitempty"`
+	Secret         string `json:"secret,omitempty"`
+	Status         string `json:"status"`
+	Code           int    `json:"code"`
+}
+
+// AddWebhookHandler subscribes a URL to events. A secret for signing the deliveries is
+// generated unless the request brings its own.
+func AddWebhookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var subscription WebhookSubscription
+	err = json.NewDecoder(r.Body).Decode(&subscription)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if errs := validateWebhook(r.Context(), subscription.URL, subscription.EventTypes); len(errs) > 0 {
+		writeValidationProblem(w, r, "Webhook "+errs[0].Field+" "+errs[0].Message, errs...)
+		return
+	}
+
+	if subscription.Secret == "" {
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		subscription.Secret = hex.EncodeToString(secret)
+	}
+
+	insertWebhookQuery := `INSERT INTO WebhookSubscriptions (url, secret, event_types, active, created_at) VALUES (?, ?, ?, 1, ?);`
+	result, err := db.Exec(insertWebhookQuery, subscription.URL, subscription.Secret, strings.Join(subscription.EventTypes, ","), now().UTC())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	subscriptionID, _ := result.LastInsertId()
+
+	response := WebhookResponse{
+		SubscriptionID: strconv.FormatInt(subscriptionID, 10),
+		Secret:         subscription.Secret,
+		Status:         "success",
+		Code:           http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetWebhooksHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(webhookSelectQuery + " ORDER BY subscription_id;")
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	subscriptions := make([]WebhookSubscription, 0)
+	for rows.Next() {
+		subscription, err := scanWebhook(rows)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(subscriptions)
+}
+
+func GetWebhookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	subscription, ok := findWebhook(w, r, db, pathParam(r.URL.Path, WebhookPath, "id"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// UpdateWebhookHandler changes a subscription's URL or event types, or pauses it with
+// "active": false. A paused subscription isn't sent new events, and deliveries already queued
+// for it wait until it's resumed.
+func UpdateWebhookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var update struct {
+		URL        *string   `json:"url"`
+		EventTypes *[]string `json:"event_types"`
+		Active     *bool     `json:"active"`
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	subscription, ok := findWebhook(w, r, db, pathParam(r.URL.Path, WebhookPath, "id"))
+	if !ok {
+		return
+	}
+
+	if update.URL != nil {
+		subscription.URL = *update.URL
+	}
+	if update.EventTypes != nil {
+		subscription.EventTypes = *update.EventTypes
+	}
+	if update.Active != nil {
+		subscription.Active = *update.Active
+	}
+
+	if errs := validateWebhook(r.Context(), subscription.URL, subscription.EventTypes); len(errs) > 0 {
+		writeValidationProblem(w, r, "Webhook "+errs[0].Field+" "+errs[0].Message, errs...)
+		return
+	}
+
+	updateWebhookQuery := `UPDATE WebhookSubscriptions SET url = ?, event_types = ?, active = ? WHERE subscription_id = ?;`
+	_, err = db.Exec(updateWebhookQuery, subscription.URL, strings.Join(subscription.EventTypes, ","), subscription.Active, subscription.SubscriptionID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := WebhookResponse{
+		SubscriptionID: subscription.SubscriptionID,
+		Status:         "success",
+		Code:           http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteWebhookHandler removes a subscription along with its queued deliveries and log
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	subscription, ok := findWebhook(w, r, db, pathParam(r.URL.Path, WebhookPath, "id"))
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM WebhookAttempts WHERE delivery_id IN (SELECT delivery_id FROM WebhookDeliveries WHERE subscription_id = ?);
+		DELETE FROM WebhookDeliveries WHERE subscription_id = ?;
+		DELETE FROM WebhookSubscriptions WHERE subscription_id = ?;`, subscription.SubscriptionID, subscription.SubscriptionID, subscription.SubscriptionID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := WebhookResponse{
+		SubscriptionID: subscription.SubscriptionID,
+		Status:         "success",
+		Code:           http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetWebhookDeliveriesHandler is a subscription's delivery log, newest first, with every
+// attempt at each delivery. Filter with ?status=pending, delivered or dead.
+func GetWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != WebhookPending && status != WebhookDelivered && status != WebhookDead {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidParameter, "Delivery status must be pending, delivered or dead")
+		return
+	}
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	subscription, ok := findWebhook(w, r, db, pathParam(r.URL.Path, WebhookDeliveriesPath, "id"))
+	if !ok {
+		return
+	}
+
+	where := "d.subscription_id = ?"
+	args := []interface{}{subscription.SubscriptionID}
+	if status != "" {
+		where += " AND d.status = ?"
+		args = append(args, status)
+	}
+
+	deliveries, err := webhookDeliveries(db, where, args...)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// GetDeadLettersHandler lists the deliveries that gave up, across every subscription
+func GetDeadLettersHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	deliveries, err := webhookDeliveries(db, "d.status = ?", WebhookDead)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// RedeliverWebhookHandler queues a dead or already delivered delivery again, with a fresh set
+// of attempts. It goes out with the next DeliverWebhooks run.
+func RedeliverWebhookHandler(w http.ResponseWriter, r *http.Request, injectedDB string) {
+	deliveryID := pathParam(r.URL.Path, WebhookRedeliverPath, "id")
+
+	db, err := openDB(r.Context(), injectedDB)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	defer db.Close()
+
+	var status string
+	err = db.QueryRow("SELECT status FROM WebhookDeliveries WHERE delivery_id = ?;", deliveryID).Scan(&status)
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeDeliveryNotFound, "Delivery not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if status == WebhookPending {
+		problem := newProblem(r, http.StatusConflict, CodeDeliveryQueued, "Delivery is already queued")
+		problem.Extensions = map[string]interface{}{"delivery_id": deliveryID}
+		problem.write(w)
+		return
+	}
+
+	redeliverQuery := `UPDATE WebhookDeliveries SET status = ?, attempts = 0, next_attempt_at = ?, delivered_at = NULL WHERE delivery_id = ?;`
+	_, err = db.Exec(redeliverQuery, WebhookPending, now().UTC(), deliveryID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	response := WebhookResponse{
+		DeliveryID: deliveryID,
+		Status:     "success",
+		Code:       http.StatusOK,
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeliverWebhooks sends the deliveries that are due and schedules retries for the ones that
+// fail. It is run on a schedule by the server.
+func DeliverWebhooks(injectedDB string) error {
+	return traceJob("DeliverWebhooks", injectedDB, deliverWebhooks)
+}
+
+func deliverWebhooks(db *sql.DB) error {
+	type dueDelivery struct {
+		deliveryID     string
+		attempts       int
+		target, secret string
+		event          Event
+	}
+
+	// Paused subscriptions keep their deliveries queued
+	rows, err := db.Query(`SELECT d.delivery_id, d.attempts, s.url, s.secret, e.event_id, e.type, e.entity_id, e.payload, e.created_at
+		FROM WebhookDeliveries d
+		INNER JOIN WebhookSubscriptions s ON s.subscription_id = d.subscription_id
+		INNER JOIN Events e ON e.event_id = d.event_id
+		WHERE d.status = ? AND d.next_attempt_at <= ? AND s.active
+		ORDER BY d.delivery_id LIMIT ?;`, WebhookPending, now().UTC(), webhookBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var due []dueDelivery
+	for rows.Next() {
+		var delivery dueDelivery
+		var payload string
+		err := rows.Scan(&delivery.deliveryID, &delivery.attempts, &delivery.target, &delivery.secret,
+			&delivery.event.EventID, &delivery.event.Type, &delivery.event.EntityID, &payload, &delivery.event.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		delivery.event.Payload = json.RawMessage(payload)
+		due = append(due, delivery)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Each delivery is sent outside of any transaction, a slow receiver mustn't hold the
+	// database, and its outcome recorded straight after
+	for _, delivery := range due {
+		attempt := sendWebhook(delivery.deliveryID, delivery.target, delivery.secret, delivery.event)
+		err := recordWebhookAttempt(db, delivery.deliveryID, delivery.attempts+1, attempt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendWebhook posts an event to a subscriber. Anything but a 2xx answer is a failure.
+func sendWebhook(deliveryID, target, secret string, event Event) WebhookAttempt {
+	attempt := WebhookAttempt{AttemptedAt: now().UTC()}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(secret, timestamp, body))
+
+	start := time.Now()
+	resp, err := webhookClient.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("receiver answered %s", resp.Status)
+	}
+	return attempt
+}
+
+// recordWebhookAttempt logs an attempt and moves its delivery on: delivered, retried after
+// WebhookRetryBase doubled for each failure so far, or dead after WebhookMaxAttempts
+func recordWebhookAttempt(db *sql.DB, deliveryID string, attempts int, attempt WebhookAttempt) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertAttemptQuery := `INSERT INTO WebhookAttempts (delivery_id, status_code, error, duration_ms, attempted_at) VALUES (?, ?, ?, ?, ?);`
+	_, err = tx.Exec(insertAttemptQuery, deliveryID, attempt.StatusCode, attempt.Error, attempt.DurationMS, attempt.AttemptedAt)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case attempt.Error == "":
+		_, err = tx.Exec("UPDATE WebhookDeliveries SET status = ?, attempts = ?, delivered_at = ? WHERE delivery_id = ?;", WebhookDelivered, attempts, attempt.AttemptedAt, deliveryID)
+	case attempts >= WebhookMaxAttempts:
+		_, err = tx.Exec("UPDATE WebhookDeliveries SET status = ?, attempts = ? WHERE delivery_id = ?;", WebhookDead, attempts, deliveryID)
+	default:
+		retryAt := attempt.AttemptedAt.Add(WebhookRetryBase << (attempts - 1))
+		_, err = tx.Exec("UPDATE WebhookDeliveries SET attempts = ?, next_attempt_at = ? WHERE delivery_id = ?;", attempts, retryAt, deliveryID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SignWebhook returns the X-Webhook-Signature for a delivery. Receivers should compute it from
+// the X-Webhook-Timestamp header and the raw body, compare it with hmac.Equal, and reject old
+// timestamps so a captured delivery can't be replayed.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhookDeliveries queues a delivery of an event for every active subscription to its
+// type. It's part of recordEvent, so in the same transaction as the event.
+func queueWebhookDeliveries(db execer, eventID int64, eventType string) error {
+	queueDeliveriesQuery := `INSERT INTO WebhookDeliveries (subscription_id, event_id, status, next_attempt_at, created_at)
+		SELECT subscription_id, ?, ?, ?, ? FROM WebhookSubscriptions
+		WHERE active AND (event_types = '' OR instr(',' || event_types || ',', ',' || ? || ',') > 0);`
+	_, err := db.Exec(queueDeliveriesQuery, eventID, WebhookPending, now().UTC(), now().UTC(), eventType)
+	return err
+}
+
+// webhookHostAllowed says whether host, a name or an IP address, is one webhooks can be sent
+// to. A name is allowed unless it resolves to an address that isn't, one that doesn't resolve
+// yet is checked again when a delivery connects to it.
+func webhookHostAllowed(ctx context.Context, host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return webhookAddressAllowed(ip)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateWebhook checks a subscription's URL and event types, returning what's wrong with
+// them or nil if nothing is
+func validateWebhook(ctx context.Context, webhookURL string, types []string) []FieldError {
+	var errs []FieldError
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		errs = append(errs, FieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	} else if !webhookHostAllowed(ctx, parsed.Hostname()) {
+		errs = append(errs, FieldError{Field: "url", Message: "must not be a loopback, link-local, private or other non-global address"})
+	}
+
+	for _, eventType := range types {
+		known := false
+		for _, t := range eventTypes {
+			if t == eventType {
+				known = true
+			}
+		}
+		if !known {
+			errs = append(errs, FieldError{Field: "event_types", Message: "must be among " + strings.Join(eventTypes, ", ")})
+			break
+		}
+	}
+	return errs
+}
+
+// webhookSelectQuery selects the columns scanWebhook expects, everything but the secret
+const webhookSelectQuery = "SELECT subscription_id, url, event_types, active, created_at FROM WebhookSubscriptions"
+
+func scanWebhook(row rowScanner) (WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	var types string
+	err := row.Scan(&subscription.SubscriptionID, &subscription.URL, &types, &subscription.Active, &subscription.CreatedAt)
+	subscription.EventTypes = make([]string, 0)
+	if types != "" {
+		subscription.EventTypes = strings.Split(types, ",")
+	}
+	return subscription, err
+}
+
+// findWebhook looks up a subscription by ID. If there isn't one it writes the error response
+// itself and returns false, so the caller should just return.
+func findWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, subscriptionID string) (WebhookSubscription, bool) {
+	subscription, err := scanWebhook(db.QueryRow(webhookSelectQuery+" WHERE subscription_id = ?;", subscriptionID))
+	if err == sql.ErrNoRows {
+		writeProblem(w, r, http.StatusNotFound, CodeWebhookNotFound, "Webhook not found")
+		return subscription, false
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return subscription, false
+	}
+
+	return subscription, true
+}
+
+// webhookDeliveries lists the newest deliveries matching where, each with its attempts
+func webhookDeliveries(db *sql.DB, where string, args ...interface{}) ([]WebhookDelivery, error) {
+	query := `SELECT d.delivery_id, d.subscription_id, d.event_id, e.type, d.status, d.attempts, d.next_attempt_at, d.created_at, d.delivered_at
+		FROM WebhookDeliveries d
+		INNER JOIN Events e ON e.event_id = d.event_id
+		WHERE ` + where + ` ORDER BY d.delivery_id DESC LIMIT ?;`
+	rows, err := db.Query(query, append(args, webhookLogLimit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var nextAttemptAt time.Time
+		err := rows.Scan(&delivery.DeliveryID, &delivery.SubscriptionID, &delivery.EventID, &delivery.EventType,
+			&delivery.Status, &delivery.Attempts, &nextAttemptAt, &delivery.CreatedAt, &delivery.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		if delivery.Status == WebhookPending {
+			delivery.NextAttemptAt = &nextAttemptAt
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range deliveries {
+		deliveries[i].Log, err = webhookAttempts(db, deliveries[i].DeliveryID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return deliveries, nil
+}
+
+func webhookAttempts(db *sql.DB, deliveryID string) ([]WebhookAttempt, error) {
+	rows, err := db.Query("SELECT status_code, error, duration_ms, attempted_at FROM WebhookAttempts WHERE delivery_id = ? ORDER BY attempt_id;", deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make([]WebhookAttempt, 0)
+	for rows.Next() {
+		var attempt WebhookAttempt
+		err := rows.Scan(&attempt.StatusCode, &attempt.Error, &attempt.DurationMS, &attempt.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,359 @@
+package routes
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is an httptest server standing in for a subscriber. It answers with status
+// and keeps every request it's sent. It's on loopback, so webhooks can be sent to loopback
+// addresses until the test ends.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T, status int) *webhookReceiver {
+	allowed := webhookAddressAllowed
+	webhookAddressAllowed = func(net.IP) bool { return true }
+	t.Cleanup(func() { webhookAddressAllowed = allowed })
+
+	receiver := &webhookReceiver{status: status}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, r)
+		receiver.bodies = append(receiver.bodies, body)
+		w.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (receiver *webhookReceiver) answer(status int) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.status = status
+}
+
+func (receiver *webhookReceiver) received() int {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return len(receiver.requests)
+}
+
+func cleanWebhookTables() {
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	db.Exec("DELETE FROM WebhookAttempts; DELETE FROM WebhookDeliveries; DELETE FROM WebhookSubscriptions;")
+}
+
+// subscribe adds a webhook for receiver, removing every subscription again when the test ends
+// so other tests' events aren't queued for it
+func subscribe(t *testing.T, receiver *webhookReceiver, eventTypes ...string) WebhookResponse {
+	cleanWebhookTables()
+	t.Cleanup(cleanWebhookTables)
+
+	r := callHandler(t, AddWebhookHandler, "POST", "/api/v1/webhooks", WebhookSubscription{URL: receiver.URL, EventTypes: eventTypes})
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	var response WebhookResponse
+	json.Unmarshal(r.Body.Bytes(), &response)
+	return response
+}
+
+func webhookDeliveryLog(t *testing.T, subscriptionID, status string) []WebhookDelivery {
+	r := callHandler(t, GetWebhookDeliveriesHandler, "GET", "/api/v1/webhooks/"+subscriptionID+"/deliveries?status="+status, nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+
+	var deliveries []WebhookDelivery
+	json.Unmarshal(r.Body.Bytes(), &deliveries)
+	return deliveries
+}
+
+func TestWebhookDeliveriesAreSigned(t *testing.T) {
+	cleanBooksTable()
+	cleanCollectionsFromTestDatabase()
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	subscription := subscribe(t, receiver, EventBookCreated)
+	if len(subscription.Secret) != 64 {
+		t.Fatalf("Expected a generated secret, got %q", subscription.Secret)
+	}
+
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	callHandler(t, AddCollectionHandler, "POST", "/api/v1/collections", CollectionRequest{Name: "Deserts"})
+
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	err := deliverWebhooks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the event type subscribed to is sent
+	if receiver.received() != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", receiver.received())
+	}
+	req, body := receiver.requests[0], receiver.bodies[0]
+
+	var event Event
+	json.Unmarshal(body, &event)
+	if event.Type != EventBookCreated || req.Header.Get(WebhookEventHeader) != EventBookCreated {
+		t.Errorf("Expected a %s event, got %s", EventBookCreated, body)
+	}
+
+	timestamp, _ := strconv.ParseInt(req.Header.Get(WebhookTimestampHeader), 10, 64)
+	expected := SignWebhook(subscription.Secret, timestamp, body)
+	if !hmac.Equal([]byte(req.Header.Get(WebhookSignatureHeader)), []byte(expected)) {
+		t.Errorf("Expected signature %s, got %s", expected, req.Header.Get(WebhookSignatureHeader))
+	}
+	if SignWebhook("another secret", timestamp, body) == expected {
+		t.Error("Expected the signature to depend on the secret")
+	}
+
+	deliveries := webhookDeliveryLog(t, subscription.SubscriptionID, WebhookDelivered)
+	if len(deliveries) != 1 || deliveries[0].DeliveredAt == nil || len(deliveries[0].Log) != 1 || deliveries[0].Log[0].StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the delivery log to show one successful attempt, got %+v", deliveries)
+	}
+
+	// Nothing is left to send
+	err = deliverWebhooks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receiver.received() != 1 {
+		t.Errorf("Expected a delivered webhook not to be sent again, got %d deliveries", receiver.received())
+	}
+}
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	defer func() { now = time.Now }()
+	clock := time.Date(2023, 6, 1, 8, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+
+	cleanBooksTable()
+	receiver := newWebhookReceiver(t, http.StatusInternalServerError)
+	subscription := subscribe(t, receiver)
+
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+
+	wait := WebhookRetryBase
+	for attempt := 1; attempt <= WebhookMaxAttempts; attempt++ {
+		err := deliverWebhooks(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receiver.received() != attempt {
+			t.Fatalf("Expected attempt %d to be sent, got %d requests", attempt, receiver.received())
+		}
+		if attempt == WebhookMaxAttempts {
+			break
+		}
+
+		// Not due again until the backoff has passed
+		pending := webhookDeliveryLog(t, subscription.SubscriptionID, WebhookPending)
+		if len(pending) != 1 || !pending[0].NextAttemptAt.Equal(clock.Add(wait)) {
+			t.Fatalf("Expected attempt %d to be retried at %s, got %+v", attempt, clock.Add(wait), pending)
+		}
+		now = func() time.Time { return clock.Add(wait - time.Second) }
+		deliverWebhooks(db)
+		if receiver.received() != attempt {
+			t.Fatalf("Expected no retry before %s", clock.Add(wait))
+		}
+
+		clock = clock.Add(wait)
+		now = func() time.Time { return clock }
+		wait *= 2
+	}
+
+	r := callHandler(t, GetDeadLettersHandler, "GET", "/api/v1/webhooks/dead-letters", nil)
+	var dead []WebhookDelivery
+	json.Unmarshal(r.Body.Bytes(), &dead)
+	if len(dead) != 1 || dead[0].Attempts != WebhookMaxAttempts || len(dead[0].Log) != WebhookMaxAttempts {
+		t.Fatalf("Expected the delivery to be dead-lettered after %d attempts, got %+v", WebhookMaxAttempts, dead)
+	}
+	if dead[0].Log[0].StatusCode != http.StatusInternalServerError || dead[0].Log[0].Error == "" {
+		t.Errorf("Expected the log to record the failure, got %+v", dead[0].Log[0])
+	}
+
+	// Once the receiver is fixed the dead letter can be sent again
+	receiver.answer(http.StatusOK)
+	r = callHandler(t, RedeliverWebhookHandler, "POST", "/api/v1/webhooks/deliveries/"+dead[0].DeliveryID+":redeliver", nil)
+	if r.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, r.Code, r.Body.String())
+	}
+	r = callHandler(t, RedeliverWebhookHandler, "POST", "/api/v1/webhooks/deliveries/"+dead[0].DeliveryID+":redeliver", nil)
+	if r.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for a queued delivery, got %d", http.StatusConflict, r.Code)
+	}
+
+	deliverWebhooks(db)
+	delivered := webhookDeliveryLog(t, subscription.SubscriptionID, WebhookDelivered)
+	if len(delivered) != 1 || len(delivered[0].Log) != WebhookMaxAttempts+1 {
+		t.Errorf("Expected the redelivery to succeed, got %+v", delivered)
+	}
+}
+
+func TestPausedWebhooksKeepTheirDeliveries(t *testing.T) {
+	cleanBooksTable()
+	receiver := newWebhookReceiver(t, http.StatusOK)
+	subscription := subscribe(t, receiver)
+	path := "/api/v1/webhooks/" + subscription.SubscriptionID
+
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+	callHandler(t, UpdateWebhookHandler, "PATCH", path, map[string]bool{"active": false})
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815"})
+
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	deliverWebhooks(db)
+	if receiver.received() != 0 {
+		t.Errorf("Expected nothing to be sent while paused, got %d requests", receiver.received())
+	}
+
+	callHandler(t, UpdateWebhookHandler, "PATCH", path, map[string]bool{"active": true})
+	deliverWebhooks(db)
+	if receiver.received() != 1 {
+		t.Errorf("Expected only the event from before the pause to be sent, got %d requests", receiver.received())
+	}
+
+	r := callHandler(t, DeleteWebhookHandler, "DELETE", path, nil)
+	if r.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, r.Code)
+	}
+	r = callHandler(t, GetWebhookHandler, "GET", path, nil)
+	if r.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d after deleting, got %d", http.StatusNotFound, r.Code)
+	}
+}
+
+func TestAddWebhookValidation(t *testing.T) {
+	for _, subscription := range []WebhookSubscription{
+		{URL: "not a url"},
+		{URL: "ftp://example.com/hook"},
+		{URL: "https://example.com/hook", EventTypes: []string{"book.burned"}},
+	} {
+		r := callHandler(t, AddWebhookHandler, "POST", "/api/v1/webhooks", subscription)
+		if r.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %+v, got %d", http.StatusBadRequest, subscription, r.Code)
+		}
+	}
+
+	cleanWebhookTables()
+	r := callHandler(t, AddWebhookHandler, "POST", "/api/v1/webhooks", WebhookSubscription{URL: "https://example.com/hook", Secret: "s3cret"})
+	t.Cleanup(cleanWebhookTables)
+
+	var response WebhookResponse
+	json.Unmarshal(r.Body.Bytes(), &response)
+	if response.Secret != "s3cret" {
+		t.Errorf("Expected the given secret to be kept, got %q", response.Secret)
+	}
+
+	r = callHandler(t, GetWebhooksHandler, "GET", "/api/v1/webhooks", nil)
+	var subscriptions []WebhookSubscription
+	json.Unmarshal(r.Body.Bytes(), &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].Secret != "" || !subscriptions[0].Active {
+		t.Errorf("Expected one active subscription without its secret, got %+v", subscriptions)
+	}
+}
+
+func TestWebhooksStayOffPrivateAddresses(t *testing.T) {
+	for _, webhookURL := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.7/hook",
+		"http://192.168.1.1/hook",
+		"http://[fd00:ec2::254]/hook",
+		"http://100.64.0.1/hook",
+		"http://[::ffff:169.254.169.254]/hook",
+		"http://[64:ff9b::a9fe:a9fe]/hook",
+	} {
+		r := callHandler(t, AddWebhookHandler, "POST", "/api/v1/webhooks", WebhookSubscription{URL: webhookURL})
+		problem := decodeProblem(t, r, http.StatusBadRequest, CodeValidationFailed)
+		if len(problem.Errors) != 1 || problem.Errors[0].Field != "url" {
+			t.Errorf("Expected %s to be refused, got %+v", webhookURL, problem.Errors)
+		}
+	}
+
+	// A receiver that was allowed when it subscribed is checked again when it's connected to
+	cleanBooksTable()
+	allowed := webhookAddressAllowed
+	receiver := newWebhookReceiver(t, http.StatusNoContent)
+	subscription := subscribe(t, receiver, EventBookCreated)
+	webhookAddressAllowed = allowed
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	err := deliverWebhooks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := webhookDeliveryLog(t, subscription.SubscriptionID, WebhookPending)
+	if receiver.received() != 0 || len(pending) != 1 || !strings.Contains(pending[0].Log[0].Error, errWebhookAddress.Error()) {
+		t.Errorf("Expected the delivery not to connect, got %d requests and %+v", receiver.received(), pending)
+	}
+}
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	for _, address := range []string{
+		"0.0.0.0", "0.1.2.3", "100.64.0.1", "100.127.255.254", "127.0.0.1", "169.254.169.254", "172.16.0.1",
+		"192.0.0.8", "198.18.0.1", "198.19.255.255", "224.0.0.1", "255.255.255.255",
+		"::", "::1", "::ffff:127.0.0.1", "::ffff:169.254.169.254", "::ffff:100.64.0.1", "::127.0.0.1",
+		"64:ff9b::a9fe:a9fe", "64:ff9b::7f00:1", "64:ff9b:1::1", "2001:db8::1", "2002:a00:1::1", "fd00:ec2::254", "fe80::1", "ff02::1",
+	} {
+		if webhookAddressAllowed(net.ParseIP(address)) {
+			t.Errorf("Expected %s to be refused", address)
+		}
+	}
+
+	// Public addresses are allowed, however they're written
+	for _, address := range []string{"93.184.216.34", "::ffff:93.184.216.34", "64:ff9b::5db8:d822", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !webhookAddressAllowed(net.ParseIP(address)) {
+			t.Errorf("Expected %s to be allowed", address)
+		}
+	}
+}
+
+func TestWebhookRedirectsAreNotFollowed(t *testing.T) {
+	cleanBooksTable()
+	target := newWebhookReceiver(t, http.StatusNoContent)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+	subscription := subscribe(t, &webhookReceiver{Server: redirect}, EventBookCreated)
+	callHandler(t, AddBookHandler, "POST", "/api/v1/books", Book{Title: "Dune", Author: "Frank Herbert", PublishedDate: "1965"})
+
+	db, _ := sql.Open("sqlite3", testDB)
+	defer db.Close()
+	err := deliverWebhooks(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := webhookDeliveryLog(t, subscription.SubscriptionID, WebhookPending)
+	if target.received() != 0 || len(pending) != 1 || pending[0].Log[0].StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("Expected the redirect to fail the delivery, got %d requests and %+v", target.received(), pending)
+	}
+}